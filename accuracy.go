@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// forecastMatchWindow is how close an observation must be to the time of a
+// forecast step to be compared with it.
+const forecastMatchWindow = 30 * time.Minute
+
+var forecastErrorsHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "forecast_absolute_error_celsius",
+		Help:    "Absolute difference between forecast and observed temperature by forecast provider and lead time in whole days",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 8},
+	},
+	[]string{"provider", "lead_days"},
+)
+
+func init() {
+	prometheus.MustRegister(forecastErrorsHistogram)
+}
+
+// accuracyCities returns FORECAST_ACCURACY_CITIES, the cities whose
+// forecasts are kept to be compared with later observations.
+func accuracyCities() []string {
+	return runningConfig().ForecastAccuracyCities
+}
+
+// prediction is one forecast step waiting for its observation.
+type prediction struct {
+	provider    string
+	issued      time.Time
+	target      time.Time
+	temperature float64
+}
+
+type accuracyKey struct {
+	city, provider string
+	leadDays       int
+}
+
+// accuracyStats accumulates the errors (forecast minus observation) of one
+// city, provider and lead time.
+type accuracyStats struct {
+	n                  int
+	sum, sumAbs, sumSq float64
+}
+
+// accuracyTracker keeps the forecast steps of FORECAST_ACCURACY_CITIES until
+// an observation close to their time arrives, then scores them. Every
+// forecast fetch is kept separately, so a step is scored once per lead time
+// it was forecast at.
+type accuracyTracker struct {
+	mu      sync.Mutex
+	pending map[string][]prediction
+	stats   map[accuracyKey]*accuracyStats
+	// names are the cities as spelled in FORECAST_ACCURACY_CITIES.
+	names map[string]string
+}
+
+var forecastAccuracy = &accuracyTracker{
+	pending: make(map[string][]prediction),
+	stats:   make(map[accuracyKey]*accuracyStats),
+	names:   make(map[string]string),
+}
+
+func (t *accuracyTracker) tracked(city string) bool {
+	for _, c := range accuracyCities() {
+		if strings.EqualFold(c, city) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record keeps the future steps of a freshly fetched forecast.
+func (t *accuracyTracker) Record(forecast Forecast, issued time.Time) {
+	if forecast.Provider == "" || !t.tracked(forecast.City) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := strings.ToLower(forecast.City)
+	t.names[key] = forecast.City
+	for _, step := range forecast.Steps {
+		if step.Time.After(issued) {
+			t.pending[key] = append(t.pending[key], prediction{forecast.Provider, issued, step.Time, step.Temperature})
+		}
+	}
+	select {
+	case accuracyWake <- struct{}{}:
+	default:
+	}
+}
+
+// Observe scores the pending steps of city within forecastMatchWindow of the
+// observation and drops those too old to be matched any more.
+func (t *accuracyTracker) Observe(city string, temperature float64, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := strings.ToLower(city)
+	pending, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	kept := pending[:0]
+	for _, p := range pending {
+		switch {
+		case at.Sub(p.target).Abs() <= forecastMatchWindow:
+			lead := int(p.target.Sub(p.issued) / (24 * time.Hour))
+			s := t.stats[accuracyKey{key, p.provider, lead}]
+			if s == nil {
+				s = &accuracyStats{}
+				t.stats[accuracyKey{key, p.provider, lead}] = s
+			}
+			diff := p.temperature - temperature
+			s.n++
+			s.sum += diff
+			s.sumAbs += math.Abs(diff)
+			s.sumSq += diff * diff
+			forecastErrorsHistogram.WithLabelValues(p.provider, strconv.Itoa(lead)).Observe(math.Abs(diff))
+		case p.target.Before(at):
+			// Missed: no observation came close enough in time.
+		default:
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = kept
+	}
+}
+
+// Due returns the cities with a forecast step due for comparison now, and
+// when the next one falls due. Steps that can no longer be matched are
+// dropped.
+func (t *accuracyTracker) Due(now time.Time) (cities []string, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, pending := range t.pending {
+		kept, due := pending[:0], false
+		for _, p := range pending {
+			if now.Sub(p.target) > forecastMatchWindow {
+				continue
+			}
+			kept = append(kept, p)
+			if !p.target.After(now) {
+				due = true
+			} else if next.IsZero() || p.target.Before(next) {
+				next = p.target
+			}
+		}
+		switch {
+		case len(kept) == 0:
+			delete(t.pending, key)
+		case due:
+			cities = append(cities, t.names[key])
+		}
+		if len(kept) > 0 {
+			t.pending[key] = kept
+		}
+	}
+	return cities, next
+}
+
+// accuracyWake interrupts runAccuracyObservations when forecast steps are
+// recorded.
+var accuracyWake = make(chan struct{}, 1)
+
+// runAccuracyObservations fetches the current weather of the tracked cities
+// when their forecast steps fall due, so forecasts are scored even when
+// nobody asks for the weather at that time.
+func runAccuracyObservations() {
+	for {
+		cities, next := forecastAccuracy.Due(time.Now())
+		for _, city := range cities {
+			if _, err := currentWeather(context.Background(), city); err != nil {
+				logError("Observation for forecast accuracy of %s failed: %v", city, err)
+			}
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = min(wait, time.Until(next))
+		}
+		select {
+		case <-time.After(wait):
+		case <-accuracyWake:
+		case <-backgroundJobs.Done():
+			return
+		}
+	}
+}
+
+// ForecastAccuracy is one row of /api/forecast/accuracy. Errors are forecast
+// minus observation in °C: bias above zero means forecasts run warm.
+type ForecastAccuracy struct {
+	City     string  `json:"city"`
+	Provider string  `json:"provider"`
+	LeadDays int     `json:"lead_days"`
+	Samples  int     `json:"samples"`
+	MAE      float64 `json:"mae"`
+	RMSE     float64 `json:"rmse"`
+	Bias     float64 `json:"bias"`
+}
+
+type ForecastAccuracyResponse struct {
+	Accuracy []ForecastAccuracy `json:"accuracy"`
+	Pending  int                `json:"pending"`
+}
+
+// Report returns the scores, for city only unless it is empty.
+func (t *accuracyTracker) Report(city string) ForecastAccuracyResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	response := ForecastAccuracyResponse{Accuracy: []ForecastAccuracy{}}
+	for key, s := range t.stats {
+		if city != "" && key.city != strings.ToLower(city) {
+			continue
+		}
+		n := float64(s.n)
+		response.Accuracy = append(response.Accuracy, ForecastAccuracy{
+			City:     t.names[key.city],
+			Provider: key.provider,
+			LeadDays: key.leadDays,
+			Samples:  s.n,
+			MAE:      math.Round(s.sumAbs/n*100) / 100,
+			RMSE:     math.Round(math.Sqrt(s.sumSq/n)*100) / 100,
+			Bias:     math.Round(s.sum/n*100) / 100,
+		})
+	}
+	for key, list := range t.pending {
+		if city == "" || key == strings.ToLower(city) {
+			response.Pending += len(list)
+		}
+	}
+	sort.Slice(response.Accuracy, func(i, j int) bool {
+		a, b := response.Accuracy[i], response.Accuracy[j]
+		if a.City != b.City {
+			return a.City < b.City
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.LeadDays < b.LeadDays
+	})
+	return response
+}
+
+// forecastAccuracyHandler serves /api/forecast/accuracy.
+func forecastAccuracyHandler(w http.ResponseWriter, r *http.Request) {
+	if !writeResponse(w, r, http.StatusOK, forecastAccuracy.Report(r.URL.Query().Get("city"))) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const backupVersion = 1
+
+// role is what an authenticated user may do. Directory groups and JWT
+// claims map to roles, which AUTH_* policies can require (see auth.go).
+type role string
+
+const (
+	roleReader role = "reader"
+	roleAdmin  role = "admin"
+)
+
+func (r role) Valid() bool {
+	return r == roleReader || r == roleAdmin
+}
+
+func hasRole(roles []role, want role) bool {
+	for _, r := range roles {
+		if r == want {
+			return true
+		}
+	}
+	return false
+}
+
+// backupRecord is one line of a backup stream. The first line carries the
+// format version and the rollup watermark, every following line exactly one
+// history point or rollup bucket.
+type backupRecord struct {
+	Version   int           `json:"version,omitempty"`
+	CreatedAt *time.Time    `json:"created_at,omitempty"`
+	Watermark *time.Time    `json:"watermark,omitempty"`
+	History   *HistoryPoint `json:"history,omitempty"`
+	Hourly    *Rollup       `json:"hourly,omitempty"`
+	Daily     *Rollup       `json:"daily,omitempty"`
+}
+
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	points := history.Snapshot()
+	hourly, daily, watermark := rollups.Snapshot()
+	now := time.Now().UTC()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="weather-backup-%s.ndjson"`, now.Format("20060102-150405")))
+
+	enc := json.NewEncoder(w)
+	err := enc.Encode(backupRecord{Version: backupVersion, CreatedAt: &now, Watermark: &watermark})
+	for i := 0; err == nil && i < len(points); i++ {
+		err = enc.Encode(backupRecord{History: &points[i]})
+	}
+	for i := 0; err == nil && i < len(hourly); i++ {
+		err = enc.Encode(backupRecord{Hourly: &hourly[i]})
+	}
+	for i := 0; err == nil && i < len(daily); i++ {
+		err = enc.Encode(backupRecord{Daily: &daily[i]})
+	}
+	if err != nil {
+		logError("Backup aborted: %v", err)
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+type RestoreResult struct {
+	History int `json:"history"`
+	Hourly  int `json:"hourly"`
+	Daily   int `json:"daily"`
+}
+
+func readBackup(body io.Reader) ([]HistoryPoint, []Rollup, []Rollup, time.Time, error) {
+	var (
+		points        []HistoryPoint
+		hourly, daily []Rollup
+		header        backupRecord
+	)
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, nil, time.Time{}, fmt.Errorf("reading header: %w", err)
+	}
+	if header.Version != backupVersion || header.Watermark == nil {
+		return nil, nil, nil, time.Time{}, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+	for line := 2; ; line++ {
+		var record backupRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, time.Time{}, fmt.Errorf("record %d: %w", line, err)
+		}
+		switch {
+		case record.History != nil:
+			points = append(points, *record.History)
+		case record.Hourly != nil:
+			hourly = append(hourly, *record.Hourly)
+		case record.Daily != nil:
+			daily = append(daily, *record.Daily)
+		default:
+			return nil, nil, nil, time.Time{}, fmt.Errorf("record %d: empty record", line)
+		}
+	}
+	return points, hourly, daily, *header.Watermark, nil
+}
+
+// restoreHandler replaces the history store with the contents of a backup
+// produced by backupHandler. Nothing is changed unless the whole stream parses.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	points, hourly, daily, watermark, err := readBackup(r.Body)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_backup", err)
+		return
+	}
+	history.Restore(points)
+	rollups.Restore(hourly, daily, watermark)
+	log.Printf("Restored backup: %d observations, %d hourly and %d daily rollups", len(points), len(hourly), len(daily))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RestoreResult{History: len(points), Hourly: len(hourly), Daily: len(daily)})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
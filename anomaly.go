@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of implausible observations.
+const (
+	anomalyJump   = "jump"
+	anomalyFrozen = "frozen"
+)
+
+// anomalyJumpInterval bounds how far apart two observations may be for the
+// difference between them to count as a jump; over longer gaps large
+// changes are real weather.
+const anomalyJumpInterval = time.Hour
+
+var observationAnomaliesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "observation_anomalies_total",
+		Help: "Total number of fetched observations flagged as implausible by kind",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(observationAnomaliesTotal)
+	for _, kind := range []string{anomalyJump, anomalyFrozen} {
+		kind := kind
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "observation_anomalous",
+			Help:        "Number of cities whose latest fetched observation is flagged as implausible",
+			ConstLabels: prometheus.Labels{"kind": kind},
+		}, func() float64 { return float64(anomalies.Count(kind)) }))
+	}
+}
+
+// anomalyState is what the detector remembers about a city.
+type anomalyState struct {
+	temperature float64
+	at          time.Time
+	// unchangedSince is when the temperature took its current value.
+	unchangedSince time.Time
+	kind           string
+}
+
+// anomalyDetector flags fetched observations that are implausible: a change
+// of more than ANOMALY_MAX_JUMP degrees from the previous observation less
+// than an hour earlier, or a temperature that has not changed for
+// ANOMALY_FROZEN_AFTER, which points at a stuck sensor or upstream cache.
+// Each observation is compared with the previous one whether or not that
+// was flagged, so a genuine sudden change only flags its first sample.
+type anomalyDetector struct {
+	mu     sync.Mutex
+	cities map[string]*anomalyState
+}
+
+var anomalies = &anomalyDetector{cities: make(map[string]*anomalyState)}
+
+// Check records an observation of city and returns the kind of anomaly it
+// shows, or "".
+func (d *anomalyDetector) Check(city string, temperature float64, at time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.cities[city]
+	if !ok {
+		d.evict()
+		d.cities[city] = &anomalyState{temperature: temperature, at: at, unchangedSince: at}
+		return ""
+	}
+	if temperature != s.temperature {
+		s.unchangedSince = at
+	}
+	s.kind = ""
+	switch {
+	case at.Sub(s.at) <= anomalyJumpInterval && math.Abs(temperature-s.temperature) > runningConfig().AnomalyMaxJump:
+		s.kind = anomalyJump
+	case at.Sub(s.unchangedSince) >= runningConfig().AnomalyFrozenAfter:
+		s.kind = anomalyFrozen
+	}
+	if s.kind != "" {
+		observationAnomaliesTotal.WithLabelValues(s.kind).Inc()
+		log.Printf("Anomalous observation for %s: %s (%.1f°C, previously %.1f°C at %s)",
+			city, s.kind, temperature, s.temperature, s.at.Format(time.RFC3339))
+	}
+	s.temperature, s.at = temperature, at
+	return s.kind
+}
+
+// evict drops the city observed longest ago once the detector holds
+// CACHE_MAX_CITIES cities.
+func (d *anomalyDetector) evict() {
+	if len(d.cities) < maxCachedCities() {
+		return
+	}
+	var oldest string
+	for city, s := range d.cities {
+		if oldest == "" || s.at.Before(d.cities[oldest].at) {
+			oldest = city
+		}
+	}
+	delete(d.cities, oldest)
+	memoryEvictionsTotal.WithLabelValues("anomalies").Inc()
+}
+
+// Kind returns the anomaly of the latest observation of city, or "".
+func (d *anomalyDetector) Kind(city string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.cities[city]; ok {
+		return s.kind
+	}
+	return ""
+}
+
+// Suppressed reports whether the latest observation of city is anomalous
+// and ANOMALY_SUPPRESS keeps such observations out of the gauges and the
+// history.
+func (d *anomalyDetector) Suppressed(city string) bool {
+	return runningConfig().AnomalySuppress && d.Kind(city) != ""
+}
+
+// Count returns the number of cities whose latest observation is anomalous
+// of kind.
+func (d *anomalyDetector) Count(kind string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, s := range d.cities {
+		if s.kind == kind {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var apiKeyFailoversTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "upstream_api_key_failovers_total",
+		Help: "Total number of switches between WEATHER_API_KEY and WEATHER_API_KEY_SECONDARY after OpenWeatherMap rejected the key in use",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(apiKeyFailoversTotal)
+}
+
+// apiKeyPair tracks which of WEATHER_API_KEY and WEATHER_API_KEY_SECONDARY
+// OpenWeatherMap accepts. The primary key is used until OpenWeatherMap
+// answers 401 to it; requests then use the secondary key until that one is
+// rejected in turn or the primary key changes.
+type apiKeyPair struct {
+	mu         sync.Mutex
+	rejected   string
+	failedOver time.Time
+	retired    []string // keys Rotate replaced, still redacted from logs
+}
+
+var owmKeys = &apiKeyPair{}
+
+func (p *apiKeyPair) keys() (primary, secondary string) {
+	cfg := runningConfig()
+	return cfg.WeatherAPIKey, cfg.WeatherAPIKeySecondary
+}
+
+// active is the key to send; p.mu must be held.
+func (p *apiKeyPair) active() string {
+	primary, secondary := p.keys()
+	if secondary != "" && primary == p.rejected {
+		return secondary
+	}
+	return primary
+}
+
+// Active returns the key requests are sent with and whether it belongs to
+// the pair, as opposed to a tenant's own key.
+func (p *apiKeyPair) Active(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	primary, secondary := p.keys()
+	if secondary == "" || (key != primary && key != secondary) {
+		return key, false
+	}
+	return p.active(), true
+}
+
+// Failover switches away from rejected and returns the key to retry with,
+// or false when there is no other key. A key another request already
+// switched away from is not switched again.
+func (p *apiKeyPair) Failover(rejected string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if active := p.active(); active != rejected {
+		return active, true
+	}
+	primary, secondary := p.keys()
+	p.rejected, p.failedOver = rejected, time.Now()
+	apiKeyFailoversTotal.Inc()
+	if rejected == primary {
+		log.Printf("OpenWeatherMap rejected WEATHER_API_KEY, switching to WEATHER_API_KEY_SECONDARY")
+		return secondary, true
+	}
+	log.Printf("OpenWeatherMap rejected WEATHER_API_KEY_SECONDARY, switching back to WEATHER_API_KEY")
+	return primary, true
+}
+
+// Rotate makes key the primary key and the key in use the secondary one,
+// which keeps working while OpenWeatherMap activates the new key. The keys
+// live in memory only: a process started by an upgrade inherits them, a
+// restart goes back to the configured ones.
+func (p *apiKeyPair) Rotate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := p.active()
+	primary, secondary := p.keys()
+	for _, old := range []string{primary, secondary} {
+		if old != "" && old != active && !slices.Contains(p.retired, old) {
+			p.retired = append(p.retired, old)
+		}
+	}
+	updateConfig(func(c *Config) *Config {
+		return c.withChanges(map[string]*string{"WEATHER_API_KEY": &key, "WEATHER_API_KEY_SECONDARY": &active})
+	})
+	p.rejected = ""
+}
+
+// Retired returns the keys Rotate replaced.
+func (p *apiKeyPair) Retired() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.retired)
+}
+
+// APIKeyStatus is the body of /admin/api-key responses. Keys are masked but
+// for their last four characters.
+type APIKeyStatus struct {
+	Active       string     `json:"active"`
+	Primary      string     `json:"primary,omitempty"`
+	Secondary    string     `json:"secondary,omitempty"`
+	FailedOverAt *time.Time `json:"failed_over_at,omitempty"`
+}
+
+func (p *apiKeyPair) Status() APIKeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	primary, secondary := p.keys()
+	status := APIKeyStatus{Active: "primary", Primary: maskKey(primary), Secondary: maskKey(secondary)}
+	if secondary != "" && p.active() == secondary {
+		status.Active = "secondary"
+	}
+	if !p.failedOver.IsZero() {
+		at := p.failedOver.UTC()
+		status.FailedOverAt = &at
+	}
+	return status
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return maskedSecret + key[len(key)-4:]
+}
+
+// keyFailoverTransport sends OpenWeatherMap requests with the active key of
+// owmKeys and, when the key is rejected with 401, once more with the other
+// key. Requests with a tenant's key pass unchanged.
+type keyFailoverTransport struct {
+	base http.RoundTripper
+}
+
+func (t keyFailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := owmKeys.Active(req.URL.Query().Get("appid"))
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(withAppID(req, key))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	next, ok := owmKeys.Failover(key)
+	if !ok || next == key {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(withAppID(req, next))
+}
+
+func withAppID(req *http.Request, key string) *http.Request {
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("appid", key)
+	req.URL.RawQuery = query.Encode()
+	return req
+}
+
+func apiKeyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(owmKeys.Status())
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// rotateAPIKeyHandler makes {"key": "..."} the primary OpenWeatherMap key
+// and keeps the one in use as the secondary key.
+func rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil || strings.TrimSpace(body.Key) == "" {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_api_key")
+		return
+	}
+	// The rotated keys are not written anywhere. An upgrade keeps them, but
+	// another shard or Vault would bring the old key back behind the
+	// operator's back, and so does a restart.
+	if shards != nil || vaultManages("WEATHER_API_KEY") || vaultManages("WEATHER_API_KEY_SECONDARY") {
+		writeProblem(w, r, http.StatusConflict, "admin.api_key_managed")
+		return
+	}
+	key := strings.TrimSpace(body.Key)
+	if primary, _ := owmKeys.keys(); key == primary {
+		writeProblem(w, r, http.StatusConflict, "admin.api_key_in_use")
+		return
+	}
+	owmKeys.Rotate(key)
+	status := owmKeys.Status()
+	auditNote(r, "primary", status.Primary)
+	log.Printf("WEATHER_API_KEY rotated through the admin API")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRotateThenUpgrade(t *testing.T) {
+	environ := []string{"WEATHER_API_KEY=old-primary", "WEATHER_API_KEY_SECONDARY=old-secondary"}
+	values, _, _ := environmentSettings(environ)
+	setTestConfig(t, values)
+	keys := &apiKeyPair{}
+	keys.Rotate("new-primary")
+	if primary, secondary := keys.keys(); primary != "new-primary" || secondary != "old-primary" {
+		t.Fatalf("after Rotate: primary %q, secondary %q", primary, secondary)
+	}
+	if want := []string{"old-secondary"}; !slices.Equal(keys.Retired(), want) {
+		t.Errorf("Retired = %q, want %q", keys.Retired(), want)
+	}
+
+	// An upgrade keeps the rotated keys, and so does the next one.
+	child := upgradedConfig(t, runningConfig(), environ)
+	if child.WeatherAPIKey != "new-primary" || child.WeatherAPIKeySecondary != "old-primary" {
+		t.Errorf("after an upgrade: primary %q, secondary %q", child.WeatherAPIKey, child.WeatherAPIKeySecondary)
+	}
+	grandchild := upgradedConfig(t, child, environ)
+	if grandchild.WeatherAPIKey != "new-primary" || grandchild.WeatherAPIKeySecondary != "old-primary" {
+		t.Errorf("after two upgrades: primary %q, secondary %q", grandchild.WeatherAPIKey, grandchild.WeatherAPIKeySecondary)
+	}
+
+	// A restart reads the configuration again.
+	if restarted := newConfig(values); restarted.WeatherAPIKey != "old-primary" {
+		t.Errorf("after a restart: primary %q", restarted.WeatherAPIKey)
+	}
+}
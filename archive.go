@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	archiveUploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "archive_uploads_total",
+			Help: "Total number of observation batches uploaded to object storage",
+		},
+		[]string{"status"},
+	)
+
+	archiveLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "archive_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful archive upload",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(archiveUploadsTotal)
+	prometheus.MustRegister(archiveLastSuccess)
+}
+
+// archiver uploads completed hours of observations as gzipped NDJSON objects
+// to an S3-compatible bucket (AWS S3, MinIO, GCS in interoperability mode).
+type archiver struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	interval  time.Duration
+	watermark time.Time
+}
+
+func newArchiver(cfg *Config) (*archiver, error) {
+	a := &archiver{
+		bucket:    cfg.ArchiveS3Bucket,
+		prefix:    strings.Trim(cfg.ArchiveS3Prefix, "/"),
+		region:    cfg.ArchiveS3Region,
+		accessKey: cfg.ArchiveS3AccessKey,
+		secretKey: cfg.ArchiveS3SecretKey,
+		interval:  cfg.ArchiveInterval,
+	}
+	if a.accessKey == "" || a.secretKey == "" {
+		return nil, fmt.Errorf("ARCHIVE_S3_ACCESS_KEY and ARCHIVE_S3_SECRET_KEY are required")
+	}
+	if a.region == "" {
+		a.region = "us-east-1"
+	}
+
+	endpoint := cfg.ArchiveS3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + a.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ARCHIVE_S3_ENDPOINT %q", endpoint)
+	}
+	a.endpoint = u
+	return a, nil
+}
+
+// runArchiver starts the archiver when ARCHIVE_S3_BUCKET is set.
+func runArchiver(cfg *Config) error {
+	if cfg.ArchiveS3Bucket == "" {
+		return nil
+	}
+	a, err := newArchiver(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Archiving observations to %s/%s every %v", a.endpoint.Host, a.bucket, a.interval)
+	go a.Run()
+	return nil
+}
+
+func (a *archiver) Run() {
+	for now := range backgroundTicks(a.interval) {
+		if err := a.archive(now.UTC().Truncate(time.Hour)); err != nil {
+			logError("Archive upload failed: %v", err)
+			archiveUploadsTotal.WithLabelValues("error").Inc()
+		}
+	}
+}
+
+// archive uploads every observation between the watermark and to. The
+// watermark only advances on success, so a failed batch is retried as part
+// of the next one.
+func (a *archiver) archive(to time.Time) error {
+	points := history.Range(a.watermark, to)
+	if len(points) == 0 {
+		a.watermark = to
+		return nil
+	}
+	from := a.watermark
+	if from.IsZero() {
+		from = points[0].Timestamp.UTC().Truncate(time.Hour)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	for _, p := range points {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s/observations-%s-%s.ndjson.gz",
+		from.Format("2006/01/02"), from.Format("20060102T150405Z"), to.Format("20060102T150405Z"))
+	if a.prefix != "" {
+		key = a.prefix + "/" + key
+	}
+	if err := a.put(key, buf.Bytes()); err != nil {
+		return err
+	}
+
+	log.Printf("Archived %d observations to %s", len(points), key)
+	archiveUploadsTotal.WithLabelValues("success").Inc()
+	archiveLastSuccess.SetToCurrentTime()
+	a.watermark = to
+	return nil
+}
+
+// put stores body under key using a path-style PUT Object request.
+func (a *archiver) put(key string, body []byte) error {
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.bucket + "/" + key
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	signS3Request(req, body, a.accessKey, a.secretKey, a.region, time.Now())
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT %s returned status %d: %s", key, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header for S3.
+func signS3Request(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	signAWSRequest(req, body, awsCredentials{AccessKeyID: accessKey, SecretAccessKey: secretKey}, region, "s3", now)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header for
+// service. Only the host, content hash, date and session token headers are
+// signed.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	headers := []string{
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		signedHeaders += ";x-amz-security-token"
+		headers = append(headers, "x-amz-security-token:"+creds.SessionToken)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		strings.Join(headers, "\n"),
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var auditWriteErrorsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "audit_write_errors_total",
+		Help: "Total number of audit entries that could not be written to AUDIT_LOG_FILE",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(auditWriteErrorsTotal)
+}
+
+// auditMaxEntries is how many of the latest entries /admin/audit serves.
+const auditMaxEntries = 10000
+
+// AuditEntry records one change made through the API: who made it, what
+// route it went to and how it ended.
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	Actor      string            `json:"actor"`
+	Scheme     string            `json:"scheme,omitempty"`
+	Action     string            `json:"action"`
+	Target     map[string]string `json:"target,omitempty"`
+	Details    map[string]any    `json:"details,omitempty"`
+	Status     int               `json:"status"`
+	RequestID  string            `json:"request_id"`
+	RemoteAddr string            `json:"remote_addr"`
+}
+
+// auditLog keeps the latest entries in memory and, with AUDIT_LOG_FILE,
+// appends every entry to that file as a JSON line. Entries are never
+// changed or removed from the file.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	file    *os.File
+}
+
+var auditTrail = &auditLog{}
+
+// openAuditLog reads the latest entries of the file at path, creating it
+// when missing, and appends to it from then on. Without a path entries
+// are only kept in memory.
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		a.add(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	a.file = f
+	return a, nil
+}
+
+func (a *auditLog) add(entry AuditEntry) {
+	if len(a.entries) == auditMaxEntries {
+		a.entries = append(a.entries[:0], a.entries[1:]...)
+	}
+	a.entries = append(a.entries, entry)
+}
+
+// Record adds entry, also to the file when there is one.
+func (a *auditLog) Record(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.add(entry)
+	if a.file == nil {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		auditWriteErrorsTotal.Inc()
+		logError("Writing the audit log failed: %v", err)
+	}
+}
+
+// Entries returns the entries newest first that match filter, at most
+// limit of them.
+func (a *auditLog) Entries(filter func(AuditEntry) bool, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0 && len(list) < limit; i-- {
+		if filter(a.entries[i]) {
+			list = append(list, a.entries[i])
+		}
+	}
+	return list
+}
+
+type auditKey struct{}
+
+// auditNote adds a detail to the audit entry of the request, such as the
+// city added or the id of the subscription created. Requests that are not
+// audited ignore it.
+func auditNote(r *http.Request, key string, value any) {
+	if entry, ok := r.Context().Value(auditKey{}).(*AuditEntry); ok {
+		if entry.Details == nil {
+			entry.Details = make(map[string]any)
+		}
+		entry.Details[key] = value
+	}
+}
+
+// auditStatusWriter remembers the status a handler answered with.
+type auditStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditStatusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditStatusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// audited records every request to next that changes something, that is
+// every one but GET and HEAD, whether it succeeded or not.
+func audited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		entry := &AuditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      "anonymous",
+			Action:     r.Method + " " + r.URL.Path,
+			RequestID:  requestTraceID(r),
+			RemoteAddr: clientIP(r),
+		}
+		if p, ok := requestPrincipal(r); ok {
+			entry.Actor, entry.Scheme = p.Name, p.Scheme
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				entry.Action = r.Method + " " + template
+			}
+		}
+		if vars := mux.Vars(r); len(vars) > 0 {
+			entry.Target = vars
+		}
+		sw := &auditStatusWriter{ResponseWriter: w}
+		defer func() {
+			if sw.status == 0 {
+				// The handler panicked; recoveryMiddleware answers 500.
+				sw.status = http.StatusInternalServerError
+			}
+			entry.Status = sw.status
+			auditTrail.Record(*entry)
+		}()
+		next(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+	}
+}
+
+// auditMiddleware audits the routes of a subrouter.
+func auditMiddleware(next http.Handler) http.Handler {
+	return audited(next.ServeHTTP)
+}
+
+// auditHandler serves /admin/audit: the latest entries newest first,
+// filtered by ?actor=, ?action= (a part of it such as "/admin/cities") and
+// ?since= (RFC 3339), at most ?limit= (default 100).
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > auditMaxEntries {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_limit", v, auditMaxEntries)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_time", v)
+			return
+		}
+		since = t
+	}
+	actor, action := q.Get("actor"), q.Get("action")
+	entries := auditTrail.Entries(func(e AuditEntry) bool {
+		return (actor == "" || e.Actor == actor) &&
+			(action == "" || strings.Contains(e.Action, action)) &&
+			!e.Time.Before(since)
+	}, limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Route groups with their own authentication policy, configured by
+// AUTH_<GROUP> (AUTH_API, AUTH_ADMIN, AUTH_METRICS, AUTH_UI).
+const (
+	authGroupAPI     = "api"
+	authGroupAdmin   = "admin"
+	authGroupMetrics = "metrics"
+	authGroupUI      = "ui"
+)
+
+// routeAuthGroup returns the group a request path belongs to, or "" for
+// routes that are always open (static files, the login, health checks and
+// station uploads, which carry their own credentials).
+func routeAuthGroup(path string) string {
+	switch {
+	case path == "/":
+		return authGroupUI
+	case path == "/api/stats" || strings.HasPrefix(path, "/admin/"):
+		return authGroupAdmin
+	case path == "/metrics":
+		return authGroupMetrics
+	case strings.HasPrefix(path, "/api/") || path == "/epaper":
+		return authGroupAPI
+	}
+	return ""
+}
+
+// authScheme verifies one kind of credentials. Authenticate reports false
+// when the request carries no valid credentials of the scheme, and an error
+// only when they could not be checked.
+type authScheme interface {
+	Authenticate(r *http.Request) (principal, bool, error)
+	// Challenge is the WWW-Authenticate value sent with 401 responses.
+	Challenge(realm string) string
+}
+
+// principal is who a scheme authenticated.
+type principal struct {
+	Scheme string
+	Name   string
+	Roles  []role
+}
+
+// tokenScheme accepts the static bearer token ADMIN_TOKEN, which carries
+// the admin role.
+type tokenScheme struct{ token string }
+
+func (s tokenScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+		return principal{}, false, nil
+	}
+	return principal{Scheme: "token", Name: "token", Roles: []role{roleAdmin}}, true, nil
+}
+
+func (tokenScheme) Challenge(realm string) string { return fmt.Sprintf("Bearer realm=%q", realm) }
+
+// ldapScheme checks HTTP Basic credentials against the directory.
+type ldapScheme struct{ directory *ldapDirectory }
+
+func (s ldapScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return principal{}, false, nil
+	}
+	roles, err := s.directory.Authenticate(username, password)
+	switch {
+	case errors.Is(err, errLDAPInvalidCredentials):
+		return principal{}, false, nil
+	case err != nil:
+		return principal{}, false, fmt.Errorf("LDAP authentication of %q failed: %w", username, err)
+	}
+	return principal{Scheme: "ldap", Name: username, Roles: roles}, true, nil
+}
+
+func (ldapScheme) Challenge(realm string) string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+}
+
+// basicScheme checks HTTP Basic credentials against BASIC_AUTH_USERS
+// ("user:password,..."), meant for scrapers that only speak Basic auth.
+// Users have the roles of BASIC_AUTH_ROLES, none by default.
+type basicScheme struct {
+	users map[string]string
+	roles map[string][]role
+}
+
+func (s basicScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	username, password, ok := r.BasicAuth()
+	want, known := s.users[username]
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		return principal{}, false, nil
+	}
+	return principal{Scheme: "basic", Name: username, Roles: s.roles[username]}, true, nil
+}
+
+func (basicScheme) Challenge(realm string) string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+}
+
+// apiKeyScheme accepts the keys of API_KEYS ("name=key,...") in the
+// X-API-Key header. Keys carry the roles of API_KEY_ROLES, the reader role
+// by default; the name identifies the client in logs and metrics without
+// revealing the key.
+type apiKeyScheme struct {
+	keys  map[string]string
+	roles map[string][]role
+}
+
+func (s apiKeyScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	got := r.Header.Get("X-API-Key")
+	if got == "" {
+		return principal{}, false, nil
+	}
+	for name, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+			roles, ok := s.roles[name]
+			if !ok {
+				roles = []role{roleReader}
+			}
+			return principal{Scheme: "apikey", Name: name, Roles: roles}, true, nil
+		}
+	}
+	return principal{}, false, nil
+}
+
+func (apiKeyScheme) Challenge(realm string) string { return fmt.Sprintf("APIKey realm=%q", realm) }
+
+// jwtScheme accepts bearer JWTs signed with HS256 and JWT_SECRET. The
+// claim at JWT_ROLES_CLAIM ("roles" by default) lists the roles of the
+// subject. Tokens must carry "exp"; "nbf" is enforced when present.
+type jwtScheme struct {
+	secret     []byte
+	rolesClaim string
+}
+
+func (s jwtScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if !ok || len(parts) != 3 {
+		return principal{}, false, nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Subject   string `json:"sub"`
+		ExpiresAt *int64 `json:"exp"`
+		NotBefore *int64 `json:"nbf"`
+	}
+	var all map[string]any
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !decodeJWTPart(parts[0], &header) || header.Alg != "HS256" {
+		return principal{}, false, nil
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) || !decodeJWTPart(parts[1], &claims) || !decodeJWTPart(parts[1], &all) {
+		return principal{}, false, nil
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == nil || now >= *claims.ExpiresAt || (claims.NotBefore != nil && now < *claims.NotBefore) {
+		return principal{}, false, nil
+	}
+	return principal{Scheme: "jwt", Name: claims.Subject, Roles: jwtRoles(all, s.rolesClaim)}, true, nil
+}
+
+// jwtRoles returns the roles in the claim at path, which descends into
+// nested objects at dots: "realm_access.roles" as issued by Keycloak. The
+// claim is a list of names or a string of names separated by spaces, as
+// "scope"; names that are not roles are ignored.
+func jwtRoles(claims map[string]any, path string) []role {
+	var value any = claims
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	var names []string
+	switch v := value.(type) {
+	case string:
+		names = strings.Fields(v)
+	case []any:
+		for _, item := range v {
+			if name, ok := item.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	var roles []role
+	for _, name := range names {
+		if r := role(name); r.Valid() {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+func decodeJWTPart(part string, v any) bool {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func (jwtScheme) Challenge(realm string) string { return fmt.Sprintf("Bearer realm=%q", realm) }
+
+// authSchemes returns the schemes whose credentials are configured.
+func authSchemes(cfg *Config, directory *ldapDirectory, oidc *oidcClient) (map[string]authScheme, error) {
+	schemes := make(map[string]authScheme)
+	if oidc != nil {
+		schemes["oidc"] = oidcScheme{oidc}
+	}
+	if token := cfg.AdminToken; token != "" {
+		schemes["token"] = tokenScheme{token}
+	}
+	if directory != nil {
+		schemes["ldap"] = ldapScheme{directory}
+	}
+	if secret := cfg.JWTSecret; secret != "" {
+		schemes["jwt"] = jwtScheme{[]byte(secret), cfg.JWTRolesClaim}
+	}
+	if v := cfg.APIKeys; v != "" {
+		keys, err := parseCredentialList(v, "=")
+		if err != nil {
+			return nil, fmt.Errorf("API_KEYS: %w", err)
+		}
+		roles, err := parseRoleAssignments(cfg.APIKeyRoles)
+		if err != nil {
+			return nil, fmt.Errorf("API_KEY_ROLES: %w", err)
+		}
+		schemes["apikey"] = apiKeyScheme{keys, roles}
+	}
+	if v := cfg.BasicAuthUsers; v != "" {
+		users, err := parseCredentialList(v, ":")
+		if err != nil {
+			return nil, fmt.Errorf("BASIC_AUTH_USERS: %w", err)
+		}
+		roles, err := parseRoleAssignments(cfg.BasicAuthRoles)
+		if err != nil {
+			return nil, fmt.Errorf("BASIC_AUTH_ROLES: %w", err)
+		}
+		schemes["basic"] = basicScheme{users, roles}
+	}
+	return schemes, nil
+}
+
+// parseRoleAssignments parses "name=role|role" entries separated by
+// commas, such as "grafana=reader,deploy=reader|admin".
+func parseRoleAssignments(v string) (map[string][]role, error) {
+	assignments := make(map[string][]role)
+	if strings.TrimSpace(v) == "" {
+		return assignments, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		name, list, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("entry %q is not name=role", entry)
+		}
+		var roles []role
+		for _, r := range strings.Split(list, "|") {
+			r := role(strings.TrimSpace(r))
+			if !r.Valid() {
+				return nil, fmt.Errorf("unknown role %q of %s, expected reader or admin", r, name)
+			}
+			roles = append(roles, r)
+		}
+		assignments[name] = roles
+	}
+	return assignments, nil
+}
+
+// requireRole admits only requests whose principal has the role want,
+// whatever the policy of their group accepted, and answers the others with
+// 403. It runs after authChain, on routes that must never be open to a
+// weaker role: a reader key in AUTH_ADMIN still cannot use the admin API.
+func requireRole(want role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := requestPrincipal(r)
+			if !ok || !hasRole(p.Roles, want) {
+				writeProblem(w, r, http.StatusForbidden, "auth.forbidden", want)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseCredentialList parses "name<sep>secret" entries separated by commas.
+func parseCredentialList(v, sep string) (map[string]string, error) {
+	entries := make(map[string]string)
+	for i, entry := range strings.Split(v, ",") {
+		name, secret, ok := strings.Cut(strings.TrimSpace(entry), sep)
+		if !ok || name == "" || secret == "" {
+			// The entry is not quoted: it may hold a secret.
+			return nil, fmt.Errorf("entry %d is not name%ssecret", i+1, sep)
+		}
+		entries[name] = secret
+	}
+	return entries, nil
+}
+
+// authSchemeNames are the schemes an AUTH_* policy may name.
+var authSchemeNames = []string{"token", "ldap", "jwt", "apikey", "basic", "oidc"}
+
+// authPolicy is an AUTH_* expression: alternatives separated by "|", each
+// a "+"-joined list of schemes that must all authenticate and roles
+// ("role:admin") one of them must grant. "jwt+role:admin|token" admits a
+// JWT with the admin role or the admin token. An empty policy admits
+// everyone.
+type authPolicy [][]string
+
+func parseAuthPolicy(expr string) (authPolicy, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	var policy authPolicy
+	for _, alternative := range strings.Split(expr, "|") {
+		var terms []string
+		schemes := 0
+		for _, term := range strings.Split(alternative, "+") {
+			term = strings.TrimSpace(term)
+			if name, ok := strings.CutPrefix(term, "role:"); ok {
+				if !role(name).Valid() {
+					return nil, fmt.Errorf("unknown role %q", name)
+				}
+			} else if !slices.Contains(authSchemeNames, term) {
+				return nil, fmt.Errorf("unknown scheme %q, expected one of %s", term, strings.Join(authSchemeNames, ", "))
+			} else {
+				schemes++
+			}
+			terms = append(terms, term)
+		}
+		if schemes == 0 {
+			return nil, fmt.Errorf("%q names no scheme", alternative)
+		}
+		policy = append(policy, terms)
+	}
+	return policy, nil
+}
+
+// groupPolicies reads the policy of every route group. Without AUTH_ADMIN
+// the admin API accepts the admin token and directory and OIDC users with
+// the admin role, whichever is configured; nil means the admin API is
+// disabled. With OIDC login the dashboard requires it unless AUTH_UI says
+// otherwise.
+func groupPolicies(cfg *Config, schemes map[string]authScheme) (map[string]authPolicy, error) {
+	policies := make(map[string]authPolicy)
+	for _, g := range []struct{ group, expr string }{
+		{authGroupAPI, cfg.AuthAPI},
+		{authGroupAdmin, cfg.AuthAdmin},
+		{authGroupMetrics, cfg.AuthMetrics},
+		{authGroupUI, cfg.AuthUI},
+	} {
+		group, expr := g.group, g.expr
+		name := "AUTH_" + strings.ToUpper(group)
+		// An invalid policy must not fall back to the default, which may
+		// leave the group open.
+		if err := cfg.check(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		_, set := cfg.Lookup(name)
+		if group == authGroupAdmin && expr == "" {
+			var defaults []string
+			if schemes["token"] != nil {
+				defaults = append(defaults, "token")
+			}
+			if schemes["ldap"] != nil {
+				defaults = append(defaults, "ldap+role:admin")
+			}
+			if schemes["oidc"] != nil {
+				defaults = append(defaults, "oidc+role:admin")
+			}
+			expr = strings.Join(defaults, "|")
+		}
+		if group == authGroupUI && !set && schemes["oidc"] != nil {
+			expr = "oidc"
+		}
+		policy, err := parseAuthPolicy(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, alternative := range policy {
+			for _, term := range alternative {
+				if !strings.HasPrefix(term, "role:") && schemes[term] == nil {
+					return nil, fmt.Errorf("%s: scheme %q is not configured", name, term)
+				}
+			}
+		}
+		policies[group] = policy
+	}
+	return policies, nil
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns who authenticated the request, if anyone.
+func requestPrincipal(r *http.Request) (principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authChain enforces the policy of each route's group. The first
+// alternative that is satisfied admits the request; schemes are checked at
+// most once per request. When none is, the answer is 403 if some
+// alternative only lacked a role, 503 if a credential store failed and 401
+// with a challenge for every scheme of the policy otherwise.
+func authChain(schemes map[string]authScheme, policies map[string]authPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			group := routeAuthGroup(r.URL.Path)
+			policy := policies[group]
+			if len(policy) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			type outcome struct {
+				principal principal
+				ok        bool
+			}
+			checked := make(map[string]outcome)
+			var missingRole string
+			var failure error
+		alternatives:
+			for _, alternative := range policy {
+				var admitted []principal
+				for _, term := range alternative {
+					if strings.HasPrefix(term, "role:") {
+						continue
+					}
+					o, seen := checked[term]
+					if !seen {
+						var err error
+						o.principal, o.ok, err = schemes[term].Authenticate(r)
+						if err != nil {
+							failure = err
+						}
+						checked[term] = o
+					}
+					if !o.ok {
+						continue alternatives
+					}
+					admitted = append(admitted, o.principal)
+				}
+				for _, term := range alternative {
+					want, ok := strings.CutPrefix(term, "role:")
+					if !ok {
+						continue
+					}
+					granted := false
+					for _, p := range admitted {
+						granted = granted || hasRole(p.Roles, role(want))
+					}
+					if !granted {
+						missingRole = want
+						continue alternatives
+					}
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, admitted[0])))
+				return
+			}
+
+			switch {
+			case missingRole != "":
+				writeProblem(w, r, http.StatusForbidden, "auth.forbidden", missingRole)
+			case failure != nil:
+				logError("Authentication failed: %v", failure)
+				writeProblem(w, r, http.StatusServiceUnavailable, "auth.unavailable")
+			case redirectToLogin(w, r, policy):
+			default:
+				challenged := make(map[string]bool)
+				for _, alternative := range policy {
+					for _, term := range alternative {
+						if scheme := schemes[term]; scheme != nil && !challenged[scheme.Challenge(group)] {
+							challenged[scheme.Challenge(group)] = true
+							w.Header().Add("WWW-Authenticate", scheme.Challenge(group))
+						}
+					}
+				}
+				writeProblem(w, r, http.StatusUnauthorized, "auth.unauthorized")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testScheme admits requests whose X-Test-Auth header names it.
+type testScheme struct {
+	name  string
+	roles []role
+	err   error
+}
+
+func (s testScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	if s.err != nil {
+		return principal{}, false, s.err
+	}
+	if !slices.Contains(strings.Split(r.Header.Get("X-Test-Auth"), ","), s.name) {
+		return principal{}, false, nil
+	}
+	return principal{Scheme: s.name, Name: "user", Roles: s.roles}, true, nil
+}
+
+func (s testScheme) Challenge(realm string) string { return s.name + " realm=" + realm }
+
+func TestParseAuthPolicy(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    authPolicy
+		wantErr bool
+	}{
+		{expr: "", want: nil},
+		{expr: "  ", want: nil},
+		{expr: "token", want: authPolicy{{"token"}}},
+		{expr: "apikey|jwt", want: authPolicy{{"apikey"}, {"jwt"}}},
+		{expr: " jwt + role:admin | token ", want: authPolicy{{"jwt", "role:admin"}, {"token"}}},
+		{expr: "basic+apikey+role:reader", want: authPolicy{{"basic", "apikey", "role:reader"}}},
+
+		{expr: "cookie", wantErr: true},
+		{expr: "JWT", wantErr: true},
+		{expr: "jwt+role:owner", wantErr: true},
+		{expr: "role:admin", wantErr: true},
+		{expr: "token|role:admin", wantErr: true},
+		{expr: "token|", wantErr: true},
+		{expr: "jwt+", wantErr: true},
+		{expr: "|", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseAuthPolicy(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAuthPolicy(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+			}
+			if !slices.EqualFunc(got, tt.want, slices.Equal[[]string]) {
+				t.Errorf("parseAuthPolicy(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupPolicies(t *testing.T) {
+	all := map[string]authScheme{
+		"token": testScheme{name: "token"},
+		"ldap":  testScheme{name: "ldap"},
+		"oidc":  testScheme{name: "oidc"},
+		"jwt":   testScheme{name: "jwt"},
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		schemes map[string]authScheme
+		want    map[string]authPolicy
+		wantErr bool
+	}{
+		{
+			name:    "nothing configured",
+			schemes: map[string]authScheme{},
+			want:    map[string]authPolicy{},
+		},
+		{
+			name:    "admin defaults",
+			schemes: all,
+			want: map[string]authPolicy{
+				authGroupAdmin: {{"token"}, {"ldap", "role:admin"}, {"oidc", "role:admin"}},
+				authGroupUI:    {{"oidc"}},
+			},
+		},
+		{
+			name:    "explicit policies",
+			env:     map[string]string{"AUTH_API": "token|jwt", "AUTH_ADMIN": "jwt+role:admin", "AUTH_UI": ""},
+			schemes: all,
+			want: map[string]authPolicy{
+				authGroupAPI:   {{"token"}, {"jwt"}},
+				authGroupAdmin: {{"jwt", "role:admin"}},
+			},
+		},
+		{
+			name:    "unconfigured scheme",
+			env:     map[string]string{"AUTH_METRICS": "basic"},
+			schemes: all,
+			wantErr: true,
+		},
+		{
+			name:    "invalid policy",
+			env:     map[string]string{"AUTH_API": "token+role:root"},
+			schemes: all,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := groupPolicies(newConfig(tt.env), tt.schemes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, group := range []string{authGroupAPI, authGroupAdmin, authGroupMetrics, authGroupUI} {
+				if !slices.EqualFunc(got[group], tt.want[group], slices.Equal[[]string]) {
+					t.Errorf("%s policy = %q, want %q", group, got[group], tt.want[group])
+				}
+			}
+		})
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+	schemes := map[string]authScheme{
+		"token":  testScheme{name: "token", roles: []role{roleAdmin}},
+		"apikey": testScheme{name: "apikey", roles: []role{roleReader}},
+		"jwt":    testScheme{name: "jwt", roles: []role{roleReader}},
+		"ldap":   testScheme{name: "ldap", err: errors.New("directory down")},
+	}
+	policies := map[string]authPolicy{
+		authGroupAPI:     {{"apikey"}, {"jwt"}},
+		authGroupAdmin:   {{"jwt", "role:admin"}, {"token"}},
+		authGroupMetrics: {{"ldap"}},
+	}
+	handler := authChain(schemes, policies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := requestPrincipal(r)
+		w.Header().Set("X-Principal", p.Scheme)
+	}))
+
+	tests := []struct {
+		name       string
+		path       string
+		creds      string
+		wantStatus int
+		wantScheme string
+		wantAuth   []string
+	}{
+		{name: "open route", path: "/static/app.js", wantStatus: http.StatusOK},
+		{name: "group without policy", path: "/", wantStatus: http.StatusOK},
+		{name: "first alternative", path: "/api/weather", creds: "apikey", wantStatus: http.StatusOK, wantScheme: "apikey"},
+		{name: "second alternative", path: "/api/weather", creds: "jwt", wantStatus: http.StatusOK, wantScheme: "jwt"},
+		{name: "no credentials", path: "/api/weather", wantStatus: http.StatusUnauthorized,
+			wantAuth: []string{"apikey realm=api", "jwt realm=api"}},
+		{name: "wrong scheme", path: "/api/weather", creds: "token", wantStatus: http.StatusUnauthorized},
+		{name: "role missing", path: "/admin/config", creds: "jwt", wantStatus: http.StatusForbidden},
+		{name: "later alternative without role", path: "/admin/config", creds: "jwt,token", wantStatus: http.StatusOK, wantScheme: "token"},
+		{name: "credential store down", path: "/metrics", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.creds != "" {
+				r.Header.Set("X-Test-Auth", tt.creds)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("X-Principal"); got != tt.wantScheme {
+				t.Errorf("principal scheme %q, want %q", got, tt.wantScheme)
+			}
+			if tt.wantAuth != nil && !slices.Equal(w.Header().Values("WWW-Authenticate"), tt.wantAuth) {
+				t.Errorf("challenges %q, want %q", w.Header().Values("WWW-Authenticate"), tt.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// apiVersion is the version of the HTTP API, raised on incompatible changes.
+const apiVersion = "1"
+
+// Capabilities describes what this deployment serves, so that the UI and
+// client SDKs can configure themselves instead of finding out by failing
+// requests.
+type Capabilities struct {
+	APIVersion string          `json:"api_version"`
+	Features   map[string]bool `json:"features"`
+	// Formats are the response content types: JSON, MessagePack and
+	// protobuf by Accept header, GeoJSON by ?format=geojson.
+	Formats []string `json:"formats"`
+	// Provider is WEATHER_PROVIDER and Providers all that it can be set to.
+	Provider   string     `json:"provider"`
+	Providers  []string   `json:"providers"`
+	RateLimits RateLimits `json:"rate_limits"`
+}
+
+// RateLimits are the limits that apply to the caller.
+type RateLimits struct {
+	// UpstreamPerMinute and UpstreamPerMonth are the OpenWeatherMap calls
+	// the deployment makes at most, shared by everyone; absent with other
+	// providers.
+	UpstreamPerMinute int `json:"upstream_per_minute,omitempty"`
+	UpstreamPerMonth  int `json:"upstream_per_month,omitempty"`
+	// APIKey is the quota of the caller's API key, absent without one.
+	APIKey *APIKeyQuota `json:"api_key,omitempty"`
+}
+
+// APIKeyQuota is an API_KEY_QUOTAS entry; absent limits are unlimited.
+type APIKeyQuota struct {
+	KeyID   string `json:"key_id"`
+	Daily   *int   `json:"daily,omitempty"`
+	Monthly *int   `json:"monthly,omitempty"`
+}
+
+// Features that depend on the configuration:
+//   - forecast: /api/window, /api/trip and forecast_change subscriptions,
+//     which need a provider with forecasts;
+//   - city_search: /api/cities, which needs CITY_CATALOG or the geocoder of
+//     WEATHER_API_KEY;
+//   - history: /api/temperature/stats and /api/temperature/history;
+//   - webhooks: /api/subscriptions;
+//   - tenants: /api/t/{tenant}/..., with TENANTS.
+func currentCapabilities(r *http.Request) Capabilities {
+	cfg := runningConfig()
+	tenants, _ := parseTenants(cfg.Tenants)
+	caps := Capabilities{
+		APIVersion: apiVersion,
+		Features: map[string]bool{
+			"forecast":    forecastSupported(),
+			"city_search": cities.Loaded() || cfg.WeatherAPIKey != "",
+			"history":     true,
+			"webhooks":    true,
+			"tenants":     len(tenants) > 0,
+		},
+		Formats:   []string{contentTypeGeoJSON},
+		Provider:  cfg.WeatherProvider,
+		Providers: weatherProviderNames,
+	}
+	if caps.Provider == "openweathermap" {
+		caps.RateLimits.UpstreamPerMinute = cfg.OWMCallsPerMinute
+		caps.RateLimits.UpstreamPerMonth = cfg.OWMCallsPerMonth
+	}
+	for _, contentType := range mediaTypes {
+		if !slices.Contains(caps.Formats, contentType) {
+			caps.Formats = append(caps.Formats, contentType)
+		}
+	}
+	slices.Sort(caps.Formats)
+	if id, ok := requestAPIKeyID(r); ok {
+		quota := quotaOf(id)
+		caps.RateLimits.APIKey = &APIKeyQuota{KeyID: id}
+		if quota.daily > 0 {
+			caps.RateLimits.APIKey.Daily = &quota.daily
+		}
+		if quota.monthly > 0 {
+			caps.RateLimits.APIKey.Monthly = &quota.monthly
+		}
+	}
+	return caps
+}
+
+// capabilitiesHandler serves /api/capabilities.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if !writeResponse(w, r, http.StatusOK, currentCapabilities(r)) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
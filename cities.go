@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cityCatalogSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "city_catalog_cities",
+		Help: "Number of cities in the offline city catalog",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(cityCatalogSize)
+}
+
+const defaultCityCatalogURL = "https://download.geonames.org/export/dump/cities15000.zip"
+
+// City is one entry of the GeoNames city database.
+type City struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	Country    string  `json:"country"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Population int     `json:"population"`
+	Timezone   string  `json:"timezone,omitempty"`
+	DistanceKm float64 `json:"distance_km,omitempty"`
+}
+
+type cityKey struct {
+	name string
+	city int32
+}
+
+// cityCatalog is an in-memory index of the GeoNames dump: every name, ASCII
+// name and alternate name of a city, lowercased and sorted, so prefix
+// searches are a binary search followed by a short scan.
+type cityCatalog struct {
+	mu     sync.RWMutex
+	cities []City
+	keys   []cityKey
+}
+
+var cities = &cityCatalog{}
+
+func normalizeCityName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// parseGeoNames reads the tab-separated GeoNames "cities" dump format.
+func parseGeoNames(r io.Reader) ([]City, []cityKey, error) {
+	var (
+		list []City
+		keys []cityKey
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) < 18 {
+			return nil, nil, fmt.Errorf("line %d: expected at least 18 columns, got %d", line, len(cols))
+		}
+		id, err1 := strconv.Atoi(cols[0])
+		lat, err2 := strconv.ParseFloat(cols[4], 64)
+		lon, err3 := strconv.ParseFloat(cols[5], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, nil, fmt.Errorf("line %d: invalid id or coordinates", line)
+		}
+		population, _ := strconv.Atoi(cols[14])
+
+		index := int32(len(list))
+		list = append(list, City{
+			ID: id, Name: cols[1], Country: cols[8],
+			Latitude: lat, Longitude: lon,
+			Population: population, Timezone: cols[17],
+		})
+		seen := make(map[string]bool)
+		names := append([]string{cols[1], cols[2]}, strings.Split(cols[3], ",")...)
+		for _, name := range names {
+			if name = normalizeCityName(name); name != "" && !seen[name] {
+				seen[name] = true
+				keys = append(keys, cityKey{name, index})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+	return list, keys, nil
+}
+
+// Loaded reports whether the catalog is ready to be queried.
+func (c *cityCatalog) Loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cities != nil
+}
+
+// Search returns up to limit cities with a name starting with prefix, the
+// most populous first.
+func (c *cityCatalog) Search(prefix string, limit int) []City {
+	prefix = normalizeCityName(prefix)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	seen := make(map[int32]bool)
+	var found []City
+	for i := sort.Search(len(c.keys), func(i int) bool { return c.keys[i].name >= prefix }); i < len(c.keys); i++ {
+		if !strings.HasPrefix(c.keys[i].name, prefix) {
+			break
+		}
+		if !seen[c.keys[i].city] {
+			seen[c.keys[i].city] = true
+			found = append(found, c.cities[c.keys[i].city])
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Population > found[j].Population })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// Lookup geocodes a city name, optionally qualified with a country code as
+// in "Paris,FR". Among cities sharing the name the most populous wins.
+func (c *cityCatalog) Lookup(query string) (City, bool) {
+	name, country, _ := strings.Cut(query, ",")
+	name, country = normalizeCityName(name), strings.ToUpper(strings.TrimSpace(country))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var best City
+	found := false
+	for i := sort.Search(len(c.keys), func(i int) bool { return c.keys[i].name >= name }); i < len(c.keys) && c.keys[i].name == name; i++ {
+		city := c.cities[c.keys[i].city]
+		if country != "" && city.Country != country {
+			continue
+		}
+		if !found || city.Population > best.Population {
+			best, found = city, true
+		}
+	}
+	return best, found
+}
+
+// Nearest returns the city closest to the given coordinates.
+func (c *cityCatalog) Nearest(lat, lon float64) (City, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var best City
+	bestDistance := math.Inf(1)
+	for _, city := range c.cities {
+		if d := haversineKm(lat, lon, city.Latitude, city.Longitude); d < bestDistance {
+			best, bestDistance = city, d
+		}
+	}
+	best.DistanceKm = math.Round(bestDistance*10) / 10
+	return best, len(c.cities) > 0
+}
+
+// haversineKm is the great-circle distance between two points in kilometres.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// readCityCatalog opens a GeoNames dump, either the plain .txt file or the
+// .zip published on download.geonames.org.
+func readCityCatalog(path string) ([]City, []cityKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".zip") {
+		return parseGeoNames(bytes.NewReader(data))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range archive.File {
+		if strings.HasSuffix(f.Name, ".txt") && !strings.HasPrefix(f.Name, "readme") {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			defer rc.Close()
+			return parseGeoNames(rc)
+		}
+	}
+	return nil, nil, fmt.Errorf("%s contains no GeoNames .txt file", path)
+}
+
+func downloadCityCatalog(path, source string) error {
+	client := &http.Client{Timeout: 10 * time.Minute, Transport: upstreamTransport}
+	resp, err := client.Get(source)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", source, resp.StatusCode)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadCityCatalog loads the catalog at path (CITY_CATALOG) in the
+// background, downloading it from source (CITY_CATALOG_URL) first when the
+// file does not exist yet. Failed downloads are retried; the catalog stays
+// unavailable until one succeeds.
+func loadCityCatalog(path, source string) {
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Printf("Downloading city catalog from %s", source)
+			if err := downloadCityCatalog(path, source); err != nil {
+				logError("City catalog download failed, retrying in 10m: %v", err)
+				select {
+				case <-time.After(10 * time.Minute):
+				case <-backgroundJobs.Done():
+					return
+				}
+				continue
+			}
+		}
+		list, keys, err := readCityCatalog(path)
+		if err != nil {
+			log.Printf("City catalog %s is unusable: %v", path, err)
+			return
+		}
+		cities.mu.Lock()
+		cities.cities, cities.keys = list, keys
+		cities.mu.Unlock()
+		cityCatalogSize.Set(float64(len(list)))
+		log.Printf("Loaded %d cities from %s", len(list), path)
+		return
+	}
+}
+
+func citySearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("q")
+	if strings.TrimSpace(prefix) == "" {
+		writeProblem(w, r, http.StatusBadRequest, "cities.missing_query")
+		return
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			writeProblem(w, r, http.StatusBadRequest, "cities.invalid_limit", v)
+			return
+		}
+		limit = n
+	}
+	found, err := searchCities(prefix, limit)
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		w.Header().Set("Retry-After", retryAfterSeconds(quotaErr.RetryAfter))
+		writeProblem(w, r, http.StatusServiceUnavailable, "temperature.quota_exceeded")
+		return
+	case err != nil:
+		logError("City search for %q failed: %v", prefix, err)
+		writeProblem(w, r, http.StatusServiceUnavailable, "cities.unavailable")
+		return
+	}
+	if found == nil {
+		found = []City{}
+	}
+	if !writeResponse(w, r, http.StatusOK, found) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+func nearestCityHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+	lon, err2 := strconv.ParseFloat(q.Get("lon"), 64)
+	if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_coordinates", q.Get("lat"), q.Get("lon"))
+		return
+	}
+	city, ok := cities.Nearest(lat, lon)
+	if !ok {
+		writeProblem(w, r, http.StatusServiceUnavailable, "cities.unavailable")
+		return
+	}
+	if !writeResponse(w, r, http.StatusOK, city) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
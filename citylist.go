@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cityListMu serializes changes of COLLECT_CITIES through the admin API,
+// which read, change and write back the list.
+var cityListMu sync.Mutex
+
+// CityList is the body of /admin/cities responses: COLLECT_CITIES as
+// configured, before sharding picks the owned ones. Persisted tells whether
+// a change was also written to CONFIG_FILE and survives a restart.
+type CityList struct {
+	Cities    []string `json:"cities"`
+	Persisted *bool    `json:"persisted,omitempty"`
+}
+
+func configuredCities() []string {
+	return append([]string{}, runningConfig().CollectCities...)
+}
+
+func cityListHandler(w http.ResponseWriter, r *http.Request) {
+	cityListMu.Lock()
+	list := CityList{Cities: configuredCities()}
+	cityListMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// addCityHandler adds {"city": "..."} to COLLECT_CITIES. The collector
+// picks it up in its next round.
+func addCityHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		City string `json:"city"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_city", body.City)
+		return
+	}
+	city := strings.TrimSpace(body.City)
+	// COLLECT_CITIES is separated by commas.
+	if city == "" || strings.Contains(city, ",") {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_city", body.City)
+		return
+	}
+	cityListMu.Lock()
+	defer cityListMu.Unlock()
+	cities := configuredCities()
+	if slices.ContainsFunc(cities, func(c string) bool { return strings.EqualFold(c, city) }) {
+		writeProblem(w, r, http.StatusConflict, "admin.city_exists", city)
+		return
+	}
+	cities = append(cities, city)
+	auditNote(r, "city", city)
+	if !writeCityList(w, r, http.StatusCreated, cities) {
+		return
+	}
+	log.Printf("Added %s to COLLECT_CITIES", city)
+}
+
+// removeCityHandler removes /admin/cities/{city} from COLLECT_CITIES.
+func removeCityHandler(w http.ResponseWriter, r *http.Request) {
+	city := mux.Vars(r)["city"]
+	cityListMu.Lock()
+	defer cityListMu.Unlock()
+	cities := configuredCities()
+	i := slices.IndexFunc(cities, func(c string) bool { return strings.EqualFold(c, city) })
+	if i < 0 {
+		writeProblem(w, r, http.StatusNotFound, "admin.no_such_city", city)
+		return
+	}
+	removed := cities[i]
+	cities = slices.Delete(cities, i, i+1)
+	if !writeCityList(w, r, http.StatusOK, cities) {
+		return
+	}
+	// Nothing refreshes the city's gauge any more; a stale value would be
+	// scraped forever.
+	temperatureGauge.DeletePartialMatch(prometheus.Labels{"city": removed})
+	log.Printf("Removed %s from COLLECT_CITIES", removed)
+}
+
+// writeCityList applies cities as COLLECT_CITIES, writes them to
+// CONFIG_FILE when they would be read from it after a restart, and sends
+// the new list. It returns false when the list could not be saved.
+func writeCityList(w http.ResponseWriter, r *http.Request, status int, cities []string) bool {
+	value := strings.Join(cities, ",")
+	persisted := false
+	if cfg := runningConfig(); cfg.file != "" && !cfg.inEnvironment("COLLECT_CITIES") {
+		path := cfg.file
+		if err := saveConfigSetting(path, "COLLECT_CITIES", cities); err != nil {
+			logError("Saving COLLECT_CITIES to %s failed: %v", path, err)
+			writeProblem(w, r, http.StatusInternalServerError, "admin.config_not_saved", err)
+			return false
+		}
+		persisted = true
+	}
+	updateConfig(func(c *Config) *Config {
+		if persisted {
+			// A process started by an upgrade reads it from CONFIG_FILE.
+			return c.with(map[string]string{"COLLECT_CITIES": value})
+		}
+		return c.withChanges(map[string]*string{"COLLECT_CITIES": &value})
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(CityList{Cities: cities, Persisted: &persisted})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(status)).Inc()
+	return true
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is the release of the binary, set at build time with
+// -ldflags "-X main.version=1.4.0".
+var version = "dev"
+
+const cliUsage = `usage: weather-app [command]
+
+commands:
+  serve [--once]     run the server (the default); with --once collect the
+                     configured cities, push metrics and exit
+  fetch [--city X]   print the current conditions of a city and exit
+  version            print the version
+  check-config [--probe]
+                     validate CONFIG_FILE and the environment, print the
+                     effective configuration and exit; with --probe also
+                     read the secrets and test the provider (alias
+                     --check-config)
+  config             print the config file schema or validate a file
+  healthcheck        probe the local server for container health checks
+`
+
+// runCommand dispatches the command line. Without a command the server
+// runs, as before commands existed.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && (!strings.HasPrefix(args[0], "-") || args[0] == "--check-config") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		once := flags.Bool("once", false, "collect the configured cities, push metrics and exit")
+		if err := flags.Parse(args); err == flag.ErrHelp {
+			fmt.Fprint(stdout, cliUsage)
+			return 0
+		} else if err != nil || flags.NArg() > 0 {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		if *once {
+			return runOnceCommand(stderr)
+		}
+		serve()
+		return 0
+	case "fetch":
+		return runFetchCommand(args, stdout, stderr)
+	case "version":
+		fmt.Fprintln(stdout, versionString())
+		return 0
+	case "check-config", "--check-config":
+		return runCheckConfigCommand(args, stdout, stderr)
+	case "config":
+		return runConfigCommand(args, stdout, stderr)
+	case "healthcheck":
+		return runHealthcheckCommand(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	}
+	fmt.Fprint(stderr, cliUsage)
+	return 2
+}
+
+// versionString describes the build: the release, or the VCS revision of
+// development builds, with the Go version and the API version.
+func versionString() string {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				v += "-" + s.Value[:12]
+			}
+		}
+	}
+	return fmt.Sprintf("weather-app %s (%s, API v%s)", v, runtime.Version(), apiVersion)
+}
+
+// runFetchCommand implements "weather-app fetch": it fetches the current
+// conditions of a city from the configured provider and prints them as
+// /api/temperature would, without the cache, history or metrics.
+func runFetchCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	city := flags.String("city", "", "city to fetch (default WEATHER_CITY)")
+	units := flags.String("units", "metric", "metric or imperial")
+	lang := flags.String("lang", "", "language of the display values (default WEATHER_LANG)")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	if *units != string(unitsMetric) && *units != string(unitsImperial) {
+		fmt.Fprintf(stderr, "invalid --units %q, expected metric or imperial\n", *units)
+		return 2
+	}
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *city == "" {
+		*city = cfg.WeatherCity
+	}
+	if *lang == "" {
+		*lang = weatherLang()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	observation, err := weatherProvider.Current(ctx, *city)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *city, err)
+		return 1
+	}
+	result := weatherResult{Observation: observation, FetchedAt: time.Now(), Source: "weather-api"}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(newWeatherResponse(*city, result, unitSystem(*units), *lang, *lang))
+	return 0
+}
+
+// loadCommandConfig applies CONFIG_FILE, secret:// references and the
+// secrets in Vault and sets up the weather provider, as serve does, for
+// commands that call the provider.
+func loadCommandConfig() (*Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file:\n%v", err)
+	}
+	setRunningConfig(cfg)
+	owmQuota = newQuotaTracker(cfg)
+	if err := configureUpstreamProxy(cfg); err != nil {
+		return nil, fmt.Errorf("Invalid upstream configuration: %v", err)
+	}
+	if cfg, err = resolveSecretReferences(cfg); err != nil {
+		return nil, fmt.Errorf("Failed to read secrets:\n%v", err)
+	}
+	if cfg, _, err = loadVaultSecrets(cfg); err != nil {
+		return nil, fmt.Errorf("Failed to read secrets from Vault: %v", err)
+	}
+	setRunningConfig(cfg)
+	if err := configureUpstream(cfg); err != nil {
+		return nil, fmt.Errorf("Invalid upstream configuration: %v", err)
+	}
+	provider, err := newWeatherProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid weather provider: %v", err)
+	}
+	weatherProvider = provider
+	return cfg, nil
+}
+
+// configCheck is a startup validation of serve that spans several settings.
+// secrets are the secret settings it parses, which it cannot check while
+// they are unresolved secret:// references.
+type configCheck struct {
+	name    string
+	secrets []string
+	check   func(cfg *Config) error
+}
+
+// configChecks are the startup validations of serve that span several
+// settings, beyond the checks of each in configSettings. None opens stores
+// or listeners or connects anywhere.
+var configChecks = []configCheck{
+	{"Vault configuration", []string{"VAULT_TOKEN", "VAULT_SECRET_ID"}, func(cfg *Config) error { _, err := newVaultClient(cfg); return err }},
+	{"upstream configuration", []string{"UPSTREAM_CLIENT_KEY"}, configureUpstream},
+	{"weather provider", nil, func(cfg *Config) error {
+		// Only the BME280 opens its device when created; the check must not.
+		if cfg.WeatherProvider == "bme280" {
+			_, _, err := bme280Device(cfg)
+			return err
+		}
+		_, err := newWeatherProvider(cfg)
+		return err
+	}},
+	{"CWOP configuration", nil, func(cfg *Config) error {
+		if cfg.CWOPCallsign == "" {
+			return nil
+		}
+		_, err := newCWOPPublisher(cfg)
+		return err
+	}},
+	{"MQTT configuration", []string{"MQTT_PASSWORD"}, func(cfg *Config) error {
+		if cfg.MQTTBroker == "" {
+			return nil
+		}
+		_, err := newMQTTPublisher(cfg)
+		return err
+	}},
+	{"shard configuration", []string{"SHARD_SECRET"}, func(cfg *Config) error { _, err := newShardRing(cfg); return err }},
+	{"archive configuration", []string{"ARCHIVE_S3_ACCESS_KEY", "ARCHIVE_S3_SECRET_KEY"}, func(cfg *Config) error {
+		if cfg.ArchiveS3Bucket == "" {
+			return nil
+		}
+		_, err := newArchiver(cfg)
+		return err
+	}},
+	{"station upload configuration", []string{"WINDY_API_KEY", "PWSWEATHER_API_KEY", "WOW_AUTH_KEY"}, func(cfg *Config) error { _, err := configuredUploadNetworks(cfg); return err }},
+	{"request mirroring configuration", nil, func(cfg *Config) error { _, err := newRequestMirror(cfg); return err }},
+	{"authentication configuration", []string{"ADMIN_TOKEN", "JWT_SECRET", "API_KEYS", "BASIC_AUTH_USERS", "LDAP_BIND_PASSWORD", "OIDC_CLIENT_SECRET", "OIDC_SESSION_KEY"}, func(cfg *Config) error {
+		directory, err := newLDAPDirectory(cfg)
+		if err != nil {
+			return err
+		}
+		oidc, err := newOIDCClient(cfg)
+		if err != nil {
+			return err
+		}
+		schemes, err := authSchemes(cfg, directory, oidc)
+		if err != nil {
+			return err
+		}
+		_, err = groupPolicies(cfg, schemes)
+		return err
+	}},
+}
+
+// unresolved returns the first input of c that is still a secret://
+// reference in cfg, "" when there is none.
+func (c configCheck) unresolved(cfg *Config) string {
+	for _, name := range c.secrets {
+		if v, _ := cfg.Lookup(name); isSecretReference(v) {
+			return name
+		}
+	}
+	return ""
+}
+
+// configProblems validates the WEATHERAPP_ variables and every setting of
+// cfg and runs the configChecks whose inputs are resolved, returning all
+// problems found, each naming the setting or check at fault.
+func configProblems(cfg *Config) []string {
+	problems := slices.Clone(cfg.problems)
+	for _, s := range configSettings {
+		value, _ := cfg.Lookup(s.Name)
+		if value == "" {
+			continue
+		}
+		if err := s.validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", s.Name, err))
+		}
+		for _, required := range s.Requires {
+			if !cfg.IsSet(required) {
+				problems = append(problems, fmt.Sprintf("%s: requires %s to be set as well", s.Name, required))
+			}
+		}
+		for _, conflicting := range s.Conflicts {
+			if cfg.IsSet(conflicting) {
+				problems = append(problems, fmt.Sprintf("%s: cannot be set together with %s", s.Name, conflicting))
+			}
+		}
+	}
+	for _, c := range configChecks {
+		if c.unresolved(cfg) != "" {
+			continue
+		}
+		if err := c.check(cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid %s: %v", c.name, err))
+		}
+	}
+	return problems
+}
+
+// runCheckConfigCommand implements "weather-app check-config": it applies
+// CONFIG_FILE, prints the effective configuration with secrets masked and
+// reports the configProblems that would stop serve, so that a deploy can be
+// stopped before a server fails to start. With -probe it also reads the
+// secrets and fetches WEATHER_CITY from the provider, as serve would.
+func runCheckConfigCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	probe := flags.Bool("probe", false, "also read secret:// references and Vault secrets and fetch WEATHER_CITY from the provider")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid config file:\n%v\n", err)
+		return 1
+	}
+	setRunningConfig(cfg)
+	owmQuota = newQuotaTracker(cfg)
+	sources := maps.Clone(cfg.sources)
+
+	var problems []string
+	if *probe {
+		for _, s := range configSettings {
+			if v, _ := cfg.Lookup(s.Name); isSecretReference(v) {
+				if ref, err := parseSecretReference(v); err == nil {
+					sources[s.Name] = ref.store
+				}
+			}
+		}
+		if err := configureUpstreamProxy(cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("Upstream: %v", err))
+		}
+		if resolved, err := resolveSecretReferences(cfg); err != nil {
+			problems = append(problems, strings.Split(err.Error(), "\n")...)
+		} else {
+			cfg = resolved
+		}
+		if secrets, err := parseVaultSecrets(cfg.VaultSecrets); err == nil && cfg.VaultAddr != "" {
+			for _, secret := range secrets {
+				sources[secret.setting] = "Vault"
+			}
+		}
+		if resolved, _, err := loadVaultSecrets(cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("Vault: %v", err))
+		} else {
+			cfg = resolved
+		}
+		setRunningConfig(cfg)
+	}
+	problems = append(problems, configProblems(cfg)...)
+	if *probe && len(problems) == 0 {
+		if err := probeProvider(cfg, stderr); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	printEffectiveConfig(stdout, cfg, sources)
+	for _, c := range configChecks {
+		if name := c.unresolved(cfg); name != "" {
+			fmt.Fprintf(stderr, "Not checked: %s, %s is a secret:// reference read only with --probe\n", c.name, name)
+		}
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(stderr, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Fprintln(stdout, "Configuration OK")
+	return 0
+}
+
+// printEffectiveConfig writes every setting that has a value, set or
+// default, as a config file with the source of each value. Secrets and the
+// credentials of URLs are masked; secret:// references, which are not
+// secret, are shown as they are.
+func printEffectiveConfig(w io.Writer, cfg *Config, sources map[string]string) {
+	for _, s := range configSettings {
+		value, set := cfg.Lookup(s.Name)
+		source := sources[s.Name]
+		if !set {
+			value, source = s.Default, "default"
+		}
+		if value == "" {
+			continue
+		}
+		if !isSecretReference(value) {
+			value = maskedValue(s, value)
+		}
+		fmt.Fprintf(w, "%s: %s # %s\n", s.Name, strconv.Quote(value), source)
+	}
+}
+
+// probeProvider fetches WEATHER_CITY from the configured provider. Without
+// WEATHER_API_KEY, OpenWeatherMap is not called but answers with demo data,
+// which proves nothing, so that is reported as a problem.
+func probeProvider(cfg *Config, w io.Writer) error {
+	if cfg.WeatherProvider == "openweathermap" && cfg.WeatherAPIKey == "" {
+		return fmt.Errorf("Provider test call not made: WEATHER_API_KEY is not set, openweathermap serves demo data")
+	}
+	provider, err := newWeatherProvider(cfg)
+	if err != nil {
+		return fmt.Errorf("Invalid weather provider: %v", err)
+	}
+	if c, ok := provider.(io.Closer); ok {
+		defer c.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	city := cfg.WeatherCity
+	observation, err := provider.Current(ctx, city)
+	if err != nil {
+		return fmt.Errorf("Provider test call for %s failed: %v", city, err)
+	}
+	fmt.Fprintf(w, "Provider test call for %s: %.1f °C\n", city, observation.Temperature)
+	return nil
+}
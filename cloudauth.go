@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// cloudClient carries calls to cloud APIs for credentials and secrets.
+// configureUpstreamProxy sets up the proxy and CA of upstreamTransport
+// before any secret is resolved.
+var cloudClient = &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+
+// awsCredentials sign requests to AWS APIs.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string `json:"Token"`
+}
+
+// awsRegion is the region of AWS_REGION or AWS_DEFAULT_REGION.
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// loadAWSCredentials finds credentials the way the AWS SDKs do: static
+// keys in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, a web identity token
+// (EKS IAM roles for service accounts), the ECS or EKS Pod Identity
+// container endpoint, and finally the EC2 instance metadata service.
+func loadAWSCredentials(ctx context.Context) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if path := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); path != "" {
+		return assumeRoleWithWebIdentity(ctx, path)
+	}
+	if endpoint := awsContainerCredentialsURL(); endpoint != "" {
+		return awsContainerCredentials(ctx, endpoint)
+	}
+	return awsInstanceCredentials(ctx)
+}
+
+// assumeRoleWithWebIdentity exchanges the token in path for credentials of
+// AWS_ROLE_ARN. The call itself is not signed.
+func assumeRoleWithWebIdentity(ctx context.Context, path string) (awsCredentials, error) {
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("reading AWS_WEB_IDENTITY_TOKEN_FILE: %w", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "weather-app"
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	endpoint := "https://sts.amazonaws.com/"
+	if region := awsRegion(); region != "" {
+		endpoint = "https://sts." + region + ".amazonaws.com/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	body, err := cloudCall(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming AWS_ROLE_ARN: %w", err)
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming AWS_ROLE_ARN: %w", err)
+	}
+	return awsCredentials(resp.Credentials), nil
+}
+
+func awsContainerCredentialsURL() string {
+	if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		return full
+	}
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		return "http://169.254.170.2" + relative
+	}
+	return ""
+}
+
+// awsContainerCredentials reads the credentials of an ECS task or an EKS
+// Pod Identity association.
+func awsContainerCredentials(ctx context.Context, endpoint string) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("reading AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var creds awsCredentials
+	if err := cloudJSON(req, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// awsInstanceCredentials reads the credentials of the EC2 instance role
+// with IMDSv2.
+func awsInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := cloudCall(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment and no instance metadata service: %w", err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imds+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		return cloudCall(req)
+	}
+	role, err := get("meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance role: %w", err)
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	data, err := get("meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance role %s: %w", name, err)
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("instance role %s: %w", name, err)
+	}
+	return creds, nil
+}
+
+// gcpServiceAccountKey is the part of a service account key file the token
+// exchange uses.
+type gcpServiceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcpAccessToken returns an OAuth access token for Google Cloud APIs: of
+// the service account key in GOOGLE_APPLICATION_CREDENTIALS, or of the
+// attached service account from the metadata server on GCE, GKE (Workload
+// Identity) and Cloud Run.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = "metadata.google.internal"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		if err := cloudJSON(req, &token); err != nil {
+			return "", fmt.Errorf("no GOOGLE_APPLICATION_CREDENTIALS and no metadata server: %w", err)
+		}
+		return token.AccessToken, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+	}
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil || key.Type != "service_account" {
+		return "", fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS %s is not a service account key", path)
+	}
+	assertion, err := gcpAssertion(key, time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := cloudJSON(req, &token); err != nil {
+		return "", fmt.Errorf("token of %s: %w", key.ClientEmail, err)
+	}
+	return token.AccessToken, nil
+}
+
+// gcpAssertion is the RS256 JWT a service account exchanges for an access
+// token.
+func gcpAssertion(key gcpServiceAccountKey, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account key of %s has no PEM private key", key.ClientEmail)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("service account key of %s: %w", key.ClientEmail, err)
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("service account key of %s is not an RSA key", key.ClientEmail)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// cloudCall sends req with cloudClient and returns the body of a 200
+// response.
+func cloudCall(req *http.Request) ([]byte, error) {
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned status %d: %s", req.Method, req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body[:min(len(body), 512)])))
+	}
+	return body, nil
+}
+
+func cloudJSON(req *http.Request, out any) error {
+	body, err := cloudCall(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
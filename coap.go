@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	coapRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coap_requests_total",
+			Help: "Total number of CoAP requests",
+		},
+		[]string{"path", "code"},
+	)
+
+	coapObserversGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "coap_observers",
+			Help: "Number of registered CoAP observers",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(coapRequestsTotal)
+	prometheus.MustRegister(coapObserversGauge)
+}
+
+// CoAP message types, codes, options and content formats (RFC 7252, RFC 7641).
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+
+	coapGET              = 0x01
+	coapContent          = 0x45 // 2.05
+	coapNotFound         = 0x84 // 4.04
+	coapMethodNotAllowed = 0x85 // 4.05
+	coapNotAcceptable    = 0x86 // 4.06
+	coapInternalError    = 0xA0 // 5.00
+	coapUnavailable      = 0xA3 // 5.03
+
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionMaxAge        = 14
+	coapOptionURIQuery      = 15
+	coapOptionAccept        = 17
+
+	coapFormatText      = 0
+	coapFormatLink      = 40
+	coapFormatOctet     = 42
+	coapFormatJSON      = 50
+	coapMaxMessageBytes = 1152
+
+	coapMaxObservers          = 1000
+	coapMaxObserversPerSource = 8
+	// Every coapConfirmEvery-th notification, starting with the first, is
+	// confirmable; an observer that does not acknowledge it by the next
+	// notification is dropped, so a registration from a spoofed address
+	// costs its victim at most one notification.
+	coapConfirmEvery = 10
+)
+
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+type coapMessage struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []coapOption
+	Payload   []byte
+}
+
+var errCoAPMalformed = errors.New("malformed CoAP message")
+
+// parseCoAP decodes a message. Messages longer than coapMaxMessageBytes, a
+// payload marker without a payload and option numbers beyond 16 bits are
+// rejected along with truncated ones.
+func parseCoAP(data []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(data) < 4 || len(data) > coapMaxMessageBytes || data[0]>>6 != 1 {
+		return m, errCoAPMalformed
+	}
+	m.Type = (data[0] >> 4) & 0x3
+	tkl := int(data[0] & 0xF)
+	m.Code = data[1]
+	m.MessageID = binary.BigEndian.Uint16(data[2:4])
+	if tkl > 8 || len(data) < 4+tkl {
+		return m, errCoAPMalformed
+	}
+	m.Token = append([]byte(nil), data[4:4+tkl]...)
+
+	rest := data[4+tkl:]
+	number := 0
+	for len(rest) > 0 {
+		if rest[0] == 0xFF {
+			if len(rest) == 1 {
+				return m, errCoAPMalformed
+			}
+			m.Payload = rest[1:]
+			break
+		}
+		delta, length := int(rest[0]>>4), int(rest[0]&0xF)
+		rest = rest[1:]
+		var err error
+		if delta, rest, err = coapExtended(delta, rest); err != nil {
+			return m, err
+		}
+		if length, rest, err = coapExtended(length, rest); err != nil {
+			return m, err
+		}
+		number += delta
+		if len(rest) < length || number > 0xFFFF {
+			return m, errCoAPMalformed
+		}
+		m.Options = append(m.Options, coapOption{Number: uint16(number), Value: rest[:length]})
+		rest = rest[length:]
+	}
+	return m, nil
+}
+
+func coapExtended(v int, rest []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(rest) < 1 {
+			return 0, nil, errCoAPMalformed
+		}
+		return int(rest[0]) + 13, rest[1:], nil
+	case 14:
+		if len(rest) < 2 {
+			return 0, nil, errCoAPMalformed
+		}
+		return int(binary.BigEndian.Uint16(rest)) + 269, rest[2:], nil
+	case 15:
+		return 0, nil, errCoAPMalformed
+	}
+	return v, rest, nil
+}
+
+func coapNibble(v int) (int, []byte) {
+	switch {
+	case v < 13:
+		return v, nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, []byte{byte((v - 269) >> 8), byte(v - 269)}
+	}
+}
+
+func (m coapMessage) Marshal() []byte {
+	buf := []byte{1<<6 | m.Type<<4 | uint8(len(m.Token)), m.Code, byte(m.MessageID >> 8), byte(m.MessageID)}
+	buf = append(buf, m.Token...)
+
+	options := append([]coapOption(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	last := 0
+	for _, opt := range options {
+		delta, deltaExt := coapNibble(int(opt.Number) - last)
+		length, lengthExt := coapNibble(len(opt.Value))
+		buf = append(buf, byte(delta<<4|length))
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, opt.Value...)
+		last = int(opt.Number)
+	}
+	if len(m.Payload) > 0 {
+		buf = append(buf, 0xFF)
+		buf = append(buf, m.Payload...)
+	}
+	return buf
+}
+
+func (m coapMessage) Option(number uint16) ([]byte, bool) {
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m coapMessage) Strings(number uint16) []string {
+	var values []string
+	for _, opt := range m.Options {
+		if opt.Number == number {
+			values = append(values, string(opt.Value))
+		}
+	}
+	return values
+}
+
+func coapUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func coapUintOption(number uint16, v uint32) coapOption {
+	var b []byte
+	for v > 0 {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+	}
+	return coapOption{Number: number, Value: b}
+}
+
+type coapObserver struct {
+	addr          *net.UDPAddr
+	token         []byte
+	city          string
+	format        uint32
+	seq           uint32
+	lastMessageID uint16
+	awaitingAck   bool
+}
+
+// coapServer exposes current conditions to constrained devices. Clients can
+// GET coap://host/weather?city=X once, or register with the Observe option
+// to receive a notification every interval.
+type coapServer struct {
+	conn      *net.UDPConn
+	interval  time.Duration
+	mu        sync.Mutex
+	messageID uint16
+	observers map[string]*coapObserver
+}
+
+func startCoAPServer(cfg *Config) error {
+	conn, err := listenUDPUpgradable("coap", cfg.CoAPListen)
+	if err != nil {
+		return err
+	}
+
+	s := &coapServer{
+		conn:      conn,
+		interval:  cfg.CoAPNotifyInterval,
+		messageID: uint16(time.Now().UnixNano()),
+		observers: make(map[string]*coapObserver),
+	}
+	log.Printf("CoAP server listening on %s", conn.LocalAddr())
+	closeOnStop(conn)
+	go s.serve()
+	go s.notifyLoop()
+	return nil
+}
+
+func (s *coapServer) nextMessageID() uint16 {
+	s.messageID++
+	return s.messageID
+}
+
+func (s *coapServer) serve() {
+	// One byte more than allowed, so that longer datagrams are not
+	// silently truncated to a valid length.
+	buf := make([]byte, coapMaxMessageBytes+1)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if backgroundJobs.Err() != nil {
+			return
+		}
+		if err != nil {
+			logError("CoAP read error: %v", err)
+			continue
+		}
+		req, err := parseCoAP(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.handle(req, addr)
+	}
+}
+
+func (s *coapServer) send(m coapMessage, addr *net.UDPAddr) {
+	if _, err := s.conn.WriteToUDP(m.Marshal(), addr); err != nil {
+		logError("CoAP write to %s failed: %v", addr, err)
+	}
+}
+
+func (s *coapServer) handle(req coapMessage, addr *net.UDPAddr) {
+	switch req.Type {
+	case coapRST:
+		// A reset in reply to a notification cancels the observation.
+		s.mu.Lock()
+		for key, o := range s.observers {
+			if o.lastMessageID == req.MessageID && o.addr.String() == addr.String() {
+				delete(s.observers, key)
+			}
+		}
+		coapObserversGauge.Set(float64(len(s.observers)))
+		s.mu.Unlock()
+		return
+	case coapACK:
+		s.mu.Lock()
+		for _, o := range s.observers {
+			if o.lastMessageID == req.MessageID && o.addr.String() == addr.String() {
+				o.awaitingAck = false
+			}
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	resp := coapMessage{Type: coapNON, Token: req.Token}
+	if req.Type == coapCON {
+		resp.Type = coapACK
+		resp.MessageID = req.MessageID
+	} else {
+		s.mu.Lock()
+		resp.MessageID = s.nextMessageID()
+		s.mu.Unlock()
+	}
+
+	path := strings.Join(req.Strings(coapOptionURIPath), "/")
+	defer func() {
+		coapRequestsTotal.WithLabelValues(path, fmt.Sprintf("%d.%02d", resp.Code>>5, resp.Code&0x1F)).Inc()
+		s.send(resp, addr)
+	}()
+
+	if req.Code != coapGET {
+		resp.Code = coapMethodNotAllowed
+		return
+	}
+
+	switch path {
+	case ".well-known/core":
+		resp.Code = coapContent
+		resp.Options = []coapOption{coapUintOption(coapOptionContentFormat, coapFormatLink)}
+		resp.Payload = []byte(`</weather>;rt="weather";ct="50 42";obs`)
+	case "weather":
+		s.handleWeather(req, addr, &resp)
+	default:
+		resp.Code = coapNotFound
+	}
+}
+
+func (s *coapServer) handleWeather(req coapMessage, addr *net.UDPAddr, resp *coapMessage) {
+	city := weatherCity()
+	for _, q := range req.Strings(coapOptionURIQuery) {
+		if v, ok := strings.CutPrefix(q, "city="); ok && v != "" {
+			city = v
+		}
+	}
+	format := uint32(coapFormatJSON)
+	if v, ok := req.Option(coapOptionAccept); ok {
+		format = coapUint(v)
+		if format != coapFormatJSON && format != coapFormatOctet {
+			resp.Code = coapNotAcceptable
+			return
+		}
+	}
+
+	result, err := currentWeather(context.Background(), city)
+	if err != nil {
+		// The error text can carry upstream details; clients get a fixed
+		// message and the error goes to the log.
+		resp.Code, resp.Payload = coapUnavailable, []byte("weather provider unavailable")
+		switch {
+		case errors.Is(err, ErrCityNotFound):
+			resp.Code, resp.Payload = coapNotFound, []byte("city not found")
+		case !errors.Is(err, ErrProviderUnavailable) && !errors.Is(err, ErrQuotaExceeded):
+			resp.Code, resp.Payload = coapInternalError, []byte("internal error")
+			logError("CoAP weather request for %s failed: %v", city, err)
+		}
+		resp.Options = []coapOption{coapUintOption(coapOptionContentFormat, coapFormatText)}
+		return
+	}
+
+	key := addr.String() + "|" + string(req.Token)
+	if v, ok := req.Option(coapOptionObserve); ok {
+		s.mu.Lock()
+		switch coapUint(v) {
+		case 0:
+			_, exists := s.observers[key]
+			if exists || len(s.observers) < coapMaxObservers && s.sourceObservers(addr) < coapMaxObserversPerSource {
+				s.observers[key] = &coapObserver{addr: addr, token: req.Token, city: city, format: format}
+				resp.Options = append(resp.Options, coapUintOption(coapOptionObserve, 0))
+			}
+		case 1:
+			delete(s.observers, key)
+		}
+		coapObserversGauge.Set(float64(len(s.observers)))
+		s.mu.Unlock()
+	}
+
+	resp.Code = coapContent
+	resp.Options = append(resp.Options,
+		coapUintOption(coapOptionContentFormat, format),
+		coapUintOption(coapOptionMaxAge, uint32(s.interval.Seconds())),
+	)
+	resp.Payload = coapPayload(result, format)
+}
+
+// sourceObservers counts the observers registered from the host of addr.
+// The caller holds s.mu.
+func (s *coapServer) sourceObservers(addr *net.UDPAddr) int {
+	n := 0
+	for _, o := range s.observers {
+		if o.addr.IP.Equal(addr.IP) {
+			n++
+		}
+	}
+	return n
+}
+
+func coapPayload(result weatherResult, format uint32) []byte {
+	if format == coapFormatOctet {
+		return encodeCompact(result)
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"temperature": result.Temperature,
+		"humidity":    result.Humidity,
+		"condition":   result.ConditionCode,
+		"timestamp":   result.FetchedAt.Unix(),
+	})
+	return payload
+}
+
+// notifyLoop pushes fresh conditions to every observer. Notifications are
+// mostly non-confirmable to keep radio time down; a client that is no longer
+// interested answers with RST, or leaves a confirmable one unacknowledged,
+// and is dropped.
+func (s *coapServer) notifyLoop() {
+	for range backgroundTicks(s.interval) {
+		s.mu.Lock()
+		byCity := make(map[string][]*coapObserver)
+		for key, o := range s.observers {
+			if o.awaitingAck {
+				delete(s.observers, key)
+				continue
+			}
+			byCity[o.city] = append(byCity[o.city], o)
+		}
+		coapObserversGauge.Set(float64(len(s.observers)))
+		s.mu.Unlock()
+
+		for city, observers := range byCity {
+			result, err := currentWeather(context.Background(), city)
+			if err != nil {
+				logError("CoAP notification for %s skipped: %v", city, err)
+				continue
+			}
+			for _, o := range observers {
+				s.mu.Lock()
+				o.seq = (o.seq + 1) & 0xFFFFFF
+				o.lastMessageID = s.nextMessageID()
+				msgType := uint8(coapNON)
+				if o.seq%coapConfirmEvery == 1 {
+					msgType, o.awaitingAck = coapCON, true
+				}
+				msg := coapMessage{
+					Type:      msgType,
+					Code:      coapContent,
+					MessageID: o.lastMessageID,
+					Token:     o.token,
+					Options: []coapOption{
+						coapUintOption(coapOptionObserve, o.seq),
+						coapUintOption(coapOptionContentFormat, o.format),
+						coapUintOption(coapOptionMaxAge, uint32(s.interval.Seconds())),
+					},
+					Payload: coapPayload(result, o.format),
+				}
+				s.mu.Unlock()
+				s.send(msg, o.addr)
+			}
+		}
+	}
+}
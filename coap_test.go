@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestParseCoAP(t *testing.T) {
+	// GET /weather?city=Oslo, confirmable, message ID 0x1234, token 0xAB,
+	// with Observe, Uri-Path, Uri-Query and Accept options.
+	get := []byte{0x41, coapGET, 0x12, 0x34, 0xAB,
+		0x60,
+		0x57, 'w', 'e', 'a', 't', 'h', 'e', 'r',
+		0x49, 'c', 'i', 't', 'y', '=', 'O', 's', 'l', 'o',
+		0x21, coapFormatJSON,
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		check   func(t *testing.T, m coapMessage)
+	}{
+		{name: "get with options", data: get, check: func(t *testing.T, m coapMessage) {
+			if m.Type != coapCON || m.Code != coapGET || m.MessageID != 0x1234 || !bytes.Equal(m.Token, []byte{0xAB}) {
+				t.Errorf("header = %d %#x %#x %x", m.Type, m.Code, m.MessageID, m.Token)
+			}
+			if _, ok := m.Option(coapOptionObserve); !ok {
+				t.Error("Observe option missing")
+			}
+			if got := m.Strings(coapOptionURIPath); !slices.Equal(got, []string{"weather"}) {
+				t.Errorf("Uri-Path = %q", got)
+			}
+			if got := m.Strings(coapOptionURIQuery); !slices.Equal(got, []string{"city=Oslo"}) {
+				t.Errorf("Uri-Query = %q", got)
+			}
+			if v, _ := m.Option(coapOptionAccept); coapUint(v) != coapFormatJSON {
+				t.Errorf("Accept = %v", v)
+			}
+		}},
+		{name: "empty message", data: []byte{0x40, 0, 0, 1}, check: func(t *testing.T, m coapMessage) {
+			if m.Code != 0 || len(m.Options) != 0 || len(m.Payload) != 0 {
+				t.Errorf("got %+v", m)
+			}
+		}},
+		{name: "payload", data: []byte{0x50, coapContent, 0, 1, 0xFF, 'h', 'i'}, check: func(t *testing.T, m coapMessage) {
+			if m.Type != coapNON || string(m.Payload) != "hi" {
+				t.Errorf("got %+v", m)
+			}
+		}},
+		{name: "one-byte option delta", data: []byte{0x40, coapGET, 0, 1, 0xD0, 0x00}, check: func(t *testing.T, m coapMessage) {
+			if len(m.Options) != 1 || m.Options[0].Number != 13 {
+				t.Errorf("options = %+v", m.Options)
+			}
+		}},
+		{name: "two-byte option delta", data: []byte{0x40, coapGET, 0, 1, 0xE0, 0x00, 0x01}, check: func(t *testing.T, m coapMessage) {
+			if len(m.Options) != 1 || m.Options[0].Number != 270 {
+				t.Errorf("options = %+v", m.Options)
+			}
+		}},
+		{name: "largest message", data: append([]byte{0x40, coapGET, 0, 1, 0xFF}, make([]byte, coapMaxMessageBytes-5)...)},
+
+		{name: "short header", data: []byte{0x40, coapGET, 0}, wantErr: true},
+		{name: "wrong version", data: []byte{0x80, coapGET, 0, 1}, wantErr: true},
+		{name: "token length over 8", data: append([]byte{0x49, coapGET, 0, 1}, make([]byte, 9)...), wantErr: true},
+		{name: "truncated token", data: []byte{0x44, coapGET, 0, 1, 0xAA, 0xBB}, wantErr: true},
+		{name: "truncated option value", data: []byte{0x40, coapGET, 0, 1, 0xB5, 'w', 'e'}, wantErr: true},
+		{name: "truncated delta extension", data: []byte{0x40, coapGET, 0, 1, 0xD0}, wantErr: true},
+		{name: "truncated length extension", data: []byte{0x40, coapGET, 0, 1, 0x0E, 0x01}, wantErr: true},
+		{name: "reserved delta 15", data: []byte{0x40, coapGET, 0, 1, 0xF0}, wantErr: true},
+		{name: "marker without payload", data: []byte{0x40, coapGET, 0, 1, 0xFF}, wantErr: true},
+		{name: "option number beyond 16 bits", data: []byte{0x40, coapGET, 0, 1, 0xE0, 0xFF, 0xFF, 0xE0, 0xFF, 0xFF}, wantErr: true},
+		{name: "oversize", data: append([]byte{0x40, coapGET, 0, 1, 0xFF}, make([]byte, coapMaxMessageBytes-4)...), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseCoAP(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCoAP error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, m)
+			}
+		})
+	}
+}
+
+func TestCoAPMarshalRoundTrip(t *testing.T) {
+	m := coapMessage{
+		Type:      coapACK,
+		Code:      coapContent,
+		MessageID: 0xBEEF,
+		Token:     []byte{1, 2, 3, 4},
+		Options: []coapOption{
+			{Number: coapOptionMaxAge, Value: []byte{60}},
+			coapUintOption(coapOptionContentFormat, coapFormatJSON),
+			{Number: 300, Value: bytes.Repeat([]byte{'x'}, 300)},
+		},
+		Payload: []byte(`{"temperature":1.5}`),
+	}
+	got, err := parseCoAP(m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.Code != m.Code || got.MessageID != m.MessageID ||
+		!bytes.Equal(got.Token, m.Token) || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+	// Marshal sorts the options by number.
+	wantNumbers := []uint16{coapOptionContentFormat, coapOptionMaxAge, 300}
+	if len(got.Options) != len(wantNumbers) {
+		t.Fatalf("options = %+v", got.Options)
+	}
+	for i, opt := range got.Options {
+		if opt.Number != wantNumbers[i] {
+			t.Errorf("option %d is %d, want %d", i, opt.Number, wantNumbers[i])
+		}
+	}
+	if v, _ := got.Option(300); len(v) != 300 {
+		t.Errorf("option 300 has %d bytes, want 300", len(v))
+	}
+}
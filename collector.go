@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectedCitiesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "collector_city_refreshes_total",
+		Help: "Total number of per-city refreshes of background collection jobs by job and status",
+	},
+	[]string{"job", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(collectedCitiesTotal)
+}
+
+// collectCities returns WEATHER_CITY followed by the COLLECT_CITIES this
+// instance owns, without duplicates.
+func collectCities() []string {
+	list := []string{weatherCity()}
+	for _, city := range runningConfig().CollectCities {
+		if !shards.Owns(city) ||
+			slices.ContainsFunc(list, func(c string) bool { return strings.EqualFold(c, city) }) {
+			continue
+		}
+		list = append(list, city)
+	}
+	return list
+}
+
+// forEachCity runs fn for every city on COLLECT_CONCURRENCY workers. Cities
+// are isolated from each other: a city that fails or panics is logged and
+// counted, and the others are refreshed regardless. The error only reports
+// how many failed.
+func forEachCity(job string, cities []string, fn func(city string) error) error {
+	work := make(chan string)
+	var mu sync.Mutex
+	failed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < min(runningConfig().CollectConcurrency, len(cities)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for city := range work {
+				if err := refreshCity(city, fn); err != nil {
+					collectedCitiesTotal.WithLabelValues(job, "error").Inc()
+					logError("Refreshing %s for job %s failed: %v", city, job, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+					continue
+				}
+				collectedCitiesTotal.WithLabelValues(job, "success").Inc()
+			}
+		}()
+	}
+	for _, city := range cities {
+		work <- city
+	}
+	close(work)
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cities failed", failed, len(cities))
+	}
+	return nil
+}
+
+// refreshCity runs fn for city, turning a panic into an error so that it
+// does not take down the worker and the cities queued behind it.
+func refreshCity(city string, fn func(city string) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(city)
+}
+
+// refreshCurrentConditions fetches the conditions of WEATHER_CITY and
+// COLLECT_CITIES for the gauges, the history and the webhooks, so they stay
+// current even when nobody asks for the temperature.
+func refreshCurrentConditions() error {
+	return forEachCity("current", collectCities(), func(city string) error {
+		result, err := currentWeather(context.Background(), city)
+		if err != nil {
+			return err
+		}
+		if anomalies.Suppressed(city) {
+			return nil
+		}
+		temperatureGauge.WithLabelValues(city, weatherProviderName()).Set(result.Temperature)
+		if city == weatherCity() {
+			setComfortGauges(comfortMetrics(result.Temperature, result.Humidity, result.WindSpeed))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"weather-app/meteo"
+)
+
+// Comfort gauges for WEATHER_CITY, set alongside current_temperature_celsius.
+// An index that does not apply to the current conditions is NaN.
+var (
+	feelsLikeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "feels_like_temperature_celsius",
+		Help: "Apparent temperature: wind chill, heat index or the air temperature",
+	})
+	dewPointGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dew_point_celsius",
+		Help: "Dew point temperature",
+	})
+	windChillGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wind_chill_celsius",
+		Help: "Wind chill index, at 10 degrees Celsius and below",
+	})
+	heatIndexGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heat_index_celsius",
+		Help: "Heat index, at 26.7 degrees Celsius and above",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(feelsLikeGauge, dewPointGauge, windChillGauge, heatIndexGauge)
+	for _, g := range []prometheus.Gauge{feelsLikeGauge, dewPointGauge, windChillGauge, heatIndexGauge} {
+		g.Set(math.NaN())
+	}
+}
+
+// Comfort holds the indices derived from temperature, humidity and wind.
+// Dew point needs the humidity, wind chill applies at 10 °C and below with
+// some wind, heat index from 26.7 °C; the others are left out.
+type Comfort struct {
+	FeelsLike float64  `json:"feels_like"`
+	DewPoint  *float64 `json:"dew_point,omitempty"`
+	WindChill *float64 `json:"wind_chill,omitempty"`
+	HeatIndex *float64 `json:"heat_index,omitempty"`
+}
+
+// comfortMetrics derives the indices from a temperature in °C, humidity in %
+// and wind speed in m/s; a negative humidity or wind speed is unknown.
+func comfortMetrics(temperature, humidity, windSpeed float64) Comfort {
+	if humidity < 0 || humidity > 100 {
+		humidity = math.NaN()
+	}
+	if windSpeed < 0 {
+		windSpeed = math.NaN()
+	}
+	c := Comfort{FeelsLike: meteo.FeelsLike(temperature, humidity, windSpeed)}
+	if humidity > 0 {
+		v := meteo.DewPoint(temperature, humidity)
+		c.DewPoint = &v
+	}
+	if !math.IsNaN(windSpeed) {
+		if v, ok := meteo.WindChill(temperature, windSpeed); ok {
+			c.WindChill = &v
+		}
+	}
+	if !math.IsNaN(humidity) {
+		if v, ok := meteo.HeatIndex(temperature, humidity); ok {
+			c.HeatIndex = &v
+		}
+	}
+	return c
+}
+
+// in returns the indices in units, rounded to 0.1 degree.
+func (c Comfort) in(units unitSystem) Comfort {
+	round := func(v float64) float64 {
+		if units == unitsImperial {
+			v = celsiusToFahrenheit(v)
+		}
+		return math.Round(v*10) / 10
+	}
+	out := Comfort{FeelsLike: round(c.FeelsLike)}
+	for _, field := range []struct{ in, out **float64 }{
+		{&c.DewPoint, &out.DewPoint}, {&c.WindChill, &out.WindChill}, {&c.HeatIndex, &out.HeatIndex},
+	} {
+		if *field.in != nil {
+			v := round(**field.in)
+			*field.out = &v
+		}
+	}
+	return out
+}
+
+// setComfortGauges publishes the indices of WEATHER_CITY.
+func setComfortGauges(c Comfort) {
+	feelsLikeGauge.Set(c.FeelsLike)
+	for _, g := range []struct {
+		gauge prometheus.Gauge
+		value *float64
+	}{{dewPointGauge, c.DewPoint}, {windChillGauge, c.WindChill}, {heatIndexGauge, c.HeatIndex}} {
+		if g.value == nil {
+			g.gauge.Set(math.NaN())
+		} else {
+			g.gauge.Set(*g.value)
+		}
+	}
+}
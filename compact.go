@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	compactMagic   = 'W'
+	compactVersion = 1
+	compactSize    = 12
+
+	compactFlagCached = 1 << 0
+)
+
+// encodeCompact packs a weather result into the fixed 12-byte big-endian
+// layout served at /api/compact:
+//
+//	offset size field
+//	0      1    magic 'W' (0x57)
+//	1      1    version (1)
+//	2      2    int16  temperature, hundredths of °C
+//	4      1    uint8  relative humidity, % (0xFF = unknown)
+//	5      1    uint8  flags (bit 0: served from cache)
+//	6      2    uint16 condition code (OpenWeatherMap IDs)
+//	8      4    uint32 observation time, Unix seconds
+func encodeCompact(result weatherResult) []byte {
+	buf := make([]byte, compactSize)
+	buf[0] = compactMagic
+	buf[1] = compactVersion
+
+	temp := math.Round(result.Temperature * 100)
+	temp = math.Max(math.MinInt16, math.Min(math.MaxInt16, temp))
+	binary.BigEndian.PutUint16(buf[2:], uint16(int16(temp)))
+
+	buf[4] = 0xFF
+	if result.Humidity >= 0 && result.Humidity <= 100 {
+		buf[4] = uint8(math.Round(result.Humidity))
+	}
+	if result.Source == "cache" {
+		buf[5] |= compactFlagCached
+	}
+	binary.BigEndian.PutUint16(buf[6:], uint16(result.ConditionCode))
+	binary.BigEndian.PutUint32(buf[8:], uint32(result.FetchedAt.Unix()))
+	return buf
+}
+
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	city, ok := requestCity(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := currentWeather(context.WithoutCancel(r.Context()), city)
+	if err != nil {
+		writeTemperatureError(w, r, city, err)
+		return
+	}
+
+	setCacheHeaders(w, result)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(compactSize))
+	w.Write(encodeCompact(result))
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Setting value types. Every value is given as a string, in the environment
+// or CONFIG_FILE; the type drives validation, the generated JSON Schema and
+// the type of the setting's Config field.
+const (
+	settingString   = "string"
+	settingSecret   = "secret"
+	settingInteger  = "integer"
+	settingNumber   = "number"
+	settingBoolean  = "boolean"
+	settingDuration = "duration" // Go duration, e.g. "90s", "10m"
+	settingWindow   = "window"   // Go duration or whole days, e.g. "7d"
+	settingURL      = "url"
+	settingAddress  = "address" // host:port to listen on
+	settingList     = "list"    // comma-separated; a YAML sequence is also accepted
+)
+
+// configSetting describes one configuration variable.
+type configSetting struct {
+	Name        string
+	Type        string
+	Description string
+	Default     string
+	Enum        []string
+	Min, Max    *float64
+	MinDuration time.Duration
+	Requires    []string
+	Conflicts   []string // settings that cannot be set together with this one
+	Check       func(value string) error
+	// Live settings are read from the running Config on every use, so
+	// changing them takes effect without a restart.
+	Live bool
+}
+
+func bound(v float64) *float64 { return &v }
+
+// configSettings is the full list of supported configuration variables.
+// Keep it in sync when adding a new one, and add its field to Config.
+var configSettings = []configSetting{
+	{Name: "PORT", Type: settingInteger, Default: "8080", Min: bound(1), Max: bound(65535), Description: "HTTP listen port on all interfaces"},
+	{Name: "HTTP_LISTEN", Type: settingAddress, Conflicts: []string{"LISTEN_SOCKET"}, Description: "TCP address of the HTTP server, e.g. 127.0.0.1:8080 or [::]:8080; overrides PORT"},
+	{Name: "LISTEN_SOCKET", Type: settingString, Description: "Unix socket the HTTP server listens on instead of PORT, e.g. /run/weather.sock behind nginx"},
+	{Name: "LISTEN_SOCKET_MODE", Type: settingString, Default: "0660", Description: "Octal permissions of LISTEN_SOCKET",
+		Check: func(v string) error { _, err := listenSocketMode(v); return err }},
+	{Name: "PID_FILE", Type: settingString, Description: "File the PID of the serving process is written to once it is ready, also after an upgrade"},
+	{Name: "UPGRADE_TIMEOUT", Type: settingDuration, Default: "1m", MinDuration: time.Second, Description: "How long a process started by SIGUSR2 has to become ready before the upgrade is abandoned"},
+	{Name: "SHUTDOWN_TIMEOUT", Type: settingDuration, Default: "30s", MinDuration: time.Second, Description: "How long the old process waits for requests in flight after an upgrade"},
+	{Name: "WEATHER_CITY", Type: settingString, Live: true, Default: "Moscow", Description: "Default city"},
+	{Name: "WEATHER_LANG", Type: settingString, Live: true, Default: "en", Description: "Language of condition descriptions requested from providers and used without Accept-Language"},
+	{Name: "WEATHER_API_KEY", Type: settingSecret, Live: true, Description: "OpenWeatherMap API key; demo mode when unset"},
+	{Name: "WEATHER_API_KEY_SECONDARY", Type: settingSecret, Live: true, Requires: []string{"WEATHER_API_KEY"}, Description: "Second OpenWeatherMap API key used while OpenWeatherMap rejects WEATHER_API_KEY with 401, for key rotation without a redeploy"},
+	{Name: "OPENWEATHER_BASE_URL", Type: settingURL, Live: true, Default: defaultOpenWeatherBaseURL, Description: "Scheme and host of the OpenWeatherMap API"},
+	{Name: "WEATHER_PROVIDER", Type: settingString, Default: "openweathermap", Enum: weatherProviderNames, Description: "Source of weather observations"},
+	{Name: "METNO_USER_AGENT", Type: settingString, Description: "User-Agent naming the application and a contact, required by Met.no"},
+	{Name: "METNO_BASE_URL", Type: settingURL, Default: defaultMetnoBaseURL, Description: "Scheme and host of the Met.no API"},
+	{Name: "TOMORROW_API_KEY", Type: settingSecret, Description: "Tomorrow.io API key for the tomorrow provider"},
+	{Name: "TOMORROW_BASE_URL", Type: settingURL, Default: defaultTomorrowBaseURL, Description: "Scheme and host of the Tomorrow.io API"},
+	{Name: "WEATHERAPI_KEY", Type: settingSecret, Description: "WeatherAPI.com API key for the weatherapi provider"},
+	{Name: "WEATHERAPI_BASE_URL", Type: settingURL, Default: defaultWeatherAPIBaseURL, Description: "Scheme and host of the WeatherAPI.com API"},
+	{Name: "WEATHER_PROVIDER_COMMAND", Type: settingString, Description: "Plugin command for the exec provider"},
+	{Name: "WEATHER_PROVIDER_URL", Type: settingURL, Description: "Sidecar adapter URL for the http provider"},
+	{Name: "SENSOR_DEVICE", Type: settingString, Description: "1-Wire id of the ds18b20 provider's sensor, or I2C bus of the bme280 provider (default /dev/i2c-1)"},
+	{Name: "SENSOR_I2C_ADDRESS", Type: settingString, Default: "0x76", Description: "I2C address of the bme280 provider's sensor",
+		Check: func(v string) error { _, err := sensorI2CAddress(v); return err }},
+	{Name: "WEATHER_CACHE_TTL", Type: settingDuration, Live: true, Default: "1m", Description: "How long an observation is served from the cache; 0 disables"},
+	{Name: "CACHE_MAX_CITIES", Type: settingInteger, Live: true, Default: "10000", Min: bound(1), Description: "Most cities, queries or stations kept by each cache, the anomaly detector and the station readings; least recently used entries are evicted"},
+	{Name: "CITY_CATALOG", Type: settingString, Description: "GeoNames dump (.txt or .zip) used for offline city search and geocoding"},
+	{Name: "CITY_CATALOG_URL", Type: settingURL, Default: defaultCityCatalogURL, Description: "Where CITY_CATALOG is downloaded from when the file is missing"},
+	{Name: "GEOCODE_CACHE_TTL", Type: settingDuration, Live: true, Default: "24h", MinDuration: time.Second, Description: "How long answers of the OpenWeatherMap geocoding API are cached"},
+	{Name: "UPSTREAM_PROXY", Type: settingURL, Description: "Proxy (http, https or socks5 URL) for outbound calls; HTTP_PROXY/HTTPS_PROXY otherwise"},
+	{Name: "UPSTREAM_CA_FILE", Type: settingString, Description: "PEM file with extra root CAs trusted for outbound calls"},
+	{Name: "UPSTREAM_TLS_MIN_VERSION", Type: settingString, Default: "1.2", Enum: []string{"1.0", "1.1", "1.2", "1.3"}, Description: "Minimum TLS version for outbound calls"},
+	{Name: "UPSTREAM_CLIENT_CERT", Type: settingString, Requires: []string{"UPSTREAM_CLIENT_KEY"}, Description: "PEM client certificate presented on outbound calls"},
+	{Name: "UPSTREAM_CLIENT_KEY", Type: settingSecret, Requires: []string{"UPSTREAM_CLIENT_CERT"}, Description: "PEM private key of UPSTREAM_CLIENT_CERT"},
+	{Name: "OWM_CALLS_PER_MINUTE", Type: settingInteger, Default: "60", Min: bound(1), Description: "OpenWeatherMap per-minute call limit"},
+	{Name: "OWM_CALLS_PER_MONTH", Type: settingInteger, Default: "1000000", Min: bound(1), Description: "OpenWeatherMap per-month call limit"},
+	{Name: "TRUSTED_PROXIES", Type: settingList, Description: "Proxies (CIDR or IP) whose X-Forwarded-For/X-Real-IP headers are trusted",
+		Check: func(v string) error { _, err := parseTrustedProxies(strings.Split(v, ",")); return err }},
+
+	{Name: "SHARD_COUNT", Type: settingInteger, Default: "1", Min: bound(1), Description: "Number of instances cities are partitioned across"},
+	{Name: "SHARD_INDEX", Type: settingInteger, Min: bound(0), Description: "Shard of this instance; defaults to the StatefulSet ordinal in the hostname"},
+	{Name: "SHARD_PEERS", Type: settingString, Requires: []string{"SHARD_COUNT"}, Description: "Base URLs of all shards in order, comma-separated, or one URL with {index}"},
+	{Name: "SHARD_SECRET", Type: settingSecret, Requires: []string{"SHARD_COUNT"}, Description: "Key of at least 32 characters the shards sign forwarded requests with, the same on every shard; required with SHARD_COUNT above 1"},
+	{Name: "MIRROR_URL", Type: settingURL, Description: "Staging instance that receives a sample of incoming requests; disabled when unset"},
+	{Name: "MIRROR_SAMPLE_RATE", Type: settingNumber, Default: "0.01", Min: bound(0), Max: bound(1), Description: "Share of requests mirrored to MIRROR_URL"},
+	{Name: "LOG_LEVEL", Type: settingString, Live: true, Default: "info", Enum: []string{"info", "debug"}, Description: "debug also logs repeats of already reported errors and upstream weather API calls"},
+	{Name: "WARMUP_TIMEOUT", Type: settingDuration, Default: "30s", Description: "How long /readyz waits at startup for WEATHER_CITY, COLLECT_CITIES and tenant cities to be fetched into the cache; 0 disables the warm-up"},
+	{Name: "READY_MAX_FETCH_AGE", Type: settingDuration, Live: true, Default: "15m", Description: "/readyz fails when no provider fetch succeeded for this long; 0 disables the check"},
+	{Name: "SENTRY_DSN", Type: settingSecret, Live: true, Description: "Sentry-compatible DSN that 5xx responses and panics are reported to, with route, request ID and city",
+		Check: func(v string) error { _, err := parseSentryDSN(v); return err }},
+	{Name: "SENTRY_ENVIRONMENT", Type: settingString, Live: true, Description: "Environment of the events reported to SENTRY_DSN, e.g. production"},
+	{Name: "ERROR_DEDUP_WINDOW", Type: settingDuration, Live: true, Default: "10m", MinDuration: time.Second, Description: "How long repeats of a logged error are only counted before it is logged again"},
+	{Name: "ANOMALY_MAX_JUMP", Type: settingNumber, Live: true, Default: "15", Min: bound(0), Description: "Temperature change in °C between observations less than an hour apart flagged as implausible"},
+	{Name: "ANOMALY_FROZEN_AFTER", Type: settingDuration, Live: true, Default: "6h", MinDuration: time.Second, Description: "How long an unchanged temperature is accepted before it is flagged as frozen"},
+	{Name: "ANOMALY_SUPPRESS", Type: settingBoolean, Live: true, Default: "false", Description: "Keep anomalous observations out of the gauges and the history"},
+	{Name: "HISTORY_STORE", Type: settingString, Default: "memory", Enum: []string{"memory", "bolt"}, Description: "Where the observation history is kept"},
+	{Name: "HISTORY_STORE_PATH", Type: settingString, Default: "history.db", Description: "Database file of the bolt history store"},
+	{Name: "HISTORY_RETENTION", Type: settingWindow, Default: "30d", Description: "How long raw observations are kept"},
+	{Name: "HISTORY_ROLLUP_RETENTION", Type: settingWindow, Default: "365d", Description: "How long hourly and daily rollups are kept"},
+	{Name: "AUDIT_LOG_FILE", Type: settingString, Description: "JSON-lines file every change made through the admin and subscription APIs is appended to; kept in memory only when unset"},
+	{Name: "HISTORY_MAX_POINTS", Type: settingInteger, Live: true, Default: "1000000", Min: bound(1), Description: "Most observations kept in the history; the oldest are dropped beyond it"},
+	{Name: "EPAPER_LAYOUT", Type: settingString, Live: true, Default: "full", Enum: []string{"full", "minimal"}, Description: "Default /epaper layout"},
+
+	{Name: "STATION_PASSWORD", Type: settingSecret, Live: true, Description: "Password weather stations must send with uploads; without it only the stations of STATION_LOCATIONS are accepted, when it lists any"},
+	{Name: "ECOWITT_PASSKEYS", Type: settingList, Live: true, Description: "Allowed Ecowitt/Ambient PASSKEY or MAC values; without it only the stations of STATION_LOCATIONS are accepted, when it lists any"},
+	{Name: "STATION_LOCATIONS", Type: settingString, Live: true, Description: "Station coordinates as \"<id>=<lat>,<lon>\" separated by ';'",
+		Check: func(v string) error { _, err := parseStationLocations(v); return err }},
+	{Name: "STATION_RADIUS_KM", Type: settingNumber, Live: true, Default: "10", Min: bound(0), Description: "Radius in which stations serve /api/weather"},
+	{Name: "STATION_MAX_AGE", Type: settingDuration, Live: true, Default: "15m", MinDuration: time.Second, Description: "Readings older than this are not used by /api/weather"},
+	{Name: "STATION_MIN_COUNT", Type: settingInteger, Live: true, Default: "1", Min: bound(1), Description: "Stations needed in the radius to serve /api/weather from the station network"},
+	{Name: "UPLOAD_STATION", Type: settingString, Description: "Station whose readings are uploaded to third-party networks"},
+	{Name: "WINDY_API_KEY", Type: settingSecret, Description: "Windy API key"},
+	{Name: "WINDY_STATION", Type: settingInteger, Default: "0", Min: bound(0), Description: "Windy station index"},
+	{Name: "WINDY_INTERVAL", Type: settingDuration, Default: "5m", MinDuration: time.Minute, Description: "Windy upload interval"},
+	{Name: "PWSWEATHER_STATION_ID", Type: settingString, Description: "PWSWeather station ID"},
+	{Name: "PWSWEATHER_API_KEY", Type: settingSecret, Description: "PWSWeather API key"},
+	{Name: "PWSWEATHER_INTERVAL", Type: settingDuration, Default: "5m", MinDuration: time.Minute, Description: "PWSWeather upload interval"},
+	{Name: "WOW_SITE_ID", Type: settingString, Description: "Met Office WOW site ID"},
+	{Name: "WOW_AUTH_KEY", Type: settingSecret, Description: "Met Office WOW authentication key"},
+	{Name: "WOW_INTERVAL", Type: settingDuration, Default: "5m", MinDuration: time.Minute, Description: "Met Office WOW upload interval"},
+
+	{Name: "CWOP_CALLSIGN", Type: settingString, Requires: []string{"CWOP_LATITUDE", "CWOP_LONGITUDE"}, Description: "CWOP/APRS-IS callsign; enables publishing"},
+	{Name: "CWOP_PASSCODE", Type: settingInteger, Default: "-1", Min: bound(-1), Description: "APRS-IS passcode"},
+	{Name: "CWOP_SERVER", Type: settingString, Default: "cwop.aprs.net:14580", Description: "APRS-IS server"},
+	{Name: "CWOP_STATION", Type: settingString, Description: "Station whose readings are published to CWOP"},
+	{Name: "CWOP_LATITUDE", Type: settingNumber, Min: bound(-90), Max: bound(90), Description: "Station latitude in decimal degrees"},
+	{Name: "CWOP_LONGITUDE", Type: settingNumber, Min: bound(-180), Max: bound(180), Description: "Station longitude in decimal degrees"},
+	{Name: "CWOP_INTERVAL", Type: settingDuration, Default: "10m", MinDuration: 5 * time.Minute, Description: "CWOP publish interval"},
+	{Name: "MQTT_BROKER", Type: settingURL, Description: "MQTT broker (mqtt:// or mqtts:// URL) to publish observations and Home Assistant discovery configs to; disabled when unset"},
+	{Name: "MQTT_USERNAME", Type: settingString, Description: "User name for the MQTT broker"},
+	{Name: "MQTT_PASSWORD", Type: settingSecret, Description: "Password for the MQTT broker"},
+	{Name: "MQTT_CLIENT_ID", Type: settingString, Description: "MQTT client identifier; weather-app-<hostname> by default"},
+	{Name: "MQTT_TOPIC_PREFIX", Type: settingString, Default: "weather-app", Description: "Prefix of the state topics, <prefix>/<city>/state"},
+	{Name: "MQTT_DISCOVERY_PREFIX", Type: settingString, Default: "homeassistant", Description: "Home Assistant MQTT discovery prefix"},
+	{Name: "MQTT_INTERVAL", Type: settingDuration, Default: "1m", MinDuration: 10 * time.Second, Description: "MQTT publish interval"},
+
+	{Name: "COAP_LISTEN", Type: settingAddress, Description: "UDP address of the CoAP server; disabled when unset"},
+	{Name: "COAP_NOTIFY_INTERVAL", Type: settingDuration, Default: "1m", MinDuration: time.Second, Description: "CoAP Observe notification interval"},
+	{Name: "MODBUS_LISTEN", Type: settingAddress, Description: "TCP address of the Modbus server; disabled when unset"},
+	{Name: "MODBUS_UNIT_ID", Type: settingInteger, Default: "1", Min: bound(0), Max: bound(247), Description: "Modbus unit ID"},
+	{Name: "MODBUS_REGISTERS", Type: settingString, Default: modbusDefaultRegisters, Description: "Modbus register map as field=address pairs",
+		Check: func(v string) error { _, err := parseModbusRegisters(v); return err }},
+	{Name: "MODBUS_CITY", Type: settingString, Description: "City served over Modbus; defaults to WEATHER_CITY"},
+	{Name: "MODBUS_REFRESH", Type: settingDuration, Default: "1m", MinDuration: time.Second, Description: "Modbus value refresh interval"},
+	{Name: "SNMP_LISTEN", Type: settingAddress, Description: "UDP address of the SNMP agent; disabled when unset"},
+	{Name: "SNMP_COMMUNITY", Type: settingSecret, Default: "public", Description: "SNMP community"},
+	{Name: "SNMP_ENTERPRISE_OID", Type: settingString, Default: snmpDefaultEnterprise, Description: "Root OID of the weather objects",
+		Check: func(v string) error { _, err := parseOID(v); return err }},
+	{Name: "SNMP_CITY", Type: settingString, Description: "City served over SNMP; defaults to WEATHER_CITY"},
+	{Name: "SNMP_REFRESH", Type: settingDuration, Default: "1m", MinDuration: time.Second, Description: "SNMP value refresh interval"},
+
+	{Name: "ARCHIVE_S3_BUCKET", Type: settingString, Description: "Bucket for observation archives; enables archiving"},
+	{Name: "ARCHIVE_S3_ACCESS_KEY", Type: settingSecret, Description: "Object storage access key"},
+	{Name: "ARCHIVE_S3_SECRET_KEY", Type: settingSecret, Description: "Object storage secret key"},
+	{Name: "ARCHIVE_S3_REGION", Type: settingString, Default: "us-east-1", Description: "Object storage region"},
+	{Name: "ARCHIVE_S3_ENDPOINT", Type: settingURL, Description: "S3-compatible endpoint; defaults to AWS S3 in the region"},
+	{Name: "ARCHIVE_S3_PREFIX", Type: settingString, Description: "Key prefix of archive objects"},
+	{Name: "ARCHIVE_INTERVAL", Type: settingDuration, Default: "1h", MinDuration: time.Minute, Description: "Archive upload interval"},
+
+	{Name: "WEBHOOK_MAX_SUBSCRIPTIONS", Type: settingInteger, Live: true, Default: "100", Min: bound(1), Description: "Maximum number of webhook subscriptions"},
+	{Name: "WEBHOOK_ALLOW_PRIVATE", Type: settingBoolean, Live: true, Default: "false", Description: "Allow webhooks to private and loopback addresses"},
+	{Name: "WEBHOOK_CONCURRENCY", Type: settingInteger, Live: true, Default: "8", Min: bound(1), Description: "Webhook requests sent at the same time across all subscriptions"},
+	{Name: "WEBHOOK_RETRY_RATIO", Type: settingNumber, Live: true, Default: "0.2", Min: bound(0), Max: bound(1), Description: "Retries allowed per webhook event on average, shared by all subscriptions"},
+	{Name: "FORECAST_INTERVAL", Type: settingDuration, MinDuration: 10 * time.Minute, Description: "Fetch forecasts at this interval instead of hourly; same as SCHEDULE_FORECAST=\"@every <interval>\", which takes precedence"},
+	{Name: "FORECAST_ACCURACY_CITIES", Type: settingList, Live: true, Description: "Cities whose forecasts are fetched on SCHEDULE_FORECAST and scored against later observations"},
+	{Name: "SCHEDULE_CURRENT", Type: settingString, Default: "* * * * *", Description: "Cron expression of the WEATHER_CITY conditions refresh, or \"off\"",
+		Check: checkSchedule},
+	{Name: "SCHEDULE_FORECAST", Type: settingString, Default: "@hourly", Description: "Cron expression of the forecast refresh for subscriptions and FORECAST_ACCURACY_CITIES, or \"off\"",
+		Check: checkSchedule},
+	{Name: "COLLECT_CITIES", Type: settingList, Live: true, Description: "Cities whose conditions are refreshed on SCHEDULE_CURRENT besides WEATHER_CITY; with sharding only the owned ones"},
+	{Name: "PUSHGATEWAY_URL", Type: settingURL, Description: "Pushgateway the metrics of a --once run are pushed to"},
+	{Name: "PUSHGATEWAY_JOB", Type: settingString, Default: "weather-app", Description: "Job label of the metrics pushed by --once"},
+	{Name: "PUSHGATEWAY_INSTANCE", Type: settingString, Description: "Instance label of the metrics pushed by --once, to keep hosts apart"},
+	{Name: "COLLECT_CONCURRENCY", Type: settingInteger, Live: true, Default: "8", Min: bound(1), Description: "Cities refreshed at the same time by each scheduled job"},
+	{Name: "SCHEDULE_JITTER", Type: settingDuration, Default: "10s", Description: "Upper bound of the random delay added to each scheduled run"},
+	{Name: "FORECAST_CACHE_TTL", Type: settingDuration, Live: true, Default: "30m", MinDuration: time.Second, Description: "How long fetched forecasts are reused by /api/window and forecast change subscriptions"},
+
+	{Name: "ADMIN_TOKEN", Type: settingSecret, Description: "Bearer token for the admin API (\"token\" scheme, admin role)"},
+	{Name: "JWT_SECRET", Type: settingSecret, Description: "HS256 key of bearer JWTs (\"jwt\" scheme, roles from JWT_ROLES_CLAIM)"},
+	{Name: "JWT_ROLES_CLAIM", Type: settingString, Default: "roles", Requires: []string{"JWT_SECRET"}, Description: "Claim of JWTs listing the roles, a list or a space-separated string; dots descend into objects, e.g. realm_access.roles"},
+	{Name: "API_KEYS", Type: settingSecret, Description: "Client API keys sent in X-API-Key as \"<name>=<key>\" separated by ',' (\"apikey\" scheme, roles from API_KEY_ROLES)",
+		Check: func(v string) error { _, err := parseCredentialList(v, "="); return err }},
+	{Name: "API_KEY_ROLES", Type: settingString, Requires: []string{"API_KEYS"}, Description: "Roles of API_KEYS as \"<name>=<role>[|<role>]\" separated by ','; keys without an entry are readers",
+		Check: func(v string) error { _, err := parseRoleAssignments(v); return err }},
+	{Name: "TENANTS", Type: settingSecret, Live: true, Description: "Tenants served at /api/t/<name>/ as \"<name>:cities=<city>|<city>[,api_key=<key>][,requests_per_minute=<n>][,principals=<scheme>:<name>|<scheme>:<name>]\" separated by ';'; callers must authenticate as one of the principals, e.g. apikey:team-a or oidc:alice, by default the API key named after the tenant",
+		Check: func(v string) error { _, err := parseTenants(v); return err }},
+	{Name: "UI_REFRESH", Type: settingDuration, Live: true, Default: "5s", MinDuration: time.Second, Description: "How often the built-in page refreshes the city cards"},
+	{Name: "UI_TITLE", Type: settingString, Live: true, Description: "Title of the built-in page and its installed app instead of the translated one"},
+	{Name: "UI_THEME", Type: settingString, Live: true, Default: "auto", Enum: []string{"auto", "light", "dark"}, Description: "Color scheme of the built-in page; auto follows the device"},
+	{Name: "UI_TEMPLATE", Type: settingString, Live: true, Description: "html/template file served at / instead of the built-in page, with the helpers of /api/templates/functions",
+		Check: checkUITemplate},
+	{Name: "API_KEY_QUOTAS", Type: settingString, Live: true, Description: "Requests per UTC day and month of each API key as \"<name>=<daily>/<monthly>\" separated by ',', empty limits unlimited, \"*\" for keys without an entry",
+		Check: func(v string) error { _, err := parseKeyQuotas(v); return err }},
+	{Name: "BASIC_AUTH_USERS", Type: settingSecret, Description: "Static HTTP Basic users as \"<user>:<password>\" separated by ',' (\"basic\" scheme)",
+		Check: func(v string) error { _, err := parseCredentialList(v, ":"); return err }},
+	{Name: "BASIC_AUTH_ROLES", Type: settingString, Requires: []string{"BASIC_AUTH_USERS"}, Description: "Roles of BASIC_AUTH_USERS as \"<user>=<role>[|<role>]\" separated by ','; users without an entry have none",
+		Check: func(v string) error { _, err := parseRoleAssignments(v); return err }},
+	{Name: "AUTH_API", Type: settingString, Description: "Authentication policy of /api/* and /epaper, e.g. \"apikey|jwt\"; open when unset",
+		Check: func(v string) error { _, err := parseAuthPolicy(v); return err }},
+	{Name: "AUTH_ADMIN", Type: settingString, Description: "Authentication policy of /admin/* and /api/stats, e.g. \"jwt+role:admin\"; defaults to \"token|ldap+role:admin|oidc+role:admin\" for the configured schemes",
+		Check: func(v string) error { _, err := parseAuthPolicy(v); return err }},
+	{Name: "AUTH_METRICS", Type: settingString, Description: "Authentication policy of /metrics, e.g. \"basic\"; open when unset",
+		Check: func(v string) error { _, err := parseAuthPolicy(v); return err }},
+	{Name: "AUTH_UI", Type: settingString, Description: "Authentication policy of the dashboard at /; \"oidc\" with OIDC_ISSUER, open otherwise",
+		Check: func(v string) error { _, err := parseAuthPolicy(v); return err }},
+	{Name: "OIDC_ISSUER", Type: settingURL, Requires: []string{"OIDC_CLIENT_ID", "OIDC_REDIRECT_URL"}, Description: "OpenID Connect provider users log in to the dashboard with (\"oidc\" scheme), e.g. https://sso.example.com/realms/corp; https only but for localhost",
+		Check: checkOIDCEndpoint},
+	{Name: "OIDC_CLIENT_ID", Type: settingString, Requires: []string{"OIDC_ISSUER"}, Description: "Client ID registered with OIDC_ISSUER"},
+	{Name: "OIDC_CLIENT_SECRET", Type: settingSecret, Requires: []string{"OIDC_ISSUER"}, Description: "Client secret of OIDC_CLIENT_ID; a public client with PKCE only when unset"},
+	{Name: "OIDC_REDIRECT_URL", Type: settingURL, Requires: []string{"OIDC_ISSUER"}, Description: "External URL of /auth/callback registered with the provider, e.g. https://weather.example.com/auth/callback"},
+	{Name: "OIDC_SCOPES", Type: settingString, Default: "openid profile email", Description: "Scopes requested at login"},
+	{Name: "OIDC_ROLES_CLAIM", Type: settingString, Default: "roles", Description: "Claim of the ID token listing the roles, with dots descending into objects"},
+	{Name: "OIDC_SESSION_KEY", Type: settingSecret, Description: "Key of at least 32 characters signing session cookies, the same on every instance; random per process when unset"},
+	{Name: "OIDC_SESSION_TTL", Type: settingDuration, Default: "8h", MinDuration: time.Second, Description: "How long a dashboard login lasts"},
+	{Name: "API_DEPRECATIONS", Type: settingString, Live: true, Description: "Routes and response fields scheduled for removal as \"<route>[#<field>]=<deprecated>[,<sunset>[,<link>]]\" separated by ';', dates as YYYY-MM-DD",
+		Check: func(v string) error { _, err := parseDeprecations(v); return err }},
+	{Name: "VAULT_ADDR", Type: settingURL, Requires: []string{"VAULT_SECRETS"}, Description: "HashiCorp Vault server that VAULT_SECRETS are read from at startup and every VAULT_REFRESH"},
+	{Name: "VAULT_SECRETS", Type: settingString, Requires: []string{"VAULT_ADDR"}, Description: "Settings read from Vault KV v2 secrets as \"<setting>=<mount>/<path>#<field>\" separated by ',', e.g. \"WEATHER_API_KEY=secret/weather-app#api_key\"",
+		Check: func(v string) error { _, err := parseVaultSecrets(v); return err }},
+	{Name: "VAULT_NAMESPACE", Type: settingString, Requires: []string{"VAULT_ADDR"}, Description: "Vault Enterprise namespace"},
+	{Name: "VAULT_AUTH_METHOD", Type: settingString, Default: "token", Enum: []string{"token", "approle", "kubernetes"}, Requires: []string{"VAULT_ADDR"}, Description: "How to log in to Vault"},
+	{Name: "VAULT_AUTH_MOUNT", Type: settingString, Requires: []string{"VAULT_ADDR"}, Description: "Mount path of the auth method; the method name when unset"},
+	{Name: "VAULT_TOKEN", Type: settingSecret, Requires: []string{"VAULT_ADDR"}, Description: "Vault token of the token auth method"},
+	{Name: "VAULT_ROLE_ID", Type: settingString, Requires: []string{"VAULT_SECRET_ID"}, Description: "Role ID of the approle auth method"},
+	{Name: "VAULT_SECRET_ID", Type: settingSecret, Requires: []string{"VAULT_ROLE_ID"}, Description: "Secret ID of the approle auth method"},
+	{Name: "VAULT_ROLE", Type: settingString, Requires: []string{"VAULT_ADDR"}, Description: "Vault role of the kubernetes auth method"},
+	{Name: "VAULT_K8S_TOKEN_FILE", Type: settingString, Default: defaultVaultK8sTokenFile, Description: "Service account token the kubernetes auth method logs in with"},
+	{Name: "VAULT_CACERT", Type: settingString, Requires: []string{"VAULT_ADDR"}, Description: "PEM file with extra root CAs trusted for VAULT_ADDR"},
+	{Name: "VAULT_REFRESH", Type: settingDuration, Default: "5m", MinDuration: 5 * time.Second, Description: "How often the secrets are read from Vault again; the token is also renewed at half its lease"},
+	{Name: "LDAP_URL", Type: settingURL, Requires: []string{"LDAP_BASE_DN", "LDAP_GROUP_ROLES"}, Description: "LDAP/AD server for admin authentication",
+		Check: func(v string) error {
+			if u, err := url.Parse(v); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+				return fmt.Errorf("expected an ldap:// or ldaps:// URL")
+			}
+			return nil
+		}},
+	{Name: "LDAP_BIND_DN", Type: settingString, Description: "Service account DN used to look up users"},
+	{Name: "LDAP_BIND_PASSWORD", Type: settingSecret, Description: "Service account password"},
+	{Name: "LDAP_BASE_DN", Type: settingString, Description: "Base DN of the user search"},
+	{Name: "LDAP_USER_ATTRIBUTE", Type: settingString, Default: "sAMAccountName", Description: "Attribute holding the login name"},
+	{Name: "LDAP_GROUP_ROLES", Type: settingString, Description: "Group DN to role mapping: \"<group DN>=<role>\" separated by ';'"},
+	{Name: "LDAP_CACHE_TTL", Type: settingDuration, Default: "1m", Description: "How long successful LDAP logins are cached"},
+}
+
+func lookupSetting(name string) (configSetting, bool) {
+	for _, s := range configSettings {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return configSetting{}, false
+}
+
+// validate checks a single value and returns a description of the problem.
+// A secret:// reference is only checked for its syntax; the secret it names
+// is validated once read at startup.
+func (s configSetting) validate(value string) error {
+	if isSecretReference(value) {
+		_, err := parseSecretReference(value)
+		return err
+	}
+	switch s.Type {
+	case settingInteger, settingNumber:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || (s.Type == settingInteger && v != float64(int64(v))) {
+			return fmt.Errorf("expected %s %s", article(s.Type), s.Type)
+		}
+		if s.Min != nil && v < *s.Min {
+			return fmt.Errorf("must be at least %v", *s.Min)
+		}
+		if s.Max != nil && v > *s.Max {
+			return fmt.Errorf("must be at most %v", *s.Max)
+		}
+	case settingBoolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("expected true or false")
+		}
+	case settingDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("expected a duration such as \"90s\" or \"10m\"")
+		}
+		if d < s.MinDuration {
+			return fmt.Errorf("must be at least %v", s.MinDuration)
+		}
+	case settingWindow:
+		if _, err := parseWindow(value); err != nil {
+			return fmt.Errorf("expected a duration such as \"24h\" or \"7d\"")
+		}
+	case settingURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("expected an absolute URL")
+		}
+	case settingAddress:
+		if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+			return fmt.Errorf("expected a listen address such as \":5683\"")
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, v := range s.Enum {
+			found = found || v == value
+		}
+		if !found {
+			return fmt.Errorf("expected one of %s", strings.Join(s.Enum, ", "))
+		}
+	}
+	if s.Check != nil {
+		return s.Check(value)
+	}
+	return nil
+}
+
+func article(word string) string {
+	if strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// configSchema returns a JSON Schema (draft 2020-12) describing a config file.
+func configSchema() map[string]any {
+	properties := make(map[string]any)
+	dependencies := make(map[string]any)
+	exclusions := []any{}
+	for _, s := range configSettings {
+		p := map[string]any{"description": s.Description}
+		switch s.Type {
+		case settingInteger, settingNumber:
+			p["type"] = s.Type
+			if s.Min != nil {
+				p["minimum"] = *s.Min
+			}
+			if s.Max != nil {
+				p["maximum"] = *s.Max
+			}
+		case settingBoolean:
+			p["type"] = "boolean"
+		case settingDuration:
+			p["type"] = "string"
+			p["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+		case settingWindow:
+			p["type"] = "string"
+			p["pattern"] = `^([0-9]+d|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+		case settingURL:
+			p["type"] = "string"
+			p["format"] = "uri"
+		case settingList:
+			p["oneOf"] = []any{
+				map[string]any{"type": "string"},
+				map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			}
+		case settingSecret:
+			p["type"] = "string"
+			p["writeOnly"] = true
+		default:
+			p["type"] = "string"
+		}
+		if len(s.Enum) > 0 {
+			p["enum"] = s.Enum
+		}
+		if s.Default != "" {
+			switch s.Type {
+			case settingInteger, settingNumber:
+				v, _ := strconv.ParseFloat(s.Default, 64)
+				p["default"] = v
+			case settingBoolean:
+				p["default"] = s.Default == "true"
+			default:
+				p["default"] = s.Default
+			}
+		}
+		properties[s.Name] = p
+		if len(s.Requires) > 0 {
+			dependencies[s.Name] = s.Requires
+		}
+		for _, conflicting := range s.Conflicts {
+			exclusions = append(exclusions, map[string]any{"not": map[string]any{"required": []string{s.Name, conflicting}}})
+		}
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "weather-app configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"dependentRequired":    dependencies,
+		"allOf":                exclusions,
+		"additionalProperties": false,
+	}
+}
+
+// configError is a validation problem at a position in a config file.
+type configError struct {
+	Line, Column int
+	Setting      string
+	Message      string
+}
+
+func (e configError) Error() string {
+	position := fmt.Sprintf("%d:%d", e.Line, e.Column)
+	if e.Column == 0 {
+		position = strconv.Itoa(e.Line)
+	}
+	if e.Setting == "" {
+		return position + ": " + e.Message
+	}
+	return position + ": " + e.Setting + ": " + e.Message
+}
+
+// parseConfig reads a YAML config file mapping setting names to values and
+// returns the values together with every validation error found.
+func parseConfig(data []byte) (map[string]string, []configError) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Syntax errors only carry a line: "yaml: line 3: ...".
+		line := 0
+		message := strings.TrimPrefix(err.Error(), "yaml: ")
+		if n, _ := fmt.Sscanf(message, "line %d:", &line); n == 1 {
+			message = strings.TrimSpace(message[strings.Index(message, ":")+1:])
+		}
+		return nil, []configError{{Line: line, Message: message}}
+	}
+	values := make(map[string]string)
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, []configError{{Line: root.Line, Column: root.Column, Message: "expected a mapping of setting names to values"}}
+	}
+
+	var errs []configError
+	positions := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		setting, ok := lookupSetting(key.Value)
+		if !ok {
+			errs = append(errs, configError{key.Line, key.Column, key.Value, "unknown setting"})
+			continue
+		}
+		if _, dup := positions[key.Value]; dup {
+			errs = append(errs, configError{key.Line, key.Column, key.Value, "duplicate setting"})
+			continue
+		}
+		positions[key.Value] = key
+
+		var value string
+		switch {
+		case node.Kind == yaml.ScalarNode:
+			value = node.Value
+		case node.Kind == yaml.SequenceNode && setting.Type == settingList:
+			items := make([]string, 0, len(node.Content))
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					errs = append(errs, configError{item.Line, item.Column, key.Value, "expected a list of strings"})
+				}
+				items = append(items, item.Value)
+			}
+			value = strings.Join(items, ",")
+		default:
+			errs = append(errs, configError{node.Line, node.Column, key.Value, "expected a single value"})
+			continue
+		}
+		if err := setting.validate(value); err != nil {
+			errs = append(errs, configError{node.Line, node.Column, key.Value, err.Error()})
+			continue
+		}
+		values[key.Value] = value
+	}
+
+	for name, key := range positions {
+		setting, _ := lookupSetting(name)
+		for _, required := range setting.Requires {
+			if _, ok := positions[required]; !ok {
+				errs = append(errs, configError{key.Line, key.Column, name, "requires " + required + " to be set as well"})
+			}
+		}
+		for _, conflicting := range setting.Conflicts {
+			if _, ok := positions[conflicting]; ok {
+				errs = append(errs, configError{key.Line, key.Column, name, "cannot be set together with " + conflicting})
+			}
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Column < errs[j].Column
+	})
+	return values, errs
+}
+
+// loadConfigFile applies the config file at path to the settings values
+// leaves unset, so environment variables always win, and records them in
+// sources.
+func loadConfigFile(path string, values, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, errs := parseConfig(data)
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = path + ":" + e.Error()
+		}
+		return fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+	for name, value := range file {
+		if _, set := values[name]; !set {
+			values[name], sources[name] = value, "CONFIG_FILE"
+		}
+	}
+	return nil
+}
+
+// saveConfigSetting sets the list setting name to values in the config file
+// at path, keeping the other settings and comments; an empty list removes
+// the setting. The file is replaced at once, so a crash leaves the old one.
+func saveConfigSetting(path, name string, values []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping of setting names to values")
+	}
+	list := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, v := range values {
+		list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: v})
+	}
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != name {
+			continue
+		}
+		found = true
+		if len(values) == 0 {
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		} else {
+			root.Content[i+1] = list
+		}
+		break
+	}
+	if !found && len(values) > 0 {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, list)
+	}
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runConfigCommand implements "weather-app config schema|validate FILE".
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(stderr, "usage: weather-app config schema")
+		fmt.Fprintln(stderr, "       weather-app config validate FILE")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "schema":
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(configSchema()); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	case "validate":
+		if len(args) != 2 {
+			return usage()
+		}
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		_, errs := parseConfig(data)
+		for _, e := range errs {
+			fmt.Fprintf(stderr, "%s:%s\n", args[1], e)
+		}
+		if len(errs) > 0 {
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s: OK\n", args[1])
+		return 0
+	}
+	return usage()
+}
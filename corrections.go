@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HistorySelection picks stored points by ID or by city and time range
+// (from <= timestamp < to), so a whole period of bad sensor data can be
+// invalidated at once.
+type HistorySelection struct {
+	IDs    []uint64  `json:"ids,omitempty"`
+	City   string    `json:"city,omitempty"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+func (s HistorySelection) valid() bool {
+	if len(s.IDs) > 0 {
+		return s.City == "" && s.From.IsZero() && s.To.IsZero()
+	}
+	return s.City != "" && !s.From.IsZero() && s.To.After(s.From)
+}
+
+func (s HistorySelection) match(p HistoryPoint) bool {
+	if len(s.IDs) > 0 {
+		for _, id := range s.IDs {
+			if p.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(p.City, s.City) && !p.Timestamp.Before(s.From) && p.Timestamp.Before(s.To)
+}
+
+// HistoryCorrection replaces the temperature of one stored point.
+type HistoryCorrection struct {
+	Temperature *float64 `json:"temperature"`
+	Reason      string   `json:"reason"`
+}
+
+type HistoryEditResult struct {
+	Edited int            `json:"edited"`
+	Points []HistoryPoint `json:"points"`
+}
+
+// adminActor names the admin user for the audit trail: the directory user,
+// the JWT subject or "token" for the static ADMIN_TOKEN.
+func adminActor(r *http.Request) string {
+	if p, ok := requestPrincipal(r); ok && p.Name != "" {
+		return p.Name
+	}
+	return "token"
+}
+
+// rebuildRollups refreshes the rollups covering edited points.
+func rebuildRollups(points []HistoryPoint) {
+	hours := make(map[string][]time.Time)
+	cityNames := make(map[string]string)
+	for _, p := range points {
+		key := strings.ToLower(p.City)
+		cityNames[key] = p.City
+		hours[key] = append(hours[key], bucketStart(resolutionHourly, p.Timestamp))
+	}
+	for key, list := range hours {
+		rollups.Rebuild(cityNames[key], list)
+	}
+}
+
+func writeHistoryEdit(w http.ResponseWriter, r *http.Request, edited []HistoryPoint) {
+	rebuildRollups(edited)
+	if edited == nil {
+		edited = []HistoryPoint{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HistoryEditResult{Edited: len(edited), Points: edited})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// listHistoryHandler returns the stored points of a city in [from, to),
+// invalidated ones and audit trails included, for review before editing.
+func listHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	city := q.Get("city")
+	if city == "" {
+		city = weatherCity()
+	}
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_time", v)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_time", v)
+			return
+		}
+	}
+
+	points := history.Scan(from, to, func(p HistoryPoint) bool { return strings.EqualFold(p.City, city) })
+	if points == nil {
+		points = []HistoryPoint{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(points)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// setValidityHandler invalidates (or, with valid, restores) the selected
+// points. Points already in the requested state are left untouched.
+func setValidityHandler(valid bool) http.HandlerFunc {
+	action := "invalidate"
+	if valid {
+		action = "revalidate"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var selection HistorySelection
+		if err := json.NewDecoder(r.Body).Decode(&selection); err != nil || !selection.valid() {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_selection")
+			return
+		}
+
+		edit := HistoryEdit{Action: action, Reason: selection.Reason, Actor: adminActor(r), EditedAt: time.Now().UTC()}
+		edited := history.Edit(selection.match, func(p *HistoryPoint) bool {
+			if p.Invalidated == !valid {
+				return false
+			}
+			p.Invalidated = !valid
+			p.Edits = append(p.Edits, edit)
+			return true
+		})
+		log.Printf("History: %s of %d points by %s", action, len(edited), edit.Actor)
+		writeHistoryEdit(w, r, edited)
+	}
+}
+
+// correctHistoryHandler replaces the temperature of one point, keeping the
+// previous value in its audit trail.
+func correctHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, "admin.no_such_point", mux.Vars(r)["id"])
+		return
+	}
+	var correction HistoryCorrection
+	if err := json.NewDecoder(r.Body).Decode(&correction); err != nil || correction.Temperature == nil {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_correction")
+		return
+	}
+
+	actor := adminActor(r)
+	edited := history.Edit(func(p HistoryPoint) bool { return p.ID == id }, func(p *HistoryPoint) bool {
+		previous := p.Temperature
+		p.Temperature = *correction.Temperature
+		p.Edits = append(p.Edits, HistoryEdit{
+			Action:   "correct",
+			Previous: &previous,
+			Value:    correction.Temperature,
+			Reason:   correction.Reason,
+			Actor:    actor,
+			EditedAt: time.Now().UTC(),
+		})
+		return true
+	})
+	if len(edited) == 0 {
+		writeProblem(w, r, http.StatusNotFound, "admin.no_such_point", mux.Vars(r)["id"])
+		return
+	}
+	log.Printf("History: point %d corrected to %.2f by %s", id, *correction.Temperature, actor)
+	writeHistoryEdit(w, r, edited)
+}
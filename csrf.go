@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+// csrfHeader carries the CSRF token of the session on requests that change
+// something.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfToken is the CSRF token of the session of r, "" without one. It is
+// derived from the session cookie with the session key, so it needs no
+// server state and changes with every login.
+func (c *oidcClient) csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write([]byte("csrf:" + cookie.Value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type csrfKey struct{}
+
+// requestCSRFToken returns the token pages render for their scripts, ""
+// when the request was not admitted by the session cookie.
+func requestCSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey{}).(string)
+	return token
+}
+
+// csrfMiddleware rejects requests that change something (all but GET,
+// HEAD and OPTIONS) and were admitted by the session cookie, unless they
+// carry the session's token in X-CSRF-Token. Browsers attach the cookie to
+// requests other sites make them send, but those sites cannot read the
+// token from the page. Requests with other credentials, which browsers do
+// not add on their own, are not affected.
+func csrfMiddleware(c *oidcClient) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := requestPrincipal(r)
+			if !ok || p.Scheme != "oidc" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			want := c.csrfToken(r)
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if got := r.Header.Get(csrfHeader); got == "" || !hmac.Equal([]byte(got), []byte(want)) {
+					writeProblem(w, r, http.StatusForbidden, "auth.csrf")
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey{}, want)))
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cwopPublishTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cwop_publish_total",
+		Help: "Total number of weather reports published to CWOP/APRS-IS",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(cwopPublishTotal)
+}
+
+type cwopPublisher struct {
+	callsign  string
+	passcode  string
+	server    string
+	stationID string
+	latitude  float64
+	longitude float64
+	interval  time.Duration
+}
+
+func newCWOPPublisher(cfg *Config) (*cwopPublisher, error) {
+	p := &cwopPublisher{
+		callsign:  strings.ToUpper(cfg.CWOPCallsign),
+		passcode:  strconv.Itoa(cfg.CWOPPasscode),
+		server:    cfg.CWOPServer,
+		stationID: cfg.CWOPStation,
+		latitude:  cfg.CWOPLatitude,
+		longitude: cfg.CWOPLongitude,
+		interval:  cfg.CWOPInterval,
+	}
+
+	if !cfg.IsSet("CWOP_LATITUDE") || math.Abs(p.latitude) > 90 {
+		return nil, fmt.Errorf("CWOP_LATITUDE must be a decimal latitude")
+	}
+	if !cfg.IsSet("CWOP_LONGITUDE") || math.Abs(p.longitude) > 180 {
+		return nil, fmt.Errorf("CWOP_LONGITUDE must be a decimal longitude")
+	}
+	return p, nil
+}
+
+func (p *cwopPublisher) Run() {
+	log.Printf("Publishing station data to CWOP as %s every %v", p.callsign, p.interval)
+	for range backgroundTicks(p.interval) {
+		reading, ok := stations.Fresh(p.stationID, 2*p.interval)
+		if !ok {
+			continue
+		}
+		if err := p.publish(reading); err != nil {
+			logError("CWOP publish failed: %v", err)
+			cwopPublishTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		cwopPublishTotal.WithLabelValues("success").Inc()
+	}
+}
+
+func (p *cwopPublisher) publish(reading StationReading) error {
+	conn, err := net.DialTimeout("tcp", p.server, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// The server greets with a banner line before accepting the login.
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return fmt.Errorf("reading server banner: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "user %s pass %s vers weather-app 1.0\r\n", p.callsign, p.passcode); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "%s\r\n", p.packet(reading))
+	return err
+}
+
+// packet formats a reading as an APRS positional weather report.
+func (p *cwopPublisher) packet(reading StationReading) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s>APRS,TCPIP*:@%sz", p.callsign, reading.Timestamp.UTC().Format("021504"))
+	b.WriteString(aprsLatitude(p.latitude))
+	b.WriteString("/")
+	b.WriteString(aprsLongitude(p.longitude))
+
+	b.WriteString("_")
+	b.WriteString(aprsField(reading.WindDirection, 3, nil))
+	b.WriteString("/")
+	b.WriteString(aprsField(reading.WindSpeed, 3, metersPerSecondToMph))
+	b.WriteString("g")
+	b.WriteString(aprsField(reading.WindGust, 3, metersPerSecondToMph))
+	b.WriteString("t")
+	b.WriteString(aprsField(reading.Temperature, 3, celsiusToFahrenheit))
+	if reading.RainRate != nil {
+		b.WriteString("r" + aprsField(reading.RainRate, 3, millimetersToHundredthsInch))
+	}
+	if reading.DailyRain != nil {
+		b.WriteString("P" + aprsField(reading.DailyRain, 3, millimetersToHundredthsInch))
+	}
+	if reading.Humidity != nil {
+		humidity := math.Round(*reading.Humidity)
+		if humidity >= 100 {
+			humidity = 0
+		}
+		b.WriteString("h" + aprsField(&humidity, 2, nil))
+	}
+	if reading.Pressure != nil {
+		b.WriteString("b" + aprsField(reading.Pressure, 5, func(hpa float64) float64 { return hpa * 10 }))
+	}
+	b.WriteString("weather-app")
+	return b.String()
+}
+
+// aprsField renders a value as a zero-padded integer of the given width, or
+// dots when the station did not report it.
+func aprsField(value *float64, width int, convert func(float64) float64) string {
+	if value == nil {
+		return strings.Repeat(".", width)
+	}
+	v := *value
+	if convert != nil {
+		v = convert(v)
+	}
+	n := int(math.Round(v))
+	if n < 0 {
+		return fmt.Sprintf("-%0*d", width-1, -n)
+	}
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+func aprsLatitude(lat float64) string {
+	hemisphere := "N"
+	if lat < 0 {
+		hemisphere = "S"
+		lat = -lat
+	}
+	degrees := math.Floor(lat)
+	return fmt.Sprintf("%02.0f%05.2f%s", degrees, (lat-degrees)*60, hemisphere)
+}
+
+func aprsLongitude(lon float64) string {
+	hemisphere := "E"
+	if lon < 0 {
+		hemisphere = "W"
+		lon = -lon
+	}
+	degrees := math.Floor(lon)
+	return fmt.Sprintf("%03.0f%05.2f%s", degrees, (lon-degrees)*60, hemisphere)
+}
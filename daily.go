@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+	// Embedded zone data: the Alpine image has no /usr/share/zoneinfo and the
+	// daily gauges reset at midnight in the city's own time zone.
+	_ "time/tzdata"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const rollingAverageWindow = time.Hour
+
+type temperatureSample struct {
+	at    time.Time
+	value float64
+}
+
+// temperatureTracker follows the observations of WEATHER_CITY for the daily
+// extreme and rolling average gauges. The gauges are computed when scraped,
+// so the daily values reset at local midnight even before the next
+// observation arrives; until then they are NaN, which no alert threshold
+// matches.
+type temperatureTracker struct {
+	mu       sync.Mutex
+	day      string
+	min, max float64
+	samples  []temperatureSample
+
+	city     string
+	location *time.Location
+	// catalogued is set once the catalog was consulted, which may load
+	// after the first observations.
+	catalogued bool
+}
+
+var dailyTemperatures = &temperatureTracker{}
+
+func init() {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "temperature_today_min_celsius",
+			Help: "Lowest temperature observed today, local time of the city",
+		}, func() float64 { return dailyTemperatures.Today(time.Now(), false) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "temperature_today_max_celsius",
+			Help: "Highest temperature observed today, local time of the city",
+		}, func() float64 { return dailyTemperatures.Today(time.Now(), true) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "temperature_rolling_average_1h_celsius",
+			Help: "Average of the temperatures observed in the last hour",
+		}, func() float64 { return dailyTemperatures.RollingAverage(time.Now()) }),
+	)
+}
+
+// zone returns the time zone of city from the city catalog, falling back to
+// the process time zone (TZ). The answer is kept until the tracked city
+// changes, which also discards the values of the previous city.
+func (t *temperatureTracker) zone(city string) *time.Location {
+	if t.location != nil && strings.EqualFold(t.city, city) && (t.catalogued || !cities.Loaded()) {
+		return t.location
+	}
+	location := time.Local
+	if c, ok := cities.Lookup(city); ok && c.Timezone != "" {
+		if l, err := time.LoadLocation(c.Timezone); err == nil {
+			location = l
+		}
+	}
+	t.city, t.location, t.catalogued = city, location, cities.Loaded()
+	return location
+}
+
+// Observe records a fresh observation of city; other cities are ignored.
+func (t *temperatureTracker) Observe(city string, value float64, at time.Time) {
+	if !strings.EqualFold(city, weatherCity()) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !strings.EqualFold(t.city, city) {
+		t.day, t.samples = "", nil
+	}
+	if day := at.In(t.zone(city)).Format("2006-01-02"); day != t.day {
+		t.day, t.min, t.max = day, value, value
+	} else {
+		t.min, t.max = math.Min(t.min, value), math.Max(t.max, value)
+	}
+
+	cutoff := at.Add(-rollingAverageWindow)
+	kept := t.samples[:0]
+	for _, s := range t.samples {
+		if s.at.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	t.samples = append(kept, temperatureSample{at, value})
+}
+
+// Today returns today's maximum or minimum, or NaN before the first
+// observation of the day.
+func (t *temperatureTracker) Today(now time.Time, max bool) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.day == "" || !strings.EqualFold(t.city, weatherCity()) || now.In(t.location).Format("2006-01-02") != t.day {
+		return math.NaN()
+	}
+	if max {
+		return t.max
+	}
+	return t.min
+}
+
+// RollingAverage averages the observations of the last hour, or returns NaN
+// when there were none.
+func (t *temperatureTracker) RollingAverage(now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !strings.EqualFold(t.city, weatherCity()) {
+		return math.NaN()
+	}
+	sum, n := 0.0, 0
+	for _, s := range t.samples {
+		if s.at.After(now.Add(-rollingAverageWindow)) {
+			sum += s.value
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deprecatedRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "deprecated_requests_total",
+		Help: "Total number of requests to deprecated routes or answered with deprecated fields by route, field (empty for the whole route) and client",
+	},
+	[]string{"route", "field", "client"},
+)
+
+func init() {
+	prometheus.MustRegister(deprecatedRequestsTotal)
+}
+
+// deprecation is one entry of API_DEPRECATIONS: a route, or a field of its
+// responses, scheduled for removal.
+type deprecation struct {
+	Route string
+	// Field is a dotted path as in ?fields=, empty for the whole route.
+	Field      string
+	Deprecated time.Time
+	// Sunset is when the route or field goes away; zero when not decided.
+	Sunset time.Time
+	// Link points at the replacement or the migration notes.
+	Link string
+}
+
+// parseDeprecations parses API_DEPRECATIONS: entries separated by ';' of the
+// form "<route>[#<field>]=<deprecated>[,<sunset>[,<link>]]", dates as
+// YYYY-MM-DD and routes as registered, e.g. "/api/subscriptions/{id}".
+func parseDeprecations(v string) ([]deprecation, error) {
+	var list []deprecation
+	for _, entry := range strings.Split(v, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		target, schedule, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q: want <route>[#<field>]=<deprecated>[,<sunset>[,<link>]]", entry)
+		}
+		var d deprecation
+		d.Route, d.Field, _ = strings.Cut(strings.TrimSpace(target), "#")
+		if !strings.HasPrefix(d.Route, "/") {
+			return nil, fmt.Errorf("entry %q: route must start with /", entry)
+		}
+		parts := strings.SplitN(schedule, ",", 3)
+		var err error
+		if d.Deprecated, err = time.Parse(time.DateOnly, strings.TrimSpace(parts[0])); err != nil {
+			return nil, fmt.Errorf("entry %q: invalid deprecation date", entry)
+		}
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+			if d.Sunset, err = time.Parse(time.DateOnly, strings.TrimSpace(parts[1])); err != nil {
+				return nil, fmt.Errorf("entry %q: invalid sunset date", entry)
+			}
+			if d.Sunset.Before(d.Deprecated) {
+				return nil, fmt.Errorf("entry %q: sunset before deprecation", entry)
+			}
+		}
+		if len(parts) > 2 {
+			d.Link = strings.TrimSpace(parts[2])
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// routeDeprecations returns the API_DEPRECATIONS entries of the route that
+// matched r. Invalid configuration is rejected at startup and by the config
+// API, so a parse error here only drops the deprecations.
+func routeDeprecations(r *http.Request) []deprecation {
+	v := runningConfig().APIDeprecations
+	if v == "" {
+		return nil
+	}
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+	all, err := parseDeprecations(v)
+	if err != nil {
+		return nil
+	}
+	var list []deprecation
+	for _, d := range all {
+		if d.Route == route {
+			list = append(list, d)
+		}
+	}
+	return list
+}
+
+// deprecationClient names the client in deprecated_requests_total: the API
+// key name, the user of another scheme, or "anonymous" when the route group
+// does not authenticate.
+func deprecationClient(r *http.Request) string {
+	if p, ok := requestPrincipal(r); ok {
+		return p.Name
+	}
+	return "anonymous"
+}
+
+// setDeprecationHeaders announces deprecations with the Deprecation (RFC
+// 9745) and Sunset (RFC 8594) headers, using the earliest dates of list, and
+// links their replacements.
+func setDeprecationHeaders(w http.ResponseWriter, list []deprecation) {
+	var deprecated, sunset time.Time
+	for _, d := range list {
+		if deprecated.IsZero() || d.Deprecated.Before(deprecated) {
+			deprecated = d.Deprecated
+		}
+		if !d.Sunset.IsZero() && (sunset.IsZero() || d.Sunset.Before(sunset)) {
+			sunset = d.Sunset
+		}
+		if d.Link != "" {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", d.Link))
+		}
+	}
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecated.Unix()))
+	if !sunset.IsZero() {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// deprecationMiddleware marks every response of a deprecated route and
+// counts who still uses it. Field deprecations are handled by
+// writeResponse, which knows whether the field is present.
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var routes []deprecation
+		for _, d := range routeDeprecations(r) {
+			if d.Field == "" {
+				routes = append(routes, d)
+			}
+		}
+		if len(routes) > 0 {
+			setDeprecationHeaders(w, routes)
+			deprecatedRequestsTotal.WithLabelValues(routes[0].Route, "", deprecationClient(r)).Inc()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyDeprecations adds a "deprecations" member to body, a decoded JSON
+// value, listing the deprecated route and the deprecated fields present in
+// it with "field" (absent for the route), "deprecated", "sunset" and "link",
+// and sets the headers for the fields. Bodies other than objects are left
+// alone.
+func applyDeprecations(w http.ResponseWriter, r *http.Request, list []deprecation, body any) {
+	object, ok := body.(map[string]any)
+	if !ok {
+		return
+	}
+	var notices []any
+	var fields []deprecation
+	for _, d := range list {
+		if d.Field != "" {
+			if !hasField(object, d.Field) {
+				continue
+			}
+			fields = append(fields, d)
+			deprecatedRequestsTotal.WithLabelValues(d.Route, d.Field, deprecationClient(r)).Inc()
+		}
+		notice := map[string]any{"deprecated": d.Deprecated.Format(time.DateOnly)}
+		if d.Field != "" {
+			notice["field"] = d.Field
+		}
+		if !d.Sunset.IsZero() {
+			notice["sunset"] = d.Sunset.Format(time.DateOnly)
+		}
+		if d.Link != "" {
+			notice["link"] = d.Link
+		}
+		notices = append(notices, notice)
+	}
+	if len(notices) == 0 {
+		return
+	}
+	if len(fields) > 0 && w.Header().Get("Deprecation") == "" {
+		setDeprecationHeaders(w, fields)
+	}
+	object["deprecations"] = notices
+}
+
+// hasField reports whether the dotted path is present in object.
+func hasField(object map[string]any, path string) bool {
+	name, rest, nested := strings.Cut(path, ".")
+	v, ok := object[name]
+	if !ok || !nested {
+		return ok
+	}
+	inner, ok := v.(map[string]any)
+	return ok && hasField(inner, rest)
+}
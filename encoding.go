@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeMsgpack  = "application/msgpack"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// mediaTypes maps accepted Accept values to the response content type.
+var mediaTypes = map[string]string{
+	"application/json":                contentTypeJSON,
+	"application/*":                   contentTypeJSON,
+	"*/*":                             contentTypeJSON,
+	"application/msgpack":             contentTypeMsgpack,
+	"application/x-msgpack":           contentTypeMsgpack,
+	"application/vnd.msgpack":         contentTypeMsgpack,
+	"application/x-protobuf":          contentTypeProtobuf,
+	"application/protobuf":            contentTypeProtobuf,
+	"application/vnd.google.protobuf": contentTypeProtobuf,
+}
+
+// protoMessage is implemented by responses that have a protobuf schema
+// (see weather.proto).
+type protoMessage interface {
+	marshalProto() []byte
+}
+
+// negotiateEncoding picks the content type with the highest quality in the
+// Accept header. Protobuf is only offered for responses with a schema. An
+// empty result means none of the accepted types can be produced.
+func negotiateEncoding(accept string, v any) string {
+	if strings.TrimSpace(accept) == "" {
+		return contentTypeJSON
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		contentType, ok := mediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		if _, proto := v.(protoMessage); contentType == contentTypeProtobuf && !proto {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		if q > bestQ {
+			best, bestQ = contentType, q
+		}
+	}
+	return best
+}
+
+// writeResponse encodes v as JSON, MessagePack or protobuf depending on the
+// Accept header. JSON and MessagePack bodies are projected onto the "fields"
+// query parameter when present; protobuf messages are always complete. It
+// reports false after answering with a problem.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) bool {
+	w.Header().Add("Vary", "Accept")
+	contentType := negotiateEncoding(r.Header.Get("Accept"), v)
+	if contentType == "" {
+		writeProblem(w, r, http.StatusNotAcceptable, "request.not_acceptable", r.Header.Get("Accept"))
+		return false
+	}
+	if contentType == contentTypeProtobuf {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write(v.(protoMessage).marshalProto())
+		return true
+	}
+
+	var body any = v
+	raw := r.URL.Query().Get("fields")
+	deprecations := routeDeprecations(r)
+	if raw != "" || contentType == contentTypeMsgpack || len(deprecations) > 0 {
+		var fields fieldSet
+		if raw != "" {
+			var ok bool
+			if fields, ok = parseFields(raw); !ok {
+				writeProblem(w, r, http.StatusBadRequest, "request.invalid_fields", raw)
+				return false
+			}
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "request.encoding_failed")
+			return false
+		}
+		var decoded any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&decoded); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "request.encoding_failed")
+			return false
+		}
+		body = fields.project(decoded)
+		applyDeprecations(w, r, deprecations, body)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if contentType == contentTypeMsgpack {
+		w.Write(appendMsgpack(nil, body))
+		return true
+	}
+	json.NewEncoder(w).Encode(body)
+	return true
+}
+
+// appendMsgpack encodes a decoded JSON value (as produced by a json.Decoder
+// with UseNumber) in MessagePack. Map keys are sorted.
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n)
+		}
+		f, _ := v.Float64()
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...)
+	case []any:
+		b = appendMsgpackHeader(b, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackHeader(b, len(v), 0x80, 0xde)
+		for _, k := range keys {
+			b = appendMsgpack(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	}
+	return append(b, 0xc0)
+}
+
+// appendMsgpackHeader writes an array or map header: fix, 16- or 32-bit.
+func appendMsgpackHeader(b []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, wide), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, wide+1), uint32(n))
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n >= -32 && n < 0:
+		return append(b, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// Protobuf wire format helpers.
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	b = appendProtoTag(b, field, 1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(v))
+}
+
+// marshalProto encodes the response as the Weather message of weather.proto.
+func (resp WeatherResponse) marshalProto() []byte {
+	var b []byte
+	b = appendProtoDouble(b, 1, resp.Temperature)
+	b = appendProtoString(b, 2, resp.Unit)
+	b = appendProtoString(b, 3, resp.Timestamp)
+	b = appendProtoString(b, 4, resp.Source)
+	keys := make([]string, 0, len(resp.Display))
+	for k := range resp.Display {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := appendProtoString(nil, 1, k)
+		entry = appendProtoString(entry, 2, resp.Display[k])
+		b = appendProtoBytes(b, 5, entry)
+	}
+	if c := resp.Comfort; c != nil {
+		comfort := appendProtoDouble(nil, 1, c.FeelsLike)
+		for i, v := range []*float64{c.DewPoint, c.WindChill, c.HeatIndex} {
+			if v != nil {
+				comfort = appendProtoDouble(comfort, i+2, *v)
+			}
+		}
+		b = appendProtoBytes(b, 6, comfort)
+	}
+	b = appendProtoString(b, 7, resp.Theme)
+	return b
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// envPrefix namespaces the settings in a shared environment:
+// WEATHERAPP_PORT sets PORT, WEATHERAPP_WEATHER_API_KEY sets WEATHER_API_KEY.
+const envPrefix = "WEATHERAPP_"
+
+// Config is the configuration of the process: every setting of
+// configSettings, typed, with its default when unset. loadConfig reads it
+// once at startup and it never changes afterwards; a setting changed at run
+// time replaces the running Config with a new one.
+type Config struct {
+	Port                    int           `setting:"PORT"`
+	HTTPListen              string        `setting:"HTTP_LISTEN"`
+	ListenSocket            string        `setting:"LISTEN_SOCKET"`
+	ListenSocketMode        string        `setting:"LISTEN_SOCKET_MODE"`
+	PIDFile                 string        `setting:"PID_FILE"`
+	UpgradeTimeout          time.Duration `setting:"UPGRADE_TIMEOUT"`
+	ShutdownTimeout         time.Duration `setting:"SHUTDOWN_TIMEOUT"`
+	WeatherCity             string        `setting:"WEATHER_CITY"`
+	WeatherLang             string        `setting:"WEATHER_LANG"`
+	WeatherAPIKey           string        `setting:"WEATHER_API_KEY"`
+	WeatherAPIKeySecondary  string        `setting:"WEATHER_API_KEY_SECONDARY"`
+	OpenWeatherBaseURL      string        `setting:"OPENWEATHER_BASE_URL"`
+	WeatherProvider         string        `setting:"WEATHER_PROVIDER"`
+	MetnoUserAgent          string        `setting:"METNO_USER_AGENT"`
+	MetnoBaseURL            string        `setting:"METNO_BASE_URL"`
+	TomorrowAPIKey          string        `setting:"TOMORROW_API_KEY"`
+	TomorrowBaseURL         string        `setting:"TOMORROW_BASE_URL"`
+	WeatherAPIComKey        string        `setting:"WEATHERAPI_KEY"`
+	WeatherAPIComBaseURL    string        `setting:"WEATHERAPI_BASE_URL"`
+	WeatherProviderCommand  string        `setting:"WEATHER_PROVIDER_COMMAND"`
+	WeatherProviderURL      string        `setting:"WEATHER_PROVIDER_URL"`
+	SensorDevice            string        `setting:"SENSOR_DEVICE"`
+	SensorI2CAddress        string        `setting:"SENSOR_I2C_ADDRESS"`
+	WeatherCacheTTL         time.Duration `setting:"WEATHER_CACHE_TTL"`
+	CacheMaxCities          int           `setting:"CACHE_MAX_CITIES"`
+	CityCatalog             string        `setting:"CITY_CATALOG"`
+	CityCatalogURL          string        `setting:"CITY_CATALOG_URL"`
+	GeocodeCacheTTL         time.Duration `setting:"GEOCODE_CACHE_TTL"`
+	UpstreamProxy           string        `setting:"UPSTREAM_PROXY"`
+	UpstreamCAFile          string        `setting:"UPSTREAM_CA_FILE"`
+	UpstreamTLSMinVersion   string        `setting:"UPSTREAM_TLS_MIN_VERSION"`
+	UpstreamClientCert      string        `setting:"UPSTREAM_CLIENT_CERT"`
+	UpstreamClientKey       string        `setting:"UPSTREAM_CLIENT_KEY"`
+	OWMCallsPerMinute       int           `setting:"OWM_CALLS_PER_MINUTE"`
+	OWMCallsPerMonth        int           `setting:"OWM_CALLS_PER_MONTH"`
+	TrustedProxies          []string      `setting:"TRUSTED_PROXIES"`
+	ShardCount              int           `setting:"SHARD_COUNT"`
+	ShardIndex              int           `setting:"SHARD_INDEX"`
+	ShardPeers              string        `setting:"SHARD_PEERS"`
+	ShardSecret             string        `setting:"SHARD_SECRET"`
+	MirrorURL               string        `setting:"MIRROR_URL"`
+	MirrorSampleRate        float64       `setting:"MIRROR_SAMPLE_RATE"`
+	LogLevel                string        `setting:"LOG_LEVEL"`
+	WarmupTimeout           time.Duration `setting:"WARMUP_TIMEOUT"`
+	ReadyMaxFetchAge        time.Duration `setting:"READY_MAX_FETCH_AGE"`
+	SentryDSN               string        `setting:"SENTRY_DSN"`
+	SentryEnvironment       string        `setting:"SENTRY_ENVIRONMENT"`
+	ErrorDedupWindow        time.Duration `setting:"ERROR_DEDUP_WINDOW"`
+	AnomalyMaxJump          float64       `setting:"ANOMALY_MAX_JUMP"`
+	AnomalyFrozenAfter      time.Duration `setting:"ANOMALY_FROZEN_AFTER"`
+	AnomalySuppress         bool          `setting:"ANOMALY_SUPPRESS"`
+	HistoryStore            string        `setting:"HISTORY_STORE"`
+	HistoryStorePath        string        `setting:"HISTORY_STORE_PATH"`
+	HistoryRetention        time.Duration `setting:"HISTORY_RETENTION"`
+	HistoryRollupRetention  time.Duration `setting:"HISTORY_ROLLUP_RETENTION"`
+	AuditLogFile            string        `setting:"AUDIT_LOG_FILE"`
+	HistoryMaxPoints        int           `setting:"HISTORY_MAX_POINTS"`
+	EPaperLayout            string        `setting:"EPAPER_LAYOUT"`
+	StationPassword         string        `setting:"STATION_PASSWORD"`
+	EcowittPasskeys         []string      `setting:"ECOWITT_PASSKEYS"`
+	StationLocations        string        `setting:"STATION_LOCATIONS"`
+	StationRadiusKm         float64       `setting:"STATION_RADIUS_KM"`
+	StationMaxAge           time.Duration `setting:"STATION_MAX_AGE"`
+	StationMinCount         int           `setting:"STATION_MIN_COUNT"`
+	UploadStation           string        `setting:"UPLOAD_STATION"`
+	WindyAPIKey             string        `setting:"WINDY_API_KEY"`
+	WindyStation            int           `setting:"WINDY_STATION"`
+	WindyInterval           time.Duration `setting:"WINDY_INTERVAL"`
+	PWSWeatherStationID     string        `setting:"PWSWEATHER_STATION_ID"`
+	PWSWeatherAPIKey        string        `setting:"PWSWEATHER_API_KEY"`
+	PWSWeatherInterval      time.Duration `setting:"PWSWEATHER_INTERVAL"`
+	WOWSiteID               string        `setting:"WOW_SITE_ID"`
+	WOWAuthKey              string        `setting:"WOW_AUTH_KEY"`
+	WOWInterval             time.Duration `setting:"WOW_INTERVAL"`
+	CWOPCallsign            string        `setting:"CWOP_CALLSIGN"`
+	CWOPPasscode            int           `setting:"CWOP_PASSCODE"`
+	CWOPServer              string        `setting:"CWOP_SERVER"`
+	CWOPStation             string        `setting:"CWOP_STATION"`
+	CWOPLatitude            float64       `setting:"CWOP_LATITUDE"`
+	CWOPLongitude           float64       `setting:"CWOP_LONGITUDE"`
+	CWOPInterval            time.Duration `setting:"CWOP_INTERVAL"`
+	MQTTBroker              string        `setting:"MQTT_BROKER"`
+	MQTTUsername            string        `setting:"MQTT_USERNAME"`
+	MQTTPassword            string        `setting:"MQTT_PASSWORD"`
+	MQTTClientID            string        `setting:"MQTT_CLIENT_ID"`
+	MQTTTopicPrefix         string        `setting:"MQTT_TOPIC_PREFIX"`
+	MQTTDiscoveryPrefix     string        `setting:"MQTT_DISCOVERY_PREFIX"`
+	MQTTInterval            time.Duration `setting:"MQTT_INTERVAL"`
+	CoAPListen              string        `setting:"COAP_LISTEN"`
+	CoAPNotifyInterval      time.Duration `setting:"COAP_NOTIFY_INTERVAL"`
+	ModbusListen            string        `setting:"MODBUS_LISTEN"`
+	ModbusUnitID            int           `setting:"MODBUS_UNIT_ID"`
+	ModbusRegisters         string        `setting:"MODBUS_REGISTERS"`
+	ModbusCity              string        `setting:"MODBUS_CITY"`
+	ModbusRefresh           time.Duration `setting:"MODBUS_REFRESH"`
+	SNMPListen              string        `setting:"SNMP_LISTEN"`
+	SNMPCommunity           string        `setting:"SNMP_COMMUNITY"`
+	SNMPEnterpriseOID       string        `setting:"SNMP_ENTERPRISE_OID"`
+	SNMPCity                string        `setting:"SNMP_CITY"`
+	SNMPRefresh             time.Duration `setting:"SNMP_REFRESH"`
+	ArchiveS3Bucket         string        `setting:"ARCHIVE_S3_BUCKET"`
+	ArchiveS3AccessKey      string        `setting:"ARCHIVE_S3_ACCESS_KEY"`
+	ArchiveS3SecretKey      string        `setting:"ARCHIVE_S3_SECRET_KEY"`
+	ArchiveS3Region         string        `setting:"ARCHIVE_S3_REGION"`
+	ArchiveS3Endpoint       string        `setting:"ARCHIVE_S3_ENDPOINT"`
+	ArchiveS3Prefix         string        `setting:"ARCHIVE_S3_PREFIX"`
+	ArchiveInterval         time.Duration `setting:"ARCHIVE_INTERVAL"`
+	WebhookMaxSubscriptions int           `setting:"WEBHOOK_MAX_SUBSCRIPTIONS"`
+	WebhookAllowPrivate     bool          `setting:"WEBHOOK_ALLOW_PRIVATE"`
+	WebhookConcurrency      int           `setting:"WEBHOOK_CONCURRENCY"`
+	WebhookRetryRatio       float64       `setting:"WEBHOOK_RETRY_RATIO"`
+	ForecastInterval        time.Duration `setting:"FORECAST_INTERVAL"`
+	ForecastAccuracyCities  []string      `setting:"FORECAST_ACCURACY_CITIES"`
+	ScheduleCurrent         string        `setting:"SCHEDULE_CURRENT"`
+	ScheduleForecast        string        `setting:"SCHEDULE_FORECAST"`
+	CollectCities           []string      `setting:"COLLECT_CITIES"`
+	PushgatewayURL          string        `setting:"PUSHGATEWAY_URL"`
+	PushgatewayJob          string        `setting:"PUSHGATEWAY_JOB"`
+	PushgatewayInstance     string        `setting:"PUSHGATEWAY_INSTANCE"`
+	CollectConcurrency      int           `setting:"COLLECT_CONCURRENCY"`
+	ScheduleJitter          time.Duration `setting:"SCHEDULE_JITTER"`
+	ForecastCacheTTL        time.Duration `setting:"FORECAST_CACHE_TTL"`
+	AdminToken              string        `setting:"ADMIN_TOKEN"`
+	JWTSecret               string        `setting:"JWT_SECRET"`
+	JWTRolesClaim           string        `setting:"JWT_ROLES_CLAIM"`
+	APIKeys                 string        `setting:"API_KEYS"`
+	APIKeyRoles             string        `setting:"API_KEY_ROLES"`
+	Tenants                 string        `setting:"TENANTS"`
+	UIRefresh               time.Duration `setting:"UI_REFRESH"`
+	UITitle                 string        `setting:"UI_TITLE"`
+	UITheme                 string        `setting:"UI_THEME"`
+	UITemplate              string        `setting:"UI_TEMPLATE"`
+	APIKeyQuotas            string        `setting:"API_KEY_QUOTAS"`
+	BasicAuthUsers          string        `setting:"BASIC_AUTH_USERS"`
+	BasicAuthRoles          string        `setting:"BASIC_AUTH_ROLES"`
+	AuthAPI                 string        `setting:"AUTH_API"`
+	AuthAdmin               string        `setting:"AUTH_ADMIN"`
+	AuthMetrics             string        `setting:"AUTH_METRICS"`
+	AuthUI                  string        `setting:"AUTH_UI"`
+	OIDCIssuer              string        `setting:"OIDC_ISSUER"`
+	OIDCClientID            string        `setting:"OIDC_CLIENT_ID"`
+	OIDCClientSecret        string        `setting:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL         string        `setting:"OIDC_REDIRECT_URL"`
+	OIDCScopes              string        `setting:"OIDC_SCOPES"`
+	OIDCRolesClaim          string        `setting:"OIDC_ROLES_CLAIM"`
+	OIDCSessionKey          string        `setting:"OIDC_SESSION_KEY"`
+	OIDCSessionTTL          time.Duration `setting:"OIDC_SESSION_TTL"`
+	APIDeprecations         string        `setting:"API_DEPRECATIONS"`
+	VaultAddr               string        `setting:"VAULT_ADDR"`
+	VaultSecrets            string        `setting:"VAULT_SECRETS"`
+	VaultNamespace          string        `setting:"VAULT_NAMESPACE"`
+	VaultAuthMethod         string        `setting:"VAULT_AUTH_METHOD"`
+	VaultAuthMount          string        `setting:"VAULT_AUTH_MOUNT"`
+	VaultToken              string        `setting:"VAULT_TOKEN"`
+	VaultRoleID             string        `setting:"VAULT_ROLE_ID"`
+	VaultSecretID           string        `setting:"VAULT_SECRET_ID"`
+	VaultRole               string        `setting:"VAULT_ROLE"`
+	VaultK8sTokenFile       string        `setting:"VAULT_K8S_TOKEN_FILE"`
+	VaultCACert             string        `setting:"VAULT_CACERT"`
+	VaultRefresh            time.Duration `setting:"VAULT_REFRESH"`
+	LDAPURL                 string        `setting:"LDAP_URL"`
+	LDAPBindDN              string        `setting:"LDAP_BIND_DN"`
+	LDAPBindPassword        string        `setting:"LDAP_BIND_PASSWORD"`
+	LDAPBaseDN              string        `setting:"LDAP_BASE_DN"`
+	LDAPUserAttribute       string        `setting:"LDAP_USER_ATTRIBUTE"`
+	LDAPGroupRoles          string        `setting:"LDAP_GROUP_ROLES"`
+	LDAPCacheTTL            time.Duration `setting:"LDAP_CACHE_TTL"`
+
+	// values are the settings that are set, as strings: secret://
+	// references until resolved, lists joined by commas.
+	values map[string]string
+	// sources name where each setting was read at startup: "environment",
+	// its WEATHERAPP_ variable or "CONFIG_FILE".
+	sources map[string]string
+	// changed are the settings set or unset through the admin API.
+	changed map[string]bool
+	// file is the path of CONFIG_FILE, "" without one.
+	file string
+	// problems are the WEATHERAPP_ variables that could not be applied.
+	problems []string
+}
+
+// newConfig returns the Config of values, with the default of every
+// setting that is unset or invalid. Settings are validated at startup and
+// when staged through the admin API, so an invalid value only shows up for
+// a setting changed behind their back.
+func newConfig(values map[string]string) *Config {
+	if values == nil {
+		values = make(map[string]string)
+	}
+	c := &Config{values: values, sources: make(map[string]string), changed: make(map[string]bool)}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("setting")
+		if name == "" {
+			continue
+		}
+		s, ok := lookupSetting(name)
+		if !ok {
+			panic("Config: unknown setting " + name)
+		}
+		value := values[name]
+		if value == "" || s.validate(value) != nil || setConfigField(v.Field(i), s, value) != nil {
+			setConfigField(v.Field(i), s, s.Default)
+		}
+	}
+	return c
+}
+
+// setConfigField parses value into the field of setting s.
+func setConfigField(field reflect.Value, s configSetting, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+		return nil
+	case []string:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+	if value == "" {
+		field.SetZero()
+		return nil
+	}
+	switch field.Interface().(type) {
+	case int:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		parse := time.ParseDuration
+		if s.Type == settingWindow {
+			parse = parseWindow
+		}
+		d, err := parse(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	default:
+		panic("Config: unsupported type of " + s.Name)
+	}
+	return nil
+}
+
+// Lookup returns a setting as set, without the default.
+func (c *Config) Lookup(name string) (string, bool) {
+	v, ok := c.values[name]
+	return v, ok
+}
+
+// IsSet reports whether a setting is set to a value other than "".
+func (c *Config) IsSet(name string) bool {
+	return c.values[name] != ""
+}
+
+// check returns the problem with the value of a setting, which the field
+// replaced with the default; nil when the value is valid or unset.
+func (c *Config) check(name string) error {
+	s, _ := lookupSetting(name)
+	if v := c.values[name]; v != "" {
+		return s.validate(v)
+	}
+	return nil
+}
+
+// inEnvironment reports whether a setting was set in the environment rather
+// than CONFIG_FILE.
+func (c *Config) inEnvironment(name string) bool {
+	source := c.sources[name]
+	return source == "environment" || source == envPrefix+name
+}
+
+// with returns a copy of c with values set that a process started by an
+// upgrade reads again by itself: secrets from Vault and secret://
+// references, and settings saved to CONFIG_FILE.
+func (c *Config) with(values map[string]string) *Config {
+	changes := make(map[string]*string, len(values))
+	for name, value := range values {
+		value := value
+		changes[name] = &value
+	}
+	return c.apply(changes, false)
+}
+
+// withChanges returns a copy of c with the changes made through the admin
+// API, nil unsetting a setting. A process started by an upgrade inherits
+// them, see runtimeChanges.
+func (c *Config) withChanges(changes map[string]*string) *Config {
+	return c.apply(changes, true)
+}
+
+func (c *Config) apply(changes map[string]*string, changed bool) *Config {
+	values := maps.Clone(c.values)
+	for name, value := range changes {
+		if value == nil {
+			delete(values, name)
+		} else {
+			values[name] = *value
+		}
+	}
+	next := newConfig(values)
+	next.sources, next.file, next.problems = c.sources, c.file, c.problems
+	next.changed = maps.Clone(c.changed)
+	if changed {
+		for name := range changes {
+			next.changed[name] = true
+		}
+	}
+	return next
+}
+
+// runtimeChanges returns the settings changed through the admin API with
+// their values, nil for those unset, for the process started by an upgrade
+// to keep them.
+func (c *Config) runtimeChanges() map[string]*string {
+	changes := make(map[string]*string, len(c.changed))
+	for name := range c.changed {
+		if value, set := c.values[name]; set {
+			changes[name] = &value
+		} else {
+			changes[name] = nil
+		}
+	}
+	return changes
+}
+
+// upgradeEnviron returns environ, the environment of this process, without
+// the settings changed through the admin API, for the process started by an
+// upgrade. It gets their values from runtimeChanges instead, by a pipe,
+// since secrets are among them.
+func (c *Config) upgradeEnviron(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if !c.changed[strings.TrimPrefix(name, envPrefix)] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// loadConfig reads the configuration: the settings in the environment,
+// under their own name or with envPrefix, and those of CONFIG_FILE that the
+// environment leaves unset. The environment itself is not changed.
+func loadConfig() (*Config, error) {
+	values, sources, problems := environmentSettings(os.Environ())
+	file := os.Getenv("CONFIG_FILE")
+	if file != "" {
+		if err := loadConfigFile(file, values, sources); err != nil {
+			return nil, err
+		}
+	}
+	c := newConfig(values)
+	c.sources, c.file, c.problems = sources, file, problems
+	return c, nil
+}
+
+// environmentSettings returns the settings of environ and where each was
+// read. A setting given with envPrefix counts as if given under its own
+// name; a prefixed variable that names no setting, or disagrees with the
+// unprefixed variable, is a problem, reported by configProblems.
+func environmentSettings(environ []string) (values, sources map[string]string, problems []string) {
+	values, sources = make(map[string]string), make(map[string]string)
+	prefixed := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if setting, ok := strings.CutPrefix(name, envPrefix); ok {
+			if _, known := lookupSetting(setting); !known {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting %s", name, setting))
+				continue
+			}
+			prefixed[setting] = value
+		} else if _, known := lookupSetting(name); known {
+			values[name], sources[name] = value, "environment"
+		}
+	}
+	for setting, value := range prefixed {
+		if current, set := values[setting]; set && current != value {
+			problems = append(problems, fmt.Sprintf("%s%s: cannot be set together with %s", envPrefix, setting, setting))
+			continue
+		}
+		values[setting], sources[setting] = value, envPrefix+setting
+	}
+	sort.Strings(problems)
+	return values, sources, problems
+}
+
+// running holds the Config in effect. Changes at run time replace it
+// under the lock, so that concurrent changes do not lose each other.
+var running struct {
+	sync.Mutex
+	config atomic.Pointer[Config]
+}
+
+// defaultConfig is the running Config before a command loaded its own:
+// every setting at its default.
+var defaultConfig = newConfig(nil)
+
+// runningConfig returns the Config in effect. Code that runs after startup
+// takes its Live settings from here on every use, so that changing them
+// takes effect without a restart.
+func runningConfig() *Config {
+	if c := running.config.Load(); c != nil {
+		return c
+	}
+	return defaultConfig
+}
+
+// setRunningConfig puts c in effect.
+func setRunningConfig(c *Config) {
+	running.config.Store(c)
+}
+
+// updateConfig replaces the running Config with what update makes of it.
+func updateConfig(update func(*Config) *Config) {
+	running.Lock()
+	defer running.Unlock()
+	running.config.Store(update(runningConfig()))
+}
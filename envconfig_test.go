@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestConfig runs the test with values as the running configuration.
+func setTestConfig(t *testing.T, values map[string]string) {
+	t.Helper()
+	previous := running.config.Load()
+	setRunningConfig(newConfig(values))
+	t.Cleanup(func() { running.config.Store(previous) })
+}
+
+func TestConfigFields(t *testing.T) {
+	fieldTypes := map[string]reflect.Type{
+		settingString:   reflect.TypeOf(""),
+		settingSecret:   reflect.TypeOf(""),
+		settingURL:      reflect.TypeOf(""),
+		settingAddress:  reflect.TypeOf(""),
+		settingInteger:  reflect.TypeOf(0),
+		settingNumber:   reflect.TypeOf(0.0),
+		settingBoolean:  reflect.TypeOf(false),
+		settingDuration: reflect.TypeOf(time.Duration(0)),
+		settingWindow:   reflect.TypeOf(time.Duration(0)),
+		settingList:     reflect.TypeOf([]string(nil)),
+	}
+	fields := make(map[string]reflect.StructField)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := field.Tag.Get("setting")
+		if name == "" {
+			continue
+		}
+		if _, dup := fields[name]; dup {
+			t.Errorf("%s has more than one field", name)
+		}
+		fields[name] = field
+	}
+	for _, s := range configSettings {
+		field, ok := fields[s.Name]
+		if !ok {
+			t.Errorf("%s has no Config field", s.Name)
+			continue
+		}
+		if want := fieldTypes[s.Type]; field.Type != want {
+			t.Errorf("%s: field %s is %v, want %v for a %s setting", s.Name, field.Name, field.Type, want, s.Type)
+		}
+	}
+	if len(fields) != len(configSettings) {
+		t.Errorf("Config has %d settings, configSettings %d", len(fields), len(configSettings))
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	c := newConfig(map[string]string{
+		"PORT":              "9090",
+		"WEATHER_CITY":      "Oslo",
+		"ANOMALY_SUPPRESS":  "true",
+		"HISTORY_RETENTION": "7d",
+		"TRUSTED_PROXIES":   " 10.0.0.0/8, ,192.168.1.1 ",
+		// Invalid values fall back to the default.
+		"MIRROR_SAMPLE_RATE": "2",
+		"WARMUP_TIMEOUT":     "soon",
+	})
+	if c.Port != 9090 || c.WeatherCity != "Oslo" || !c.AnomalySuppress {
+		t.Errorf("Port %d, WeatherCity %q, AnomalySuppress %v", c.Port, c.WeatherCity, c.AnomalySuppress)
+	}
+	if c.HistoryRetention != 7*24*time.Hour {
+		t.Errorf("HistoryRetention %v, want 168h", c.HistoryRetention)
+	}
+	if want := []string{"10.0.0.0/8", "192.168.1.1"}; !slices.Equal(c.TrustedProxies, want) {
+		t.Errorf("TrustedProxies %q, want %q", c.TrustedProxies, want)
+	}
+	if c.MirrorSampleRate != defaultConfig.MirrorSampleRate || c.WarmupTimeout != defaultConfig.WarmupTimeout {
+		t.Errorf("invalid values gave MirrorSampleRate %v, WarmupTimeout %v, want the defaults", c.MirrorSampleRate, c.WarmupTimeout)
+	}
+	if defaultConfig.Port != 8080 || defaultConfig.MirrorSampleRate != 0.01 || defaultConfig.HistoryRetention != 30*24*time.Hour {
+		t.Errorf("defaults: Port %d, MirrorSampleRate %v, HistoryRetention %v", defaultConfig.Port, defaultConfig.MirrorSampleRate, defaultConfig.HistoryRetention)
+	}
+	if c.IsSet("SHARD_INDEX") || !c.IsSet("PORT") {
+		t.Errorf("IsSet(SHARD_INDEX) %v, IsSet(PORT) %v", c.IsSet("SHARD_INDEX"), c.IsSet("PORT"))
+	}
+}
+
+func TestEnvironmentSettings(t *testing.T) {
+	tests := []struct {
+		name         string
+		environ      []string
+		want         map[string]string
+		wantSources  map[string]string
+		wantProblems int
+	}{
+		{
+			name:        "plain and prefixed",
+			environ:     []string{"PORT=9090", "WEATHERAPP_WEATHER_CITY=Oslo", "HOME=/root"},
+			want:        map[string]string{"PORT": "9090", "WEATHER_CITY": "Oslo"},
+			wantSources: map[string]string{"PORT": "environment", "WEATHER_CITY": "WEATHERAPP_WEATHER_CITY"},
+		},
+		{
+			name:        "both agreeing",
+			environ:     []string{"PORT=9090", "WEATHERAPP_PORT=9090"},
+			want:        map[string]string{"PORT": "9090"},
+			wantSources: map[string]string{"PORT": "WEATHERAPP_PORT"},
+		},
+		{
+			name:         "both disagreeing",
+			environ:      []string{"PORT=9090", "WEATHERAPP_PORT=9091"},
+			want:         map[string]string{"PORT": "9090"},
+			wantSources:  map[string]string{"PORT": "environment"},
+			wantProblems: 1,
+		},
+		{
+			name:         "unknown prefixed setting",
+			environ:      []string{"WEATHERAPP_COLOUR=blue"},
+			want:         map[string]string{},
+			wantSources:  map[string]string{},
+			wantProblems: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, sources, problems := environmentSettings(tt.environ)
+			if !maps.Equal(values, tt.want) || !maps.Equal(sources, tt.wantSources) {
+				t.Errorf("values %v from %v, want %v from %v", values, sources, tt.want, tt.wantSources)
+			}
+			if len(problems) != tt.wantProblems {
+				t.Errorf("problems %q, want %d", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	key, city := "new-secret-key", "Oslo"
+	c := newConfig(map[string]string{"WEATHER_CITY": "Moscow", "WEATHER_LANG": "ru"})
+	next := c.withChanges(map[string]*string{"WEATHER_CITY": &city, "WEATHER_LANG": nil, "WEATHER_API_KEY": &key})
+	if c.WeatherCity != "Moscow" || c.WeatherLang != "ru" {
+		t.Errorf("the original changed: WeatherCity %q, WeatherLang %q", c.WeatherCity, c.WeatherLang)
+	}
+	if next.WeatherCity != "Oslo" || next.WeatherLang != defaultConfig.WeatherLang || next.WeatherAPIKey != key {
+		t.Errorf("WeatherCity %q, WeatherLang %q, WeatherAPIKey %q", next.WeatherCity, next.WeatherLang, next.WeatherAPIKey)
+	}
+
+	// Vault values are read again by the new process, not inherited.
+	next = next.with(map[string]string{"WEATHER_API_KEY_SECONDARY": "from-vault"})
+	environ := []string{"PATH=/bin", "WEATHER_CITY=Moscow", "WEATHERAPP_WEATHER_LANG=ru", "PORT=8080"}
+	got := next.upgradeEnviron(environ)
+	if want := []string{"PATH=/bin", "PORT=8080"}; !slices.Equal(got, want) {
+		t.Errorf("upgradeEnviron = %q, want %q", got, want)
+	}
+
+	// The changes, the secret among them, reach the new process by a pipe.
+	child := upgradedConfig(t, next, environ)
+	if child.WeatherCity != "Oslo" || child.WeatherLang != defaultConfig.WeatherLang || child.WeatherAPIKey != key || child.Port != 8080 {
+		t.Errorf("new process: WeatherCity %q, WeatherLang %q, WeatherAPIKey %q, Port %d", child.WeatherCity, child.WeatherLang, child.WeatherAPIKey, child.Port)
+	}
+	if child.IsSet("WEATHER_API_KEY_SECONDARY") {
+		t.Error("the Vault value was inherited")
+	}
+	if !maps.Equal(child.changed, next.changed) {
+		t.Errorf("changed %v, want %v", child.changed, next.changed)
+	}
+}
+
+// upgradedConfig returns the Config a process started by an upgrade of a
+// process with c and environ would load.
+func upgradedConfig(t *testing.T, c *Config, environ []string) *Config {
+	t.Helper()
+	var pipe bytes.Buffer
+	if err := writeUpgradeSettings(&pipe, c.runtimeChanges()); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := readUpgradeSettings(&pipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := c.upgradeEnviron(environ)
+	for name, value := range changes {
+		if value != nil && strings.Contains(strings.Join(env, "\n"), *value) {
+			t.Errorf("%s is in the environment of the new process", name)
+		}
+	}
+	values, _, _ := environmentSettings(env)
+	return newConfig(values).withChanges(changes)
+}
+
+func TestReadUpgradeSettings(t *testing.T) {
+	changes, err := readUpgradeSettings(strings.NewReader(`{"WEATHER_CITY":"Oslo","WEATHER_LANG":null,"NO_SUCH_SETTING":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || *changes["WEATHER_CITY"] != "Oslo" || changes["WEATHER_LANG"] != nil {
+		t.Errorf("changes %v", changes)
+	}
+	if _, err := readUpgradeSettings(strings.NewReader("")); err == nil {
+		t.Error("an empty pipe gave no error")
+	}
+}
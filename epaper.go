@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	epaperDefaultWidth  = 296
+	epaperDefaultHeight = 128
+	epaperMaxSide       = 2048
+
+	glyphWidth  = 7
+	glyphHeight = 13
+)
+
+// degreeGlyph is drawn by hand because basicfont only covers ASCII.
+var degreeGlyph = []string{
+	"..###..",
+	".#...#.",
+	".#...#.",
+	"..###..",
+}
+
+func parseEpaperSize(value string) (int, int, bool) {
+	if value == "" {
+		return epaperDefaultWidth, epaperDefaultHeight, true
+	}
+	w, h, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return 0, 0, false
+	}
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if err1 != nil || err2 != nil || width < glyphWidth*4 || height < glyphHeight*2 ||
+		width > epaperMaxSide || height > epaperMaxSide {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// epaperCanvas is a 1-bit image: palette index 0 is the background, 1 the ink.
+type epaperCanvas struct {
+	*image.Paletted
+}
+
+func newEpaperCanvas(width, height int, invert bool) epaperCanvas {
+	palette := color.Palette{color.White, color.Black}
+	if invert {
+		palette = color.Palette{color.Black, color.White}
+	}
+	return epaperCanvas{image.NewPaletted(image.Rect(0, 0, width, height), palette)}
+}
+
+func textWidth(text string, scale int) int {
+	return len([]rune(text)) * glyphWidth * scale
+}
+
+// drawText renders text with its top-left corner at (x, y), scaling every
+// glyph pixel to a scale x scale block so large digits stay crisp.
+func (c epaperCanvas) drawText(text string, x, y, scale int) {
+	mask := image.NewAlpha(image.Rect(0, 0, glyphWidth, glyphHeight))
+	for i, r := range []rune(text) {
+		for p := range mask.Pix {
+			mask.Pix[p] = 0
+		}
+		switch r {
+		case '°':
+			for gy, row := range degreeGlyph {
+				for gx, ch := range row {
+					if ch == '#' {
+						mask.SetAlpha(gx, gy+1, color.Alpha{A: 0xff})
+					}
+				}
+			}
+		case '‑', '−':
+			r = '-'
+			fallthrough
+		default:
+			d := &font.Drawer{
+				Dst:  mask,
+				Src:  image.Opaque,
+				Face: basicfont.Face7x13,
+				Dot:  fixed.P(0, basicfont.Face7x13.Ascent),
+			}
+			d.DrawString(string(r))
+		}
+
+		originX := x + i*glyphWidth*scale
+		for gy := 0; gy < glyphHeight; gy++ {
+			for gx := 0; gx < glyphWidth; gx++ {
+				if mask.AlphaAt(gx, gy).A < 0x80 {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						c.SetColorIndex(originX+gx*scale+dx, y+gy*scale+dy, 1)
+					}
+				}
+			}
+		}
+	}
+}
+
+// fitScale returns the largest integer scale at which text fits the box.
+func fitScale(text string, maxWidth, maxHeight int) int {
+	scale := 1
+	for textWidth(text, scale+1) <= maxWidth && glyphHeight*(scale+1) <= maxHeight {
+		scale++
+	}
+	return scale
+}
+
+func (c epaperCanvas) drawCentered(text string, top, height, scale int) {
+	width := c.Bounds().Dx()
+	x := (width - textWidth(text, scale)) / 2
+	y := top + (height-glyphHeight*scale)/2
+	c.drawText(text, x, y, scale)
+}
+
+// renderEpaper lays out current conditions. The "full" layout shows the
+// city, the temperature and the update time; "minimal" only the temperature.
+func renderEpaper(c epaperCanvas, layout, city, temperature, updated string) {
+	width, height := c.Bounds().Dx(), c.Bounds().Dy()
+	margin := width / 20
+
+	if layout == "minimal" {
+		scale := fitScale(temperature, width-2*margin, height-2*margin)
+		c.drawCentered(temperature, 0, height, scale)
+		return
+	}
+
+	small := 1
+	if height >= 200 {
+		small = 2
+	}
+	header := glyphHeight*small + margin
+	footer := glyphHeight*small + margin
+
+	c.drawText(city, margin, margin/2, small)
+	for x := margin; x < width-margin; x++ {
+		c.SetColorIndex(x, header, 1)
+	}
+
+	body := height - header - footer
+	scale := fitScale(temperature, width-2*margin, body-margin)
+	c.drawCentered(temperature, header, body, scale)
+
+	c.drawText(updated, width-margin-textWidth(updated, small), height-glyphHeight*small-margin/2, small)
+}
+
+// encodeBMP writes a 1-bit uncompressed BMP, the format most ESP32 e-paper
+// libraries can stream straight to the display.
+func encodeBMP(c epaperCanvas) []byte {
+	width, height := c.Bounds().Dx(), c.Bounds().Dy()
+	rowSize := ((width + 31) / 32) * 4
+	const headerSize = 14 + 40 + 8
+	imageSize := rowSize * height
+
+	var buf bytes.Buffer
+	buf.WriteString("BM")
+	binary.Write(&buf, binary.LittleEndian, []uint32{uint32(headerSize + imageSize), 0, headerSize})
+	binary.Write(&buf, binary.LittleEndian, []uint32{40, uint32(width), uint32(height)})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 1})
+	binary.Write(&buf, binary.LittleEndian, []uint32{0, uint32(imageSize), 2835, 2835, 2, 2})
+	for _, entry := range c.Palette {
+		r, g, b, _ := entry.RGBA()
+		buf.Write([]byte{byte(b >> 8), byte(g >> 8), byte(r >> 8), 0})
+	}
+
+	row := make([]byte, rowSize)
+	for y := height - 1; y >= 0; y-- {
+		for i := range row {
+			row[i] = 0
+		}
+		for x := 0; x < width; x++ {
+			if c.ColorIndexAt(x, y) == 1 {
+				row[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		buf.Write(row)
+	}
+	return buf.Bytes()
+}
+
+func epaperHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	width, height, ok := parseEpaperSize(q.Get("size"))
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "epaper.invalid_size", q.Get("size"))
+		return
+	}
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "bmp" {
+		writeProblem(w, r, http.StatusBadRequest, "epaper.invalid_format", format)
+		return
+	}
+	layout := q.Get("layout")
+	if layout == "" {
+		layout = runningConfig().EPaperLayout
+	}
+	if layout != "full" && layout != "minimal" {
+		writeProblem(w, r, http.StatusBadRequest, "epaper.invalid_layout", layout)
+		return
+	}
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+	city, ok := requestCity(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := currentWeather(context.WithoutCancel(r.Context()), city)
+	if err != nil {
+		writeTemperatureError(w, r, city, err)
+		return
+	}
+
+	value := result.Temperature
+	if units == unitsImperial {
+		value = celsiusToFahrenheit(value)
+	}
+	invert := q.Get("invert") == "1" || q.Get("invert") == "true"
+	canvas := newEpaperCanvas(width, height, invert)
+	renderEpaper(canvas, layout, locationLabel(city), formatTemperature(value, units, requestLocale(r)), result.FetchedAt.Format("02.01 15:04"))
+
+	setCacheHeaders(w, result)
+	if format == "bmp" {
+		w.Header().Set("Content-Type", "image/bmp")
+		w.Write(encodeBMP(canvas))
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, canvas.Paletted)
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var suppressedErrorLogsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "error_logs_suppressed_total",
+		Help: "Total number of repeated errors logged at debug level instead of error level",
+	},
+)
+
+var recoveredPanicsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "http_panics_recovered_total",
+		Help: "Total number of panics in HTTP handlers answered with 500",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(suppressedErrorLogsTotal, recoveredPanicsTotal)
+}
+
+const errorLogMaxEntries = 1000
+
+// variableParts are the parts of an error message that change between
+// occurrences of the same error: quoted strings, addresses and numbers.
+var variableParts = regexp.MustCompile(`"[^"]*"|'[^']*'|\[[0-9a-f:.]+\]:\d+|\d+(\.\d+)*`)
+
+// errorEntry is one group of errors with the same fingerprint.
+type errorEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	Site        string    `json:"site"`
+	Message     string    `json:"message"`
+	Count       uint64    `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+
+	reportedAt time.Time
+	suppressed uint64
+}
+
+// errorLog groups repeated errors by fingerprint, the code location that
+// reported them plus the message with its variable parts removed. The first
+// error of a group is logged at error level; repeats within
+// ERROR_DEDUP_WINDOW are only counted, and logged when LOG_LEVEL is debug,
+// so a long upstream outage does not flood the log. Once the window has
+// passed the next repeat is logged at error level again with the number of
+// repeats in between.
+type errorLog struct {
+	mu      sync.Mutex
+	entries map[string]*errorEntry
+}
+
+var errorsSeen = &errorLog{entries: make(map[string]*errorEntry)}
+
+// logError logs an error through errorsSeen, fingerprinted by the caller's
+// location.
+func logError(format string, args ...any) {
+	_, file, line, _ := runtime.Caller(1)
+	errorsSeen.Log(fmt.Sprintf("%s:%d", filepath.Base(file), line), "", format, args...)
+}
+
+func debugLogging() bool {
+	return runningConfig().LogLevel == "debug"
+}
+
+func errorFingerprint(site, message string) string {
+	h := fnv.New64a()
+	h.Write([]byte(site))
+	h.Write([]byte{0})
+	h.Write([]byte(variableParts.ReplaceAllString(message, "_")))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Log records one error reported at site. detail, such as a stack trace, is
+// only written when the error is logged at error level.
+func (l *errorLog) Log(site, detail, format string, args ...any) {
+	message := redactSecrets(fmt.Sprintf(format, args...))
+	detail = redactSecrets(detail)
+	fingerprint := errorFingerprint(site, message)
+	now := time.Now()
+
+	l.mu.Lock()
+	entry, ok := l.entries[fingerprint]
+	if !ok {
+		if len(l.entries) >= errorLogMaxEntries {
+			l.evictOldest()
+		}
+		entry = &errorEntry{Fingerprint: fingerprint, Site: site, Message: message, FirstSeen: now}
+		l.entries[fingerprint] = entry
+	}
+	entry.Count++
+	entry.LastSeen = now
+	report := !ok || now.Sub(entry.reportedAt) >= runningConfig().ErrorDedupWindow
+	suppressed, count := entry.suppressed, entry.Count
+	if report {
+		entry.reportedAt, entry.suppressed = now, 0
+	} else {
+		entry.suppressed++
+	}
+	l.mu.Unlock()
+
+	switch {
+	case report && suppressed > 0:
+		log.Printf("ERROR [%s] %s (repeated %d times since the last report)", fingerprint, message, suppressed)
+	case report:
+		log.Printf("ERROR [%s] %s", fingerprint, message)
+	default:
+		suppressedErrorLogsTotal.Inc()
+		if debugLogging() {
+			log.Printf("DEBUG [%s] %s (occurrence %d)", fingerprint, message, count)
+		}
+		return
+	}
+	if detail != "" {
+		log.Printf("ERROR [%s] %s", fingerprint, detail)
+	}
+}
+
+func (l *errorLog) evictOldest() {
+	var oldest *errorEntry
+	for _, entry := range l.entries {
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	delete(l.entries, oldest.Fingerprint)
+}
+
+// Entries returns the error groups, most frequent first.
+func (l *errorLog) Entries() []errorEntry {
+	l.mu.Lock()
+	entries := make([]errorEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, *entry)
+	}
+	l.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	return entries
+}
+
+// panicSite is the location of the code that panicked: the first frame
+// outside the runtime above the deferred recover.
+func panicSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	panicking := false
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			panicking = true
+		} else if panicking && !strings.HasPrefix(frame.Function, "runtime.") {
+			return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// recoveryMiddleware answers requests whose handler panicked with a 500
+// problem instead of dropping the connection. Panics are fingerprinted by the
+// panicking line, so a handler that fails on every request logs its stack
+// once per ERROR_DEDUP_WINDOW. With SENTRY_DSN panics are also reported
+// there.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			recoveredPanicsTotal.Inc()
+			errorsSeen.Log(panicSite(), string(debug.Stack()), "panic serving %s %s: %v", r.Method, r.URL.Path, p)
+			r = reportPanic(r, p)
+			writeProblem(w, r, http.StatusInternalServerError, "request.internal_error")
+			httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "500").Inc()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorsHandler lists the fingerprinted error groups with their counts.
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(errorsSeen.Entries())
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,49 @@
+package main
+
+import "strings"
+
+// fieldSet is a parsed "fields" query parameter. Dotted names select nested
+// fields ("display.temperature"); inside arrays they apply to every element
+// ("points.timestamp").
+type fieldSet map[string]fieldSet
+
+func parseFields(raw string) (fieldSet, bool) {
+	fields := fieldSet{}
+	for _, name := range strings.Split(raw, ",") {
+		node := fields
+		for _, part := range strings.Split(strings.TrimSpace(name), ".") {
+			if part == "" {
+				return nil, false
+			}
+			if node[part] == nil {
+				node[part] = fieldSet{}
+			}
+			node = node[part]
+		}
+	}
+	return fields, true
+}
+
+// project keeps only the selected fields of a decoded JSON value. A field
+// without sub-selections is kept whole; unknown names are ignored.
+func (f fieldSet) project(v any) any {
+	if len(f) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(f))
+		for name, sub := range f {
+			if value, ok := v[name]; ok {
+				out[name] = sub.project(value)
+			}
+		}
+		return out
+	case []any:
+		for i := range v {
+			v[i] = f.project(v[i])
+		}
+		return v
+	}
+	return v
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var forecastFetchesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "forecast_fetches_total",
+		Help: "Total number of forecast fetches for forecast change subscriptions by status",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(forecastFetchesTotal)
+}
+
+// forecastDays is how far ahead the OpenWeatherMap 5 day / 3 hour forecast
+// reaches, counting today as day 0.
+const forecastDays = 5
+
+// DayForecast summarises the forecast for one local calendar day.
+type DayForecast struct {
+	Date            string  `json:"date"`
+	MinTemperature  float64 `json:"min_temperature"`
+	MaxTemperature  float64 `json:"max_temperature"`
+	RainProbability float64 `json:"rain_probability"`
+}
+
+// ForecastStep is one 3 hour step of the forecast, starting at Time.
+type ForecastStep struct {
+	Time            time.Time
+	Temperature     float64
+	WindSpeed       float64
+	RainProbability float64
+}
+
+// forecastStep is the length of a ForecastStep.
+const forecastStep = 3 * time.Hour
+
+// Forecast is the forecast of a city, step by step and folded into days.
+// TimezoneOffset is the city's offset from UTC in seconds, which decides
+// where its days begin. Latitude and Longitude are where the provider placed
+// the city, nil for the demo forecast.
+type Forecast struct {
+	City string
+	// Provider is the source of the forecast, empty for the demo forecast.
+	Provider            string
+	TimezoneOffset      int
+	Latitude, Longitude *float64
+	Steps               []ForecastStep
+	Days                []DayForecast
+}
+
+type cachedForecast struct {
+	forecast  Forecast
+	fetchedAt time.Time
+}
+
+// forecastCache keeps forecasts for FORECAST_CACHE_TTL, since OpenWeatherMap
+// only recomputes them every three hours.
+var forecastCache = newLRUCache[string, cachedForecast]("forecasts", maxCachedCities)
+
+// Date returns the local date daysAhead days from now in the forecast's city.
+func (f Forecast) Date(now time.Time, daysAhead int) string {
+	return now.UTC().Add(time.Duration(f.TimezoneOffset)*time.Second).AddDate(0, 0, daysAhead).Format("2006-01-02")
+}
+
+// Day returns the forecast for date.
+func (f Forecast) Day(date string) (DayForecast, bool) {
+	for _, day := range f.Days {
+		if day.Date == date {
+			return day, true
+		}
+	}
+	return DayForecast{}, false
+}
+
+// getForecast returns the forecast of city from the cache or, when missing
+// or older than FORECAST_CACHE_TTL, from OpenWeatherMap.
+func getForecast(city string) (Forecast, error) {
+	key := strings.ToLower(city)
+	cached, ok := forecastCache.Get(key)
+	if ok && time.Since(cached.fetchedAt) < runningConfig().ForecastCacheTTL {
+		return cached.forecast, nil
+	}
+
+	forecast, err := fetchForecast(city)
+	if err != nil {
+		return Forecast{}, err
+	}
+	forecastCache.Set(key, cachedForecast{forecast: forecast, fetchedAt: time.Now()})
+	forecastAccuracy.Record(forecast, time.Now())
+	return forecast, nil
+}
+
+// forecastSupported reports whether the configured provider has forecasts;
+// only OpenWeatherMap does.
+func forecastSupported() bool {
+	return runningConfig().WeatherProvider == "openweathermap"
+}
+
+// fetchForecast fetches the OpenWeatherMap 5 day / 3 hour forecast and folds
+// the steps into local days: the lowest minimum, the highest maximum and the
+// highest precipitation probability of the day. Without WEATHER_API_KEY it
+// returns a flat demo forecast.
+func fetchForecast(city string) (Forecast, error) {
+	apiKey := runningConfig().WeatherAPIKey
+	if apiKey == "" {
+		forecast := Forecast{City: city}
+		start := time.Now().UTC().Truncate(forecastStep)
+		for i := 0; i < forecastDays*8; i++ {
+			forecast.Steps = append(forecast.Steps, ForecastStep{Time: start.Add(time.Duration(i) * forecastStep), Temperature: 15, WindSpeed: 3})
+		}
+		for i := 0; i < forecastDays; i++ {
+			date := forecast.Date(time.Now(), i)
+			forecast.Days = append(forecast.Days, DayForecast{Date: date, MinTemperature: 10, MaxTemperature: 15})
+		}
+		return forecast, nil
+	}
+
+	params := url.Values{"appid": {apiKey}, "units": {"metric"}}
+	if code, country, ok := splitZip(city); ok {
+		if country != "" {
+			code += "," + country
+		}
+		params.Set("zip", code)
+	} else if c, ok := cities.Lookup(city); ok {
+		params.Set("lat", strconv.FormatFloat(c.Latitude, 'g', -1, 64))
+		params.Set("lon", strconv.FormatFloat(c.Longitude, 'g', -1, 64))
+	} else {
+		params.Set("q", city)
+	}
+
+	if wait := owmQuota.Reserve(); wait > 0 {
+		upstreamThrottledTotal.Inc()
+		return Forecast{}, &QuotaError{RetryAfter: wait}
+	}
+	upstreamCallsTotal.Inc()
+
+	resp, err := upstreamGet(context.Background(), weatherClient, openWeatherBaseURL()+"/data/2.5/forecast?"+params.Encode())
+	if err != nil {
+		return Forecast{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest:
+		return Forecast{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := retryAfterHeader(resp)
+		owmQuota.Block(wait)
+		return Forecast{}, &QuotaError{RetryAfter: wait}
+	case resp.StatusCode != http.StatusOK:
+		return Forecast{}, fmt.Errorf("%w: forecast API returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	var body struct {
+		List []struct {
+			Dt   int64 `json:"dt"`
+			Main struct {
+				Temp    float64 `json:"temp"`
+				TempMin float64 `json:"temp_min"`
+				TempMax float64 `json:"temp_max"`
+			} `json:"main"`
+			Wind struct {
+				Speed float64 `json:"speed"`
+			} `json:"wind"`
+			Pop float64 `json:"pop"`
+		} `json:"list"`
+		City struct {
+			Timezone int `json:"timezone"`
+			Coord    *struct {
+				Lat float64 `json:"lat"`
+				Lon float64 `json:"lon"`
+			} `json:"coord"`
+		} `json:"city"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&body); err != nil {
+		return Forecast{}, fmt.Errorf("%w: invalid forecast response: %v", ErrProviderUnavailable, err)
+	}
+
+	forecast := Forecast{City: city, Provider: "openweathermap", TimezoneOffset: body.City.Timezone}
+	if c := body.City.Coord; c != nil {
+		forecast.Latitude, forecast.Longitude = &c.Lat, &c.Lon
+	}
+	for _, step := range body.List {
+		forecast.Steps = append(forecast.Steps, ForecastStep{
+			Time:            time.Unix(step.Dt, 0).UTC(),
+			Temperature:     step.Main.Temp,
+			WindSpeed:       step.Wind.Speed,
+			RainProbability: math.Round(step.Pop * 100),
+		})
+		date := time.Unix(step.Dt+int64(body.City.Timezone), 0).UTC().Format("2006-01-02")
+		n := len(forecast.Days)
+		if n == 0 || forecast.Days[n-1].Date != date {
+			forecast.Days = append(forecast.Days, DayForecast{Date: date, MinTemperature: math.Inf(1), MaxTemperature: math.Inf(-1)})
+			n++
+		}
+		day := &forecast.Days[n-1]
+		day.MinTemperature = math.Min(day.MinTemperature, step.Main.TempMin)
+		day.MaxTemperature = math.Max(day.MaxTemperature, step.Main.TempMax)
+		day.RainProbability = math.Max(day.RainProbability, math.Round(step.Pop*100))
+	}
+	return forecast, nil
+}
+
+// parseForecastDay validates the day of a forecast change subscription: a
+// date such as "2026-10-18" or "+N" for N days ahead of the current day.
+func parseForecastDay(day string) bool {
+	if offset, ok := strings.CutPrefix(day, "+"); ok {
+		n, err := strconv.Atoi(offset)
+		return err == nil && n >= 0 && n < forecastDays
+	}
+	_, err := time.Parse("2006-01-02", day)
+	return err == nil
+}
+
+// forecastWake asks the forecast job to fetch now, so a new subscription
+// gets its baseline without waiting for the next scheduled run.
+var forecastWake = make(chan struct{}, 1)
+
+// refreshForecasts fetches the forecast of every city with forecast change
+// subscriptions or in FORECAST_ACCURACY_CITIES and hands it to the webhook
+// store, which compares it with what each subscriber was last told.
+func refreshForecasts() error {
+	cities := webhooks.ForecastCities()
+	for _, city := range accuracyCities() {
+		if !slices.ContainsFunc(cities, func(c string) bool { return strings.EqualFold(c, city) }) {
+			cities = append(cities, city)
+		}
+	}
+	return forEachCity("forecast", cities, func(city string) error {
+		forecast, err := getForecast(city)
+		if err != nil {
+			forecastFetchesTotal.WithLabelValues("error").Inc()
+			return err
+		}
+		forecastFetchesTotal.WithLabelValues("success").Inc()
+		webhooks.NotifyForecast(forecast, time.Now())
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type unitSystem string
+
+const (
+	unitsMetric   unitSystem = "metric"
+	unitsImperial unitSystem = "imperial"
+)
+
+// requestUnits reads the ?units= parameter, defaulting to metric.
+func requestUnits(r *http.Request) (unitSystem, bool) {
+	switch units := unitSystem(strings.ToLower(r.URL.Query().Get("units"))); units {
+	case "":
+		return unitsMetric, true
+	case unitsMetric, unitsImperial:
+		return units, true
+	default:
+		return "", false
+	}
+}
+
+// decimalCommaLanguages lists the languages that write 3,5 rather than 3.5.
+var decimalCommaLanguages = map[string]bool{
+	"ru": true, "uk": true, "be": true, "kk": true, "de": true, "fr": true,
+	"es": true, "it": true, "pt": true, "nl": true, "pl": true, "cs": true,
+	"sk": true, "sv": true, "fi": true, "nb": true, "da": true, "tr": true,
+}
+
+// requestLocale returns the base language used to format display values:
+// ?lang= wins over Accept-Language, and English is the default.
+func requestLocale(r *http.Request) string {
+	langs := acceptedLanguages(r.Header.Get("Accept-Language"))
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		langs = []string{strings.ToLower(lang)}
+	}
+	if len(langs) == 0 {
+		return defaultLanguage
+	}
+	base, _, _ := strings.Cut(langs[0], "-")
+	return base
+}
+
+func formatNumber(v float64, decimals int, lang string) string {
+	s := strconv.FormatFloat(v, 'f', decimals, 64)
+	if s == "-"+strconv.FormatFloat(0, 'f', decimals, 64) {
+		s = s[1:]
+	}
+	if decimalCommaLanguages[lang] {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	// A non-breaking hyphen keeps the sign attached to the number when a
+	// display wraps lines.
+	return strings.Replace(s, "-", "‑", 1)
+}
+
+func formatTemperature(value float64, units unitSystem, lang string) string {
+	unit := "°C"
+	if units == unitsImperial {
+		unit = "°F"
+	}
+	return formatNumber(value, 1, lang) + " " + unit
+}
+
+// weatherLang is WEATHER_LANG, the language asked of providers and used for
+// descriptions when a request does not name one.
+func weatherLang() string {
+	return strings.ToLower(runningConfig().WeatherLang)
+}
+
+// descriptionLanguage is the language of condition descriptions for r:
+// ?lang= or Accept-Language when given, WEATHER_LANG otherwise.
+func descriptionLanguage(r *http.Request) string {
+	if r.URL.Query().Get("lang") == "" && r.Header.Get("Accept-Language") == "" {
+		return weatherLang()
+	}
+	return requestLocale(r)
+}
+
+// conditionKey finds the catalog key describing code in lang: the code
+// itself or its group, as in "condition.5xx".
+func conditionKey(lang string, code int) (string, bool) {
+	if code == 0 {
+		return "", false
+	}
+	for _, key := range []string{"condition." + strconv.Itoa(code), "condition." + strconv.Itoa(code/100) + "xx"} {
+		if _, ok := messageCatalogs[lang][key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// conditionDescription describes the conditions in lang. The provider's own
+// wording is used when it is in that language; otherwise the message
+// catalogs translate the condition code, and as a last resort the provider
+// wording or the English description is returned.
+func conditionDescription(lang string, observation Observation) string {
+	if observation.Description != "" && observation.DescriptionLang == lang {
+		return observation.Description
+	}
+	if key, ok := conditionKey(lang, observation.ConditionCode); ok {
+		return localize(lang, key)
+	}
+	if observation.Description != "" {
+		return observation.Description
+	}
+	if key, ok := conditionKey(defaultLanguage, observation.ConditionCode); ok {
+		return localize(defaultLanguage, key)
+	}
+	return ""
+}
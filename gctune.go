@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSettings uses the syntax of the GOGC and GOMEMLIMIT environment
+// variables: "off" or a percentage, and "off" or a byte count with an
+// optional B, KiB, MiB, GiB or TiB suffix.
+type GCSettings struct {
+	GOGC       string `json:"gogc,omitempty"`
+	GOMEMLIMIT string `json:"gomemlimit,omitempty"`
+}
+
+// GCStatus reports the active settings together with the heap, so the
+// effect of a change can be judged without a profiler.
+type GCStatus struct {
+	GCSettings
+	HeapAllocBytes   uint64  `json:"heap_alloc_bytes"`
+	HeapSysBytes     uint64  `json:"heap_sys_bytes"`
+	HeapObjects      uint64  `json:"heap_objects"`
+	NextGCBytes      uint64  `json:"next_gc_bytes"`
+	NumGC            uint32  `json:"num_gc"`
+	LastPauseSeconds float64 `json:"last_pause_seconds"`
+	GCCPUFraction    float64 `json:"gc_cpu_fraction"`
+}
+
+var gcMu sync.Mutex
+
+var memLimitUnits = []struct {
+	suffix string
+	size   int64
+}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+
+func parseGOGC(v string) (int, error) {
+	if v == "off" {
+		return -1, nil
+	}
+	percent, err := strconv.Atoi(v)
+	if err != nil || percent < 0 {
+		return 0, fmt.Errorf("invalid gogc %q, expected \"off\" or a non-negative percentage", v)
+	}
+	return percent, nil
+}
+
+func parseMemoryLimit(v string) (int64, error) {
+	if v == "off" {
+		return math.MaxInt64, nil
+	}
+	number, size := v, int64(1)
+	for _, unit := range memLimitUnits {
+		if strings.HasSuffix(v, unit.suffix) {
+			number, size = strings.TrimSuffix(v, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/size {
+		return 0, fmt.Errorf("invalid gomemlimit %q, expected \"off\" or a size such as \"512MiB\"", v)
+	}
+	return n * size, nil
+}
+
+func formatMemoryLimit(limit int64) string {
+	if limit == math.MaxInt64 {
+		return "off"
+	}
+	for _, unit := range memLimitUnits {
+		if limit >= unit.size && limit%unit.size == 0 {
+			return strconv.FormatInt(limit/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// currentGCStatus must be called with gcMu held: reading GOGC means setting it.
+func currentGCStatus() GCStatus {
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+	gogc := "off"
+	if percent >= 0 {
+		gogc = strconv.Itoa(percent)
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return GCStatus{
+		GCSettings:       GCSettings{GOGC: gogc, GOMEMLIMIT: formatMemoryLimit(debug.SetMemoryLimit(-1))},
+		HeapAllocBytes:   m.HeapAlloc,
+		HeapSysBytes:     m.HeapSys,
+		HeapObjects:      m.HeapObjects,
+		NextGCBytes:      m.NextGC,
+		NumGC:            m.NumGC,
+		LastPauseSeconds: time.Duration(m.PauseNs[(m.NumGC+255)%256]).Seconds(),
+		GCCPUFraction:    m.GCCPUFraction,
+	}
+}
+
+func gcStatusHandler(w http.ResponseWriter, r *http.Request) {
+	gcMu.Lock()
+	status := currentGCStatus()
+	gcMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// gcTuneHandler changes GOGC and/or GOMEMLIMIT of the running process. With
+// ?collect=true a collection is forced afterwards so the reported heap
+// reflects the new settings. Changes are lost on restart.
+func gcTuneHandler(w http.ResponseWriter, r *http.Request) {
+	var settings GCSettings
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&settings); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_gc_settings", err)
+		return
+	}
+	percent, limit := 0, int64(0)
+	var err error
+	if settings.GOGC != "" {
+		if percent, err = parseGOGC(settings.GOGC); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_gc_settings", err)
+			return
+		}
+	}
+	if settings.GOMEMLIMIT != "" {
+		if limit, err = parseMemoryLimit(settings.GOMEMLIMIT); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "admin.invalid_gc_settings", err)
+			return
+		}
+	}
+
+	gcMu.Lock()
+	if settings.GOGC != "" {
+		debug.SetGCPercent(percent)
+	}
+	if settings.GOMEMLIMIT != "" {
+		debug.SetMemoryLimit(limit)
+	}
+	if r.URL.Query().Get("collect") == "true" {
+		runtime.GC()
+	}
+	status := currentGCStatus()
+	gcMu.Unlock()
+	log.Printf("GC settings changed: GOGC=%s GOMEMLIMIT=%s", status.GOGC, status.GOMEMLIMIT)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var geocodeLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "geocode_lookups_total",
+		Help: "Total number of city name lookups through the provider geocoding API by source (cache or api)",
+	},
+	[]string{"source"},
+)
+
+func init() {
+	prometheus.MustRegister(geocodeLookupsTotal)
+}
+
+const (
+	// geocodeLimit is the most results the OpenWeatherMap geocoding API
+	// returns for one query.
+	geocodeLimit = 5
+)
+
+var errGeocoderUnavailable = errors.New("geocoding needs WEATHER_API_KEY")
+
+type geocodeEntry struct {
+	cities  []City
+	expires time.Time
+}
+
+// owmGeocoder resolves city names through the OpenWeatherMap geocoding API,
+// for instances running without the offline city catalog. Answers, including
+// empty ones, are cached for GEOCODE_CACHE_TTL since city names rarely move
+// and every lookup counts against the same quota as weather requests.
+type owmGeocoder struct {
+	entries *lruCache[string, geocodeEntry]
+}
+
+var geocoder = &owmGeocoder{entries: newLRUCache[string, geocodeEntry]("geocode", maxCachedCities)}
+
+// Search returns up to limit (at most geocodeLimit) cities matching query.
+func (g *owmGeocoder) Search(query string, limit int) ([]City, error) {
+	apiKey := runningConfig().WeatherAPIKey
+	if apiKey == "" {
+		return nil, errGeocoderUnavailable
+	}
+	key := normalizeCityName(query)
+
+	entry, ok := g.entries.Get(key)
+	if ok && time.Now().Before(entry.expires) {
+		geocodeLookupsTotal.WithLabelValues("cache").Inc()
+		return firstCities(entry.cities, limit), nil
+	}
+
+	if wait := owmQuota.Reserve(); wait > 0 {
+		upstreamThrottledTotal.Inc()
+		return nil, &QuotaError{RetryAfter: wait}
+	}
+	upstreamCallsTotal.Inc()
+	geocodeLookupsTotal.WithLabelValues("api").Inc()
+
+	params := url.Values{"q": {query}, "limit": {strconv.Itoa(geocodeLimit)}, "appid": {apiKey}}
+	resp, err := upstreamGet(context.Background(), weatherClient, openWeatherBaseURL()+"/geo/1.0/direct?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := retryAfterHeader(resp)
+		owmQuota.Block(wait)
+		return nil, &QuotaError{RetryAfter: wait}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: geocoding API returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	var places []struct {
+		Name    string  `json:"name"`
+		Country string  `json:"country"`
+		Lat     float64 `json:"lat"`
+		Lon     float64 `json:"lon"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&places); err != nil {
+		return nil, fmt.Errorf("%w: invalid geocoding response: %v", ErrProviderUnavailable, err)
+	}
+	found := make([]City, 0, len(places))
+	for _, p := range places {
+		found = append(found, City{Name: p.Name, Country: p.Country, Latitude: p.Lat, Longitude: p.Lon})
+	}
+
+	g.entries.Set(key, geocodeEntry{cities: found, expires: time.Now().Add(runningConfig().GeocodeCacheTTL)})
+	return firstCities(found, limit), nil
+}
+
+func firstCities(found []City, limit int) []City {
+	if len(found) > limit {
+		return found[:limit]
+	}
+	return found
+}
+
+// zipPrefix marks locations given as a postal code with ?zip= rather than a
+// city name. They travel through the cache, history and shard ring as
+// "zip:<code>[,<country>]".
+const zipPrefix = "zip:"
+
+// zipPattern matches a postal code with an optional ISO 3166 country code,
+// as in "10115,de" or "SW1A 1AA,GB".
+var zipPattern = regexp.MustCompile(`^([0-9A-Za-z][0-9A-Za-z -]{1,9})(?:,\s*([A-Za-z]{2}))?$`)
+
+// zipLocation turns a ?zip= value into its location key.
+func zipLocation(zip string) (string, bool) {
+	m := zipPattern.FindStringSubmatch(strings.TrimSpace(zip))
+	if m == nil {
+		return "", false
+	}
+	location := zipPrefix + strings.ToUpper(strings.TrimSpace(m[1]))
+	if m[2] != "" {
+		location += "," + strings.ToUpper(m[2])
+	}
+	return location, true
+}
+
+// splitZip returns the postal code and country of a location key made by
+// zipLocation. The country is empty when the request gave none.
+func splitZip(location string) (code, country string, ok bool) {
+	rest, ok := strings.CutPrefix(location, zipPrefix)
+	if !ok {
+		return "", "", false
+	}
+	code, country, _ = strings.Cut(rest, ",")
+	return code, country, true
+}
+
+// locationLabel is a location key as shown to people: "10115, DE" for
+// postal codes and the name itself for cities.
+func locationLabel(location string) string {
+	if code, country, ok := splitZip(location); ok {
+		if country != "" {
+			return code + ", " + country
+		}
+		return code
+	}
+	return location
+}
+
+// requestCity reads the location of a request from ?zip= or ?city=,
+// defaulting to WEATHER_CITY. It writes a 400 problem and reports false for
+// malformed values.
+func requestCity(w http.ResponseWriter, r *http.Request) (string, bool) {
+	q := r.URL.Query()
+	city, zip := q.Get("city"), q.Get("zip")
+	switch {
+	case zip != "" && city != "":
+		writeProblem(w, r, http.StatusBadRequest, "request.city_and_zip")
+		return "", false
+	case zip != "":
+		location, ok := zipLocation(zip)
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, "request.invalid_zip", zip)
+		}
+		return location, ok
+	case city == "":
+		return weatherCity(), true
+	case !validCityName(city) || strings.HasPrefix(strings.ToLower(city), zipPrefix):
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_city", city)
+		return "", false
+	}
+	return city, true
+}
+
+// validCityName rejects city parameters that no provider could resolve:
+// empty, overlong or containing control characters.
+func validCityName(name string) bool {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		return false
+	}
+	return !strings.ContainsFunc(name, unicode.IsControl)
+}
+
+// searchCities serves city name prefixes from the catalog when it is loaded
+// and from the provider's geocoding API otherwise.
+func searchCities(prefix string, limit int) ([]City, error) {
+	if cities.Loaded() {
+		return cities.Search(prefix, limit), nil
+	}
+	return geocoder.Search(prefix, min(limit, geocodeLimit))
+}
+
+// citySuggestions offers known cities for a name the provider did not
+// recognise, trying ever shorter beginnings of the name down to three
+// letters so "Moscw" still suggests Moscow. The geocoding API is only asked
+// once, for the full name, to spare the quota.
+func citySuggestions(name string) []City {
+	if _, _, ok := splitZip(name); ok {
+		return nil
+	}
+	name, _, _ = strings.Cut(name, ",")
+	name = strings.TrimSpace(name)
+	if !cities.Loaded() {
+		found, _ := geocoder.Search(name, geocodeLimit)
+		return found
+	}
+	for n := utf8.RuneCountInString(name); n >= 3; n-- {
+		if found := cities.Search(string([]rune(name)[:n]), geocodeLimit); len(found) > 0 {
+			return found
+		}
+	}
+	return nil
+}
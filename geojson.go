@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const contentTypeGeoJSON = "application/geo+json"
+
+// GeoJSON types (RFC 7946) for ?format=geojson. Only Point geometries are
+// produced; a feature whose position is unknown has a null geometry.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string        `json:"type"`
+	Geometry   *GeoJSONPoint `json:"geometry"`
+	Properties any           `json:"properties"`
+}
+
+type GeoJSONPoint struct {
+	Type string `json:"type"`
+	// Coordinates are longitude, latitude in this order.
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// newGeoJSONFeature returns a feature at lat, lon, or without geometry when
+// either is nil.
+func newGeoJSONFeature(lat, lon *float64, properties any) GeoJSONFeature {
+	feature := GeoJSONFeature{Type: "Feature", Properties: properties}
+	if lat != nil && lon != nil {
+		feature.Geometry = &GeoJSONPoint{Type: "Point", Coordinates: [2]float64{*lon, *lat}}
+	}
+	return feature
+}
+
+// requestGeoJSON reports whether the request asks for ?format=geojson;
+// "json" and no format select the regular response. Other formats are
+// answered with a problem and ok false.
+func requestGeoJSON(w http.ResponseWriter, r *http.Request) (geojson, ok bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return false, true
+	case "geojson":
+		return true, true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_format", format)
+		return false, false
+	}
+}
+
+// writeGeoJSON answers with a feature collection. GeoJSON is always JSON,
+// regardless of the Accept header and ?fields=.
+func writeGeoJSON(w http.ResponseWriter, r *http.Request, features []GeoJSONFeature) {
+	if features == nil {
+		features = []GeoJSONFeature{}
+	}
+	w.Header().Set("Content-Type", contentTypeGeoJSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -5,12 +5,16 @@ go 1.21
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/prometheus/client_golang v1.19.0
+	github.com/prometheus/client_model v0.5.0
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/image v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
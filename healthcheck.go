@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// runHealthcheckCommand implements "weather-app healthcheck": a GET of
+// /healthz, or /readyz with "ready", on the server of this configuration,
+// exiting 0 on 200 and 1 otherwise. It lets container images probe the
+// service without curl or wget.
+func runHealthcheckCommand(args []string, stdout, stderr io.Writer) int {
+	path := "/healthz"
+	switch {
+	case len(args) == 1 && args[0] == "ready":
+		path = "/readyz"
+	case len(args) > 0:
+		fmt.Fprintln(stderr, "usage: weather-app healthcheck [ready]")
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid config file:\n%v\n", err)
+		return 1
+	}
+
+	client, url := healthcheckTarget(cfg, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := upstreamGet(ctx, client, url)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "%s: %s\n", url, resp.Status)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: %s\n", url, resp.Status)
+	return 0
+}
+
+// healthcheckTarget returns the client and URL reaching path on the local
+// server: over LISTEN_SOCKET, or over TCP on HTTP_LISTEN or PORT with
+// wildcard hosts replaced by loopback.
+func healthcheckTarget(cfg *Config, path string) (*http.Client, string) {
+	if socket := cfg.ListenSocket; socket != "" {
+		transport := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}}
+		return &http.Client{Transport: transport}, "http://localhost" + path
+	}
+	host, port, err := net.SplitHostPort(httpListenAddr(cfg))
+	if err != nil {
+		host, port = "", "8080"
+	}
+	switch ip := net.ParseIP(host); {
+	case host == "" || (ip != nil && ip.Equal(net.IPv4zero)):
+		host = "127.0.0.1"
+	case ip != nil && ip.Equal(net.IPv6unspecified):
+		host = "::1"
+	}
+	return &http.Client{}, "http://" + net.JoinHostPort(host, port) + path
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var historyPrunedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "history_pruned_points_total",
+		Help: "Total number of history points removed by the retention janitor",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(historyPrunedTotal)
+}
+
+// HistoryPoint is a single temperature observation kept in the history store.
+// Invalidated points stay stored, with their edits, but are left out of every
+// query, statistic and rollup.
+type HistoryPoint struct {
+	ID          uint64        `json:"id"`
+	City        string        `json:"city"`
+	Temperature float64       `json:"temperature"`
+	Timestamp   time.Time     `json:"timestamp"`
+	Invalidated bool          `json:"invalidated,omitempty"`
+	Edits       []HistoryEdit `json:"edits,omitempty"`
+}
+
+// HistoryEdit is one entry of the audit trail of a history point.
+type HistoryEdit struct {
+	Action   string    `json:"action"`
+	Previous *float64  `json:"previous,omitempty"`
+	Value    *float64  `json:"value,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Actor    string    `json:"actor"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// Store keeps the observation history. HISTORY_STORE selects the backend:
+// historyStore in memory or boltStore on disk.
+type Store interface {
+	Add(city string, temperature float64, at time.Time) HistoryPoint
+	Query(city string, from, to time.Time) []HistoryPoint
+	Range(from, to time.Time) []HistoryPoint
+	Scan(from, to time.Time, keep func(HistoryPoint) bool) []HistoryPoint
+	Edit(match func(HistoryPoint) bool, fn func(*HistoryPoint) bool) []HistoryPoint
+	Prune(cutoff time.Time) int
+	Snapshot() []HistoryPoint
+	Restore(points []HistoryPoint)
+}
+
+// historyStore keeps observations in memory ordered by timestamp.
+type historyStore struct {
+	mu     sync.RWMutex
+	nextID uint64
+	points []HistoryPoint
+}
+
+var history Store = &historyStore{}
+
+// Add stores an observation and, when the store holds more than
+// HISTORY_MAX_POINTS, drops the oldest points.
+func (h *historyStore) Add(city string, temperature float64, at time.Time) HistoryPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	point := HistoryPoint{ID: h.nextID, City: city, Temperature: temperature, Timestamp: at}
+
+	// Observations almost always arrive in order; only fall back to a
+	// sorted insert for the rare late one.
+	i := len(h.points)
+	if i > 0 && at.Before(h.points[i-1].Timestamp) {
+		i = sort.Search(len(h.points), func(j int) bool { return h.points[j].Timestamp.After(at) })
+	}
+	h.points = append(h.points, HistoryPoint{})
+	copy(h.points[i+1:], h.points[i:])
+	h.points[i] = point
+
+	excess := len(h.points) - runningConfig().HistoryMaxPoints
+	if excess <= 0 {
+		return point
+	}
+	// Points sharing the timestamp of the last dropped one go too, so that
+	// the cutoff is a plain timestamp.
+	cutoff := h.points[excess-1].Timestamp.Add(time.Nanosecond)
+	// Unlike Prune this runs on every addition at the cap, so the prefix is
+	// only resliced away; append releases it when it next grows the slice.
+	n := sort.Search(len(h.points), func(j int) bool { return !h.points[j].Timestamp.Before(cutoff) })
+	h.points = h.points[n:]
+	memoryEvictionsTotal.WithLabelValues("history").Add(float64(n))
+	return point
+}
+
+// Query returns the observations for city with from <= timestamp < to.
+func (h *historyStore) Query(city string, from, to time.Time) []HistoryPoint {
+	return h.filter(from, to, func(p HistoryPoint) bool { return strings.EqualFold(p.City, city) })
+}
+
+// Range returns the observations of every city with from <= timestamp < to.
+func (h *historyStore) Range(from, to time.Time) []HistoryPoint {
+	return h.filter(from, to, func(HistoryPoint) bool { return true })
+}
+
+func (h *historyStore) filter(from, to time.Time, keep func(HistoryPoint) bool) []HistoryPoint {
+	return h.Scan(from, to, func(p HistoryPoint) bool { return !p.Invalidated && keep(p) })
+}
+
+// Scan is filter without the exclusion of invalidated points.
+func (h *historyStore) Scan(from, to time.Time, keep func(HistoryPoint) bool) []HistoryPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	start := sort.Search(len(h.points), func(i int) bool { return !h.points[i].Timestamp.Before(from) })
+	var result []HistoryPoint
+	for _, p := range h.points[start:] {
+		if !p.Timestamp.Before(to) {
+			break
+		}
+		if keep(p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Edit applies fn to every stored point accepted by match, invalidated ones
+// included, and returns copies of the points fn changed. fn reports whether
+// it changed the point.
+func (h *historyStore) Edit(match func(HistoryPoint) bool, fn func(*HistoryPoint) bool) []HistoryPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var edited []HistoryPoint
+	for i := range h.points {
+		if match(h.points[i]) && fn(&h.points[i]) {
+			edited = append(edited, h.points[i])
+		}
+	}
+	return edited
+}
+
+// Prune drops every observation older than cutoff and returns how many were
+// removed. The remaining points are copied into a fresh slice so the memory
+// held by the pruned prefix is actually released.
+func (h *historyStore) Prune(cutoff time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.Search(len(h.points), func(j int) bool { return !h.points[j].Timestamp.Before(cutoff) })
+	if i == 0 {
+		return 0
+	}
+	h.points = append([]HistoryPoint(nil), h.points[i:]...)
+	return i
+}
+
+// Snapshot returns a copy of every stored observation.
+func (h *historyStore) Snapshot() []HistoryPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]HistoryPoint(nil), h.points...)
+}
+
+// Restore replaces the stored observations. IDs are kept so that references
+// to them survive a migration; new observations continue after the highest.
+func (h *historyStore) Restore(points []HistoryPoint) {
+	points = append([]HistoryPoint(nil), points...)
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	var nextID uint64
+	for _, p := range points {
+		if p.ID > nextID {
+			nextID = p.ID
+		}
+	}
+
+	h.mu.Lock()
+	h.points = points
+	h.nextID = nextID
+	h.mu.Unlock()
+}
+
+// runHistoryJanitor enforces HISTORY_RETENTION (default 30d) in the
+// background.
+func runHistoryJanitor(cfg *Config) error {
+	retention := cfg.HistoryRetention
+
+	interval := retention / 24
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		for range backgroundTicks(interval) {
+			if n := history.Prune(time.Now().Add(-retention)); n > 0 {
+				historyPrunedTotal.Add(float64(n))
+				log.Printf("History janitor pruned %d observations older than %v", n, retention)
+			}
+			compactHistory()
+		}
+	}()
+	return nil
+}
+
+// parseWindow parses a Go duration, additionally accepting whole days ("7d").
+func parseWindow(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+type TemperatureStats struct {
+	City   string   `json:"city"`
+	Window string   `json:"window"`
+	Unit   string   `json:"unit"`
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Count  int      `json:"count"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Avg    *float64 `json:"avg,omitempty"`
+	StdDev *float64 `json:"stddev,omitempty"`
+}
+
+func computeStats(total Rollup, stats *TemperatureStats) {
+	stats.Count = total.Count
+	if total.Count == 0 {
+		return
+	}
+	min, max, avg, stddev := total.Min, total.Max, total.Avg(), total.StdDev()
+	stats.Min, stats.Max, stats.Avg, stats.StdDev = &min, &max, &avg, &stddev
+}
+
+func temperatureStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	windowParam := q.Get("window")
+	if windowParam == "" {
+		windowParam = "24h"
+	}
+	window, err := parseWindow(windowParam)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_window", windowParam)
+		return
+	}
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+	city := q.Get("city")
+	if city == "" {
+		city = weatherCity()
+	}
+
+	to := time.Now()
+	from := to.Add(-window)
+	stats := TemperatureStats{
+		City:   city,
+		Window: windowParam,
+		Unit:   "celsius",
+		From:   from.Format(time.RFC3339),
+		To:     to.Format(time.RFC3339),
+	}
+
+	// Long windows are served from the hourly rollups; the partial hour at
+	// the start of the window is dropped in that case.
+	var total Rollup
+	if autoResolution(window) == resolutionRaw {
+		for _, p := range history.Query(city, from, to) {
+			total.Add(p.Temperature)
+		}
+	} else {
+		for _, bucket := range rollups.Series(city, resolutionHourly, from, to) {
+			total.Merge(bucket)
+		}
+	}
+	computeStats(total, &stats)
+
+	if units == unitsImperial {
+		stats.Unit = "fahrenheit"
+		if stats.Count > 0 {
+			*stats.Min = celsiusToFahrenheit(*stats.Min)
+			*stats.Max = celsiusToFahrenheit(*stats.Max)
+			*stats.Avg = celsiusToFahrenheit(*stats.Avg)
+			*stats.StdDev = *stats.StdDev * 9 / 5
+		}
+	}
+
+	if !writeResponse(w, r, http.StatusOK, stats) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+type HistorySeries struct {
+	City       string          `json:"city"`
+	Window     string          `json:"window"`
+	Resolution string          `json:"resolution"`
+	Unit       string          `json:"unit"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Points     []HistorySample `json:"points"`
+}
+
+// HistorySample is either a raw observation or the aggregate of an hourly or
+// daily bucket, in which case Temperature is the bucket average.
+type HistorySample struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Temperature float64   `json:"temperature"`
+	Min         *float64  `json:"min,omitempty"`
+	Max         *float64  `json:"max,omitempty"`
+	Count       int       `json:"count,omitempty"`
+}
+
+func temperatureHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	windowParam := q.Get("window")
+	if windowParam == "" {
+		windowParam = "24h"
+	}
+	window, err := parseWindow(windowParam)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_window", windowParam)
+		return
+	}
+	resolution := q.Get("resolution")
+	switch resolution {
+	case "", "auto":
+		resolution = autoResolution(window)
+	case resolutionRaw, resolutionHourly, resolutionDaily:
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_resolution", resolution)
+		return
+	}
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+	city := q.Get("city")
+	if city == "" {
+		city = weatherCity()
+	}
+
+	convert := func(v float64) float64 { return v }
+	unit := "celsius"
+	if units == unitsImperial {
+		convert = celsiusToFahrenheit
+		unit = "fahrenheit"
+	}
+
+	to := time.Now()
+	from := to.Add(-window)
+	series := HistorySeries{
+		City:       city,
+		Window:     windowParam,
+		Resolution: resolution,
+		Unit:       unit,
+		From:       from.Format(time.RFC3339),
+		To:         to.Format(time.RFC3339),
+		Points:     []HistorySample{},
+	}
+	if resolution == resolutionRaw {
+		for _, p := range history.Query(city, from, to) {
+			series.Points = append(series.Points, HistorySample{Timestamp: p.Timestamp, Temperature: convert(p.Temperature)})
+		}
+	} else {
+		for _, bucket := range rollups.Series(city, resolution, from, to) {
+			min, max := convert(bucket.Min), convert(bucket.Max)
+			series.Points = append(series.Points, HistorySample{
+				Timestamp:   bucket.Start,
+				Temperature: convert(bucket.Avg()),
+				Min:         &min,
+				Max:         &max,
+				Count:       bucket.Count,
+			})
+		}
+	}
+
+	if !writeResponse(w, r, http.StatusOK, series) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiKeyRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_requests_total",
+			Help: "Total number of API requests admitted within the quota of an API key",
+		},
+		[]string{"key_id"},
+	)
+	apiKeyQuotaExceededTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_quota_exceeded_total",
+			Help: "Total number of API requests rejected because the daily or monthly quota of an API key is used up",
+		},
+		[]string{"key_id", "period"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiKeyRequestsTotal, apiKeyQuotaExceededTotal)
+}
+
+// keyQuota is the number of requests an API key may make per UTC day and
+// per UTC month; 0 is unlimited.
+type keyQuota struct {
+	daily, monthly int
+}
+
+// parseKeyQuotas parses API_KEY_QUOTAS: "<name>=<daily>/<monthly>" entries
+// separated by commas, where either limit may be left empty for none and
+// the name "*" sets the quota of keys without an entry of their own.
+func parseKeyQuotas(v string) (map[string]keyQuota, error) {
+	quotas := make(map[string]keyQuota)
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, limits, ok := strings.Cut(entry, "=")
+		daily, monthly, ok2 := strings.Cut(limits, "/")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("entry %q: want <name>=<daily>/<monthly>", entry)
+		}
+		var q keyQuota
+		for _, l := range []struct {
+			text  string
+			limit *int
+		}{{daily, &q.daily}, {monthly, &q.monthly}} {
+			if l.text = strings.TrimSpace(l.text); l.text == "" {
+				continue
+			}
+			n, err := strconv.Atoi(l.text)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("entry %q: limits must be positive integers", entry)
+			}
+			*l.limit = n
+		}
+		quotas[strings.TrimSpace(name)] = q
+	}
+	return quotas, nil
+}
+
+// quotaOf returns the quota of key from API_KEY_QUOTAS. Invalid
+// configuration is rejected at startup and by the config API, so a parse
+// error here means no quota.
+func quotaOf(key string) keyQuota {
+	quotas, _ := parseKeyQuotas(runningConfig().APIKeyQuotas)
+	if q, ok := quotas[key]; ok {
+		return q
+	}
+	return quotas["*"]
+}
+
+// keyUsage counts the requests of one key in the current UTC day and month.
+type keyUsage struct {
+	day, month           string
+	dayCount, monthCount int
+}
+
+// keyUsageTracker counts the requests of every API key. Counts are kept in
+// memory, so a restart grants every key its full quota again.
+type keyUsageTracker struct {
+	mu   sync.Mutex
+	keys map[string]*keyUsage
+}
+
+var apiKeyUsage = &keyUsageTracker{keys: make(map[string]*keyUsage)}
+
+// current returns the usage of key, reset when the day or month has
+// changed. The caller holds t.mu.
+func (t *keyUsageTracker) current(key string, now time.Time) *keyUsage {
+	day, month := now.UTC().Format(time.DateOnly), now.UTC().Format("2006-01")
+	u := t.keys[key]
+	if u == nil {
+		u = &keyUsage{}
+		t.keys[key] = u
+	}
+	if u.day != day {
+		u.day, u.dayCount = day, 0
+	}
+	if u.month != month {
+		u.month, u.monthCount = month, 0
+	}
+	return u
+}
+
+// Take counts a request of key unless it would exceed quota. Otherwise it
+// returns the exhausted period, "daily" or "monthly", and when it resets.
+func (t *keyUsageTracker) Take(key string, quota keyQuota, now time.Time) (period string, resetsAt time.Time, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.current(key, now)
+	dayReset, monthReset := quotaResets(now)
+	switch {
+	case quota.monthly > 0 && u.monthCount >= quota.monthly:
+		return "monthly", monthReset, false
+	case quota.daily > 0 && u.dayCount >= quota.daily:
+		return "daily", dayReset, false
+	}
+	u.dayCount++
+	u.monthCount++
+	return "", time.Time{}, true
+}
+
+// quotaResets returns the start of the next UTC day and month.
+func quotaResets(now time.Time) (day, month time.Time) {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// QuotaUsage is the use of one quota period. Limit and Remaining are absent
+// when the period is unlimited.
+type QuotaUsage struct {
+	Used      int    `json:"used"`
+	Limit     *int   `json:"limit,omitempty"`
+	Remaining *int   `json:"remaining,omitempty"`
+	ResetsAt  string `json:"resets_at"`
+}
+
+type APIKeyUsage struct {
+	KeyID   string     `json:"key_id"`
+	Daily   QuotaUsage `json:"daily"`
+	Monthly QuotaUsage `json:"monthly"`
+}
+
+func quotaUsage(used, limit int, resetsAt time.Time) QuotaUsage {
+	usage := QuotaUsage{Used: used, ResetsAt: resetsAt.Format(time.RFC3339)}
+	if limit > 0 {
+		remaining := max(limit-used, 0)
+		usage.Limit, usage.Remaining = &limit, &remaining
+	}
+	return usage
+}
+
+// Usage returns the usage of key against its quota.
+func (t *keyUsageTracker) Usage(key string, now time.Time) APIKeyUsage {
+	t.mu.Lock()
+	u := *t.current(key, now)
+	t.mu.Unlock()
+	quota := quotaOf(key)
+	dayReset, monthReset := quotaResets(now)
+	return APIKeyUsage{
+		KeyID:   key,
+		Daily:   quotaUsage(u.dayCount, quota.daily, dayReset),
+		Monthly: quotaUsage(u.monthCount, quota.monthly, monthReset),
+	}
+}
+
+type apiKeyIDKey struct{}
+
+// requestAPIKeyID returns the name of the API key the request was made with.
+func requestAPIKeyID(r *http.Request) (string, bool) {
+	id, ok := r.Context().Value(apiKeyIDKey{}).(string)
+	return id, ok
+}
+
+// keyQuotaMiddleware enforces API_KEY_QUOTAS on /api/* and /epaper. The key
+// is the one the access policy admitted the request with or, when the
+// policy does not ask for one, a valid X-API-Key sent anyway; requests
+// without a key are not counted. /api/usage is never counted, so a client
+// can check its usage after running out, nor is a request another shard
+// forwarded, which that shard counted already: only one whose signature
+// shardPeerMiddleware verified, as the forwarding header alone can be sent
+// by any client. Usage is per instance.
+func keyQuotaMiddleware(schemes map[string]authScheme) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routeAuthGroup(r.URL.Path) != authGroupAPI {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, ok := requestPrincipal(r)
+			if !ok || p.Scheme != "apikey" {
+				ok = false
+				if scheme := schemes["apikey"]; scheme != nil {
+					p, ok, _ = scheme.Authenticate(r)
+				}
+			}
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyIDKey{}, p.Name))
+			if r.URL.Path == "/api/usage" || shardForwarded(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := time.Now()
+			period, resetsAt, ok := apiKeyUsage.Take(p.Name, quotaOf(p.Name), now)
+			if !ok {
+				apiKeyQuotaExceededTotal.WithLabelValues(p.Name, period).Inc()
+				w.Header().Set("Retry-After", retryAfterSeconds(resetsAt.Sub(now)))
+				writeProblem(w, r, http.StatusTooManyRequests, "apikey."+period+"_quota_exceeded", resetsAt.Format(time.RFC3339))
+				return
+			}
+			apiKeyRequestsTotal.WithLabelValues(p.Name).Inc()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// usageHandler serves /api/usage, the usage of the caller's API key.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := requestAPIKeyID(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", apiKeyScheme{}.Challenge(authGroupAPI))
+		writeProblem(w, r, http.StatusUnauthorized, "apikey.required")
+		return
+	}
+	if !writeResponse(w, r, http.StatusOK, apiKeyUsage.Usage(id, time.Now())) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// usageListHandler serves /admin/usage, the usage of every configured key.
+func usageListHandler(w http.ResponseWriter, r *http.Request) {
+	keys, _ := parseCredentialList(runningConfig().APIKeys, "=")
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	usage := make([]APIKeyUsage, len(names))
+	for i, name := range names {
+		usage[i] = apiKeyUsage.Usage(name, now)
+	}
+	if !writeResponse(w, r, http.StatusOK, usage) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAP protocol operations and result codes (RFC 4511).
+const (
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+	ldapUnbindRequest   = 0x42
+
+	ldapSimpleAuth    = 0x80
+	ldapFilterAnd     = 0xA0
+	ldapFilterEqual   = 0xA3
+	ldapFilterPresent = 0x87
+	berBoolean        = 0x01
+	berEnumerated     = 0x0A
+	berSet            = 0x31
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+
+	ldapTimeout     = 10 * time.Second
+	ldapMaxResponse = 1 << 20
+)
+
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// ldapDirectory authenticates admin users against LDAP/Active Directory and
+// maps their groups (memberOf) to roles.
+type ldapDirectory struct {
+	url          *url.URL
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userAttr     string
+	groupRoles   map[string]role
+	cacheTTL     time.Duration
+
+	mu    sync.Mutex
+	cache map[[32]byte]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	roles   []role
+	expires time.Time
+}
+
+// newLDAPDirectory returns nil when LDAP_URL is not set.
+func newLDAPDirectory(cfg *Config) (*ldapDirectory, error) {
+	raw := cfg.LDAPURL
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP_URL %q", raw)
+	}
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	d := &ldapDirectory{
+		url:          u,
+		bindDN:       cfg.LDAPBindDN,
+		bindPassword: cfg.LDAPBindPassword,
+		baseDN:       cfg.LDAPBaseDN,
+		userAttr:     cfg.LDAPUserAttribute,
+		groupRoles:   make(map[string]role),
+		cacheTTL:     cfg.LDAPCacheTTL,
+		cache:        make(map[[32]byte]ldapCacheEntry),
+	}
+	if d.baseDN == "" {
+		return nil, fmt.Errorf("LDAP_BASE_DN is required")
+	}
+
+	// Group DNs contain '=' themselves, so the role follows the last one:
+	// "CN=Weather Admins,OU=Groups,DC=corp,DC=example=admin;...".
+	for _, entry := range strings.Split(cfg.LDAPGroupRoles, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		r := role(strings.TrimSpace(entry[i+1:]))
+		if i <= 0 || !r.Valid() {
+			return nil, fmt.Errorf("invalid LDAP_GROUP_ROLES entry %q", entry)
+		}
+		d.groupRoles[normalizeDN(entry[:i])] = r
+	}
+	if len(d.groupRoles) == 0 {
+		return nil, fmt.Errorf("LDAP_GROUP_ROLES must map at least one group to a role")
+	}
+	return d, nil
+}
+
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Authenticate verifies the user's password by binding as them and returns
+// the roles granted by their groups.
+func (d *ldapDirectory) Authenticate(username, password string) ([]role, error) {
+	// An empty password would be an unauthenticated bind, which most servers
+	// accept for any DN.
+	if username == "" || password == "" {
+		return nil, errLDAPInvalidCredentials
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.roles, nil
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(d.bindDN, d.bindPassword); err != nil {
+		return nil, fmt.Errorf("service bind: %w", err)
+	}
+	dn, groups, err := conn.FindUser(d.baseDN, d.userAttr, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(dn, password); err != nil {
+		return nil, err
+	}
+
+	var roles []role
+	for _, group := range groups {
+		if r, ok := d.groupRoles[normalizeDN(group)]; ok {
+			roles = append(roles, r)
+		}
+	}
+
+	d.mu.Lock()
+	for k, e := range d.cache {
+		if time.Now().After(e.expires) {
+			delete(d.cache, k)
+		}
+	}
+	d.cache[key] = ldapCacheEntry{roles: roles, expires: time.Now().Add(d.cacheTTL)}
+	d.mu.Unlock()
+	return roles, nil
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+}
+
+func (d *ldapDirectory) dial() (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if d.url.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", d.url.Host, &tls.Config{ServerName: d.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", d.url.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) Close() {
+	c.messageID++
+	c.conn.Write(berTLV(berSequence, berInt(berInteger, c.messageID), berTLV(ldapUnbindRequest, nil)))
+	c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.messageID++
+	_, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.messageID), op))
+	return err
+}
+
+// receive reads the next LDAPMessage and returns its protocol operation.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length >= 0x80 {
+		n := length & 0x7F
+		if n == 0 || n > 4 {
+			return 0, nil, errBERMalformed
+		}
+		size := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, size); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range size {
+			length = length<<8 | int(b)
+		}
+	}
+	if header[0] != berSequence || length > ldapMaxResponse {
+		return 0, nil, errBERMalformed
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	_, rest, err := berExpect(body, berInteger)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, op, _, err := berRead(rest)
+	return tag, op, err
+}
+
+// ldapResult decodes the resultCode and diagnostic message of an LDAPResult.
+func ldapResult(op []byte) error {
+	code, rest, err := berExpect(op, berEnumerated)
+	if err != nil {
+		return err
+	}
+	result, err := berDecodeInt(code)
+	if err != nil {
+		return err
+	}
+	switch result {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errLDAPInvalidCredentials
+	}
+	_, rest, _ = berExpect(rest, berOctetString)
+	message, _, _ := berExpect(rest, berOctetString)
+	return fmt.Errorf("LDAP result %d: %s", result, message)
+}
+
+func (c *ldapConn) Bind(dn, password string) error {
+	err := c.send(berTLV(ldapBindRequest,
+		berInt(berInteger, 3),
+		berTLV(berOctetString, []byte(dn)),
+		berTLV(ldapSimpleAuth, []byte(password)),
+	))
+	if err != nil {
+		return err
+	}
+	tag, op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return errBERMalformed
+	}
+	return ldapResult(op)
+}
+
+// FindUser looks up the single entry with attr=value below baseDN and returns
+// its DN and memberOf values.
+func (c *ldapConn) FindUser(baseDN, attr, value string) (string, []string, error) {
+	filter := berTLV(ldapFilterAnd,
+		berTLV(ldapFilterEqual, berTLV(berOctetString, []byte(attr)), berTLV(berOctetString, []byte(value))),
+		berTLV(ldapFilterPresent, []byte("objectClass")),
+	)
+	err := c.send(berTLV(ldapSearchRequest,
+		berTLV(berOctetString, []byte(baseDN)),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),
+		berInt(berInteger, int64(ldapTimeout/time.Second)),
+		berTLV(berBoolean, []byte{0}),
+		filter,
+		berTLV(berSequence, berTLV(berOctetString, []byte("memberOf"))),
+	))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		dn      string
+		groups  []string
+		entries int
+	)
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return "", nil, err
+		}
+		switch tag {
+		case ldapSearchEntry:
+			entries++
+			if dn, groups, err = parseLDAPEntry(op); err != nil {
+				return "", nil, err
+			}
+		case ldapSearchReference:
+		case ldapSearchDone:
+			if err := ldapResult(op); err != nil {
+				return "", nil, err
+			}
+			if entries != 1 {
+				return "", nil, errLDAPInvalidCredentials
+			}
+			return dn, groups, nil
+		default:
+			return "", nil, errBERMalformed
+		}
+	}
+}
+
+func parseLDAPEntry(op []byte) (string, []string, error) {
+	dn, rest, err := berExpect(op, berOctetString)
+	if err != nil {
+		return "", nil, err
+	}
+	attributes, _, err := berExpect(rest, berSequence)
+	if err != nil {
+		return "", nil, err
+	}
+	var groups []string
+	for len(attributes) > 0 {
+		var attribute, name, values []byte
+		if attribute, attributes, err = berExpect(attributes, berSequence); err != nil {
+			return "", nil, err
+		}
+		if name, rest, err = berExpect(attribute, berOctetString); err != nil {
+			return "", nil, err
+		}
+		if values, _, err = berExpect(rest, berSet); err != nil {
+			return "", nil, err
+		}
+		if !strings.EqualFold(string(name), "memberOf") {
+			continue
+		}
+		for len(values) > 0 {
+			var value []byte
+			if value, values, err = berExpect(values, berOctetString); err != nil {
+				return "", nil, err
+			}
+			groups = append(groups, string(value))
+		}
+	}
+	return string(dn), groups, nil
+}
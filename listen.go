@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// httpListenAddr is HTTP_LISTEN, such as "127.0.0.1:8080" or "[::1]:8080",
+// or all interfaces, IPv4 and IPv6, on PORT.
+func httpListenAddr(cfg *Config) string {
+	if cfg.HTTPListen != "" {
+		return cfg.HTTPListen
+	}
+	return ":" + strconv.Itoa(cfg.Port)
+}
+
+// listenHTTP returns the listener of the HTTP server, in order of
+// precedence: the one inherited from the process being upgraded, the socket
+// passed by systemd socket activation, the Unix socket LISTEN_SOCKET, or TCP
+// on httpListenAddr. A host name in the address is resolved to one address.
+func listenHTTP(cfg *Config) (net.Listener, error) {
+	if ln, ok, err := upgradeListener(); ok {
+		return ln, err
+	}
+	if ln, ok, err := systemdListener(); ok {
+		return ln, err
+	}
+	if cfg.ListenSocket != "" {
+		return listenUnix(cfg.ListenSocket, cfg.ListenSocketMode)
+	}
+	return net.Listen("tcp", httpListenAddr(cfg))
+}
+
+// listenUnix listens on the Unix socket at path with the permissions
+// socketMode (LISTEN_SOCKET_MODE), replacing the socket file a previous run
+// left behind.
+func listenUnix(path, socketMode string) (net.Listener, error) {
+	mode, err := listenSocketMode(socketMode)
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_SOCKET_MODE: %w", err)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenSocketMode parses LISTEN_SOCKET_MODE, octal permissions; 0660 lets
+// the group of the reverse proxy connect.
+func listenSocketMode(v string) (os.FileMode, error) {
+	if v == "" {
+		return 0o660, nil
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("want octal permissions such as 0660")
+	}
+	return os.FileMode(mode), nil
+}
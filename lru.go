@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var memoryEvictionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "memory_store_evictions_total",
+		Help: "Total number of entries dropped from in-memory stores to stay within their caps by store",
+	},
+	[]string{"store"},
+)
+
+func init() {
+	prometheus.MustRegister(memoryEvictionsTotal)
+}
+
+// maxCachedCities is CACHE_MAX_CITIES, the cap of every cache keyed by
+// city or query. Cities come from query parameters, so without a cap an
+// instance exposed to arbitrary requests would grow without bound.
+func maxCachedCities() int {
+	return runningConfig().CacheMaxCities
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// lruCache is a map capped at capacity() entries that drops the least
+// recently used entry when full. The capacity is read on every insertion, so
+// lowering it shrinks the cache as new entries arrive.
+type lruCache[K comparable, V any] struct {
+	name     string
+	capacity func() int
+
+	// evicted, when set, is called with each evicted entry, the cache
+	// locked.
+	evicted func(K, V)
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+// newLRUCache returns an empty cache reported as name in
+// memory_store_entries and memory_store_evictions_total.
+func newLRUCache[K comparable, V any](name string, capacity func() int) *lruCache[K, V] {
+	c := &lruCache[K, V]{name: name, capacity: capacity, order: list.New(), entries: make(map[K]*list.Element)}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "memory_store_entries",
+		Help:        "Number of entries held by an in-memory cache",
+		ConstLabels: prometheus.Labels{"store": name},
+	}, func() float64 { return float64(c.Len()) }))
+	return c
+}
+
+// Get returns the value of key and marks it as recently used.
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+// Set stores value under key, evicting the least recently used entries
+// beyond the capacity.
+func (c *lruCache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key, value})
+	for limit := max(c.capacity(), 1); len(c.entries) > limit; {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*lruEntry[K, V])
+		delete(c.entries, entry.key)
+		memoryEvictionsTotal.WithLabelValues(c.name).Inc()
+		if c.evicted != nil {
+			c.evicted(entry.key, entry.value)
+		}
+	}
+}
+
+// Values returns the values, most recently used first, without marking
+// them as used.
+func (c *lruCache[K, V]) Values() []V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([]V, 0, len(c.entries))
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		values = append(values, e.Value.(*lruEntry[K, V]).value)
+	}
+	return values
+}
+
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
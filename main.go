@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -32,11 +37,12 @@ var (
 		[]string{"method", "endpoint"},
 	)
 
-	temperatureGauge = prometheus.NewGauge(
+	temperatureGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "current_temperature_celsius",
 			Help: "Current temperature in Celsius",
 		},
+		[]string{"city", "provider"},
 	)
 )
 
@@ -47,82 +53,301 @@ func init() {
 }
 
 type WeatherResponse struct {
-	Temperature float64 `json:"temperature"`
-	Unit        string  `json:"unit"`
-	Timestamp   string  `json:"timestamp"`
-	Source      string  `json:"source"`
+	Temperature float64           `json:"temperature"`
+	Unit        string            `json:"unit"`
+	Timestamp   string            `json:"timestamp"`
+	Source      string            `json:"source"`
+	Comfort     *Comfort          `json:"comfort,omitempty"`
+	Display     map[string]string `json:"display,omitempty"`
+	// Theme is the token of the look matching the conditions, see
+	// /api/themes.
+	Theme string `json:"theme,omitempty"`
 }
 
 type OpenWeatherResponse struct {
 	Main struct {
-		Temp float64 `json:"temp"`
+		Temp     float64 `json:"temp"`
+		Humidity float64 `json:"humidity"`
 	} `json:"main"`
+	Wind struct {
+		Speed *float64 `json:"speed"`
+	} `json:"wind"`
+	Weather []struct {
+		ID          int    `json:"id"`
+		Description string `json:"description"`
+		// Icon ends in "d" by day and "n" by night, e.g. "01n".
+		Icon string `json:"icon"`
+	} `json:"weather"`
 }
 
-func getTemperature() (float64, error) {
-	apiKey := os.Getenv("WEATHER_API_KEY")
-	city := os.Getenv("WEATHER_CITY")
-	if city == "" {
-		city = "Moscow"
-	}
+// Observation is the provider-independent set of current conditions.
+// ConditionCode uses the OpenWeatherMap condition IDs (800 = clear sky).
+type Observation struct {
+	Temperature float64
+	// Humidity (%) and WindSpeed (m/s) are -1 when the provider does not
+	// report them.
+	Humidity      float64
+	WindSpeed     float64
+	ConditionCode int
+	// Description is the provider's own wording of the conditions in
+	// DescriptionLang, when the provider supplies one.
+	Description     string
+	DescriptionLang string
+	// Night is whether the provider considers it night at the location,
+	// nil when it does not say.
+	Night *bool
+}
+
+var (
+	ErrProviderUnavailable = errors.New("weather provider unavailable")
+	ErrCityNotFound        = errors.New("city not found")
+	ErrQuotaExceeded       = errors.New("weather provider quota exceeded")
+)
 
+func weatherCity() string {
+	return runningConfig().WeatherCity
+}
+
+const defaultOpenWeatherBaseURL = "https://api.openweathermap.org"
+
+// openWeatherBaseURL is OPENWEATHER_BASE_URL, which points the provider at a
+// staging mock or a regional mirror.
+func openWeatherBaseURL() string {
+	return strings.TrimSuffix(runningConfig().OpenWeatherBaseURL, "/")
+}
+
+func getWeather(ctx context.Context, city string) (Observation, error) {
+	return openWeatherCurrent(ctx, runningConfig().WeatherAPIKey, owmQuota, city)
+}
+
+// openWeatherCurrent fetches the conditions from OpenWeatherMap with apiKey,
+// counting the call against quota.
+func openWeatherCurrent(ctx context.Context, apiKey string, quota *quotaTracker, city string) (Observation, error) {
 	if apiKey == "" {
 
-		return 15.0, nil
+		return Observation{Temperature: 15.0, Humidity: 60, WindSpeed: 3, ConditionCode: 800}, nil
+	}
+
+	params := url.Values{"appid": {apiKey}, "units": {"metric"}, "lang": {weatherLang()}}
+	if code, country, ok := splitZip(city); ok {
+		// Without a country OpenWeatherMap assumes a US ZIP code.
+		if country != "" {
+			code += "," + country
+		}
+		params.Set("zip", code)
+	} else if c, ok := cities.Lookup(city); ok {
+		params.Set("lat", strconv.FormatFloat(c.Latitude, 'g', -1, 64))
+		params.Set("lon", strconv.FormatFloat(c.Longitude, 'g', -1, 64))
+	} else {
+		params.Set("q", city)
 	}
+	endpoint := openWeatherBaseURL() + "/data/2.5/weather?" + params.Encode()
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?q=%s&appid=%s&units=metric", city, apiKey)
+	if wait := quota.Reserve(); wait > 0 {
+		upstreamThrottledTotal.Inc()
+		return Observation{}, &QuotaError{RetryAfter: wait}
+	}
+	upstreamCallsTotal.Inc()
 
-	resp, err := http.Get(url)
+	resp, err := upstreamGet(ctx, weatherClient, endpoint)
 	if err != nil {
-		return 0, err
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("API returned status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest:
+		// 400 is OpenWeatherMap's answer to names it cannot geocode at all.
+		return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait := retryAfterHeader(resp)
+		quota.Block(wait)
+		return Observation{}, &QuotaError{RetryAfter: wait}
+	case resp.StatusCode >= 500:
+		return Observation{}, fmt.Errorf("%w: API returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return Observation{}, fmt.Errorf("API returned status %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return 0, err
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
 	}
 
 	var weather OpenWeatherResponse
 	if err := json.Unmarshal(body, &weather); err != nil {
-		return 0, err
+		return Observation{}, fmt.Errorf("%w: invalid response: %v", ErrProviderUnavailable, err)
+	}
+
+	observation := Observation{Temperature: weather.Main.Temp, Humidity: weather.Main.Humidity, WindSpeed: -1}
+	if weather.Wind.Speed != nil {
+		observation.WindSpeed = *weather.Wind.Speed
 	}
+	if len(weather.Weather) > 0 {
+		observation.ConditionCode = weather.Weather[0].ID
+		observation.Description, observation.DescriptionLang = weather.Weather[0].Description, weatherLang()
+		if icon := weather.Weather[0].Icon; icon != "" {
+			night := strings.HasSuffix(icon, "n")
+			observation.Night = &night
+		}
+	}
+	return observation, nil
+}
+
+type weatherResult struct {
+	Observation
+	FetchedAt  time.Time
+	Source     string
+	RetryAfter time.Duration
+	// Lifetime is how long after FetchedAt the result is considered fresh.
+	Lifetime time.Duration
+}
+
+// currentWeather fetches the conditions for city, recording fresh values in
+// the cache and history. Observations younger than WEATHER_CACHE_TTL are
+// served from the cache. While the upstream quota is exhausted it falls back
+// to the last cached observation; RetryAfter is set in that case. ctx carries
+// the trace of the request, if any, to the provider. The fetch updates state
+// every client shares, so handlers pass their request's context without its
+// cancellation: a client that hangs up must not abort it or count as a
+// provider failure.
+func currentWeather(ctx context.Context, city string) (weatherResult, error) {
+	return currentWeatherFrom(ctx, weatherProvider, city)
+}
+
+// currentWeatherFrom is currentWeather with the observation fetched from
+// provider on a cache miss.
+func currentWeatherFrom(ctx context.Context, provider WeatherProvider, city string) (weatherResult, error) {
+	result := weatherResult{FetchedAt: time.Now(), Source: "weather-api"}
+
+	ttl := weatherCacheTTL()
+	cached, haveCached := lastObservations.Get(city)
+	if age := time.Since(cached.fetchedAt); haveCached && age < ttl {
+		result.Observation, result.FetchedAt, result.Source = cached.observation, cached.fetchedAt, "cache"
+		result.Lifetime = ttl
+		cacheHits.Add(1)
+		return result, nil
+	}
+	cacheMisses.Add(1)
+
+	observation, err := provider.Current(ctx, city)
+	upstreamHealth.Record(err)
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		result.RetryAfter = quotaErr.RetryAfter
+		if haveCached {
+			result.Observation, result.FetchedAt, result.Source = cached.observation, cached.fetchedAt, "cache"
+			result.Lifetime = time.Since(cached.fetchedAt) + result.RetryAfter
+			return result, nil
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Observation = observation
+	result.Lifetime = ttl
+	lastObservations.Set(city, cachedObservation{observation: observation, fetchedAt: result.FetchedAt})
+	anomalies.Check(city, observation.Temperature, result.FetchedAt)
+	if !anomalies.Suppressed(city) {
+		dailyTemperatures.Observe(city, observation.Temperature, result.FetchedAt)
+		forecastAccuracy.Observe(city, observation.Temperature, result.FetchedAt)
+		if shards.Owns(city) {
+			history.Add(city, observation.Temperature, result.FetchedAt)
+		}
+	}
+	webhooks.Notify(city, result)
+	streams.Publish(city, result)
+	return result, nil
+}
 
-	return weather.Main.Temp, nil
+// writeTemperatureError logs a failed fetch and maps the provider error to
+// the matching problem response.
+func writeTemperatureError(w http.ResponseWriter, r *http.Request, city string, err error) {
+	logError("Error fetching temperature (trace %q): %v", requestTraceID(r), err)
+	sendProblem(w, r, temperatureProblem(r, city, err))
+}
+
+func temperatureProblem(r *http.Request, city string, err error) Problem {
+	switch {
+	case errors.Is(err, ErrCityNotFound):
+		problem := newProblem(r, http.StatusNotFound, "temperature.city_not_found", locationLabel(city))
+		problem.Suggestions = citySuggestions(city)
+		return problem
+	case errors.Is(err, ErrQuotaExceeded):
+		return newProblem(r, http.StatusServiceUnavailable, "temperature.quota_exceeded")
+	case errors.Is(err, ErrProviderUnavailable):
+		return newProblem(r, http.StatusServiceUnavailable, "temperature.provider_unavailable")
+	}
+	return newProblem(r, http.StatusInternalServerError, "temperature.fetch_failed")
 }
 
 func temperatureHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	temp, err := getTemperature()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching temperature: %v", err), http.StatusInternalServerError)
-		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "500").Inc()
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", r.URL.Query().Get("units"))
 		return
 	}
 
-	temperatureGauge.Set(temp)
+	city, ok := requestCity(w, r)
+	if !ok {
+		return
+	}
+	result, err := currentWeatherFrom(context.WithoutCancel(r.Context()), requestProvider(r), city)
+	if result.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(result.RetryAfter))
+	}
+	if err != nil {
+		writeTemperatureError(w, r, city, err)
+		return
+	}
 
-	response := WeatherResponse{
-		Temperature: temp,
-		Unit:        "celsius",
-		Timestamp:   time.Now().Format(time.RFC3339),
-		Source:      "weather-api",
+	setCacheHeaders(w, result)
+	comfort := comfortMetrics(result.Temperature, result.Humidity, result.WindSpeed)
+	if city == weatherCity() && !anomalies.Suppressed(city) {
+		temperatureGauge.WithLabelValues(city, weatherProviderName()).Set(result.Temperature)
+		setComfortGauges(comfort)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	response := newWeatherResponse(city, result, units, requestLocale(r), descriptionLanguage(r))
+	if !writeResponse(w, r, http.StatusOK, response) {
+		return
+	}
 
 	duration := time.Since(start).Seconds()
 	httpRequestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(duration)
 	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
 }
 
+// newWeatherResponse is the /api/temperature response for result, fetched
+// for city: display values are formatted in locale and the condition is
+// described in descriptionLang.
+func newWeatherResponse(city string, result weatherResult, units unitSystem, locale, descriptionLang string) WeatherResponse {
+	response := WeatherResponse{
+		Temperature: result.Temperature,
+		Unit:        "celsius",
+		Timestamp:   result.FetchedAt.Format(time.RFC3339),
+		Source:      result.Source,
+	}
+	if units == unitsImperial {
+		response.Temperature = celsiusToFahrenheit(result.Temperature)
+		response.Unit = "fahrenheit"
+	}
+	comfort := comfortMetrics(result.Temperature, result.Humidity, result.WindSpeed).in(units)
+	response.Comfort = &comfort
+	response.Display = map[string]string{
+		"temperature": formatTemperature(response.Temperature, units, locale),
+		"feels_like":  formatTemperature(comfort.FeelsLike, units, locale),
+	}
+	if description := conditionDescription(descriptionLang, result.Observation); description != "" {
+		response.Display["condition"] = description
+	}
+	response.Theme = observationTheme(city, result)
+	return response
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -134,62 +359,281 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		next.ServeHTTP(w, r)
-		log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
+		requestsServed.Add(1)
+		log.Printf("%s %s %s %v trace=%s", r.RemoteAddr, r.Method, r.URL.Path, time.Since(start), requestTraceID(r))
 	})
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve runs the server until it is upgraded or killed.
+func serve() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid config file:\n%v", err)
+	}
+	changes, err := inheritedSettings()
+	if err != nil {
+		log.Fatalf("Upgrade: %v", err)
 	}
+	if len(changes) > 0 {
+		cfg = cfg.withChanges(changes)
+		log.Printf("Keeping %d settings changed in the process being upgraded", len(changes))
+	}
+	setRunningConfig(cfg)
+	owmQuota = newQuotaTracker(cfg)
+
+	if err := configureUpstreamProxy(cfg); err != nil {
+		log.Fatalf("Invalid upstream configuration: %v", err)
+	}
+	if cfg, err = resolveSecretReferences(cfg); err != nil {
+		log.Fatalf("Failed to read secrets:\n%v", err)
+	}
+	cfg, vault, err := loadVaultSecrets(cfg)
+	if err != nil {
+		log.Fatalf("Failed to read secrets from Vault: %v", err)
+	}
+	if problems := configProblems(cfg); len(problems) > 0 {
+		log.Fatalf("Invalid configuration:\n%s", strings.Join(problems, "\n"))
+	}
+	setRunningConfig(cfg)
+	if vault != nil {
+		go vault.Run()
+	}
+
+	if err := configureUpstream(cfg); err != nil {
+		log.Fatalf("Invalid upstream configuration: %v", err)
+	}
+
+	provider, err := newWeatherProvider(cfg)
+	if err != nil {
+		log.Fatalf("Invalid weather provider: %v", err)
+	}
+	weatherProvider = provider
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	trustedProxies = proxies
+
+	if cfg.CWOPCallsign != "" {
+		publisher, err := newCWOPPublisher(cfg)
+		if err != nil {
+			log.Fatalf("Invalid CWOP configuration: %v", err)
+		}
+		go publisher.Run()
+	}
+
+	if cfg.MQTTBroker != "" {
+		publisher, err := newMQTTPublisher(cfg)
+		if err != nil {
+			log.Fatalf("Invalid MQTT configuration: %v", err)
+		}
+		go publisher.Run()
+	}
+
+	ring, err := newShardRing(cfg)
+	if err != nil {
+		log.Fatalf("Invalid shard configuration: %v", err)
+	}
+	shards = ring
+
+	store, err := openHistoryStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open history store: %v", err)
+	}
+	history = store
+	audit, err := openAuditLog(cfg.AuditLogFile)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	auditTrail = audit
+	if err := runHistoryJanitor(cfg); err != nil {
+		log.Fatalf("Invalid history configuration: %v", err)
+	}
+	if err := runHistoryRollups(cfg); err != nil {
+		log.Fatalf("Invalid history configuration: %v", err)
+	}
+
+	if cfg.CoAPListen != "" {
+		if err := startCoAPServer(cfg); err != nil {
+			log.Fatalf("Failed to start CoAP server: %v", err)
+		}
+	}
+
+	if cfg.ModbusListen != "" {
+		if err := startModbusServer(cfg); err != nil {
+			log.Fatalf("Failed to start Modbus server: %v", err)
+		}
+	}
+
+	if cfg.SNMPListen != "" {
+		if err := startSNMPAgent(cfg); err != nil {
+			log.Fatalf("Failed to start SNMP agent: %v", err)
+		}
+	}
+
+	if err := runArchiver(cfg); err != nil {
+		log.Fatalf("Invalid archive configuration: %v", err)
+	}
+
+	if cfg.CityCatalog != "" {
+		go loadCityCatalog(cfg.CityCatalog, cfg.CityCatalogURL)
+	}
+
+	if err := runStationUploads(cfg); err != nil {
+		log.Fatalf("Invalid station upload configuration: %v", err)
+	}
+	go runWarmup(cfg)
+	if err := startScheduler(cfg); err != nil {
+		log.Fatalf("Invalid schedule: %v", err)
+	}
+	go runAccuracyObservations()
+	go runSunEvents()
 
 	r := mux.NewRouter()
+	r.Use(shardPeerMiddleware)
+	r.Use(realIPMiddleware)
+	r.Use(traceMiddleware)
 	r.Use(loggingMiddleware)
+	r.Use(recoveryMiddleware)
+	mirror, err := newRequestMirror(cfg)
+	if err != nil {
+		log.Fatalf("Invalid request mirroring configuration: %v", err)
+	}
+	if mirror != nil {
+		r.Use(mirror.Middleware)
+	}
+	directory, err := newLDAPDirectory(cfg)
+	if err != nil {
+		log.Fatalf("Invalid LDAP configuration: %v", err)
+	}
+	oidc, err := newOIDCClient(cfg)
+	if err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	schemes, err := authSchemes(cfg, directory, oidc)
+	if err != nil {
+		log.Fatalf("Invalid authentication configuration: %v", err)
+	}
+	policies, err := groupPolicies(cfg, schemes)
+	if err != nil {
+		log.Fatalf("Invalid authentication configuration: %v", err)
+	}
+	r.Use(authChain(schemes, policies))
+	if oidc != nil {
+		r.Use(csrfMiddleware(oidc))
+	}
+	if _, err := parseKeyQuotas(cfg.APIKeyQuotas); err != nil {
+		log.Fatalf("Invalid API_KEY_QUOTAS: %v", err)
+	}
+	r.Use(keyQuotaMiddleware(schemes))
+	if _, err := parseTenants(cfg.Tenants); err != nil {
+		log.Fatalf("Invalid TENANTS: %v", err)
+	}
+	if dsn := cfg.SentryDSN; dsn != "" {
+		if _, err := parseSentryDSN(dsn); err != nil {
+			log.Fatalf("Invalid SENTRY_DSN: %v", err)
+		}
+	}
+	go sendErrorReports()
+	if path := cfg.UITemplate; path != "" {
+		if err := checkUITemplate(path); err != nil {
+			log.Fatalf("Invalid UI_TEMPLATE: %v", err)
+		}
+	}
+	if _, err := parseDeprecations(cfg.APIDeprecations); err != nil {
+		log.Fatalf("Invalid API_DEPRECATIONS: %v", err)
+	}
+	r.Use(deprecationMiddleware)
 
 	// API endpoints
-	r.HandleFunc("/api/temperature", temperatureHandler).Methods("GET")
+	r.HandleFunc("/api/temperature", shardRouted(temperatureHandler)).Methods("GET")
+	r.HandleFunc("/api/temperature/stream", shardRouted(temperatureStreamHandler)).Methods("GET")
+	r.HandleFunc("/api/temperature/stats", shardRouted(temperatureStatsHandler)).Methods("GET")
+	r.HandleFunc("/api/temperature/history", shardRouted(temperatureHistoryHandler)).Methods("GET")
+	r.HandleFunc("/api/compact", shardRouted(compactHandler)).Methods("GET")
+	r.HandleFunc("/api/t/{tenant}/temperature", tenantRouted(shardRouted(temperatureHandler))).Methods("GET")
+	r.HandleFunc("/api/t/{tenant}/temperature/stats", tenantRouted(shardRouted(temperatureStatsHandler))).Methods("GET")
+	r.HandleFunc("/api/t/{tenant}/temperature/history", tenantRouted(shardRouted(temperatureHistoryHandler))).Methods("GET")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/healthz", healthHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/api/stations", stationsHandler).Methods("GET")
+	r.HandleFunc("/api/weather", shardRouted(weatherHandler)).Methods("GET")
+	r.HandleFunc("/api/cities", citySearchHandler).Methods("GET")
+	r.HandleFunc("/api/cities/nearest", nearestCityHandler).Methods("GET")
+	r.HandleFunc("/api/window", windowHandler).Methods("GET")
+	r.HandleFunc("/api/trip", tripHandler).Methods("POST")
+	r.HandleFunc("/api/forecast/accuracy", forecastAccuracyHandler).Methods("GET")
+	r.HandleFunc("/api/themes", themesHandler).Methods("GET")
+	r.HandleFunc("/api/capabilities", capabilitiesHandler).Methods("GET")
+	r.HandleFunc("/api/templates/functions", templateFunctionsHandler).Methods("GET")
+	r.HandleFunc("/api/usage", usageHandler).Methods("GET")
+	r.HandleFunc("/epaper", shardRouted(epaperHandler)).Methods("GET")
+	r.HandleFunc("/api/subscriptions", audited(createSubscriptionHandler)).Methods("POST")
+	r.HandleFunc("/api/subscriptions/{id}", getSubscriptionHandler).Methods("GET")
+	r.HandleFunc("/api/subscriptions/{id}", audited(deleteSubscriptionHandler)).Methods("DELETE")
+
+	// Personal weather station uploads
+	r.HandleFunc("/weatherstation/updateweatherstation.php", wundergroundHandler).Methods("GET")
+	r.HandleFunc("/data/report", ecowittHandler).Methods("GET", "POST")
+	r.HandleFunc("/data/report/", ecowittHandler).Methods("GET", "POST")
+
+	// Admin API, only served with an authentication policy
+	if policies[authGroupAdmin] != nil {
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Use(auditMiddleware)
+		admin.Use(requireRole(roleAdmin))
+		admin.HandleFunc("/audit", auditHandler).Methods("GET")
+		admin.HandleFunc("/backup", backupHandler).Methods("GET")
+		admin.HandleFunc("/restore", restoreHandler).Methods("POST")
+		admin.HandleFunc("/config", runningConfigHandler).Methods("GET")
+		admin.HandleFunc("/config/candidate", stageConfigHandler).Methods("PUT")
+		admin.HandleFunc("/config/candidate", candidateConfigHandler).Methods("GET")
+		admin.HandleFunc("/config/candidate", discardConfigHandler).Methods("DELETE")
+		admin.HandleFunc("/config/activate", activateConfigHandler).Methods("POST")
+		admin.HandleFunc("/config/rollback", rollbackConfigHandler).Methods("POST")
+		admin.HandleFunc("/runtime/gc", gcStatusHandler).Methods("GET")
+		admin.HandleFunc("/runtime/gc", gcTuneHandler).Methods("PUT")
+		admin.HandleFunc("/api-key", apiKeyStatusHandler).Methods("GET")
+		admin.HandleFunc("/api-key/rotate", rotateAPIKeyHandler).Methods("POST")
+		admin.HandleFunc("/cities", cityListHandler).Methods("GET")
+		admin.HandleFunc("/cities", addCityHandler).Methods("POST")
+		admin.HandleFunc("/cities/{city}", removeCityHandler).Methods("DELETE")
+		admin.HandleFunc("/errors", errorsHandler).Methods("GET")
+		admin.HandleFunc("/usage", usageListHandler).Methods("GET")
+		admin.HandleFunc("/history", listHistoryHandler).Methods("GET")
+		admin.HandleFunc("/history/invalidate", setValidityHandler(false)).Methods("POST")
+		admin.HandleFunc("/history/revalidate", setValidityHandler(true)).Methods("POST")
+		admin.HandleFunc("/history/{id}/correction", correctHistoryHandler).Methods("POST")
+		r.Handle("/api/stats", requireRole(roleAdmin)(http.HandlerFunc(runtimeStatsHandler))).Methods("GET")
+	}
 
 	// Prometheus metrics
 	r.Handle("/metrics", promhttp.Handler())
 
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Weather App</title>
-    <style>
-        body { font-family: Arial, sans-serif; text-align: center; padding: 50px; }
-        .temperature { font-size: 48px; color: #2196F3; margin: 20px; }
-        .info { color: #666; }
-    </style>
-</head>
-<body>
-    <h1>Weather Application</h1>
-    <div class="temperature" id="temp">Loading...</div>
-    <div class="info">Temperature updates every 5 seconds</div>
-    <script>
-        function updateTemperature() {
-            fetch('/api/temperature')
-                .then(response => response.json())
-                .then(data => {
-                    document.getElementById('temp').textContent = data.temperature.toFixed(1) + '°C';
-                })
-                .catch(err => console.error('Error:', err));
-        }
-        updateTemperature();
-        setInterval(updateTemperature, 5000);
-    </script>
-</body>
-</html>
-		`)
-		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
-	}).Methods("GET")
-
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	// Dashboard login, only served with OIDC_ISSUER
+	if oidc != nil {
+		r.HandleFunc("/auth/login", oidc.loginHandler).Methods("GET")
+		r.HandleFunc("/auth/callback", oidc.callbackHandler).Methods("GET")
+		r.HandleFunc("/auth/logout", oidc.logoutHandler).Methods("POST")
+	}
+
+	r.PathPrefix("/static/").HandlerFunc(staticHandler).Methods("GET")
+	r.HandleFunc("/favicon.ico", faviconHandler).Methods("GET")
+	r.HandleFunc("/manifest.webmanifest", manifestHandler).Methods("GET")
+	r.HandleFunc("/sw.js", serviceWorkerHandler).Methods("GET")
+	r.HandleFunc("/", indexHandler).Methods("GET")
+
+	ln, err := listenHTTP(cfg)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	go announceReady()
+	log.Printf("weather-app %s starting on %s %s", version, ln.Addr().Network(), ln.Addr())
+	serveHTTP(ln, r)
 }
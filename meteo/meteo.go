@@ -0,0 +1,69 @@
+// Package meteo derives comfort metrics from temperature, relative humidity
+// and wind speed. Temperatures are in °C, humidity in percent and wind speed
+// in m/s, as the weather providers report them.
+package meteo
+
+import "math"
+
+// DewPoint returns the temperature at which the air would be saturated,
+// using the Magnus formula with the Sonntag (1990) constants, which is
+// within 0.1 °C between -45 °C and 60 °C. Humidity must be above zero.
+func DewPoint(temperature, humidity float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(humidity/100) + a*temperature/(b+temperature)
+	return b * gamma / (a - gamma)
+}
+
+// WindChill returns the North American / UK wind chill index (2001). It
+// reports false outside the range the index is defined for: temperatures
+// above 10 °C or wind below 4.8 km/h.
+func WindChill(temperature, windSpeed float64) (float64, bool) {
+	kmh := windSpeed * 3.6
+	if temperature > 10 || kmh < 4.8 {
+		return 0, false
+	}
+	v := math.Pow(kmh, 0.16)
+	return 13.12 + 0.6215*temperature - 11.37*v + 0.3965*temperature*v, true
+}
+
+// HeatIndex returns the apparent temperature of warm, humid air with the
+// algorithm of the US National Weather Service: Steadman's simple formula,
+// refined by the Rothfusz regression and its adjustments when the result is
+// 80 °F or more. It reports false below 26.7 °C (80 °F), where heat stress
+// is not a concern.
+func HeatIndex(temperature, humidity float64) (float64, bool) {
+	if temperature < 26.7 {
+		return 0, false
+	}
+	t, rh := temperature*9/5+32, humidity
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+			0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+			0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9, true
+}
+
+// FeelsLike returns the wind chill in the cold, the heat index in the heat
+// and the air temperature otherwise. Pass NaN for an unknown humidity or
+// wind speed; the corresponding index is then not applied.
+func FeelsLike(temperature, humidity, windSpeed float64) float64 {
+	if !math.IsNaN(windSpeed) {
+		if chill, ok := WindChill(temperature, windSpeed); ok {
+			return chill
+		}
+	}
+	if !math.IsNaN(humidity) {
+		if heat, ok := HeatIndex(temperature, humidity); ok {
+			return heat
+		}
+	}
+	return temperature
+}
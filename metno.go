@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultMetnoBaseURL = "https://api.met.no"
+
+// metnoForecast is the part of a Locationforecast 2.0 "compact" response the
+// provider reads.
+type metnoForecast struct {
+	Properties struct {
+		Timeseries []struct {
+			Time time.Time `json:"time"`
+			Data struct {
+				Instant struct {
+					Details struct {
+						AirTemperature   *float64 `json:"air_temperature"`
+						RelativeHumidity *float64 `json:"relative_humidity"`
+						WindSpeed        *float64 `json:"wind_speed"`
+					} `json:"details"`
+				} `json:"instant"`
+				Next1Hours struct {
+					Summary struct {
+						SymbolCode string `json:"symbol_code"`
+					} `json:"summary"`
+				} `json:"next_1_hours"`
+			} `json:"data"`
+		} `json:"timeseries"`
+	} `json:"properties"`
+}
+
+// metnoConditions maps Met.no weather symbols, without their _day/_night
+// suffix, to the OpenWeatherMap condition codes used everywhere else.
+var metnoConditions = map[string]int{
+	"clearsky":     800,
+	"fair":         801,
+	"partlycloudy": 802,
+	"cloudy":       804,
+	"fog":          741,
+	"lightrain":    500, "rain": 501, "heavyrain": 502,
+	"lightrainshowers": 520, "rainshowers": 521, "heavyrainshowers": 522,
+	"lightsleet": 612, "sleet": 611, "heavysleet": 613,
+	"lightsleetshowers": 612, "sleetshowers": 611, "heavysleetshowers": 613,
+	"lightsnow": 600, "snow": 601, "heavysnow": 602,
+	"lightsnowshowers": 620, "snowshowers": 621, "heavysnowshowers": 622,
+}
+
+func metnoCondition(symbol string) int {
+	base, _, _ := strings.Cut(symbol, "_")
+	if code, ok := metnoConditions[base]; ok {
+		return code
+	}
+	if strings.Contains(base, "thunder") {
+		return 211
+	}
+	return 0
+}
+
+// metnoEntry is the last response for one location. Met.no's terms require
+// clients not to ask again before Expires and to revalidate with
+// If-Modified-Since afterwards.
+type metnoEntry struct {
+	observation  Observation
+	lastModified string
+	expires      time.Time
+}
+
+// metnoProvider uses the keyless Met.no Locationforecast API. Cities are
+// located through the city catalog, since the API only takes coordinates.
+type metnoProvider struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+}
+
+// metnoEntries caches the responses by coordinates.
+var metnoEntries = newLRUCache[string, metnoEntry]("metno", maxCachedCities)
+
+// newMetnoProvider reads METNO_USER_AGENT, which Met.no requires to name the
+// application and a contact address, and METNO_BASE_URL.
+func newMetnoProvider(cfg *Config) (*metnoProvider, error) {
+	userAgent := cfg.MetnoUserAgent
+	if userAgent == "" {
+		return nil, fmt.Errorf("METNO_USER_AGENT is required for the metno provider, e.g. \"weather-app/1.0 ops@example.com\"")
+	}
+	baseURL := cfg.MetnoBaseURL
+	return &metnoProvider{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		userAgent: userAgent,
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: tracedUpstream},
+	}, nil
+}
+
+func (p *metnoProvider) Current(ctx context.Context, city string) (Observation, error) {
+	if !cities.Loaded() {
+		return Observation{}, fmt.Errorf("%w: the metno provider needs the city catalog (CITY_CATALOG)", ErrProviderUnavailable)
+	}
+	c, ok := cities.Lookup(city)
+	if !ok {
+		return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	}
+	// The terms ask for at most four decimals so responses can be cached.
+	key := fmt.Sprintf("lat=%.4f&lon=%.4f", c.Latitude, c.Longitude)
+
+	entry, cached := metnoEntries.Get(key)
+	if cached && time.Now().Before(entry.expires) {
+		return entry.observation, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/weatherapi/locationforecast/2.0/compact?"+key, nil)
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	if cached && entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+	upstreamCallsTotal.Inc()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		entry.expires = metnoExpires(resp)
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNonAuthoritativeInfo:
+		if resp.StatusCode == http.StatusNonAuthoritativeInfo {
+			log.Printf("Met.no reports the Locationforecast version in use as deprecated")
+		}
+		observation, err := parseMetnoForecast(resp.Body)
+		if err != nil {
+			return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+		}
+		entry = metnoEntry{observation: observation, lastModified: resp.Header.Get("Last-Modified"), expires: metnoExpires(resp)}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return Observation{}, &QuotaError{RetryAfter: retryAfterHeader(resp)}
+	case resp.StatusCode == http.StatusForbidden:
+		return Observation{}, fmt.Errorf("%w: Met.no refused the request, check METNO_USER_AGENT", ErrProviderUnavailable)
+	default:
+		return Observation{}, fmt.Errorf("%w: Met.no returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	metnoEntries.Set(key, entry)
+	return entry.observation, nil
+}
+
+// metnoExpires is the Expires header, or one minute from now when it is
+// missing or malformed.
+func metnoExpires(resp *http.Response) time.Time {
+	if t, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		return t
+	}
+	return time.Now().Add(time.Minute)
+}
+
+// parseMetnoForecast takes the conditions from the first time step, which
+// is the current hour.
+func parseMetnoForecast(body io.Reader) (Observation, error) {
+	var forecast metnoForecast
+	if err := json.NewDecoder(io.LimitReader(body, 4<<20)).Decode(&forecast); err != nil {
+		return Observation{}, fmt.Errorf("invalid Met.no response: %v", err)
+	}
+	if len(forecast.Properties.Timeseries) == 0 {
+		return Observation{}, fmt.Errorf("Met.no response has no time steps")
+	}
+	now := forecast.Properties.Timeseries[0].Data
+	if now.Instant.Details.AirTemperature == nil {
+		return Observation{}, fmt.Errorf("Met.no response has no air temperature")
+	}
+	observation := Observation{
+		Temperature:   *now.Instant.Details.AirTemperature,
+		Humidity:      -1,
+		WindSpeed:     -1,
+		ConditionCode: metnoCondition(now.Next1Hours.Summary.SymbolCode),
+	}
+	if h := now.Instant.Details.RelativeHumidity; h != nil {
+		observation.Humidity = *h
+	}
+	if v := now.Instant.Details.WindSpeed; v != nil {
+		observation.WindSpeed = *v
+	}
+	return observation, nil
+}
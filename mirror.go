@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var mirroredRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mirrored_requests_total",
+		Help: "Total number of sampled requests mirrored to the staging instance by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(mirroredRequestsTotal)
+}
+
+const (
+	mirrorMaxBody     = 1 << 20
+	mirrorMaxInFlight = 32
+)
+
+// sensitiveParams are query parameters and JSON keys that never leave the
+// instance: station passwords and passkeys, API keys, tokens, secrets,
+// OIDC authorization codes, states and sessions, and webhook URLs, which
+// staging must not call.
+var sensitiveParams = []string{"password", "passkey", "mac", "appid", "key", "token", "id_token", "secret", "code", "state", "session", "url"}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveParams {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestMirror copies a sample of incoming requests to a staging instance.
+// Copies are sent in the background and their responses discarded; when
+// mirrorMaxInFlight copies are pending, further ones are dropped so a slow
+// staging instance never holds up production traffic.
+type requestMirror struct {
+	target *url.URL
+	rate   float64
+	client *http.Client
+	slots  chan struct{}
+}
+
+// newRequestMirror reads MIRROR_URL and MIRROR_SAMPLE_RATE (0–1, default
+// 0.01). It returns nil when mirroring is disabled.
+func newRequestMirror(cfg *Config) (*requestMirror, error) {
+	raw := cfg.MirrorURL
+	if raw == "" {
+		return nil, nil
+	}
+	target, err := url.Parse(raw)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid MIRROR_URL %q", raw)
+	}
+	return &requestMirror{
+		target: target,
+		rate:   cfg.MirrorSampleRate,
+		client: &http.Client{Timeout: 5 * time.Second, Transport: upstreamTransport},
+		slots:  make(chan struct{}, mirrorMaxInFlight),
+	}, nil
+}
+
+// Middleware mirrors sampled requests before serving them. The admin API,
+// the dashboard login and the metrics endpoint are never mirrored.
+func (m *requestMirror) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin") || strings.HasPrefix(r.URL.Path, "/auth/") || r.URL.Path == "/metrics" || rand.Float64() >= m.rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, mirrorMaxBody+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+		mirrored, err := m.sanitize(r, body)
+		if err == nil {
+			select {
+			case m.slots <- struct{}{}:
+			default:
+				err = fmt.Errorf("too many mirrored requests in flight")
+			}
+		}
+		if err != nil {
+			mirroredRequestsTotal.WithLabelValues("dropped").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		go m.send(mirrored)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sanitize builds the mirrored request: sensitive query parameters and JSON
+// fields are replaced with "REDACTED", credentials and cookies are dropped,
+// and form or other non-JSON bodies are not forwarded at all.
+func (m *requestMirror) sanitize(r *http.Request, body []byte) (*http.Request, error) {
+	if len(body) > mirrorMaxBody {
+		return nil, fmt.Errorf("body too large to mirror")
+	}
+
+	u := *m.target
+	u.Path = strings.TrimSuffix(m.target.Path, "/") + r.URL.Path
+	query := r.URL.Query()
+	for name := range query {
+		if isSensitive(name) {
+			query[name] = []string{"REDACTED"}
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	var sanitized []byte
+	contentType := r.Header.Get("Content-Type")
+	if len(body) > 0 && strings.HasPrefix(contentType, "application/json") {
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, fmt.Errorf("unparsable JSON body")
+		}
+		sanitized, _ = json.Marshal(redactJSON(v))
+	}
+
+	mirrored, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(sanitized))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Accept", "Accept-Language", "User-Agent"} {
+		if v := r.Header.Get(name); v != "" {
+			mirrored.Header.Set(name, v)
+		}
+	}
+	if sanitized != nil {
+		mirrored.Header.Set("Content-Type", contentType)
+	}
+	mirrored.Header.Set("X-Mirrored-From", r.Host)
+	return mirrored, nil
+}
+
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if isSensitive(k) {
+				v[k] = "REDACTED"
+			} else {
+				v[k] = redactJSON(item)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+func (m *requestMirror) send(req *http.Request) {
+	defer func() { <-m.slots }()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		mirroredRequestsTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	mirroredRequestsTotal.WithLabelValues("sent").Inc()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var modbusRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "modbus_requests_total",
+		Help: "Total number of Modbus TCP requests",
+	},
+	[]string{"function", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(modbusRequestsTotal)
+}
+
+// Modbus function and exception codes used by the read-only register server.
+const (
+	modbusReadHolding = 0x03
+	modbusReadInput   = 0x04
+
+	modbusIllegalFunction = 0x01
+	modbusIllegalAddress  = 0x02
+	modbusIllegalValue    = 0x03
+
+	modbusMaxRegisters = 125
+	modbusIdleTimeout  = 2 * time.Minute
+
+	modbusFlagCached = 1 << 0
+	modbusFlagStale  = 1 << 1
+)
+
+// modbusFields lists the values that can be mapped to registers and how many
+// 16-bit registers each occupies.
+var modbusFields = map[string]int{
+	"temperature":   1, // int16, hundredths of °C
+	"temperature_f": 1, // int16, hundredths of °F
+	"humidity":      1, // uint16, % (0xFFFF = unknown)
+	"condition":     1, // uint16, OpenWeatherMap condition code
+	"timestamp":     2, // uint32, Unix seconds, high word first
+	"age":           1, // uint16, seconds since the observation, saturating
+	"flags":         1, // bit 0: served from cache, bit 1: last refresh failed
+}
+
+const modbusDefaultRegisters = "temperature=0,humidity=1,condition=2,timestamp=3,flags=5,age=6"
+
+// parseModbusRegisters parses a "field=address,..." register map.
+func parseModbusRegisters(value string) (map[string]uint16, error) {
+	mapping := make(map[string]uint16)
+	used := make(map[uint16]string)
+	for _, entry := range strings.Split(value, ",") {
+		name, addr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		size, known := modbusFields[name]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid register mapping %q", entry)
+		}
+		start, err := strconv.ParseUint(addr, 10, 16)
+		if err != nil || start+uint64(size) > math.MaxUint16+1 {
+			return nil, fmt.Errorf("invalid register address in %q", entry)
+		}
+		for i := uint16(0); i < uint16(size); i++ {
+			if other, taken := used[uint16(start)+i]; taken {
+				return nil, fmt.Errorf("register %d mapped to both %s and %s", uint16(start)+i, other, name)
+			}
+			used[uint16(start)+i] = name
+		}
+		mapping[name] = uint16(start)
+	}
+	return mapping, nil
+}
+
+type modbusServer struct {
+	unitID  uint8
+	mapping map[string]uint16
+	poller  *weatherPoller
+}
+
+// startModbusServer exposes the current conditions of MODBUS_CITY as a
+// read-only Modbus TCP slave. Readings are refreshed in the background every
+// MODBUS_REFRESH so PLC polling never reaches the upstream provider.
+func startModbusServer(cfg *Config) error {
+	mapping, err := parseModbusRegisters(cfg.ModbusRegisters)
+	if err != nil {
+		return fmt.Errorf("invalid MODBUS_REGISTERS: %w", err)
+	}
+	city := cfg.ModbusCity
+	if city == "" {
+		city = cfg.WeatherCity
+	}
+
+	ln, err := listenTCPUpgradable("modbus", cfg.ModbusListen)
+	if err != nil {
+		return err
+	}
+	s := &modbusServer{
+		unitID:  uint8(cfg.ModbusUnitID),
+		mapping: mapping,
+		poller:  newWeatherPoller("Modbus", city, cfg.ModbusRefresh),
+	}
+	log.Printf("Modbus TCP server listening on %s (unit %d, %s)", ln.Addr(), s.unitID, city)
+	closeOnStop(ln)
+	go s.poller.Run()
+	go s.serve(ln)
+	return nil
+}
+
+func (s *modbusServer) encode(result weatherResult, stale bool, now time.Time) (map[uint16]uint16, uint16) {
+	centi := func(v float64) uint16 {
+		return uint16(int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(v*100)))))
+	}
+
+	humidity := uint16(0xFFFF)
+	if result.Humidity >= 0 && result.Humidity <= 100 {
+		humidity = uint16(math.Round(result.Humidity))
+	}
+	var flags uint16
+	if result.Source == "cache" {
+		flags |= modbusFlagCached
+	}
+	if stale {
+		flags |= modbusFlagStale
+	}
+	age := math.Min(math.MaxUint16, math.Max(0, now.Sub(result.FetchedAt).Seconds()))
+	if result.FetchedAt.IsZero() {
+		age = math.MaxUint16
+	}
+	timestamp := uint32(0)
+	if !result.FetchedAt.IsZero() {
+		timestamp = uint32(result.FetchedAt.Unix())
+	}
+
+	values := map[string][]uint16{
+		"temperature":   {centi(result.Temperature)},
+		"temperature_f": {centi(celsiusToFahrenheit(result.Temperature))},
+		"humidity":      {humidity},
+		"condition":     {uint16(result.ConditionCode)},
+		"timestamp":     {uint16(timestamp >> 16), uint16(timestamp)},
+		"age":           {uint16(age)},
+		"flags":         {flags},
+	}
+
+	registers := make(map[uint16]uint16)
+	var highest uint16
+	for name, start := range s.mapping {
+		for i, v := range values[name] {
+			addr := start + uint16(i)
+			registers[addr] = v
+			if addr > highest {
+				highest = addr
+			}
+		}
+	}
+	return registers, highest
+}
+
+func (s *modbusServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if backgroundJobs.Err() != nil {
+			return
+		}
+		if err != nil {
+			logError("Modbus accept error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn answers MBAP-framed requests until the client disconnects or
+// stays idle for too long. Requests for other unit IDs are ignored.
+func (s *modbusServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 7)
+	for {
+		conn.SetReadDeadline(time.Now().Add(modbusIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		unit := header[6]
+		if unit != s.unitID && unit != 0xFF {
+			continue
+		}
+
+		reply := s.handle(pdu)
+		frame := make([]byte, 7, 7+len(reply))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(reply)+1))
+		frame[6] = unit
+		if _, err := conn.Write(append(frame, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *modbusServer) handle(pdu []byte) []byte {
+	function := pdu[0]
+	label := strconv.Itoa(int(function))
+	exception := func(code byte) []byte {
+		modbusRequestsTotal.WithLabelValues(label, "exception").Inc()
+		return []byte{function | 0x80, code}
+	}
+
+	if function != modbusReadHolding && function != modbusReadInput {
+		return exception(modbusIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(modbusIllegalValue)
+	}
+	start := binary.BigEndian.Uint16(pdu[1:])
+	count := binary.BigEndian.Uint16(pdu[3:])
+	if count == 0 || count > modbusMaxRegisters {
+		return exception(modbusIllegalValue)
+	}
+
+	result, stale := s.poller.Latest()
+	registers, highest := s.encode(result, stale, time.Now())
+	if uint32(start)+uint32(count)-1 > uint32(highest) {
+		return exception(modbusIllegalAddress)
+	}
+	reply := make([]byte, 2+2*int(count))
+	reply[0] = function
+	reply[1] = byte(2 * count)
+	for i := uint16(0); i < count; i++ {
+		// Gaps in the register map read as zero.
+		binary.BigEndian.PutUint16(reply[2+2*i:], registers[start+i])
+	}
+	modbusRequestsTotal.WithLabelValues(label, "ok").Inc()
+	return reply
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testModbusServer(t *testing.T) *modbusServer {
+	t.Helper()
+	mapping, err := parseModbusRegisters(modbusDefaultRegisters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller := newWeatherPoller("Modbus", "Oslo", time.Minute)
+	poller.result = weatherResult{
+		Observation: Observation{Temperature: -3.25, Humidity: 81, ConditionCode: 600},
+		FetchedAt:   time.Now(),
+	}
+	poller.stale = false
+	return &modbusServer{unitID: 1, mapping: mapping, poller: poller}
+}
+
+func TestParseModbusRegisters(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]uint16
+		wantErr bool
+	}{
+		{value: "temperature=0", want: map[string]uint16{"temperature": 0}},
+		{value: " temperature=10 , timestamp=11", want: map[string]uint16{"temperature": 10, "timestamp": 11}},
+		{value: "timestamp=65534", want: map[string]uint16{"timestamp": 65534}},
+		{value: "timestamp=65535", wantErr: true},
+		{value: "temperature=65536", wantErr: true},
+		{value: "temperature=-1", wantErr: true},
+		{value: "temperature", wantErr: true},
+		{value: "pressure=0", wantErr: true},
+		{value: "timestamp=0,humidity=1", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseModbusRegisters(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, addr := range tt.want {
+				if got[name] != addr {
+					t.Errorf("%s at %d, want %d", name, got[name], addr)
+				}
+			}
+		})
+	}
+}
+
+func TestModbusHandle(t *testing.T) {
+	s := testModbusServer(t)
+	read := func(function byte, start, count uint16) []byte {
+		pdu := []byte{function, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], start)
+		binary.BigEndian.PutUint16(pdu[3:], count)
+		return pdu
+	}
+
+	tests := []struct {
+		name string
+		pdu  []byte
+		want []byte
+	}{
+		{"temperature and humidity", read(modbusReadHolding, 0, 2), []byte{modbusReadHolding, 4, 0xFE, 0xBB, 0, 81}},
+		{"input registers", read(modbusReadInput, 2, 1), []byte{modbusReadInput, 2, 0x02, 0x58}},
+		{"write function", []byte{0x06, 0, 0, 0, 1}, []byte{0x86, modbusIllegalFunction}},
+		{"short request", []byte{modbusReadHolding, 0, 0}, []byte{0x83, modbusIllegalValue}},
+		{"long request", append(read(modbusReadHolding, 0, 1), 0), []byte{0x83, modbusIllegalValue}},
+		{"zero registers", read(modbusReadHolding, 0, 0), []byte{0x83, modbusIllegalValue}},
+		{"too many registers", read(modbusReadHolding, 0, modbusMaxRegisters+1), []byte{0x83, modbusIllegalValue}},
+		{"past the last register", read(modbusReadHolding, 6, 2), []byte{0x83, modbusIllegalAddress}},
+		{"wrapping address", read(modbusReadHolding, 0xFFFF, 2), []byte{0x83, modbusIllegalAddress}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.handle(tt.pdu); !bytes.Equal(got, tt.want) {
+				t.Errorf("handle(% x) = % x, want % x", tt.pdu, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModbusFrames(t *testing.T) {
+	request := []byte{0x00, 0x07, 0, 0, 0, 6, 1, modbusReadHolding, 0, 2, 0, 1}
+	reply := []byte{0x00, 0x07, 0, 0, 0, 5, 1, modbusReadHolding, 2, 0x02, 0x58}
+	withUnit := func(unit byte) []byte {
+		frame := append([]byte(nil), request...)
+		frame[6] = unit
+		return frame
+	}
+
+	tests := []struct {
+		name string
+		sent []byte
+		// want is the reply; without one the server must close the
+		// connection, at the latest when the client does.
+		want []byte
+	}{
+		{"read", request, reply},
+		{"broadcast unit", withUnit(0xFF), append(append([]byte(nil), reply[:6]...), append([]byte{0xFF}, reply[7:]...)...)},
+		{"other unit ignored", append(withUnit(9), request...), reply},
+		{"truncated header", request[:5], nil},
+		{"truncated PDU", request[:10], nil},
+		{"wrong protocol", []byte{0, 7, 0, 1, 0, 6, 1, modbusReadHolding, 0, 2, 0, 1}, nil},
+		{"length too short", []byte{0, 7, 0, 0, 0, 1, 1}, nil},
+		{"length too long", []byte{0, 7, 0, 0, 0, 255, 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testModbusServer(t)
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				s.handleConn(server)
+				close(done)
+			}()
+
+			go client.Write(tt.sent)
+			if tt.want != nil {
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				got := make([]byte, len(tt.want))
+				if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, tt.want) {
+					t.Errorf("reply % x (%v), want % x", got, err, tt.want)
+				}
+			} else {
+				client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if n, _ := client.Read(make([]byte, 1)); n > 0 {
+					t.Error("got a reply, want none")
+				}
+			}
+			client.Close()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Error("server still serving after the client closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var mqttPublishTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mqtt_publish_total",
+		Help: "Total number of rounds of observations published to the MQTT broker",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(mqttPublishTotal)
+}
+
+// MQTT 3.1.1 control packets used by the publisher.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xE0
+
+	mqttRetain       = 0x01
+	mqttCleanSession = 0x02
+	mqttPasswordFlag = 0x40
+	mqttUsernameFlag = 0x80
+)
+
+// mqttPublisher publishes the conditions of WEATHER_CITY and COLLECT_CITIES
+// to an MQTT broker as retained JSON states, with Home Assistant discovery
+// configs so that each city shows up as a device with temperature and
+// humidity sensors. It connects for each round, like the CWOP publisher;
+// expire_after marks the sensors unavailable when rounds stop.
+type mqttPublisher struct {
+	broker    *url.URL
+	username  string
+	password  string
+	clientID  string
+	prefix    string
+	discovery string
+	interval  time.Duration
+}
+
+func newMQTTPublisher(cfg *Config) (*mqttPublisher, error) {
+	broker, err := url.Parse(cfg.MQTTBroker)
+	if err != nil || (broker.Scheme != "mqtt" && broker.Scheme != "mqtts") || broker.Hostname() == "" {
+		return nil, fmt.Errorf("MQTT_BROKER must be an mqtt:// or mqtts:// URL")
+	}
+	p := &mqttPublisher{
+		broker:    broker,
+		username:  cfg.MQTTUsername,
+		password:  cfg.MQTTPassword,
+		clientID:  cfg.MQTTClientID,
+		prefix:    strings.TrimSuffix(cfg.MQTTTopicPrefix, "/"),
+		discovery: strings.TrimSuffix(cfg.MQTTDiscoveryPrefix, "/"),
+		interval:  cfg.MQTTInterval,
+	}
+	if p.clientID == "" {
+		host, _ := os.Hostname()
+		p.clientID = "weather-app-" + host
+	}
+	return p, nil
+}
+
+func (p *mqttPublisher) Run() {
+	log.Printf("Publishing observations to MQTT broker %s under %s/ every %v", p.broker.Host, p.prefix, p.interval)
+	ticks := backgroundTicks(p.interval)
+	for {
+		if err := p.publishRound(); err != nil {
+			logError("MQTT publish failed: %v", err)
+			mqttPublishTotal.WithLabelValues("error").Inc()
+		} else {
+			mqttPublishTotal.WithLabelValues("success").Inc()
+		}
+		if _, ok := <-ticks; !ok {
+			return
+		}
+	}
+}
+
+// mqttState is the retained state message of a city.
+type mqttState struct {
+	Temperature float64  `json:"temperature"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Condition   int      `json:"condition"`
+	Timestamp   string   `json:"timestamp"`
+}
+
+// publishRound fetches every city and publishes its discovery configs and
+// state on one connection. Cities that cannot be fetched are skipped.
+func (p *mqttPublisher) publishRound() error {
+	type message struct {
+		topic   string
+		payload []byte
+	}
+	var messages []message
+	for _, city := range collectCities() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		result, err := currentWeather(ctx, city)
+		cancel()
+		if err != nil {
+			logError("MQTT refresh for %s failed: %v", city, err)
+			continue
+		}
+		state := mqttState{
+			Temperature: result.Temperature,
+			Condition:   result.ConditionCode,
+			Timestamp:   result.FetchedAt.UTC().Format(time.RFC3339),
+		}
+		if result.Humidity >= 0 {
+			humidity := result.Humidity
+			state.Humidity = &humidity
+		}
+		id := mqttObjectID(city)
+		stateTopic := p.prefix + "/" + id + "/state"
+		for _, config := range p.discoveryConfigs(city, id, stateTopic, state.Humidity != nil) {
+			payload, _ := json.Marshal(config.payload)
+			messages = append(messages, message{config.topic, payload})
+		}
+		payload, _ := json.Marshal(state)
+		messages = append(messages, message{stateTopic, payload})
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("no city could be fetched")
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, m := range messages {
+		if err := writeMQTTPacket(conn, mqttPublish|mqttRetain, mqttString(m.topic), m.payload); err != nil {
+			return err
+		}
+	}
+	return writeMQTTPacket(conn, mqttDisconnect)
+}
+
+type mqttDiscoveryConfig struct {
+	topic   string
+	payload map[string]any
+}
+
+// discoveryConfigs returns the Home Assistant MQTT discovery configs of the
+// sensors of a city, one device per city.
+func (p *mqttPublisher) discoveryConfigs(city, id, stateTopic string, humidity bool) []mqttDiscoveryConfig {
+	device := map[string]any{
+		"identifiers":  []string{"weather-app_" + id},
+		"name":         "Weather " + city,
+		"manufacturer": "weather-app",
+		"sw_version":   version,
+	}
+	// Unavailable once two rounds were missed.
+	expireAfter := int(3 * p.interval / time.Second)
+	sensor := func(kind, name, deviceClass, unit string) mqttDiscoveryConfig {
+		return mqttDiscoveryConfig{
+			topic: p.discovery + "/sensor/weather-app_" + id + "/" + kind + "/config",
+			payload: map[string]any{
+				"name":                name,
+				"unique_id":           "weather-app_" + id + "_" + kind,
+				"object_id":           "weather_" + id + "_" + kind,
+				"state_topic":         stateTopic,
+				"value_template":      "{{ value_json." + kind + " }}",
+				"device_class":        deviceClass,
+				"unit_of_measurement": unit,
+				"state_class":         "measurement",
+				"expire_after":        expireAfter,
+				"device":              device,
+			},
+		}
+	}
+	configs := []mqttDiscoveryConfig{sensor("temperature", "Temperature", "temperature", "°C")}
+	if humidity {
+		configs = append(configs, sensor("humidity", "Humidity", "humidity", "%"))
+	}
+	return configs
+}
+
+// mqttObjectID turns a city into the characters allowed in topics and
+// Home Assistant ids: "Sankt-Peterburg, RU" becomes "sankt-peterburg_ru".
+// Names without any, such as "Москва", get a checksum instead.
+func mqttObjectID(city string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(city) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	if id := strings.TrimSuffix(b.String(), "_"); id != "" {
+		return id
+	}
+	return fmt.Sprintf("city_%08x", crc32.ChecksumIEEE([]byte(city)))
+}
+
+// connect opens a clean session with the broker and waits for its CONNACK.
+func (p *mqttPublisher) connect() (net.Conn, error) {
+	addr := p.broker.Host
+	if p.broker.Port() == "" {
+		port := "1883"
+		if p.broker.Scheme == "mqtts" {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(p.broker.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if p.broker.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: p.broker.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	flags := byte(mqttCleanSession)
+	payload := [][]byte{mqttString(p.clientID)}
+	if p.username != "" {
+		flags |= mqttUsernameFlag
+		payload = append(payload, mqttString(p.username))
+		if p.password != "" {
+			flags |= mqttPasswordFlag
+			payload = append(payload, mqttString(p.password))
+		}
+	}
+	// Protocol name, level 4 (3.1.1), flags and a keep alive of 60s.
+	header := append(mqttString("MQTT"), 4, flags, 0, 60)
+	if err := writeMQTTPacket(conn, mqttConnect, append([][]byte{header}, payload...)...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if ack[0] != mqttConnack || ack[1] != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply %#x to CONNECT", ack[0])
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused the connection: %s", mqttConnackReason(ack[3]))
+	}
+	return conn, nil
+}
+
+func mqttConnackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", code)
+}
+
+// writeMQTTPacket writes a control packet: the type and flags, the
+// remaining length as a variable length integer, then the parts.
+func writeMQTTPacket(w io.Writer, header byte, parts ...[]byte) error {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	packet := []byte{header}
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	for _, part := range parts {
+		packet = append(packet, part...)
+	}
+	_, err := w.Write(packet)
+	return err
+}
+
+// mqttString encodes s with its 16-bit length prefix.
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies of the OIDC login: the session, and the state of a login in
+// progress between the redirect to the provider and the callback.
+const (
+	oidcSessionCookie = "weather_session"
+	oidcLoginCookie   = "weather_login"
+	oidcLoginTimeout  = 10 * time.Minute
+)
+
+// oidcHTTPClient talks to the provider. It shares the proxy and TLS
+// settings of upstream calls, but not weatherClient's API key failover and
+// request logging, which are meant for weather providers.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+
+// checkOIDCEndpoint requires https, since the ID token is trusted for
+// arriving over TLS and not checked for a signature; plain http is only
+// accepted on the loopback interface, for a provider run locally.
+func checkOIDCEndpoint(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if u.Scheme == "http" && (u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("must be an https URL")
+}
+
+// oidcClient logs dashboard users in with the authorization code flow of
+// an OpenID Connect provider (Keycloak, Azure AD, Google, Dex...). Sessions
+// are cookies signed with OIDC_SESSION_KEY rather than server state, so
+// they survive upgrades and work across shards.
+type oidcClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  *url.URL
+	scopes       string
+	rolesClaim   string
+	sessionKey   []byte
+	sessionTTL   time.Duration
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+// oidcDiscovery is the part of the provider's
+// /.well-known/openid-configuration the login uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcSession is the payload of the session cookie.
+type oidcSession struct {
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	Roles     []role `json:"roles,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// oidcLogin is the payload of the login cookie: what the callback checks
+// the provider's answer against and where it sends the user afterwards.
+type oidcLogin struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	Next      string `json:"next"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// newOIDCClient reads the OIDC_* settings; nil means OIDC login is off.
+func newOIDCClient(cfg *Config) (*oidcClient, error) {
+	issuer := strings.TrimSuffix(cfg.OIDCIssuer, "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	c := &oidcClient{
+		issuer:       issuer,
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		scopes:       cfg.OIDCScopes,
+		rolesClaim:   cfg.OIDCRolesClaim,
+		sessionTTL:   cfg.OIDCSessionTTL,
+	}
+	if c.clientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	redirect, err := url.Parse(cfg.OIDCRedirectURL)
+	if err != nil || (redirect.Scheme != "http" && redirect.Scheme != "https") || redirect.Host == "" || redirect.Path != "/auth/callback" {
+		return nil, fmt.Errorf("OIDC_REDIRECT_URL must be the absolute URL of /auth/callback, e.g. https://weather.example.com/auth/callback")
+	}
+	c.redirectURL = redirect
+	if key := cfg.OIDCSessionKey; key != "" {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("OIDC_SESSION_KEY must be at least 32 characters")
+		}
+		c.sessionKey = []byte(key)
+	} else {
+		// Sessions then end with the process.
+		c.sessionKey = []byte(randomHex(32))
+		log.Printf("OIDC_SESSION_KEY is not set, dashboard sessions end on restart")
+	}
+	return c, nil
+}
+
+// provider fetches the discovery document once; a failure is retried on
+// the next login, so that an unreachable provider does not stop the start.
+func (c *oidcClient) provider(ctx context.Context) (*oidcDiscovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: status %d", resp.StatusCode)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.Issuer != c.issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery: issuer %q or endpoints do not match OIDC_ISSUER", d.Issuer)
+	}
+	if err := checkOIDCEndpoint(d.TokenEndpoint); err != nil {
+		return nil, fmt.Errorf("discovery: token endpoint %s", err)
+	}
+	c.discovery = &d
+	return c.discovery, nil
+}
+
+// Purposes of signed cookies. The MAC covers the purpose, so that a login
+// cookie, which anyone can get from /auth/login, does not open as a session.
+const (
+	oidcPurposeSession = "session"
+	oidcPurposeLogin   = "login"
+)
+
+// sign and open protect cookie payloads: base64 JSON, a dot and the
+// HMAC-SHA256 of purpose and payload with the session key.
+func (c *oidcClient) sign(purpose string, v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(c.mac(purpose, payload))
+}
+
+func (c *oidcClient) open(purpose, value string, v any) bool {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, c.mac(purpose, payload)) {
+		return false
+	}
+	return decodeJWTPart(payload, v)
+}
+
+func (c *oidcClient) mac(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write([]byte(purpose + ":" + payload))
+	return mac.Sum(nil)
+}
+
+func (c *oidcClient) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   c.redirectURL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginHandler serves /auth/login: it sends the browser to the provider,
+// and back to ?next= once logged in.
+func (c *oidcClient) loginHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := c.provider(r.Context())
+	if err != nil {
+		logError("OIDC discovery at %s failed: %v", c.issuer, err)
+		writeProblem(w, r, http.StatusServiceUnavailable, "auth.unavailable")
+		return
+	}
+	login := oidcLogin{
+		State:     randomHex(16),
+		Nonce:     randomHex(16),
+		Verifier:  randomHex(32),
+		Next:      localRedirect(r.URL.Query().Get("next")),
+		ExpiresAt: time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.clientID},
+		"redirect_uri":          {c.redirectURL.String()},
+		"scope":                 {c.scopes},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	c.setCookie(w, oidcLoginCookie, c.sign(oidcPurposeLogin, login), oidcLoginTimeout)
+	target := d.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "302").Inc()
+}
+
+// localRedirect keeps ?next= on this site, so that the login cannot be
+// used to send users elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// callbackHandler serves /auth/callback: it redeems the code for an ID
+// token, checks it and starts the session.
+func (c *oidcClient) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil || !c.open(oidcPurposeLogin, cookie.Value, &login) || time.Now().Unix() > login.ExpiresAt ||
+		q.Get("state") == "" || q.Get("state") != login.State {
+		writeProblem(w, r, http.StatusBadRequest, "auth.login_failed", "unknown or expired login, start again")
+		return
+	}
+	c.setCookie(w, oidcLoginCookie, "", -1)
+	if e := q.Get("error"); e != "" {
+		writeProblem(w, r, http.StatusForbidden, "auth.login_failed", strings.TrimSpace(e+" "+q.Get("error_description")))
+		return
+	}
+	session, err := c.redeem(r.Context(), q.Get("code"), login)
+	if err != nil {
+		logError("OIDC login failed: %v", err)
+		writeProblem(w, r, http.StatusBadGateway, "auth.login_failed", err)
+		return
+	}
+	c.setCookie(w, oidcSessionCookie, c.sign(oidcPurposeSession, session), c.sessionTTL)
+	log.Printf("OIDC login of %s (%s)", session.Name, session.Subject)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "302").Inc()
+}
+
+// redeem exchanges the code at the token endpoint. The ID token comes
+// straight from the provider over TLS, authenticated with the client
+// secret, so its signature need not be checked (OpenID Connect Core
+// 3.1.3.7); issuer, audience, expiry and nonce are.
+func (c *oidcClient) redeem(ctx context.Context, code string, login oidcLogin) (oidcSession, error) {
+	d, err := c.provider(ctx)
+	if err != nil {
+		return oidcSession{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURL.String()},
+		"code_verifier": {login.Verifier},
+	}
+	if c.clientSecret == "" {
+		form.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return oidcSession{}, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return oidcSession{}, fmt.Errorf("token endpoint: status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return oidcSession{}, fmt.Errorf("token endpoint: status %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	parts := strings.Split(tokens.IDToken, ".")
+	var claims map[string]any
+	if len(parts) != 3 || !decodeJWTPart(parts[1], &claims) {
+		return oidcSession{}, fmt.Errorf("malformed ID token")
+	}
+	var id struct {
+		Issuer    string          `json:"iss"`
+		Subject   string          `json:"sub"`
+		Audience  json.RawMessage `json:"aud"`
+		ExpiresAt *int64          `json:"exp"`
+		Nonce     string          `json:"nonce"`
+		Username  string          `json:"preferred_username"`
+		Email     string          `json:"email"`
+	}
+	decodeJWTPart(parts[1], &id)
+	var audiences []string
+	if json.Unmarshal(id.Audience, &audiences) != nil {
+		var audience string
+		json.Unmarshal(id.Audience, &audience)
+		audiences = []string{audience}
+	}
+	switch {
+	case id.Issuer != d.Issuer:
+		return oidcSession{}, fmt.Errorf("ID token issued by %q", id.Issuer)
+	case !slices.Contains(audiences, c.clientID):
+		return oidcSession{}, fmt.Errorf("ID token is not for client %q", c.clientID)
+	case id.ExpiresAt == nil:
+		return oidcSession{}, fmt.Errorf("ID token has no expiry")
+	case time.Now().Unix() >= *id.ExpiresAt:
+		return oidcSession{}, fmt.Errorf("ID token expired")
+	case id.Nonce != login.Nonce:
+		return oidcSession{}, fmt.Errorf("ID token nonce does not match")
+	case id.Subject == "":
+		return oidcSession{}, fmt.Errorf("ID token has no subject")
+	}
+	session := oidcSession{
+		Subject:   id.Subject,
+		Name:      id.Username,
+		Roles:     jwtRoles(claims, c.rolesClaim),
+		ExpiresAt: time.Now().Add(c.sessionTTL).Unix(),
+	}
+	if session.Name == "" {
+		session.Name = id.Email
+	}
+	if session.Name == "" {
+		session.Name = id.Subject
+	}
+	return session, nil
+}
+
+// logoutHandler serves /auth/logout: it ends the session here and, when
+// the provider supports it, there. The session's CSRF token must come in
+// X-CSRF-Token or the csrf_token form field, so that other sites cannot
+// log users out.
+func (c *oidcClient) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if want := c.csrfToken(r); want != "" {
+		got := r.Header.Get(csrfHeader)
+		if got == "" {
+			got = r.PostFormValue("csrf_token")
+		}
+		if !hmac.Equal([]byte(got), []byte(want)) {
+			writeProblem(w, r, http.StatusForbidden, "auth.csrf")
+			return
+		}
+	}
+	c.setCookie(w, oidcSessionCookie, "", -1)
+	target := "/"
+	if d, err := c.provider(r.Context()); err == nil && d.EndSessionEndpoint != "" {
+		home := *c.redirectURL
+		home.Path, home.RawQuery = "/", ""
+		target = d.EndSessionEndpoint + "?" + url.Values{
+			"client_id":                {c.clientID},
+			"post_logout_redirect_uri": {home.String()},
+		}.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "303").Inc()
+}
+
+// oidcScheme accepts the session cookie of the OIDC login. Its roles come
+// from the OIDC_ROLES_CLAIM of the ID token.
+type oidcScheme struct{ client *oidcClient }
+
+func (s oidcScheme) Authenticate(r *http.Request) (principal, bool, error) {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	var session oidcSession
+	if err != nil || !s.client.open(oidcPurposeSession, cookie.Value, &session) ||
+		session.Subject == "" || time.Now().Unix() >= session.ExpiresAt {
+		return principal{}, false, nil
+	}
+	return principal{Scheme: "oidc", Name: session.Name, Roles: session.Roles}, true, nil
+}
+
+func (oidcScheme) Challenge(realm string) string { return fmt.Sprintf("Session realm=%q", realm) }
+
+// redirectToLogin sends browsers that opened a page of a policy accepting
+// oidc to the login instead of answering 401.
+func redirectToLogin(w http.ResponseWriter, r *http.Request, policy authPolicy) bool {
+	if r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	for _, alternative := range policy {
+		if slices.Contains(alternative, "oidc") {
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "302").Inc()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testOIDCClient() *oidcClient {
+	redirect, _ := url.Parse("https://weather.example.com/auth/callback")
+	return &oidcClient{sessionKey: []byte("0123456789abcdef0123456789abcdef"), redirectURL: redirect, sessionTTL: time.Hour}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	c := testOIDCClient()
+	other := testOIDCClient()
+	other.sessionKey = []byte("another key of at least 32 characters")
+	future := time.Now().Add(time.Hour).Unix()
+	session := oidcSession{Subject: "u-1", Name: "alice", Roles: []role{roleAdmin}, ExpiresAt: future}
+	valid := c.sign(oidcPurposeSession, session)
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   bool
+	}{
+		{name: "valid", cookie: valid, want: true},
+		{name: "expired", cookie: c.sign(oidcPurposeSession, oidcSession{Subject: "u-1", ExpiresAt: time.Now().Add(-time.Second).Unix()})},
+		{name: "no subject", cookie: c.sign(oidcPurposeSession, oidcSession{Name: "alice", ExpiresAt: future})},
+		// The login cookie is handed to anyone who opens /auth/login.
+		{name: "login cookie", cookie: c.sign(oidcPurposeLogin, oidcLogin{State: "s", ExpiresAt: future})},
+		{name: "login cookie with a subject", cookie: c.sign(oidcPurposeLogin, session)},
+		{name: "other key", cookie: other.sign(oidcPurposeSession, session)},
+		{name: "tampered payload", cookie: "e30" + valid[2:]},
+		{name: "no signature", cookie: "e30"},
+		{name: "bad signature encoding", cookie: "e30.!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: tt.cookie})
+			p, ok, err := oidcScheme{c}.Authenticate(r)
+			if err != nil || ok != tt.want {
+				t.Fatalf("Authenticate = %v, %v, want %v", ok, err, tt.want)
+			}
+			if ok && (p.Scheme != "oidc" || p.Name != "alice" || len(p.Roles) != 1 || p.Roles[0] != roleAdmin) {
+				t.Errorf("principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginCookie(t *testing.T) {
+	c := testOIDCClient()
+	login := oidcLogin{State: "state", Nonce: "nonce", Verifier: "verifier", Next: "/history", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	var got oidcLogin
+	if !c.open(oidcPurposeLogin, c.sign(oidcPurposeLogin, login), &got) || got != login {
+		t.Errorf("round trip gave %+v, want %+v", got, login)
+	}
+	session := oidcSession{Subject: "u-1", ExpiresAt: login.ExpiresAt}
+	if c.open(oidcPurposeLogin, c.sign(oidcPurposeSession, session), &got) {
+		t.Error("a session cookie opened as a login")
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct{ next, want string }{
+		{"", "/"},
+		{"/", "/"},
+		{"/history?city=Oslo", "/history?city=Oslo"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com/", "/"},
+		{"history", "/"},
+		{"javascript:alert(1)", "/"},
+	}
+	for _, tt := range tests {
+		if got := localRedirect(tt.next); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	c := testOIDCClient()
+	cookie := &http.Cookie{Name: oidcSessionCookie, Value: c.sign(oidcPurposeSession, oidcSession{Subject: "u-1", ExpiresAt: time.Now().Add(time.Hour).Unix()})}
+	handler := authChain(
+		map[string]authScheme{"oidc": oidcScheme{c}, "token": testScheme{name: "token"}},
+		map[string]authPolicy{authGroupAPI: {{"oidc"}, {"token"}}},
+	)(csrfMiddleware(c)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-CSRF", requestCSRFToken(r))
+	})))
+	token := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		return c.csrfToken(r)
+	}()
+
+	tests := []struct {
+		name       string
+		method     string
+		session    bool
+		creds      string
+		csrf       string
+		wantStatus int
+	}{
+		{name: "read with session", method: http.MethodGet, session: true, wantStatus: http.StatusOK},
+		{name: "change without token", method: http.MethodPost, session: true, wantStatus: http.StatusForbidden},
+		{name: "change with wrong token", method: http.MethodDelete, session: true, csrf: "nope", wantStatus: http.StatusForbidden},
+		{name: "change with token", method: http.MethodPost, session: true, csrf: token, wantStatus: http.StatusOK},
+		{name: "other credentials", method: http.MethodPost, creds: "token", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/subscriptions", nil)
+			if tt.session {
+				r.AddCookie(cookie)
+			}
+			if tt.creds != "" {
+				r.Header.Set("X-Test-Auth", tt.creds)
+			}
+			if tt.csrf != "" {
+				r.Header.Set(csrfHeader, tt.csrf)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.session && w.Code == http.StatusOK && w.Header().Get("X-CSRF") != token {
+				t.Errorf("page token %q, want %q", w.Header().Get("X-CSRF"), token)
+			}
+		})
+	}
+}
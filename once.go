@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// runOnceCommand implements "weather-app --once": one collection of
+// WEATHER_CITY and COLLECT_CITIES into the history store, then a push of
+// the metrics to PUSHGATEWAY_URL, for cron jobs instead of a long-running
+// server. It fails when any city or the push failed.
+func runOnceCommand(stderr io.Writer) int {
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	ring, err := newShardRing(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid shard configuration: %v\n", err)
+		return 1
+	}
+	shards = ring
+	store, err := openHistoryStore(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to open history store: %v\n", err)
+		return 1
+	}
+	history = store
+	if cfg.HistoryStore == "memory" {
+		log.Printf("HISTORY_STORE is memory, observations are not kept after this run")
+	}
+
+	job := &scheduledJob{name: "current", run: refreshCurrentConditions}
+	failed := job.runOnce() != nil
+	if url := cfg.PushgatewayURL; url != "" {
+		if err := pushMetrics(cfg, url); err != nil {
+			fmt.Fprintf(stderr, "Pushing metrics to %s failed: %v\n", url, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// pushMetrics replaces the metrics of PUSHGATEWAY_JOB on the Pushgateway at
+// url with the ones of this run.
+func pushMetrics(cfg *Config, url string) error {
+	pusher := push.New(url, cfg.PushgatewayJob).Gatherer(pushGatherer).Client(&http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport})
+	if instance := cfg.PushgatewayInstance; instance != "" {
+		pusher = pusher.Grouping("instance", instance)
+	}
+	return pusher.Push()
+}
+
+// pushGatherer is the default registry with the job label of metrics such
+// as scheduled_job_runs_total renamed to exported_job, as Prometheus does on
+// scrapes, since the Pushgateway reserves job for the grouping key.
+var pushGatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	exportedJob := "exported_job"
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == "job" {
+					label.Name = &exportedJob
+				}
+			}
+		}
+	}
+	return families, err
+})
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// pluginProcessGroup does nothing: process groups are a Unix feature.
+func pluginProcessGroup(cmd *exec.Cmd) {}
+
+// killPluginGroup kills the plugin started by cmd; processes it started
+// are left running.
+func killPluginGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
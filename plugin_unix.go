@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// pluginProcessGroup starts cmd in a process group of its own, so that
+// killPluginGroup also reaches the processes the plugin started.
+func pluginProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killPluginGroup kills the plugin started by cmd and every process left
+// in its group.
+func killPluginGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
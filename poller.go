@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// weatherPoller keeps the conditions of one city refreshed in the background
+// for protocol servers whose clients poll far more often than the upstream
+// quota allows.
+type weatherPoller struct {
+	name     string
+	city     string
+	interval time.Duration
+
+	mu     sync.RWMutex
+	result weatherResult
+	stale  bool
+}
+
+func newWeatherPoller(name, city string, interval time.Duration) *weatherPoller {
+	return &weatherPoller{name: name, city: city, interval: interval, stale: true}
+}
+
+func (p *weatherPoller) Run() {
+	p.refresh()
+	for range backgroundTicks(p.interval) {
+		p.refresh()
+	}
+}
+
+func (p *weatherPoller) refresh() {
+	result, err := currentWeather(context.Background(), p.city)
+	if err != nil {
+		logError("%s refresh for %s failed: %v", p.name, p.city, err)
+	}
+
+	p.mu.Lock()
+	p.stale = err != nil
+	if err == nil {
+		p.result = result
+	}
+	p.mu.Unlock()
+}
+
+// Latest returns the last successfully fetched conditions and whether the
+// most recent refresh failed. Before the first success it returns a zero
+// result marked stale.
+func (p *weatherPoller) Latest() (weatherResult, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.result, p.stale
+}
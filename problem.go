@@ -0,0 +1,139 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const defaultLanguage = "en"
+
+// messageCatalogs maps a language code to its message key -> format string
+// table. English is the fallback for missing languages and missing keys.
+var messageCatalogs = loadMessageCatalogs()
+
+func loadMessageCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		log.Fatalf("Failed to read message catalogs: %v", err)
+	}
+
+	catalogs := make(map[string]map[string]string)
+	for _, file := range files {
+		data, err := localeFiles.ReadFile("locales/" + file.Name())
+		if err != nil {
+			log.Fatalf("Failed to read message catalog %s: %v", file.Name(), err)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			log.Fatalf("Invalid message catalog %s: %v", file.Name(), err)
+		}
+		catalogs[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = messages
+	}
+	return catalogs
+}
+
+// acceptedLanguages parses an Accept-Language header into lower-cased language
+// tags ordered by preference, dropping those with q=0.
+func acceptedLanguages(header string) []string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	langs := make([]string, len(candidates))
+	for i, c := range candidates {
+		langs[i] = c.lang
+	}
+	return langs
+}
+
+// negotiateLanguage picks the best language with a message catalog from an
+// Accept-Language header, falling back from "ru-RU" to "ru".
+func negotiateLanguage(header string) string {
+	for _, lang := range acceptedLanguages(header) {
+		base, _, _ := strings.Cut(lang, "-")
+		if _, ok := messageCatalogs[base]; ok {
+			return base
+		}
+	}
+	return defaultLanguage
+}
+
+func localize(lang, key string, args ...any) string {
+	format, ok := messageCatalogs[lang][key]
+	if !ok {
+		format, ok = messageCatalogs[defaultLanguage][key]
+	}
+	if !ok {
+		return key
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Problem is an RFC 7807 problem details body.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Suggestions lists known cities when the requested one was not found.
+	Suggestions []City `json:"suggestions,omitempty"`
+}
+
+// writeProblem responds with an application/problem+json body whose detail is
+// the message identified by key, localized for the request's Accept-Language.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, key string, args ...any) {
+	sendProblem(w, r, newProblem(r, status, key, args...))
+}
+
+func newProblem(r *http.Request, status int, key string, args ...any) Problem {
+	return Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   localize(negotiateLanguage(r.Header.Get("Accept-Language")), key, args...),
+		Instance: r.URL.Path,
+	}
+}
+
+// sendProblem writes a problem built with newProblem, for callers that add
+// extension members.
+func sendProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Language", negotiateLanguage(r.Header.Get("Accept-Language")))
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(problem.Status)).Inc()
+	reportProblem(r, problem)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// WeatherProvider fetches the current conditions for a city. Errors wrap
+// ErrCityNotFound or ErrProviderUnavailable, or are a *QuotaError.
+// ctx carries the trace of the request the observation is fetched for.
+type WeatherProvider interface {
+	Current(ctx context.Context, city string) (Observation, error)
+}
+
+type providerFunc func(ctx context.Context, city string) (Observation, error)
+
+func (f providerFunc) Current(ctx context.Context, city string) (Observation, error) {
+	return f(ctx, city)
+}
+
+var weatherProvider WeatherProvider = providerFunc(getWeather)
+
+const pluginTimeout = 10 * time.Second
+
+// weatherProviderNames are the values of WEATHER_PROVIDER.
+var weatherProviderNames = []string{"openweathermap", "metno", "tomorrow", "weatherapi", "exec", "http", "ds18b20", "bme280"}
+
+// weatherProviderName is the configured WEATHER_PROVIDER.
+func weatherProviderName() string {
+	return runningConfig().WeatherProvider
+}
+
+// newWeatherProvider selects the provider from WEATHER_PROVIDER:
+// "openweathermap" (default), "metno" for the Met.no Locationforecast API,
+// "tomorrow" for Tomorrow.io, "weatherapi" for WeatherAPI.com, "exec" for a
+// plugin subprocess speaking JSON over stdio, "http" for a sidecar
+// adapter, or "ds18b20" and "bme280" for a sensor attached to this machine.
+func newWeatherProvider(cfg *Config) (WeatherProvider, error) {
+	switch kind := cfg.WeatherProvider; kind {
+	case "openweathermap":
+		return providerFunc(getWeather), nil
+	case "metno":
+		return newMetnoProvider(cfg)
+	case "tomorrow":
+		return newTomorrowProvider(cfg)
+	case "weatherapi":
+		return newWeatherAPIProvider(cfg)
+	case "exec":
+		command := strings.Fields(cfg.WeatherProviderCommand)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("WEATHER_PROVIDER_COMMAND is required for the exec provider")
+		}
+		return &execProvider{command: command, busy: make(chan struct{}, 1)}, nil
+	case "http":
+		endpoint := cfg.WeatherProviderURL
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("WEATHER_PROVIDER_URL must be an http or https URL for the http provider")
+		}
+		return &httpProvider{endpoint: u, client: &http.Client{Timeout: pluginTimeout, Transport: tracedUpstream}}, nil
+	case "ds18b20":
+		return newDS18B20Provider(cfg)
+	case "bme280":
+		return newBME280Provider(cfg)
+	default:
+		return nil, fmt.Errorf("unknown WEATHER_PROVIDER %q", kind)
+	}
+}
+
+// pluginResponse is the reply of an external provider, both for exec plugins
+// (one JSON object per line, matched by id) and HTTP sidecars.
+type pluginResponse struct {
+	ID            uint64       `json:"id"`
+	Temperature   *float64     `json:"temperature"`
+	Humidity      *float64     `json:"humidity"`
+	WindSpeed     *float64     `json:"wind_speed"`
+	ConditionCode int          `json:"condition_code"`
+	Description   string       `json:"description"`
+	Error         *pluginError `json:"error"`
+}
+
+// pluginError codes: "city_not_found", "quota_exceeded" (with retry_after in
+// seconds) and anything else, which is treated as the provider being down.
+type pluginError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+func (r pluginResponse) observation(city string) (Observation, error) {
+	if e := r.Error; e != nil {
+		switch e.Code {
+		case "city_not_found":
+			return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+		case "quota_exceeded":
+			wait := time.Duration(e.RetryAfter) * time.Second
+			if wait <= 0 {
+				wait = time.Minute
+			}
+			return Observation{}, &QuotaError{RetryAfter: wait}
+		}
+		return Observation{}, fmt.Errorf("%w: plugin error %s: %s", ErrProviderUnavailable, e.Code, e.Message)
+	}
+	if r.Temperature == nil {
+		return Observation{}, fmt.Errorf("%w: plugin response without temperature", ErrProviderUnavailable)
+	}
+	observation := Observation{Temperature: *r.Temperature, Humidity: -1, WindSpeed: -1, ConditionCode: r.ConditionCode}
+	if r.Description != "" {
+		observation.Description, observation.DescriptionLang = r.Description, weatherLang()
+	}
+	if r.Humidity != nil {
+		observation.Humidity = *r.Humidity
+	}
+	if r.WindSpeed != nil {
+		observation.WindSpeed = *r.WindSpeed
+	}
+	return observation, nil
+}
+
+// execProvider keeps a plugin subprocess running and sends it one request
+// line per lookup: {"id": 1, "city": "Moscow", "lang": "en"}. The plugin's stderr is
+// passed through to ours. A plugin that exits or stops answering is killed,
+// with every process it started, and restarted on the next lookup.
+type execProvider struct {
+	command []string
+
+	// busy holds one token while a lookup talks to the plugin; waiting for
+	// it gives up with the lookup's context.
+	busy   chan struct{}
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lines  chan []byte
+	done   chan struct{}
+	nextID uint64
+}
+
+// pluginEnv are the environment variables a provider plugin inherits. The
+// rest of the environment holds our settings, secrets among them, which are
+// none of the plugin's business.
+var pluginEnv = []string{"PATH", "HOME", "TMPDIR", "TZ", "LANG", "LC_ALL"}
+
+func (p *execProvider) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Env = []string{}
+	for _, name := range pluginEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, name+"="+v)
+		}
+	}
+	cmd.Stderr = os.Stderr
+	pluginProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started provider plugin %s (pid %d)", p.command[0], cmd.Process.Pid)
+
+	lines, done := make(chan []byte), make(chan struct{})
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			select {
+			case lines <- append([]byte(nil), scanner.Bytes()...):
+			case <-done:
+				return
+			}
+		}
+	}()
+	p.cmd, p.stdin, p.lines, p.done = cmd, stdin, lines, done
+	return nil
+}
+
+// stop kills the plugin's process group without waiting for its output to
+// end: a process left behind could hold stdout open forever. Wait closes
+// stdout once the plugin exits, which ends the reader.
+func (p *execProvider) stop() {
+	p.stdin.Close()
+	killPluginGroup(p.cmd)
+	close(p.done)
+	go p.cmd.Wait()
+	p.cmd = nil
+}
+
+// Current asks the plugin for city. A lookup whose context ends gives up
+// without restarting the plugin; the late answer is skipped by its id.
+func (p *execProvider) Current(ctx context.Context, city string) (Observation, error) {
+	select {
+	case p.busy <- struct{}{}:
+	case <-ctx.Done():
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, ctx.Err())
+	}
+	defer func() { <-p.busy }()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return Observation{}, fmt.Errorf("%w: starting plugin: %v", ErrProviderUnavailable, err)
+		}
+	}
+
+	p.nextID++
+	request, _ := json.Marshal(struct {
+		ID   uint64 `json:"id"`
+		City string `json:"city"`
+		Lang string `json:"lang"`
+	}{p.nextID, city, weatherLang()})
+	if _, err := p.stdin.Write(append(request, '\n')); err != nil {
+		p.stop()
+		return Observation{}, fmt.Errorf("%w: writing to plugin: %v", ErrProviderUnavailable, err)
+	}
+
+	timeout := time.After(pluginTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, ctx.Err())
+		case line, ok := <-p.lines:
+			if !ok {
+				p.stop()
+				return Observation{}, fmt.Errorf("%w: plugin exited", ErrProviderUnavailable)
+			}
+			var resp pluginResponse
+			if err := json.Unmarshal(line, &resp); err != nil {
+				p.stop()
+				return Observation{}, fmt.Errorf("%w: invalid plugin response: %v", ErrProviderUnavailable, err)
+			}
+			if resp.ID != p.nextID {
+				continue
+			}
+			return resp.observation(city)
+		case <-timeout:
+			p.stop()
+			return Observation{}, fmt.Errorf("%w: plugin did not answer within %v", ErrProviderUnavailable, pluginTimeout)
+		}
+	}
+}
+
+// httpProvider asks a sidecar adapter: GET <WEATHER_PROVIDER_URL>?city=Moscow&lang=en
+// answered with the same JSON object as exec plugins. 404 and 429 map to an
+// unknown city and an exhausted quota.
+type httpProvider struct {
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func (p *httpProvider) Current(ctx context.Context, city string) (Observation, error) {
+	u := *p.endpoint
+	q := u.Query()
+	q.Set("city", city)
+	q.Set("lang", weatherLang())
+	u.RawQuery = q.Encode()
+
+	resp, err := upstreamGet(ctx, p.client, u.String())
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return Observation{}, &QuotaError{RetryAfter: retryAfterHeader(resp)}
+	case resp.StatusCode != http.StatusOK:
+		return Observation{}, fmt.Errorf("%w: sidecar returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	var body pluginResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return Observation{}, fmt.Errorf("%w: invalid sidecar response: %v", ErrProviderUnavailable, err)
+	}
+	return body.observation(city)
+}
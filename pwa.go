@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	texttemplate "text/template"
+)
+
+// serviceWorkerTemplate is web/sw.js, which precaches the hashed static
+// files. Its cache is named after them, so a build with changed files
+// makes browsers install a new worker and drop the old cache.
+var serviceWorkerTemplate = texttemplate.Must(texttemplate.ParseFS(webFiles, "web/sw.js"))
+
+// webManifest is the web app manifest that lets phones and tablets install
+// the built-in page.
+type webManifest struct {
+	Name            string            `json:"name"`
+	ShortName       string            `json:"short_name"`
+	Lang            string            `json:"lang"`
+	StartURL        string            `json:"start_url"`
+	Scope           string            `json:"scope"`
+	Display         string            `json:"display"`
+	BackgroundColor string            `json:"background_color"`
+	ThemeColor      string            `json:"theme_color"`
+	Icons           []webManifestIcon `json:"icons"`
+}
+
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// manifestHandler serves /manifest.webmanifest in the language of ?lang= or
+// Accept-Language.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	if l := r.URL.Query().Get("lang"); l != "" {
+		lang = negotiateLanguage(l)
+	}
+	manifest := webManifest{
+		Name:            uiTitle(lang, "ui.title"),
+		ShortName:       uiTitle(lang, "ui.short_title"),
+		Lang:            lang,
+		StartURL:        "/",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: "#ffffff",
+		ThemeColor:      "#2196F3",
+		Icons:           []webManifestIcon{{Src: staticURL("favicon.svg"), Sizes: "any", Type: "image/svg+xml"}},
+	}
+	if uiColorScheme() == "dark" {
+		manifest.BackgroundColor = "#121212"
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(manifest)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// serviceWorkerHandler serves /sw.js from the root, so that the worker
+// controls the whole page, and without caching, so that browsers notice a
+// new build on their next visit.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	var assets []string
+	for name := range staticNames {
+		assets = append(assets, staticURL(name))
+	}
+	sort.Strings(assets)
+	sum := sha256.New()
+	for _, asset := range assets {
+		sum.Write([]byte(asset))
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	serviceWorkerTemplate.Execute(w, map[string]any{
+		"Cache":  "weather-app-" + hex.EncodeToString(sum.Sum(nil))[:8],
+		"Assets": assets,
+	})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
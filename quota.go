@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstreamCallsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "weather_api_calls_total",
+			Help: "Total number of calls made to the upstream weather API",
+		},
+	)
+
+	upstreamThrottledTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "weather_api_throttled_total",
+			Help: "Total number of upstream calls skipped to stay within the API quota",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamCallsTotal)
+	prometheus.MustRegister(upstreamThrottledTotal)
+}
+
+// QuotaError reports that the upstream quota is exhausted and when it is
+// expected to be available again. It matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrQuotaExceeded, e.RetryAfter)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// quotaTracker keeps our own count of upstream calls against the provider's
+// per-minute and per-month limits (OpenWeatherMap free tier by default), so
+// that we stop before the provider starts answering with 429.
+type quotaTracker struct {
+	mu           sync.Mutex
+	perMinute    int
+	perMonth     int
+	recent       []time.Time
+	month        time.Time
+	monthCalls   int
+	blockedUntil time.Time
+}
+
+func newQuotaTracker(cfg *Config) *quotaTracker {
+	return &quotaTracker{
+		perMinute: cfg.OWMCallsPerMinute,
+		perMonth:  cfg.OWMCallsPerMonth,
+	}
+}
+
+var owmQuota = newQuotaTracker(defaultConfig)
+
+// Reserve records an upstream call if the quota allows it. When it does not,
+// it returns how long the caller should wait instead.
+func (q *quotaTracker) Reserve() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(q.blockedUntil) {
+		return q.blockedUntil.Sub(now)
+	}
+
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if !month.Equal(q.month) {
+		q.month = month
+		q.monthCalls = 0
+	}
+	if q.monthCalls >= q.perMonth {
+		return month.AddDate(0, 1, 0).Sub(now)
+	}
+
+	cutoff := now.Add(-time.Minute)
+	for len(q.recent) > 0 && !q.recent[0].After(cutoff) {
+		q.recent = q.recent[1:]
+	}
+	if len(q.recent) >= q.perMinute {
+		return q.recent[0].Add(time.Minute).Sub(now)
+	}
+
+	q.recent = append(q.recent, now)
+	q.monthCalls++
+	return 0
+}
+
+// Block stops upstream calls for d, used when the provider itself reports
+// that the quota has been exceeded.
+func (q *quotaTracker) Block(d time.Duration) {
+	q.mu.Lock()
+	q.blockedUntil = time.Now().Add(d)
+	q.mu.Unlock()
+}
+
+func retryAfterHeader(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Minute
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// weatherCacheTTL is how long an observation is served without asking the
+// provider again: WEATHER_CACHE_TTL, default 1m, 0 disables the cache.
+func weatherCacheTTL() time.Duration {
+	return runningConfig().WeatherCacheTTL
+}
+
+// setCacheHeaders lets browsers and CDNs reuse a result for as long as the
+// server itself considers it fresh: max-age minus Age is the remaining TTL.
+func setCacheHeaders(w http.ResponseWriter, result weatherResult) {
+	age := time.Since(result.FetchedAt)
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(result.Lifetime.Seconds())))
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+}
+
+type cachedObservation struct {
+	observation Observation
+	fetchedAt   time.Time
+}
+
+// lastObservations keeps the last successfully fetched observation per city
+// so that it can be served while fresh and while the upstream quota is
+// exhausted.
+var lastObservations = newLRUCache[string, cachedObservation]("observations", maxCachedCities)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var readinessCheckOK = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "readiness_check_ok",
+		Help: "Whether a /readyz check passed when last evaluated (1) or failed (0) by check",
+	},
+	[]string{"check"},
+)
+
+func init() {
+	prometheus.MustRegister(readinessCheckOK)
+}
+
+// Readiness is the /readyz response.
+type Readiness struct {
+	// Status is "ready" when no check failed, "not_ready" otherwise.
+	Status string                    `json:"status"`
+	Checks map[string]ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck is the outcome of one dependency check.
+type ReadinessCheck struct {
+	// Status is "ok", "failed" or "skipped" for checks that are disabled.
+	Status  string `json:"status"`
+	Backend string `json:"backend,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	// LastSuccess is the last successful provider fetch.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// readyMaxFetchAge is READY_MAX_FETCH_AGE, how recent the last successful
+// provider fetch must be; 0 disables the check.
+func readyMaxFetchAge() time.Duration {
+	return runningConfig().ReadyMaxFetchAge
+}
+
+// checkProvider fails when no fetch from the weather provider succeeded
+// within READY_MAX_FETCH_AGE, which the scheduled refresh of WEATHER_CITY
+// keeps satisfied on a healthy instance.
+func checkProvider() ReadinessCheck {
+	check := ReadinessCheck{Status: "ok", Backend: weatherProviderName()}
+	upstreamHealth.mu.Lock()
+	lastSuccess, lastError := upstreamHealth.lastSuccess, upstreamHealth.lastError
+	upstreamHealth.mu.Unlock()
+	if !lastSuccess.IsZero() {
+		t := lastSuccess.UTC()
+		check.LastSuccess = &t
+	}
+
+	maxAge := readyMaxFetchAge()
+	switch {
+	case maxAge == 0:
+		check.Status = "skipped"
+	case lastSuccess.IsZero():
+		check.Status, check.Detail = "failed", "no successful fetch yet"
+	case time.Since(lastSuccess) > maxAge:
+		check.Status = "failed"
+		check.Detail = fmt.Sprintf("no successful fetch for %s, READY_MAX_FETCH_AGE is %s", time.Since(lastSuccess).Round(time.Second), maxAge)
+	}
+	if check.Status == "failed" && lastError != "" {
+		check.Detail += ": " + lastError
+	}
+	return check
+}
+
+// checkCache reports the observation cache. It is kept in process memory,
+// so it is reachable whenever the process answers.
+func checkCache() ReadinessCheck {
+	return ReadinessCheck{Status: "ok", Backend: "memory", Detail: fmt.Sprintf("%d entries", lastObservations.Len())}
+}
+
+// checkDatabase fails when the history store cannot persist observations.
+// Stores that keep nothing outside the process have nothing to check.
+func checkDatabase() ReadinessCheck {
+	check := ReadinessCheck{Status: "ok", Backend: runningConfig().HistoryStore}
+	if checker, ok := history.(interface{ Check() error }); ok {
+		if err := checker.Check(); err != nil {
+			check.Status, check.Detail = "failed", err.Error()
+		}
+	}
+	return check
+}
+
+// currentReadiness runs the dependency checks.
+func currentReadiness() Readiness {
+	readiness := Readiness{Status: "ready", Checks: map[string]ReadinessCheck{
+		"provider": checkProvider(),
+		"cache":    checkCache(),
+		"database": checkDatabase(),
+		"warmup":   checkWarmup(),
+	}}
+	for name, check := range readiness.Checks {
+		if check.Status == "failed" {
+			readiness.Status = "not_ready"
+			readinessCheckOK.WithLabelValues(name).Set(0)
+		} else {
+			readinessCheckOK.WithLabelValues(name).Set(1)
+		}
+	}
+	return readiness
+}
+
+// readyzHandler serves /readyz for readiness probes: 200 when every
+// dependency check passes, 503 with the failing checks otherwise. Unlike
+// /health, which only says the process is up, a failing /readyz should take
+// the instance out of the load balancer rather than restart it.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := currentReadiness()
+	status := http.StatusOK
+	if readiness.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	if !writeResponse(w, r, status, readiness) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(status)).Inc()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies holds the networks whose X-Forwarded-For / X-Real-IP headers
+// are honored. It is populated from TRUSTED_PROXIES at startup.
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the address of the original client. Forwarding headers
+// are only consulted when the direct peer is a trusted proxy, and the
+// X-Forwarded-For chain is walked from the right so that a client cannot
+// spoof its address by prepending entries. Peers on a Unix socket are
+// trusted: only those allowed to open the socket file, the local reverse
+// proxy, can connect.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	_, unixSocket := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	if peerIP := net.ParseIP(peer); !unixSocket && (peerIP == nil || !isTrustedProxy(peerIP)) {
+		return peer
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !isTrustedProxy(ip) || i == 0 {
+				return ip.String()
+			}
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// realIPMiddleware replaces r.RemoteAddr with the resolved client address so
+// that everything downstream sees the genuine client.
+func realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = clientIP(r)
+		next.ServeHTTP(w, r)
+	})
+}
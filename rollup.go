@@ -0,0 +1,282 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	resolutionRaw    = "raw"
+	resolutionHourly = "hourly"
+	resolutionDaily  = "daily"
+)
+
+// Rollup aggregates the observations of one city over an hourly or daily
+// bucket starting at Start (UTC).
+type Rollup struct {
+	City  string    `json:"city"`
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Sum   float64   `json:"sum"`
+	SumSq float64   `json:"sum_sq"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+}
+
+func (r *Rollup) Add(v float64) {
+	r.Merge(Rollup{Count: 1, Sum: v, SumSq: v * v, Min: v, Max: v})
+}
+
+func (r *Rollup) Merge(o Rollup) {
+	if o.Count == 0 {
+		return
+	}
+	if r.Count == 0 {
+		r.Min, r.Max = o.Min, o.Max
+	}
+	r.Count += o.Count
+	r.Sum += o.Sum
+	r.SumSq += o.SumSq
+	r.Min = math.Min(r.Min, o.Min)
+	r.Max = math.Max(r.Max, o.Max)
+}
+
+func (r Rollup) Avg() float64 {
+	return r.Sum / float64(r.Count)
+}
+
+func (r Rollup) StdDev() float64 {
+	avg := r.Avg()
+	return math.Sqrt(math.Max(0, r.SumSq/float64(r.Count)-avg*avg))
+}
+
+func bucketStart(resolution string, t time.Time) time.Time {
+	if resolution == resolutionDaily {
+		return t.UTC().Truncate(24 * time.Hour)
+	}
+	return t.UTC().Truncate(time.Hour)
+}
+
+// bucketize aggregates time-ordered points into per-city buckets.
+func bucketize(points []HistoryPoint, resolution string) []Rollup {
+	var buckets []Rollup
+	index := make(map[string]int)
+	for _, p := range points {
+		start := bucketStart(resolution, p.Timestamp)
+		key := strings.ToLower(p.City) + "|" + start.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(buckets)
+			index[key] = i
+			buckets = append(buckets, Rollup{City: p.City, Start: start})
+		}
+		buckets[i].Add(p.Temperature)
+	}
+	return buckets
+}
+
+// rollupStore holds hourly and daily aggregates per city. Everything before
+// the watermark has been rolled up; newer raw points are bucketed on demand.
+type rollupStore struct {
+	mu        sync.RWMutex
+	hourly    map[string][]Rollup
+	daily     map[string][]Rollup
+	watermark time.Time
+}
+
+var rollups = &rollupStore{
+	hourly: make(map[string][]Rollup),
+	daily:  make(map[string][]Rollup),
+}
+
+// Update rolls up every raw point in the hours completed since the last run.
+func (s *rollupStore) Update(now time.Time) {
+	s.mu.RLock()
+	from := s.watermark
+	s.mu.RUnlock()
+	to := bucketStart(resolutionHourly, now)
+	if !to.After(from) {
+		return
+	}
+
+	hourly := bucketize(history.Range(from, to), resolutionHourly)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bucket := range hourly {
+		key := strings.ToLower(bucket.City)
+		s.hourly[key] = append(s.hourly[key], bucket)
+
+		day := bucket
+		day.Start = bucketStart(resolutionDaily, bucket.Start)
+		daily := s.daily[key]
+		if n := len(daily); n > 0 && daily[n-1].Start.Equal(day.Start) {
+			daily[n-1].Merge(day)
+		} else {
+			s.daily[key] = append(daily, day)
+		}
+	}
+	s.watermark = to
+}
+
+// Rebuild recomputes the stored hourly buckets of city for the given hours,
+// and the daily buckets containing them, from the raw history. It is used
+// after stored points were invalidated or corrected; hours past the
+// watermark are bucketed on demand and need no rebuild.
+func (s *rollupStore) Rebuild(city string, hours []time.Time) {
+	key := strings.ToLower(city)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days := make(map[time.Time]bool)
+	for _, hour := range hours {
+		if !hour.Before(s.watermark) {
+			continue
+		}
+		list := s.hourly[key]
+		i := sort.Search(len(list), func(j int) bool { return !list[j].Start.Before(hour) })
+		bucket := Rollup{City: city, Start: hour}
+		for _, p := range history.Query(city, hour, hour.Add(time.Hour)) {
+			bucket.Add(p.Temperature)
+		}
+		switch {
+		case i < len(list) && list[i].Start.Equal(hour) && bucket.Count == 0:
+			list = append(list[:i], list[i+1:]...)
+		case i < len(list) && list[i].Start.Equal(hour):
+			list[i] = bucket
+		case bucket.Count > 0:
+			list = append(list[:i], append([]Rollup{bucket}, list[i:]...)...)
+		}
+		s.hourly[key] = list
+		days[bucketStart(resolutionDaily, hour)] = true
+	}
+
+	for day := range days {
+		total := Rollup{City: city, Start: day}
+		for _, bucket := range s.hourly[key] {
+			if bucketStart(resolutionDaily, bucket.Start).Equal(day) {
+				total.Merge(bucket)
+			}
+		}
+		list := s.daily[key]
+		i := sort.Search(len(list), func(j int) bool { return !list[j].Start.Before(day) })
+		switch {
+		case i < len(list) && list[i].Start.Equal(day) && total.Count == 0:
+			list = append(list[:i], list[i+1:]...)
+		case i < len(list) && list[i].Start.Equal(day):
+			list[i] = total
+		case total.Count > 0:
+			list = append(list[:i], append([]Rollup{total}, list[i:]...)...)
+		}
+		s.daily[key] = list
+	}
+}
+
+func (s *rollupStore) Prune(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, buckets := range []map[string][]Rollup{s.hourly, s.daily} {
+		for key, list := range buckets {
+			i := sort.Search(len(list), func(j int) bool { return !list[j].Start.Before(cutoff) })
+			if i == len(list) {
+				delete(buckets, key)
+			} else if i > 0 {
+				buckets[key] = append([]Rollup(nil), list[i:]...)
+			}
+		}
+	}
+}
+
+// Snapshot returns copies of all hourly and daily rollups and the watermark.
+func (s *rollupStore) Snapshot() (hourly, daily []Rollup, watermark time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, list := range s.hourly {
+		hourly = append(hourly, list...)
+	}
+	for _, list := range s.daily {
+		daily = append(daily, list...)
+	}
+	return hourly, daily, s.watermark
+}
+
+// Restore replaces the stored rollups.
+func (s *rollupStore) Restore(hourly, daily []Rollup, watermark time.Time) {
+	group := func(buckets []Rollup) map[string][]Rollup {
+		byCity := make(map[string][]Rollup)
+		for _, bucket := range buckets {
+			key := strings.ToLower(bucket.City)
+			byCity[key] = append(byCity[key], bucket)
+		}
+		for _, list := range byCity {
+			sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+		}
+		return byCity
+	}
+
+	s.mu.Lock()
+	s.hourly = group(hourly)
+	s.daily = group(daily)
+	s.watermark = watermark
+	s.mu.Unlock()
+}
+
+// Series returns the buckets of city covering [from, to): stored rollups up to
+// the watermark followed by the newer raw points bucketed on the fly.
+func (s *rollupStore) Series(city, resolution string, from, to time.Time) []Rollup {
+	s.mu.RLock()
+	stored := s.hourly[strings.ToLower(city)]
+	if resolution == resolutionDaily {
+		stored = s.daily[strings.ToLower(city)]
+	}
+	var series []Rollup
+	for _, bucket := range stored {
+		if !bucket.Start.Before(from) && bucket.Start.Before(to) {
+			series = append(series, bucket)
+		}
+	}
+	watermark := s.watermark
+	s.mu.RUnlock()
+
+	if watermark.Before(from) {
+		watermark = from
+	}
+	for _, bucket := range bucketize(history.Query(city, watermark, to), resolution) {
+		if n := len(series); n > 0 && series[n-1].Start.Equal(bucket.Start) {
+			series[n-1].Merge(bucket)
+		} else {
+			series = append(series, bucket)
+		}
+	}
+	return series
+}
+
+// autoResolution picks the coarsest data that still gives a useful number
+// of points for the requested window.
+func autoResolution(window time.Duration) string {
+	switch {
+	case window <= 48*time.Hour:
+		return resolutionRaw
+	case window <= 90*24*time.Hour:
+		return resolutionHourly
+	default:
+		return resolutionDaily
+	}
+}
+
+// runHistoryRollups refreshes the rollups every few minutes and prunes them
+// after HISTORY_ROLLUP_RETENTION (default 365d).
+func runHistoryRollups(cfg *Config) error {
+	retention := cfg.HistoryRollupRetention
+
+	go func() {
+		for now := range backgroundTicks(5 * time.Minute) {
+			rollups.Update(now)
+			rollups.Prune(now.Add(-retention))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scheduledJobRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scheduled_job_runs_total",
+			Help: "Total number of runs of background collection jobs by job and status",
+		},
+		[]string{"job", "status"},
+	)
+	scheduledJobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "scheduled_job_duration_seconds",
+			Help:    "Duration of background collection job runs",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"job"},
+	)
+	scheduledJobLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_job_last_success_timestamp_seconds",
+			Help: "Time of the last background collection job run without errors",
+		},
+		[]string{"job"},
+	)
+	scheduledJobNextRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_job_next_run_timestamp_seconds",
+			Help: "Time of the next scheduled run of a background collection job, jitter included",
+		},
+		[]string{"job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scheduledJobRunsTotal, scheduledJobDuration, scheduledJobLastSuccess, scheduledJobNextRun)
+}
+
+// schedule returns the next run time after t.
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval from the previous run.
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time { return t.Add(time.Duration(s)) }
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week, in local time.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" day field: as in cron, when both day
+	// fields are restricted a day matching either runs.
+	domAny, dowAny bool
+}
+
+// parseSchedule parses a cron expression ("*/5 * * * *"), one of @hourly,
+// @daily, @weekly and @monthly, or "@every <duration>".
+func parseSchedule(expr string) (schedule, error) {
+	expr = strings.TrimSpace(expr)
+	switch expr {
+	case "@hourly":
+		expr = "0 * * * *"
+	case "@daily", "@midnight":
+		expr = "0 0 * * *"
+	case "@weekly":
+		expr = "0 0 * * 0"
+	case "@monthly":
+		expr = "0 0 1 * *"
+	}
+	if every, ok := strings.CutPrefix(expr, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", every)
+		}
+		return everySchedule(d), nil
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+	var s cronSchedule
+	for i, f := range []struct {
+		name     string
+		bits     *uint64
+		min, max int
+	}{
+		{"minute", &s.minute, 0, 59},
+		{"hour", &s.hour, 0, 23},
+		{"day of month", &s.dom, 1, 31},
+		{"month", &s.month, 1, 12},
+		{"day of week", &s.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %v", f.name, fields[i], err)
+		}
+		*f.bits = bits
+	}
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of "*", values and ranges,
+// each optionally with a "/step", into a bit set of the values it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step")
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value")
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value")
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<t.Weekday()) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first whole minute after t that matches, giving up after
+// five years for expressions such as "0 0 31 2 *" that never do.
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scheduledJob is a background collection job run on its schedule. A run
+// that overlaps the next scheduled time delays it rather than running twice
+// at once.
+type scheduledJob struct {
+	name     string
+	schedule schedule
+	run      func() error
+	// wake, when set, triggers an extra run outside the schedule.
+	wake <-chan struct{}
+	// after, when set, delays the run at startup until it is closed.
+	after <-chan struct{}
+}
+
+func checkSchedule(v string) error {
+	if v == "off" {
+		return nil
+	}
+	_, err := parseSchedule(v)
+	return err
+}
+
+// jobSchedule returns the schedule of job from SCHEDULE_<JOB>; "off"
+// disables the job.
+func jobSchedule(cfg *Config, job string) (schedule, error) {
+	name := "SCHEDULE_" + strings.ToUpper(job)
+	expr := cfg.ScheduleCurrent
+	if job == "forecast" {
+		expr = cfg.ScheduleForecast
+		// FORECAST_INTERVAL predates SCHEDULE_FORECAST and applies without it.
+		if cfg.ForecastInterval > 0 && !cfg.IsSet(name) {
+			expr = "@every " + cfg.ForecastInterval.String()
+		}
+	}
+	if expr == "off" {
+		return nil, nil
+	}
+	s, err := parseSchedule(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return s, nil
+}
+
+// scheduleJitter returns SCHEDULE_JITTER; "0s" disables the jitter.
+func scheduleJitter() time.Duration {
+	return runningConfig().ScheduleJitter
+}
+
+// Run runs the job until background jobs are stopped. Each run is delayed by a random part of
+// SCHEDULE_JITTER so that instances started together, and jobs scheduled for
+// the same minute, do not all hit the upstream at once.
+func (j *scheduledJob) Run() {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			logError("Schedule of job %s never runs again", j.name)
+			return
+		}
+		if jitter := scheduleJitter(); jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		scheduledJobNextRun.WithLabelValues(j.name).Set(float64(next.Unix()))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-j.wake:
+		case <-backgroundJobs.Done():
+			return
+		}
+		j.runOnce()
+	}
+}
+
+func (j *scheduledJob) runOnce() error {
+	start := time.Now()
+	err := j.run()
+	scheduledJobDuration.WithLabelValues(j.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		scheduledJobRunsTotal.WithLabelValues(j.name, "error").Inc()
+		logError("Scheduled job %s failed: %v", j.name, err)
+		return err
+	}
+	scheduledJobRunsTotal.WithLabelValues(j.name, "success").Inc()
+	scheduledJobLastSuccess.WithLabelValues(j.name).SetToCurrentTime()
+	return nil
+}
+
+// startScheduler starts the background collection jobs: current conditions
+// of WEATHER_CITY every minute and forecasts hourly, each adjustable or
+// disabled with SCHEDULE_CURRENT and SCHEDULE_FORECAST.
+func startScheduler(cfg *Config) error {
+	jobs := []*scheduledJob{
+		// The warm-up has just fetched the same cities, so the first run
+		// waits for it and is served from the cache.
+		{name: "current", run: refreshCurrentConditions, after: warmup.done},
+		{name: "forecast", run: refreshForecasts, wake: forecastWake},
+	}
+	for _, job := range jobs {
+		s, err := jobSchedule(cfg, job.name)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			continue
+		}
+		job.schedule = s
+		go func(job *scheduledJob) {
+			// Collect once at startup instead of waiting for the first
+			// scheduled time.
+			if job.after != nil {
+				select {
+				case <-job.after:
+				case <-backgroundJobs.Done():
+					return
+				}
+			}
+			job.runOnce()
+			job.Run()
+		}(job)
+	}
+	return nil
+}
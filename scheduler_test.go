@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "* * * * *"},
+		{expr: "*/5 * * * *"},
+		{expr: "0,30 8-18 * * 1-5"},
+		{expr: "5-50/15 */2 1,15 1-12/3 0,7"},
+		{expr: "  0 0 * * *  "},
+		{expr: "@hourly"},
+		{expr: "@daily"},
+		{expr: "@midnight"},
+		{expr: "@weekly"},
+		{expr: "@monthly"},
+		{expr: "@every 90s"},
+		{expr: "@every  1h30m"},
+
+		{expr: "", wantErr: true},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * 32 * *", wantErr: true},
+		{expr: "* * * 0 *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "-1 * * * *", wantErr: true},
+		{expr: "30-10 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "*/-5 * * * *", wantErr: true},
+		{expr: "*/x * * * *", wantErr: true},
+		{expr: "1,,2 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+		{expr: "1-x * * * *", wantErr: true},
+		{expr: "* * * JAN *", wantErr: true},
+		{expr: "@yearly", wantErr: true},
+		{expr: "@every", wantErr: true},
+		{expr: "@every 500ms", wantErr: true},
+		{expr: "@every -1m", wantErr: true},
+		{expr: "@every soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseSchedule(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSchedule(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday.
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	from := at(time.January, 14, 10, 7).Add(30 * time.Second)
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, at(time.January, 14, 10, 8)},
+		{"*/15 * * * *", from, at(time.January, 14, 10, 15)},
+		{"7 * * * *", from, at(time.January, 14, 11, 7)},
+		{"0 9 * * *", from, at(time.January, 15, 9, 0)},
+		{"@hourly", from, at(time.January, 14, 11, 0)},
+		{"@monthly", from, at(time.February, 1, 0, 0)},
+		// Sunday as 7 as well as 0.
+		{"0 0 * * 7", from, at(time.January, 18, 0, 0)},
+		{"@weekly", from, at(time.January, 18, 0, 0)},
+		// Weekdays only: Friday evening to Monday.
+		{"30 8 * * 1-5", at(time.January, 16, 20, 0), at(time.January, 19, 8, 30)},
+		// With both day fields restricted, either matches: the 20th or the
+		// next Monday, whichever comes first.
+		{"0 0 20 * 1", from, at(time.January, 19, 0, 0)},
+		{"0 0 15 * 1", from, at(time.January, 15, 0, 0)},
+		// Across the end of the year.
+		{"0 0 1 1 *", from, time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// 29 February, next in 2028.
+		{"0 12 29 2 *", from, time.Date(2028, time.February, 29, 12, 0, 0, 0, time.UTC)},
+		// Never: the zero time.
+		{"0 0 31 2 *", from, time.Time{}},
+		{"@every 90s", from, from.Add(90 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseSchedule(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const secretScheme = "secret://"
+
+// secretReference is a setting value that names a secret in a cloud
+// secret manager instead of holding it:
+//
+//	secret://aws-secretsmanager/<secret ID or ARN>[?region=<region>][#<JSON field>]
+//	secret://aws-ssm/<parameter name>[?region=<region>][#<JSON field>]
+//	secret://gcp-secretmanager/<project>/<secret>[/<version>][#<JSON field>]
+type secretReference struct {
+	store  string
+	name   string
+	region string
+	field  string
+}
+
+func isSecretReference(v string) bool {
+	return strings.HasPrefix(v, secretScheme)
+}
+
+func parseSecretReference(v string) (secretReference, error) {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme != "secret" {
+		return secretReference{}, fmt.Errorf("invalid secret reference %q", v)
+	}
+	ref := secretReference{store: u.Host, name: strings.TrimPrefix(u.Path, "/"), region: u.Query().Get("region"), field: u.Fragment}
+	if ref.name == "" {
+		return secretReference{}, fmt.Errorf("secret reference %q names no secret", v)
+	}
+	switch ref.store {
+	case "aws-secretsmanager":
+	case "aws-ssm":
+		// Parameters in a hierarchy have a leading slash, which the
+		// reference drops after the store.
+		if strings.Contains(ref.name, "/") {
+			ref.name = "/" + ref.name
+		}
+	case "gcp-secretmanager":
+		if n := strings.Count(ref.name, "/"); n < 1 || n > 2 {
+			return secretReference{}, fmt.Errorf("secret reference %q: expected gcp-secretmanager/<project>/<secret>[/<version>]", v)
+		}
+	default:
+		return secretReference{}, fmt.Errorf("secret reference %q: unknown store %q, expected aws-secretsmanager, aws-ssm or gcp-secretmanager", v, ref.store)
+	}
+	if strings.HasPrefix(ref.store, "aws-") && ref.region == "" && awsRegion() == "" {
+		return secretReference{}, fmt.Errorf("secret reference %q: no region, set AWS_REGION or ?region=", v)
+	}
+	return ref, nil
+}
+
+// secretResolver reads references, obtaining the credentials of each cloud
+// once.
+type secretResolver struct {
+	aws      *awsCredentials
+	gcpToken string
+}
+
+func (r *secretResolver) fetch(ctx context.Context, ref secretReference) (string, error) {
+	var (
+		value string
+		err   error
+	)
+	switch ref.store {
+	case "aws-secretsmanager":
+		var resp struct {
+			SecretString string
+			SecretBinary []byte
+		}
+		err = r.callAWS(ctx, ref, "secretsmanager", "secretsmanager.GetSecretValue", map[string]any{"SecretId": ref.name}, &resp)
+		value = resp.SecretString
+		if value == "" {
+			value = string(resp.SecretBinary)
+		}
+	case "aws-ssm":
+		var resp struct {
+			Parameter struct {
+				Value string
+			}
+		}
+		err = r.callAWS(ctx, ref, "ssm", "AmazonSSM.GetParameter", map[string]any{"Name": ref.name, "WithDecryption": true}, &resp)
+		value = resp.Parameter.Value
+	case "gcp-secretmanager":
+		value, err = r.accessGCP(ctx, ref)
+	}
+	if err != nil {
+		return "", err
+	}
+	if ref.field == "" {
+		return value, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object with field %q", ref.name, ref.field)
+	}
+	field, ok := fields[ref.field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no string field %q", ref.name, ref.field)
+	}
+	return field, nil
+}
+
+// callAWS calls action of an AWS JSON API with SigV4. AWS_ENDPOINT_URL
+// replaces the regional endpoint, e.g. for LocalStack.
+func (r *secretResolver) callAWS(ctx context.Context, ref secretReference, service, action string, input, out any) error {
+	if r.aws == nil {
+		creds, err := loadAWSCredentials(ctx)
+		if err != nil {
+			return err
+		}
+		r.aws = &creds
+	}
+	region := ref.region
+	if region == "" {
+		region = awsRegion()
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com"
+	}
+	body, _ := json.Marshal(input)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", action)
+	signAWSRequest(req, body, *r.aws, region, service, time.Now())
+	if err := cloudJSON(req, out); err != nil {
+		return fmt.Errorf("%s %s: %w", action, ref.name, err)
+	}
+	return nil
+}
+
+func (r *secretResolver) accessGCP(ctx context.Context, ref secretReference) (string, error) {
+	if r.gcpToken == "" {
+		token, err := gcpAccessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		r.gcpToken = token
+	}
+	parts := strings.Split(ref.name, "/")
+	version := "latest"
+	if len(parts) == 3 {
+		version = parts[2]
+	}
+	endpoint := "https://secretmanager.googleapis.com/v1/projects/" + url.PathEscape(parts[0]) +
+		"/secrets/" + url.PathEscape(parts[1]) + "/versions/" + url.PathEscape(version) + ":access"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.gcpToken)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := cloudJSON(req, &resp); err != nil {
+		return "", fmt.Errorf("accessing %s: %w", ref.name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("accessing %s: %w", ref.name, err)
+	}
+	return string(data), nil
+}
+
+// resolveSecrets replaces the secret:// references among values with the
+// secrets. Every reference is tried, and a problem is returned for each
+// that could not be read or is invalid for its setting.
+func resolveSecrets(values map[string]string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resolver := &secretResolver{}
+	var problems []string
+	for _, s := range configSettings {
+		v, ok := values[s.Name]
+		if !ok || !isSecretReference(v) {
+			continue
+		}
+		ref, err := parseSecretReference(v)
+		if err == nil {
+			v, err = resolver.fetch(ctx, ref)
+		}
+		if err == nil {
+			err = s.validate(v)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", s.Name, err))
+			continue
+		}
+		values[s.Name] = v
+		log.Printf("%s read from %s", s.Name, ref.store)
+	}
+	return problems
+}
+
+// resolveSecretReferences replaces the settings whose value is a secret://
+// reference, from the environment or CONFIG_FILE, with the secret, reporting
+// all failures at once.
+func resolveSecretReferences(cfg *Config) (*Config, error) {
+	references := make(map[string]string)
+	for _, s := range configSettings {
+		if v, _ := cfg.Lookup(s.Name); isSecretReference(v) {
+			references[s.Name] = v
+		}
+	}
+	if problems := resolveSecrets(references); len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return cfg.with(references), nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// w1DevicesDir is where the Linux 1-Wire bus driver (w1-gpio, w1-therm)
+// lists the sensors it found.
+const w1DevicesDir = "/sys/bus/w1/devices"
+
+// sensorProvider reads a sensor attached to this machine instead of a
+// weather service. Every city gets the same reading, so the service is
+// meant to run with one WEATHER_CITY naming the site of the sensor.
+type sensorProvider struct {
+	mu    sync.Mutex
+	read  func() (Observation, error)
+	close func() error
+}
+
+func (p *sensorProvider) Current(ctx context.Context, city string) (Observation, error) {
+	// Readings of the same bus must not interleave.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	observation, err := p.read()
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	return observation, nil
+}
+
+// Close releases the device, for a provider opened only to be tried.
+func (p *sensorProvider) Close() error {
+	if p.close == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.close()
+}
+
+// newDS18B20Provider reads a DS18B20 1-Wire thermometer: SENSOR_DEVICE is
+// its id such as 28-0316a2795aff, by default the only one on the bus.
+func newDS18B20Provider(cfg *Config) (WeatherProvider, error) {
+	id := cfg.SensorDevice
+	if id == "" {
+		matches, _ := filepath.Glob(filepath.Join(w1DevicesDir, "28-*"))
+		if len(matches) != 1 {
+			return nil, fmt.Errorf("found %d DS18B20 sensors in %s, set SENSOR_DEVICE to one of them", len(matches), w1DevicesDir)
+		}
+		id = filepath.Base(matches[0])
+	}
+	path := filepath.Join(w1DevicesDir, id, "w1_slave")
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("DS18B20 sensor %s: %w", id, err)
+	}
+	return &sensorProvider{read: func() (Observation, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Observation{}, err
+		}
+		celsius, err := parseW1Slave(string(data))
+		if err != nil {
+			return Observation{}, fmt.Errorf("DS18B20 %s: %w", id, err)
+		}
+		return Observation{Temperature: celsius, Humidity: -1, WindSpeed: -1}, nil
+	}}, nil
+}
+
+// parseW1Slave parses the w1_slave file of the w1-therm driver: the
+// scratchpad with "YES" when its CRC matched, then the temperature in
+// thousandths of °C:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func parseW1Slave(data string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "YES") {
+		return 0, fmt.Errorf("CRC check failed")
+	}
+	_, value, ok := strings.Cut(lines[1], "t=")
+	if !ok {
+		return 0, fmt.Errorf("no temperature in %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature %q", value)
+	}
+	// 85 °C is the power-on value of the scratchpad: the conversion did not
+	// run, usually for lack of power on parasite-powered wiring.
+	if milli == 85000 {
+		return 0, fmt.Errorf("conversion not run")
+	}
+	return float64(milli) / 1000, nil
+}
+
+// BME280 registers, see the Bosch BME280 datasheet.
+const (
+	bme280ChipID      = 0x60
+	bme280RegID       = 0xD0
+	bme280RegCalib1   = 0x88 // 26 bytes: T1-T3, P1-P9, H1 at 0xA1
+	bme280RegCalib2   = 0xE1 // 7 bytes: H2-H6
+	bme280RegCtrlHum  = 0xF2
+	bme280RegStatus   = 0xF3
+	bme280RegCtrlMeas = 0xF4
+	bme280RegData     = 0xF7 // 8 bytes: pressure, temperature, humidity
+
+	// One sample each of temperature and humidity in forced mode; pressure
+	// is skipped as no response carries it.
+	bme280HumX1       = 0x01
+	bme280TempX1Force = 0x21
+)
+
+// bme280Calibration holds the trimming parameters factory-programmed into
+// every BME280.
+type bme280Calibration struct {
+	t1         uint16
+	t2, t3     int16
+	h1, h3     uint8
+	h2, h4, h5 int16
+	h6         int8
+}
+
+// newBME280Provider reads a BME280 temperature and humidity sensor on the
+// I2C bus SENSOR_DEVICE (default /dev/i2c-1) at SENSOR_I2C_ADDRESS (default
+// 0x76, 0x77 when SDO is tied high).
+func newBME280Provider(cfg *Config) (WeatherProvider, error) {
+	bus, addr, err := bme280Device(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := openI2C(bus, addr)
+	if err != nil {
+		return nil, fmt.Errorf("BME280 on %s: %w", bus, err)
+	}
+	id, err := i2cRead(dev, bme280RegID, 1)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("BME280 on %s at %#x: %w", bus, addr, err)
+	}
+	if id[0] != bme280ChipID {
+		dev.Close()
+		return nil, fmt.Errorf("device at %#x on %s has chip id %#x, not a BME280", addr, bus, id[0])
+	}
+	calib, err := readBME280Calibration(dev)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("BME280 calibration: %w", err)
+	}
+	return &sensorProvider{
+		read:  func() (Observation, error) { return readBME280(dev, calib) },
+		close: dev.Close,
+	}, nil
+}
+
+// bme280Device returns the bus and address of the BME280 from the settings,
+// without opening the bus.
+func bme280Device(cfg *Config) (bus string, addr uint16, err error) {
+	bus = cfg.SensorDevice
+	if bus == "" {
+		bus = "/dev/i2c-1"
+	}
+	addr, err = sensorI2CAddress(cfg.SensorI2CAddress)
+	if err != nil {
+		return "", 0, fmt.Errorf("SENSOR_I2C_ADDRESS: %w", err)
+	}
+	return bus, addr, nil
+}
+
+// sensorI2CAddress parses a 7-bit I2C address such as 0x76.
+func sensorI2CAddress(v string) (uint16, error) {
+	if v == "" {
+		return 0x76, nil
+	}
+	addr, err := strconv.ParseUint(v, 0, 16)
+	if err != nil || addr < 0x03 || addr > 0x77 {
+		return 0, fmt.Errorf("want a 7-bit address such as 0x76")
+	}
+	return uint16(addr), nil
+}
+
+func readBME280Calibration(dev io.ReadWriter) (bme280Calibration, error) {
+	b1, err := i2cRead(dev, bme280RegCalib1, 26)
+	if err != nil {
+		return bme280Calibration{}, err
+	}
+	b2, err := i2cRead(dev, bme280RegCalib2, 7)
+	if err != nil {
+		return bme280Calibration{}, err
+	}
+	le := binary.LittleEndian
+	return bme280Calibration{
+		t1: le.Uint16(b1[0:]),
+		t2: int16(le.Uint16(b1[2:])),
+		t3: int16(le.Uint16(b1[4:])),
+		h1: b1[25],
+		h2: int16(le.Uint16(b2[0:])),
+		h3: b2[2],
+		// H4 and H5 are 12-bit values sharing the nibbles of 0xE5.
+		h4: int16(int8(b2[3]))<<4 | int16(b2[4]&0x0F),
+		h5: int16(int8(b2[5]))<<4 | int16(b2[4]>>4),
+		h6: int8(b2[6]),
+	}, nil
+}
+
+// readBME280 runs one forced-mode measurement and compensates it with the
+// floating point formulas of the datasheet.
+func readBME280(dev io.ReadWriter, c bme280Calibration) (Observation, error) {
+	if _, err := dev.Write([]byte{bme280RegCtrlHum, bme280HumX1}); err != nil {
+		return Observation{}, err
+	}
+	if _, err := dev.Write([]byte{bme280RegCtrlMeas, bme280TempX1Force}); err != nil {
+		return Observation{}, err
+	}
+	// A measurement with single samples takes under 10ms.
+	for i := 0; ; i++ {
+		time.Sleep(5 * time.Millisecond)
+		status, err := i2cRead(dev, bme280RegStatus, 1)
+		if err != nil {
+			return Observation{}, err
+		}
+		if status[0]&0x08 == 0 {
+			break
+		}
+		if i == 20 {
+			return Observation{}, fmt.Errorf("BME280 measurement did not finish")
+		}
+	}
+	data, err := i2cRead(dev, bme280RegData, 8)
+	if err != nil {
+		return Observation{}, err
+	}
+	adcT := float64(uint32(data[3])<<12 | uint32(data[4])<<4 | uint32(data[5])>>4)
+	adcH := float64(uint32(data[6])<<8 | uint32(data[7]))
+
+	var1 := (adcT/16384 - float64(c.t1)/1024) * float64(c.t2)
+	d := adcT/131072 - float64(c.t1)/8192
+	tFine := var1 + d*d*float64(c.t3)
+
+	h := tFine - 76800
+	h = (adcH - (float64(c.h4)*64 + float64(c.h5)/16384*h)) *
+		(float64(c.h2) / 65536 * (1 + float64(c.h6)/67108864*h*(1+float64(c.h3)/67108864*h)))
+	h *= 1 - float64(c.h1)*h/524288
+	h = min(max(h, 0), 100)
+
+	return Observation{Temperature: tFine / 5120, Humidity: h, WindSpeed: -1}, nil
+}
+
+// i2cRead reads n registers from reg on, which the BME280 auto-increments.
+func i2cRead(dev io.ReadWriter, reg byte, n int) ([]byte, error) {
+	if _, err := dev.Write([]byte{reg}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(dev, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// i2cSlave is the I2C_SLAVE ioctl of linux/i2c-dev.h, which addresses the
+// following reads and writes of the file to one device on the bus.
+const i2cSlave = 0x0703
+
+// openI2C opens the i2c-dev bus at path (/dev/i2c-1 on a Raspberry Pi) for
+// the device at addr.
+func openI2C(path string, addr uint16) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), i2cSlave, uintptr(addr)); errno != 0 {
+		f.Close()
+		return nil, &os.PathError{Op: "ioctl I2C_SLAVE", Path: path, Err: errno}
+	}
+	return f, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// openI2C fails: the bme280 provider uses the i2c-dev interface of Linux.
+func openI2C(path string, addr uint16) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("I2C sensors are only supported on Linux")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errorReportsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "error_reports_total",
+		Help: "Total number of errors reported to SENTRY_DSN by status (sent, failed, dropped)",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(errorReportsTotal)
+}
+
+// sentryDSN is a parsed SENTRY_DSN, "https://<key>@<host>[/<path>]/<project>".
+type sentryDSN struct {
+	raw      string
+	key      string
+	envelope string
+}
+
+func parseSentryDSN(v string) (sentryDSN, error) {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return sentryDSN{}, fmt.Errorf("want https://<key>@<host>/<project>")
+	}
+	prefix, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return sentryDSN{}, fmt.Errorf("no project ID")
+	}
+	return sentryDSN{
+		raw:      v,
+		key:      u.User.Username(),
+		envelope: u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/envelope/",
+	}, nil
+}
+
+// sentryFrame is a stack frame in the Sentry event format.
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// sentryEvent is the part of the Sentry event payload this service fills.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     *sentryMessage    `json:"message,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	Request     sentryRequest     `json:"request"`
+}
+
+type sentryMessage struct {
+	Formatted string `json:"formatted"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// errorReports queues events for the sender, so that a slow or unreachable
+// Sentry never holds up a response.
+var errorReports = make(chan sentryEvent, 100)
+
+// newSentryEvent describes an error while serving r: the route template,
+// the request ID (the trace ID) and the city asked for as tags. The query
+// string is left out of the URL as it may hold credentials.
+func newSentryEvent(r *http.Request) sentryEvent {
+	event := sentryEvent{
+		EventID:     randomHex(16),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       "error",
+		Logger:      "weather-app",
+		Environment: runningConfig().SentryEnvironment,
+		Tags:        map[string]string{"route": r.URL.Path, "request_id": requestTraceID(r)},
+		Request:     sentryRequest{Method: r.Method, URL: r.URL.Path},
+	}
+	event.ServerName, _ = os.Hostname()
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			event.Tags["route"] = tpl
+		}
+	}
+	if city := r.URL.Query().Get("city"); city != "" {
+		event.Tags["city"] = city
+	}
+	return event
+}
+
+// reportError queues event when SENTRY_DSN is set, dropping it when the
+// queue is full.
+func reportError(event sentryEvent) {
+	if runningConfig().SentryDSN == "" {
+		return
+	}
+	select {
+	case errorReports <- event:
+	default:
+		errorReportsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+type errorReportedKey struct{}
+
+// reportProblem reports a 5xx problem answered to r, unless the error
+// behind it has been reported already.
+func reportProblem(r *http.Request, problem Problem) {
+	if problem.Status < 500 || r.Context().Value(errorReportedKey{}) != nil {
+		return
+	}
+	event := newSentryEvent(r)
+	event.Message = &sentryMessage{Formatted: fmt.Sprintf("%d %s: %s", problem.Status, problem.Title, problem.Detail)}
+	event.Tags["status"] = fmt.Sprint(problem.Status)
+	reportError(event)
+}
+
+// reportPanic reports a panic recovered while serving r and returns r
+// marked as reported, so that the 500 answered for it is not reported
+// again.
+func reportPanic(r *http.Request, p any) *http.Request {
+	event := newSentryEvent(r)
+	event.Level = "fatal"
+	exception := sentryException{Type: "panic", Value: fmt.Sprint(p)}
+	exception.Stacktrace.Frames = panicFrames()
+	event.Exception = &sentryExceptions{Values: []sentryException{exception}}
+	reportError(event)
+	return r.WithContext(context.WithValue(r.Context(), errorReportedKey{}, true))
+}
+
+// panicFrames returns the stack of the panicking goroutine from the
+// deferred recover, outermost call first as Sentry expects.
+func panicFrames() []sentryFrame {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var list []sentryFrame
+	panicking := false
+	for {
+		frame, more := frames.Next()
+		if panicking {
+			module, function := frame.Function, frame.Function
+			if i := strings.LastIndex(module, "."); i >= 0 {
+				module, function = module[:i], module[i+1:]
+			}
+			list = append(list, sentryFrame{
+				Function: function,
+				Module:   module,
+				Filename: filepath.Base(frame.File),
+				AbsPath:  frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, "main."),
+			})
+		}
+		if frame.Function == "runtime.gopanic" {
+			panicking = true
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+// sendErrorReports delivers queued events to SENTRY_DSN as envelopes.
+func sendErrorReports() {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+	for event := range errorReports {
+		dsn, err := parseSentryDSN(runningConfig().SentryDSN)
+		if err != nil {
+			errorReportsTotal.WithLabelValues("dropped").Inc()
+			continue
+		}
+		if err := sendSentryEnvelope(client, dsn, event); err != nil {
+			errorReportsTotal.WithLabelValues("failed").Inc()
+			logError("Error report to Sentry failed: %v", err)
+			continue
+		}
+		errorReportsTotal.WithLabelValues("sent").Inc()
+	}
+}
+
+func sendSentryEnvelope(client *http.Client, dsn sentryDSN, event sentryEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(map[string]string{"event_id": event.EventID, "dsn": dsn.raw, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	json.NewEncoder(&body).Encode(map[string]any{"type": "event", "length": len(payload)})
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, dsn.envelope, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=weather-app/1, sentry_key="+dsn.key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var shardForwardedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "shard_forwarded_requests_total",
+		Help: "Total number of requests forwarded to the shard owning the city",
+	},
+	[]string{"shard"},
+)
+
+func init() {
+	prometheus.MustRegister(shardForwardedTotal)
+}
+
+// shardForwardedHeader marks requests forwarded by a peer, which are always
+// served locally so that a misconfigured peer list cannot cause loops. The
+// peer signs the request with SHARD_SECRET in shardSignatureHeader over the
+// method, path, query and shardTimestampHeader.
+const (
+	shardForwardedHeader = "X-Weather-Shard-Forwarded"
+	shardTimestampHeader = "X-Weather-Shard-Timestamp"
+	shardSignatureHeader = "X-Weather-Shard-Signature"
+)
+
+// shardSignatureMaxAge bounds how far the timestamp of a forwarded request
+// may be from the local clock, so a captured request cannot be replayed
+// later.
+const shardSignatureMaxAge = 30 * time.Second
+
+type shardForwardedKey struct{}
+
+// shardForwarded reports whether a shard peer forwarded r, having already
+// counted it against rate limits and quotas. Only requests whose signature
+// shardPeerMiddleware verified count as forwarded.
+func shardForwarded(r *http.Request) bool {
+	forwarded, _ := r.Context().Value(shardForwardedKey{}).(bool)
+	return forwarded
+}
+
+// shardSignature signs a forwarded request.
+func shardSignature(secret []byte, method, path, query, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shardPeerMiddleware marks requests forwarded by a peer once their
+// signature is verified and removes the forwarding headers from every
+// request, so that a client cannot pass itself off as a peer to skip the
+// rate limits and quotas or the routing to the owning shard.
+func shardPeerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded := r.Header.Get(shardForwardedHeader) != "" && shards.verify(r)
+		r.Header.Del(shardForwardedHeader)
+		r.Header.Del(shardTimestampHeader)
+		r.Header.Del(shardSignatureHeader)
+		if forwarded {
+			r = r.WithContext(context.WithValue(r.Context(), shardForwardedKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verify checks the signature and timestamp of a request forwarded by a
+// peer.
+func (s *shardRing) verify(r *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	timestamp := r.Header.Get(shardTimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > shardSignatureMaxAge || age < -shardSignatureMaxAge {
+		return false
+	}
+	want := shardSignature(s.secret, r.Method, r.URL.Path, r.URL.RawQuery, timestamp)
+	return hmac.Equal([]byte(r.Header.Get(shardSignatureHeader)), []byte(want))
+}
+
+// sign marks an outgoing request as forwarded by this shard.
+func (s *shardRing) sign(r *http.Request) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(shardForwardedHeader, strconv.Itoa(s.index))
+	r.Header.Set(shardTimestampHeader, timestamp)
+	r.Header.Set(shardSignatureHeader, shardSignature(s.secret, r.Method, r.URL.Path, r.URL.RawQuery, timestamp))
+}
+
+// shardRing assigns every city to one of count instances by rendezvous
+// hashing, so changing the shard count only moves the cities of the added
+// or removed shards.
+type shardRing struct {
+	count   int
+	index   int
+	secret  []byte
+	proxies []*httputil.ReverseProxy
+}
+
+// shardSecretMinLength is the shortest SHARD_SECRET accepted.
+const shardSecretMinLength = 32
+
+// shards is nil unless SHARD_COUNT is greater than one.
+var shards *shardRing
+
+// Owner returns the index of the shard that polls and stores city.
+func (s *shardRing) Owner(city string) int {
+	if s == nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(city))))
+	key := h.Sum64()
+	best, bestScore := 0, uint64(0)
+	for i := 0; i < s.count; i++ {
+		if score := mix64(key ^ uint64(i)*0x9e3779b97f4a7c15); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix64 is the SplitMix64 finalizer; FNV alone spreads too little of a
+// one-byte difference into the high bits for rendezvous scores.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// Owns reports whether this instance is responsible for city. Without
+// sharding it owns every city.
+func (s *shardRing) Owns(city string) bool {
+	return s == nil || s.Owner(city) == s.index
+}
+
+// shardOrdinal extracts the StatefulSet ordinal from a pod hostname such as
+// "weather-app-2".
+func shardOrdinal(hostname string) (int, bool) {
+	i := strings.LastIndex(hostname, "-")
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(hostname[i+1:])
+	return n, err == nil && n >= 0
+}
+
+// newShardRing reads SHARD_COUNT, SHARD_INDEX (defaulting to the StatefulSet
+// ordinal in HOSTNAME), SHARD_PEERS: either one base URL per shard,
+// comma-separated in shard order, or a single URL containing "{index}", and
+// SHARD_SECRET, which the shards sign forwarded requests with.
+func newShardRing(cfg *Config) (*shardRing, error) {
+	count := cfg.ShardCount
+	if count == 1 {
+		return nil, nil
+	}
+
+	var index int
+	if cfg.IsSet("SHARD_INDEX") {
+		index = cfg.ShardIndex
+	} else {
+		hostname, _ := os.Hostname()
+		n, ok := shardOrdinal(hostname)
+		if !ok {
+			return nil, fmt.Errorf("SHARD_INDEX is unset and hostname %q has no StatefulSet ordinal", hostname)
+		}
+		index = n
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index %d is outside 0..%d", index, count-1)
+	}
+
+	raw := cfg.ShardPeers
+	peers := strings.Split(raw, ",")
+	if strings.Contains(raw, "{index}") {
+		peers = make([]string, count)
+		for i := range peers {
+			peers[i] = strings.ReplaceAll(raw, "{index}", strconv.Itoa(i))
+		}
+	}
+	if len(peers) != count {
+		return nil, fmt.Errorf("SHARD_PEERS lists %d peers for SHARD_COUNT %d", len(peers), count)
+	}
+
+	secret := cfg.ShardSecret
+	if len(secret) < shardSecretMinLength {
+		return nil, fmt.Errorf("SHARD_SECRET must be set to at least %d characters, the same on every shard", shardSecretMinLength)
+	}
+
+	ring := &shardRing{count: count, index: index, secret: []byte(secret), proxies: make([]*httputil.ReverseProxy, count)}
+	for i, peer := range peers {
+		i := i
+		target, err := url.Parse(strings.TrimSpace(peer))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid shard peer %q", peer)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		// The request is signed as the peer receives it, after the
+		// director joined the peer's base path.
+		direct := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			direct(r)
+			ring.sign(r)
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			logError("Forwarding %s to shard %d failed: %v", r.URL.Path, i, err)
+			writeProblem(w, r, http.StatusBadGateway, "shard.unavailable", i)
+		}
+		ring.proxies[i] = proxy
+	}
+	return ring, nil
+}
+
+// shardRouted forwards reads of a city owned by another shard to that shard.
+// The city is the "city" or "zip" query parameter or WEATHER_CITY; requests locating
+// a place by coordinates are served locally.
+func shardRouted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if shards == nil || shardForwarded(r) || q.Get("lat") != "" || q.Get("lon") != "" {
+			next(w, r)
+			return
+		}
+		city := q.Get("city")
+		if location, ok := zipLocation(q.Get("zip")); ok {
+			city = location
+		} else if city == "" {
+			city = weatherCity()
+		}
+		owner := shards.Owner(city)
+		if owner == shards.index {
+			next(w, r)
+			return
+		}
+		shardForwardedTotal.WithLabelValues(strconv.Itoa(owner)).Inc()
+		shards.proxies[owner].ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var snmpRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "snmp_requests_total",
+		Help: "Total number of SNMP requests",
+	},
+	[]string{"pdu", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(snmpRequestsTotal)
+}
+
+// BER tags, PDU types and error codes used by the read-only SNMPv1/v2c agent
+// (RFC 1157, RFC 3416).
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	berGauge32     = 0x42
+	berTimeTicks   = 0x43
+
+	snmpGet      = 0xA0
+	snmpGetNext  = 0xA1
+	snmpResponse = 0xA2
+	snmpSet      = 0xA3
+	snmpGetBulk  = 0xA5
+
+	snmpNoSuchObject = 0x80
+	snmpEndOfMIBView = 0x82
+
+	snmpV1  = 0
+	snmpV2c = 1
+
+	snmpErrNoSuchName  = 2
+	snmpErrReadOnly    = 4
+	snmpErrNotWritable = 17
+
+	snmpMaxVarBinds     = 64
+	snmpMaxMessageBytes = 1472
+
+	// The NET-SNMP "playpen" subtree, reserved for local experiments. Sites
+	// with their own Private Enterprise Number should set SNMP_ENTERPRISE_OID.
+	snmpDefaultEnterprise = "1.3.6.1.4.1.8072.9999.9999"
+)
+
+var snmpPDUNames = map[byte]string{
+	snmpGet:     "get",
+	snmpGetNext: "getnext",
+	snmpSet:     "set",
+	snmpGetBulk: "getbulk",
+}
+
+var errBERMalformed = errors.New("malformed BER encoding")
+
+type oid []uint32
+
+func parseOID(value string) (oid, error) {
+	var o oid
+	for _, part := range strings.Split(strings.Trim(value, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", value)
+		}
+		o = append(o, uint32(n))
+	}
+	// The first two arcs are encoded as one: the second is below 40 under
+	// 0 and 1, and bounded only by the 32 bits of the sum under 2.
+	if len(o) < 2 || o[0] > 2 || (o[0] < 2 && o[1] >= 40) || o[1] > math.MaxUint32-80 {
+		return nil, fmt.Errorf("invalid OID %q", value)
+	}
+	return o, nil
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (o oid) Compare(other oid) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+func (o oid) Append(arcs ...uint32) oid {
+	return append(append(oid(nil), o...), arcs...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	out := []byte{tag}
+	if n := len(body); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, body...)
+}
+
+func berInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v >= -0x80 && v < 0x80) || len(b) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, b)
+}
+
+func berUint(tag byte, v uint32) []byte {
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	for len(b) > 1 && b[0] == 0 && b[1] < 0x80 {
+		b = b[1:]
+	}
+	if b[0] >= 0x80 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berEncodeOID(o oid) []byte {
+	var body []byte
+	for _, arc := range append(oid{o[0]*40 + o[1]}, o[2:]...) {
+		chunk := []byte{byte(arc & 0x7F)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			chunk = append([]byte{byte(arc&0x7F) | 0x80}, chunk...)
+		}
+		body = append(body, chunk...)
+	}
+	return berTLV(berOID, body)
+}
+
+// berRead splits the first TLV off data.
+func berRead(data []byte) (tag byte, value, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errBERMalformed
+	}
+	tag, length, data := data[0], int(data[1]), data[2:]
+	if length >= 0x80 {
+		n := length & 0x7F
+		if n == 0 || n > 3 || len(data) < n {
+			return 0, nil, nil, errBERMalformed
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if len(data) < length {
+		return 0, nil, nil, errBERMalformed
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+func berExpect(data []byte, want byte) (value, rest []byte, err error) {
+	tag, value, rest, err := berRead(data)
+	if err == nil && tag != want {
+		err = errBERMalformed
+	}
+	return value, rest, err
+}
+
+func berDecodeInt(value []byte) (int64, error) {
+	if len(value) == 0 || len(value) > 8 {
+		return 0, errBERMalformed
+	}
+	v := int64(int8(value[0]))
+	for _, b := range value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func berDecodeOID(value []byte) (oid, error) {
+	if len(value) == 0 {
+		return nil, errBERMalformed
+	}
+	var o oid
+	var arc uint32
+	for i, b := range value {
+		if arc > math.MaxUint32>>7 {
+			return nil, errBERMalformed
+		}
+		arc = arc<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			// The first subidentifier holds the first two arcs.
+			if o == nil {
+				o = oid{min(arc/40, 2), arc - min(arc/40, 2)*40}
+			} else {
+				o = append(o, arc)
+			}
+			arc = 0
+		} else if i == len(value)-1 {
+			return nil, errBERMalformed
+		}
+	}
+	return o, nil
+}
+
+type snmpRequest struct {
+	version   int64
+	community string
+	pdu       byte
+	requestID int64
+	// For GetBulk these hold non-repeaters and max-repetitions.
+	nonRepeaters   int64
+	maxRepetitions int64
+	oids           []oid
+}
+
+// parseSNMP decodes a request. Messages longer than snmpMaxMessageBytes or
+// with more than snmpMaxVarBinds variable bindings are rejected along with
+// truncated ones.
+func parseSNMP(data []byte) (snmpRequest, error) {
+	var req snmpRequest
+	if len(data) > snmpMaxMessageBytes {
+		return req, errBERMalformed
+	}
+	msg, _, err := berExpect(data, berSequence)
+	if err != nil {
+		return req, err
+	}
+	value, msg, err := berExpect(msg, berInteger)
+	if err != nil {
+		return req, err
+	}
+	if req.version, err = berDecodeInt(value); err != nil {
+		return req, err
+	}
+	value, msg, err = berExpect(msg, berOctetString)
+	if err != nil {
+		return req, err
+	}
+	req.community = string(value)
+
+	pdu, body, _, err := berRead(msg)
+	if err != nil {
+		return req, err
+	}
+	req.pdu = pdu
+	var fields [3]int64
+	for i := range fields {
+		if value, body, err = berExpect(body, berInteger); err != nil {
+			return req, err
+		}
+		if fields[i], err = berDecodeInt(value); err != nil {
+			return req, err
+		}
+	}
+	req.requestID, req.nonRepeaters, req.maxRepetitions = fields[0], fields[1], fields[2]
+
+	list, _, err := berExpect(body, berSequence)
+	if err != nil {
+		return req, err
+	}
+	for len(list) > 0 {
+		if len(req.oids) == snmpMaxVarBinds {
+			return req, errBERMalformed
+		}
+		var varbind []byte
+		if varbind, list, err = berExpect(list, berSequence); err != nil {
+			return req, err
+		}
+		if value, _, err = berExpect(varbind, berOID); err != nil {
+			return req, err
+		}
+		o, err := berDecodeOID(value)
+		if err != nil {
+			return req, err
+		}
+		req.oids = append(req.oids, o)
+	}
+	return req, nil
+}
+
+type snmpObject struct {
+	oid   oid
+	value func(result weatherResult, stale bool) []byte
+}
+
+type snmpAgent struct {
+	conn      *net.UDPConn
+	community string
+	objects   []snmpObject
+	poller    *weatherPoller
+}
+
+// startSNMPAgent serves the current conditions of SNMP_CITY over SNMPv1/v2c
+// for network management systems that monitor everything via SNMP.
+func startSNMPAgent(cfg *Config) error {
+	enterprise, err := parseOID(cfg.SNMPEnterpriseOID)
+	if err != nil {
+		return fmt.Errorf("invalid SNMP_ENTERPRISE_OID: %w", err)
+	}
+	city := cfg.SNMPCity
+	if city == "" {
+		city = cfg.WeatherCity
+	}
+
+	conn, err := listenUDPUpgradable("snmp", cfg.SNMPListen)
+	if err != nil {
+		return err
+	}
+
+	a := &snmpAgent{
+		conn:      conn,
+		community: cfg.SNMPCommunity,
+		objects:   snmpObjects(enterprise, city, time.Now()),
+		poller:    newWeatherPoller("SNMP", city, cfg.SNMPRefresh),
+	}
+	log.Printf("SNMP agent listening on %s (%s)", conn.LocalAddr(), enterprise)
+	closeOnStop(conn)
+	go a.poller.Run()
+	go a.serve()
+	return nil
+}
+
+// snmpObjects builds the MIB: the standard system group plus the weather
+// objects under <enterprise>.1, sorted by OID for GetNext walks.
+func snmpObjects(enterprise oid, city string, started time.Time) []snmpObject {
+	system := oid{1, 3, 6, 1, 2, 1, 1}
+	weather := enterprise.Append(1)
+	centi := func(v float64) int64 { return int64(math.Round(v * 100)) }
+
+	objects := []snmpObject{
+		{system.Append(1, 0), func(weatherResult, bool) []byte {
+			return berTLV(berOctetString, []byte("Weather App"))
+		}},
+		{system.Append(2, 0), func(weatherResult, bool) []byte {
+			return berEncodeOID(enterprise)
+		}},
+		{system.Append(3, 0), func(weatherResult, bool) []byte {
+			return berUint(berTimeTicks, uint32(time.Since(started)/(10*time.Millisecond)))
+		}},
+		// Temperature in hundredths of °C.
+		{weather.Append(1, 0), func(r weatherResult, _ bool) []byte {
+			return berInt(berInteger, centi(r.Temperature))
+		}},
+		// Relative humidity in %, -1 when unknown.
+		{weather.Append(2, 0), func(r weatherResult, _ bool) []byte {
+			if r.Humidity < 0 || r.Humidity > 100 {
+				return berInt(berInteger, -1)
+			}
+			return berInt(berInteger, int64(math.Round(r.Humidity)))
+		}},
+		// OpenWeatherMap condition code.
+		{weather.Append(3, 0), func(r weatherResult, _ bool) []byte {
+			return berInt(berInteger, int64(r.ConditionCode))
+		}},
+		// Observation time, Unix seconds.
+		{weather.Append(4, 0), func(r weatherResult, _ bool) []byte {
+			if r.FetchedAt.IsZero() {
+				return berUint(berGauge32, 0)
+			}
+			return berUint(berGauge32, uint32(r.FetchedAt.Unix()))
+		}},
+		// TruthValue: 1 when the last refresh failed or the value is cached.
+		{weather.Append(5, 0), func(r weatherResult, stale bool) []byte {
+			if stale || r.Source == "cache" {
+				return berInt(berInteger, 1)
+			}
+			return berInt(berInteger, 2)
+		}},
+		{weather.Append(6, 0), func(weatherResult, bool) []byte {
+			return berTLV(berOctetString, []byte(city))
+		}},
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].oid.Compare(objects[j].oid) < 0 })
+	return objects
+}
+
+func (a *snmpAgent) serve() {
+	buf := make([]byte, snmpMaxMessageBytes*2)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if backgroundJobs.Err() != nil {
+			return
+		}
+		if err != nil {
+			logError("SNMP read error: %v", err)
+			continue
+		}
+		req, err := parseSNMP(buf[:n])
+		if err != nil || (req.version != snmpV1 && req.version != snmpV2c) {
+			continue
+		}
+		if _, known := snmpPDUNames[req.pdu]; !known {
+			continue
+		}
+		if req.community != a.community {
+			snmpRequestsTotal.WithLabelValues(snmpPDUNames[req.pdu], "bad_community").Inc()
+			continue
+		}
+		resp, ok := a.handle(req)
+		if !ok {
+			continue
+		}
+		if _, err := a.conn.WriteToUDP(resp, addr); err != nil {
+			logError("SNMP write to %s failed: %v", addr, err)
+		}
+	}
+}
+
+// next returns the index of the first object strictly after o.
+func (a *snmpAgent) next(o oid) int {
+	return sort.Search(len(a.objects), func(i int) bool { return a.objects[i].oid.Compare(o) > 0 })
+}
+
+func (a *snmpAgent) handle(req snmpRequest) ([]byte, bool) {
+	result, stale := a.poller.Latest()
+	v1 := req.version == snmpV1
+	var (
+		varbinds          [][]byte
+		errStatus, errIdx int64
+	)
+	fail := func(status int64, index int) {
+		if errStatus == 0 {
+			errStatus, errIdx = status, int64(index+1)
+		}
+	}
+	bind := func(o oid, value []byte) {
+		varbinds = append(varbinds, berTLV(berSequence, berEncodeOID(o), value))
+	}
+	getNext := func(i int, o oid) oid {
+		if j := a.next(o); j < len(a.objects) {
+			bind(a.objects[j].oid, a.objects[j].value(result, stale))
+			return a.objects[j].oid
+		}
+		if v1 {
+			fail(snmpErrNoSuchName, i)
+		}
+		bind(o, berTLV(snmpEndOfMIBView, nil))
+		return nil
+	}
+
+	switch {
+	case req.pdu == snmpGet:
+		for i, o := range req.oids {
+			j := sort.Search(len(a.objects), func(k int) bool { return a.objects[k].oid.Compare(o) >= 0 })
+			if j < len(a.objects) && a.objects[j].oid.Compare(o) == 0 {
+				bind(o, a.objects[j].value(result, stale))
+				continue
+			}
+			if v1 {
+				fail(snmpErrNoSuchName, i)
+			}
+			bind(o, berTLV(snmpNoSuchObject, nil))
+		}
+	case req.pdu == snmpGetNext:
+		for i, o := range req.oids {
+			getNext(i, o)
+		}
+	case req.pdu == snmpGetBulk && !v1:
+		nonRepeaters := len(req.oids)
+		if req.nonRepeaters >= 0 && req.nonRepeaters < int64(nonRepeaters) {
+			nonRepeaters = int(req.nonRepeaters)
+		}
+		for i, o := range req.oids[:nonRepeaters] {
+			getNext(i, o)
+		}
+		cursors := append([]oid(nil), req.oids[nonRepeaters:]...)
+		for r := int64(0); r < req.maxRepetitions && len(varbinds) < snmpMaxVarBinds && len(cursors) > 0; r++ {
+			done := true
+			for i, o := range cursors {
+				if o == nil {
+					bind(req.oids[nonRepeaters+i], berTLV(snmpEndOfMIBView, nil))
+					continue
+				}
+				if cursors[i] = getNext(nonRepeaters+i, o); cursors[i] != nil {
+					done = false
+				}
+			}
+			if done {
+				break
+			}
+		}
+	case req.pdu == snmpSet:
+		status := int64(snmpErrNotWritable)
+		if v1 {
+			status = snmpErrReadOnly
+		}
+		fail(status, 0)
+		for _, o := range req.oids {
+			bind(o, berTLV(berNull, nil))
+		}
+	default:
+		return nil, false
+	}
+
+	if v1 && errStatus != 0 {
+		// SNMPv1 error responses echo the request variable bindings.
+		varbinds = varbinds[:0]
+		for _, o := range req.oids {
+			bind(o, berTLV(berNull, nil))
+		}
+	}
+	status := "ok"
+	if errStatus != 0 {
+		status = "error"
+	}
+	snmpRequestsTotal.WithLabelValues(snmpPDUNames[req.pdu], status).Inc()
+
+	return berTLV(berSequence,
+		berInt(berInteger, req.version),
+		berTLV(berOctetString, []byte(req.community)),
+		berTLV(snmpResponse,
+			berInt(berInteger, req.requestID),
+			berInt(berInteger, errStatus),
+			berInt(berInteger, errIdx),
+			berTLV(berSequence, varbinds...),
+		),
+	), true
+}
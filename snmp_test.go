@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// snmpTestMessage encodes a request as a manager would send it.
+func snmpTestMessage(version int64, community string, pdu byte, fields [3]int64, oids ...oid) []byte {
+	var varbinds [][]byte
+	for _, o := range oids {
+		varbinds = append(varbinds, berTLV(berSequence, berEncodeOID(o), berTLV(berNull)))
+	}
+	return berTLV(berSequence,
+		berInt(berInteger, version),
+		berTLV(berOctetString, []byte(community)),
+		berTLV(pdu,
+			berInt(berInteger, fields[0]),
+			berInt(berInteger, fields[1]),
+			berInt(berInteger, fields[2]),
+			berTLV(berSequence, varbinds...),
+		),
+	)
+}
+
+func TestParseSNMP(t *testing.T) {
+	sysDescr := oid{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	large := oid{1, 3, 6, 1, 4, 1, 8072, 4294967295}
+	get := snmpTestMessage(snmpV1, "public", snmpGet, [3]int64{42, 0, 0}, sysDescr)
+
+	manyOIDs := make([]oid, snmpMaxVarBinds+1)
+	for i := range manyOIDs {
+		manyOIDs[i] = sysDescr
+	}
+	// An OID whose last byte still has the continuation bit set.
+	badOID := berTLV(berSequence,
+		berInt(berInteger, snmpV2c),
+		berTLV(berOctetString, []byte("public")),
+		berTLV(snmpGet, berInt(berInteger, 1), berInt(berInteger, 0), berInt(berInteger, 0),
+			berTLV(berSequence, berTLV(berSequence, berTLV(berOID, []byte{0x2B, 0x86}), berTLV(berNull)))),
+	)
+	// A nine-byte request ID.
+	longInt := berTLV(berSequence,
+		berInt(berInteger, snmpV2c),
+		berTLV(berOctetString, []byte("public")),
+		berTLV(snmpGet, berTLV(berInteger, make([]byte, 9)), berInt(berInteger, 0), berInt(berInteger, 0),
+			berTLV(berSequence)),
+	)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    snmpRequest
+		wantErr bool
+	}{
+		{name: "v1 get", data: get,
+			want: snmpRequest{version: snmpV1, community: "public", pdu: snmpGet, requestID: 42, oids: []oid{sysDescr}}},
+		{name: "v2c getbulk", data: snmpTestMessage(snmpV2c, "private", snmpGetBulk, [3]int64{-7, 1, 20}, sysDescr, large),
+			want: snmpRequest{version: snmpV2c, community: "private", pdu: snmpGetBulk, requestID: -7, nonRepeaters: 1, maxRepetitions: 20, oids: []oid{sysDescr, large}}},
+		{name: "no varbinds", data: snmpTestMessage(snmpV2c, "", snmpGetNext, [3]int64{1, 0, 0}),
+			want: snmpRequest{version: snmpV2c, pdu: snmpGetNext, requestID: 1}},
+		{name: "most varbinds", data: snmpTestMessage(snmpV2c, "public", snmpGet, [3]int64{}, manyOIDs[1:]...),
+			want: snmpRequest{version: snmpV2c, community: "public", pdu: snmpGet, oids: manyOIDs[1:]}},
+
+		{name: "empty", data: nil, wantErr: true},
+		{name: "truncated header", data: get[:1], wantErr: true},
+		{name: "truncated message", data: get[:len(get)-1], wantErr: true},
+		{name: "truncated community", data: get[:8], wantErr: true},
+		{name: "not a sequence", data: append([]byte{berOctetString}, get[1:]...), wantErr: true},
+		{name: "indefinite length", data: []byte{berSequence, 0x80, 0, 0}, wantErr: true},
+		{name: "length of four bytes", data: []byte{berSequence, 0x84, 0, 0, 0, 1, 0}, wantErr: true},
+		{name: "long-form length past the end", data: []byte{berSequence, 0x82, 0x01, 0x00, 0x02, 0x01}, wantErr: true},
+		{name: "too many varbinds", data: snmpTestMessage(snmpV2c, "public", snmpGet, [3]int64{}, manyOIDs...), wantErr: true},
+		{name: "oversize", data: berTLV(berSequence, make([]byte, snmpMaxMessageBytes)), wantErr: true},
+		{name: "unterminated OID arc", data: badOID, wantErr: true},
+		{name: "integer too long", data: longInt, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSNMP(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSNMP error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.version != tt.want.version || got.community != tt.want.community || got.pdu != tt.want.pdu ||
+				got.requestID != tt.want.requestID || got.nonRepeaters != tt.want.nonRepeaters ||
+				got.maxRepetitions != tt.want.maxRepetitions {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !slices.EqualFunc(got.oids, tt.want.oids, func(a, b oid) bool { return a.Compare(b) == 0 }) {
+				t.Errorf("OIDs %v, want %v", got.oids, tt.want.oids)
+			}
+		})
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    oid
+		wantErr bool
+	}{
+		{value: "1.3.6.1.4.1.8072", want: oid{1, 3, 6, 1, 4, 1, 8072}},
+		{value: ".1.3.6.1.", want: oid{1, 3, 6, 1}},
+		{value: "2.999.4294967295", want: oid{2, 999, 4294967295}},
+		{value: "1", wantErr: true},
+		{value: "3.1", wantErr: true},
+		{value: "1.40", wantErr: true},
+		{value: "2.4294967216", wantErr: true},
+		{value: "1.3.4294967296", wantErr: true},
+		{value: "1..3", wantErr: true},
+		{value: "1.3.x", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseOID(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Compare(tt.want) != 0 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBEROIDRoundTrip(t *testing.T) {
+	for _, o := range []oid{
+		{1, 3, 6, 1, 2, 1, 1, 3, 0},
+		{1, 3, 6, 1, 4, 1, 8072, 9999, 9999, 1, 4, 0},
+		{2, 999, 127, 128, 16383, 16384, 4294967295},
+		{0, 39},
+	} {
+		_, value, rest, err := berRead(berEncodeOID(o))
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("berRead(%v): %v, %d bytes left", o, err, len(rest))
+		}
+		got, err := berDecodeOID(value)
+		if err != nil || got.Compare(o) != 0 {
+			t.Errorf("round trip of %v gave %v (%v)", o, got, err)
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 127, 128, -128, -129, 1 << 31, -1 << 63, 1<<63 - 1} {
+		_, value, _, err := berRead(berInt(berInteger, v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := berDecodeInt(value); err != nil || got != v {
+			t.Errorf("round trip of %d gave %d (%v)", v, got, err)
+		}
+	}
+	if enc := berUint(berGauge32, 0x80000000); !bytes.Equal(enc, []byte{berGauge32, 5, 0, 0x80, 0, 0, 0}) {
+		t.Errorf("berUint(0x80000000) = % x", enc)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maskedSecret = "********"
+
+// maskedValue returns value of setting s as it may be shown: secrets are
+// masked, and so are the credentials of URLs, such as a proxy's user:pass@.
+func maskedValue(s configSetting, value string) string {
+	switch s.Type {
+	case settingSecret:
+		return maskedSecret
+	case settingURL:
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			u.User = nil
+			return u.Scheme + "://" + maskedSecret + "@" + strings.TrimPrefix(u.String(), u.Scheme+"://")
+		}
+	}
+	return value
+}
+
+// ConfigChange is one setting whose candidate value differs from the
+// running one. Secrets are masked; nil means the setting is unset.
+type ConfigChange struct {
+	Setting         string  `json:"setting"`
+	Running         *string `json:"running"`
+	Candidate       *string `json:"candidate"`
+	RestartRequired bool    `json:"restart_required,omitempty"`
+}
+
+// ConfigStageStatus describes the staged candidate config.
+type ConfigStageStatus struct {
+	UploadedAt time.Time      `json:"uploaded_at"`
+	Changes    []ConfigChange `json:"changes"`
+}
+
+// configStage holds a candidate config uploaded through the admin API and
+// the values replaced by the last activation, so it can be rolled back.
+// A candidate only lists the settings it changes; settings it omits keep
+// their running values.
+type configStage struct {
+	mu         sync.Mutex
+	candidate  map[string]string
+	uploadedAt time.Time
+	previous   map[string]*string
+}
+
+var stagedConfig = &configStage{}
+
+// runningValue returns the value of a setting in c, nil when unset.
+func runningValue(c *Config, name string) *string {
+	if v, ok := c.Lookup(name); ok {
+		return &v
+	}
+	return nil
+}
+
+// diffConfig compares values with the running configuration, in the order
+// of configSettings.
+func diffConfig(values map[string]*string) []ConfigChange {
+	changes := []ConfigChange{}
+	cfg := runningConfig()
+	for _, s := range configSettings {
+		candidate, ok := values[s.Name]
+		if !ok {
+			continue
+		}
+		running := runningValue(cfg, s.Name)
+		if (running == nil) == (candidate == nil) && (running == nil || *running == *candidate) {
+			continue
+		}
+		change := ConfigChange{Setting: s.Name, Running: running, Candidate: candidate, RestartRequired: !s.Live}
+		if change.Running != nil {
+			masked := maskedValue(s, *change.Running)
+			change.Running = &masked
+		}
+		if change.Candidate != nil {
+			masked := maskedValue(s, *change.Candidate)
+			change.Candidate = &masked
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func candidateValues(candidate map[string]string) map[string]*string {
+	values := make(map[string]*string, len(candidate))
+	for name, value := range candidate {
+		value := value
+		values[name] = &value
+	}
+	return values
+}
+
+// applyConfig puts values in the running configuration and returns what
+// they replaced. Settings read on every use pick the new values up
+// immediately; the others keep their startup values until the next restart.
+func applyConfig(values map[string]*string) map[string]*string {
+	replaced := make(map[string]*string, len(values))
+	updateConfig(func(c *Config) *Config {
+		for name := range values {
+			replaced[name] = runningValue(c, name)
+		}
+		return c.withChanges(values)
+	})
+	return replaced
+}
+
+// changedSettings names the settings of changes, for the audit log, which
+// must not hold secret values.
+func changedSettings(changes []ConfigChange) []string {
+	names := make([]string, len(changes))
+	for i, c := range changes {
+		names[i] = c.Setting
+	}
+	return names
+}
+
+// runningConfigHandler returns the values of all settings that are set.
+func runningConfigHandler(w http.ResponseWriter, r *http.Request) {
+	running := make(map[string]string)
+	cfg := runningConfig()
+	for _, s := range configSettings {
+		if v := runningValue(cfg, s.Name); v != nil {
+			running[s.Name] = maskedValue(s, *v)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(running)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// stageConfigHandler validates a YAML config (same format as CONFIG_FILE)
+// and stages it as the candidate, replacing any previous candidate. Its
+// secret:// references are read right away, so activation cannot fail.
+func stageConfigHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "admin.invalid_config", err)
+		return
+	}
+	values, errs := parseConfig(data)
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = e.Error()
+		}
+		writeProblem(w, r, http.StatusUnprocessableEntity, "admin.invalid_config", strings.Join(messages, "; "))
+		return
+	}
+	if problems := resolveSecrets(values); len(problems) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "admin.invalid_config", strings.Join(problems, "; "))
+		return
+	}
+
+	s := stagedConfig
+	s.mu.Lock()
+	s.candidate, s.uploadedAt = values, time.Now().UTC()
+	status := ConfigStageStatus{UploadedAt: s.uploadedAt, Changes: diffConfig(candidateValues(values))}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+func candidateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s := stagedConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.candidate == nil {
+		writeProblem(w, r, http.StatusNotFound, "admin.no_candidate")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfigStageStatus{UploadedAt: s.uploadedAt, Changes: diffConfig(candidateValues(s.candidate))})
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+func discardConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s := stagedConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.candidate == nil {
+		writeProblem(w, r, http.StatusNotFound, "admin.no_candidate")
+		return
+	}
+	s.candidate = nil
+	w.WriteHeader(http.StatusNoContent)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "204").Inc()
+}
+
+// restartRequired names the changes that only take effect after a restart.
+func restartRequired(changes []ConfigChange) []string {
+	var names []string
+	for _, c := range changes {
+		if c.RestartRequired {
+			names = append(names, c.Setting)
+		}
+	}
+	return names
+}
+
+// activateConfigHandler makes the candidate the running config. The values
+// it replaces are kept for a single rollback. A candidate changing settings
+// that are only read at startup is refused unless ?restart_required=accept
+// acknowledges that those keep their old values until the next restart.
+func activateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s := stagedConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.candidate == nil {
+		writeProblem(w, r, http.StatusConflict, "admin.no_candidate")
+		return
+	}
+	values := candidateValues(s.candidate)
+	changes := diffConfig(values)
+	pending := restartRequired(changes)
+	if len(pending) > 0 && r.URL.Query().Get("restart_required") != "accept" {
+		writeProblem(w, r, http.StatusConflict, "admin.restart_required", strings.Join(pending, ", "))
+		return
+	}
+	s.previous = applyConfig(values)
+	s.candidate = nil
+	auditNote(r, "changes", changedSettings(changes))
+	log.Printf("Activated staged config: %d settings changed", len(changes))
+	if len(pending) > 0 {
+		auditNote(r, "restart_required", pending)
+		log.Printf("Activated settings that take effect after a restart: %s", strings.Join(pending, ", "))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// rollbackConfigHandler restores the values replaced by the last activation.
+func rollbackConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s := stagedConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.previous == nil {
+		writeProblem(w, r, http.StatusConflict, "admin.nothing_to_roll_back")
+		return
+	}
+	changes := diffConfig(s.previous)
+	applyConfig(s.previous)
+	auditNote(r, "changes", changedSettings(changes))
+	s.previous = nil
+	log.Printf("Rolled back config: %d settings restored", len(changes))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
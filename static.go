@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticAsset is a file of web/static, served under its own name and under
+// a name carrying a hash of its content, app.3f9a1c2e.js for app.js.
+type staticAsset struct {
+	data        []byte
+	hash        string
+	contentType string
+}
+
+var (
+	// staticAssets maps both names of every file to it.
+	staticAssets = make(map[string]*staticAsset)
+	// staticNames maps the name of every file to its hashed name.
+	staticNames = make(map[string]string)
+)
+
+func init() {
+	err := fs.WalkDir(webFiles, "web/static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := webFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		name := strings.TrimPrefix(p, "web/static/")
+		ext := path.Ext(name)
+		asset := &staticAsset{data: data, hash: hex.EncodeToString(sum[:4]), contentType: mime.TypeByExtension(ext)}
+		hashed := strings.TrimSuffix(name, ext) + "." + asset.hash + ext
+		staticAssets[name], staticAssets[hashed] = asset, asset
+		staticNames[name] = hashed
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to read static files: %v", err)
+	}
+}
+
+// staticURL is the URL of a file of web/static with its hashed name, for
+// the "static" helper of the page template.
+func staticURL(name string) string {
+	if hashed, ok := staticNames[name]; ok {
+		return "/static/" + hashed
+	}
+	return "/static/" + name
+}
+
+// staticHandler serves /static/. Hashed names change with the content, so
+// they are cached for a year; plain names are revalidated on every use.
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	asset, ok := staticAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		httpRequestsTotal.WithLabelValues(r.Method, "/static/", "404").Inc()
+		return
+	}
+	if staticNames[name] == "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	if asset.contentType != "" {
+		w.Header().Set("Content-Type", asset.contentType)
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.data))
+	httpRequestsTotal.WithLabelValues(r.Method, "/static/", "200").Inc()
+}
+
+// faviconHandler redirects /favicon.ico, which browsers ask for on their
+// own, to the icon of the page.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, staticURL("favicon.svg"), http.StatusFound)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "302").Inc()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stationTemperatureGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "station_temperature_celsius",
+			Help: "Latest temperature reported by a local weather station in Celsius",
+		},
+		[]string{"station"},
+	)
+
+	stationUpdatesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "station_updates_total",
+			Help: "Total number of updates received from local weather stations",
+		},
+		[]string{"station", "protocol"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(stationTemperatureGauge)
+	prometheus.MustRegister(stationUpdatesTotal)
+}
+
+// StationReading is a single observation pushed by a personal weather
+// station. All values are stored in metric units; fields the station did
+// not report are left nil.
+type StationReading struct {
+	StationID     string    `json:"station_id"`
+	Protocol      string    `json:"protocol"`
+	Temperature   *float64  `json:"temperature,omitempty"`
+	Humidity      *float64  `json:"humidity,omitempty"`
+	DewPoint      *float64  `json:"dew_point,omitempty"`
+	Pressure      *float64  `json:"pressure,omitempty"`
+	WindSpeed     *float64  `json:"wind_speed,omitempty"`
+	WindGust      *float64  `json:"wind_gust,omitempty"`
+	WindDirection *float64  `json:"wind_direction,omitempty"`
+	RainRate      *float64  `json:"rain_rate,omitempty"`
+	DailyRain     *float64  `json:"daily_rain,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// stationStore holds the latest reading of each station. Station IDs come
+// from uploads, so it is capped at CACHE_MAX_CITIES like the caches, and
+// the metric series of a station go with it.
+type stationStore struct {
+	readings *lruCache[string, StationReading]
+}
+
+var stations = newStationStore()
+
+func newStationStore() *stationStore {
+	s := &stationStore{readings: newLRUCache[string, StationReading]("stations", maxCachedCities)}
+	s.readings.evicted = func(id string, _ StationReading) {
+		stationUpdatesTotal.DeletePartialMatch(prometheus.Labels{"station": id})
+		stationTemperatureGauge.DeleteLabelValues(id)
+	}
+	return s
+}
+
+func (s *stationStore) Update(reading StationReading) {
+	s.readings.Set(reading.StationID, reading)
+
+	stationUpdatesTotal.WithLabelValues(reading.StationID, reading.Protocol).Inc()
+	if reading.Temperature != nil {
+		stationTemperatureGauge.WithLabelValues(reading.StationID).Set(*reading.Temperature)
+	}
+}
+
+func (s *stationStore) Get(id string) (StationReading, bool) {
+	return s.readings.Get(id)
+}
+
+// Latest returns the most recent reading across all stations.
+func (s *stationStore) Latest() (StationReading, bool) {
+	var latest StationReading
+	found := false
+	for _, reading := range s.readings.Values() {
+		if !found || reading.Timestamp.After(latest.Timestamp) {
+			latest = reading
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// Fresh returns the reading of the given station (or the latest one when id
+// is empty), provided it is not older than maxAge. Publishers use it so that
+// stale values never reach external networks.
+func (s *stationStore) Fresh(id string, maxAge time.Duration) (StationReading, bool) {
+	var reading StationReading
+	var ok bool
+	if id != "" {
+		reading, ok = s.Get(id)
+	} else {
+		reading, ok = s.Latest()
+	}
+	if !ok || time.Since(reading.Timestamp) > maxAge {
+		return StationReading{}, false
+	}
+	return reading, true
+}
+
+func (s *stationStore) List() []StationReading {
+	list := s.readings.Values()
+	sort.Slice(list, func(i, j int) bool { return list[i].StationID < list[j].StationID })
+	return list
+}
+
+func fahrenheitToCelsius(f float64) float64          { return (f - 32) * 5 / 9 }
+func inchesHgToHPa(in float64) float64               { return in * 33.8639 }
+func mphToMetersPerSecond(mph float64) float64       { return mph * 0.44704 }
+func inchesToMillimeters(in float64) float64         { return in * 25.4 }
+func celsiusToFahrenheit(c float64) float64          { return c*9/5 + 32 }
+func metersPerSecondToMph(ms float64) float64        { return ms / 0.44704 }
+func millimetersToHundredthsInch(mm float64) float64 { return mm / 25.4 * 100 }
+func millimetersToInches(mm float64) float64         { return mm / 25.4 }
+func hPaToInchesHg(hpa float64) float64              { return hpa / 33.8639 }
+
+// formValue returns the converted value of a station parameter, or nil when
+// it is absent or carries the -9999 "no data" marker used by station firmware.
+func formValue(form url.Values, key string, convert func(float64) float64) *float64 {
+	raw := form.Get(key)
+	if raw == "" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || v <= -9999 {
+		return nil
+	}
+	if convert != nil {
+		v = convert(v)
+	}
+	return &v
+}
+
+func parseStationTime(raw string) time.Time {
+	if raw == "" || raw == "now" {
+		return time.Now().UTC()
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", raw)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// stationPasswordValid checks the PASSWORD of a Wunderground upload from
+// station id. Without STATION_PASSWORD, only the stations of
+// STATION_LOCATIONS are accepted when it lists any.
+func stationPasswordValid(id, password string) bool {
+	expected := runningConfig().StationPassword
+	if expected == "" {
+		return stationListed(id)
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// stationListed reports whether STATION_LOCATIONS lists station id or no
+// station at all.
+func stationListed(id string) bool {
+	locations, _ := parseStationLocations(runningConfig().StationLocations)
+	_, ok := locations[id]
+	return ok || len(locations) == 0
+}
+
+// wundergroundHandler implements the Weather Underground PWS upload protocol,
+// so stations configured for wunderground.com can point at this app instead.
+func wundergroundHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	id := q.Get("ID")
+	if id == "" {
+		http.Error(w, "missing station ID", http.StatusBadRequest)
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "400").Inc()
+		return
+	}
+	if !stationPasswordValid(id, q.Get("PASSWORD")) {
+		http.Error(w, "INVALID PASSWORD", http.StatusUnauthorized)
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "401").Inc()
+		return
+	}
+
+	reading := StationReading{
+		StationID:     id,
+		Protocol:      "wunderground",
+		Temperature:   formValue(q, "tempf", fahrenheitToCelsius),
+		Humidity:      formValue(q, "humidity", nil),
+		DewPoint:      formValue(q, "dewptf", fahrenheitToCelsius),
+		Pressure:      formValue(q, "baromin", inchesHgToHPa),
+		WindSpeed:     formValue(q, "windspeedmph", mphToMetersPerSecond),
+		WindGust:      formValue(q, "windgustmph", mphToMetersPerSecond),
+		WindDirection: formValue(q, "winddir", nil),
+		RainRate:      formValue(q, "rainin", inchesToMillimeters),
+		DailyRain:     formValue(q, "dailyrainin", inchesToMillimeters),
+		Timestamp:     parseStationTime(q.Get("dateutc")),
+	}
+	stations.Update(reading)
+	log.Printf("Station %s update via wunderground protocol", id)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success\n"))
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+func stationsHandler(w http.ResponseWriter, r *http.Request) {
+	geojson, ok := requestGeoJSON(w, r)
+	if !ok {
+		return
+	}
+	if geojson {
+		locations, _ := parseStationLocations(runningConfig().StationLocations)
+		var features []GeoJSONFeature
+		for _, reading := range stations.List() {
+			var lat, lon *float64
+			if l, ok := locations[reading.StationID]; ok {
+				lat, lon = &l[0], &l[1]
+			}
+			features = append(features, newGeoJSONFeature(lat, lon, reading))
+		}
+		writeGeoJSON(w, r, features)
+		return
+	}
+	if !writeResponse(w, r, http.StatusOK, stations.List()) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// ecowittPasskeyAllowed reports whether ECOWITT_PASSKEYS lists passkey, a
+// PASSKEY or MAC. Without ECOWITT_PASSKEYS, the stations of
+// STATION_LOCATIONS are accepted, as for Wunderground uploads without
+// STATION_PASSWORD.
+func ecowittPasskeyAllowed(passkey string) bool {
+	allowed := runningConfig().EcowittPasskeys
+	if len(allowed) == 0 {
+		return stationListed(passkey)
+	}
+	return slices.Contains(allowed, passkey)
+}
+
+// ecowittHandler accepts the "customized server" uploads of Ecowitt stations
+// (form POST) and Ambient Weather stations (GET with query parameters). The
+// protocol carries no secret, so stations are identified by PASSKEY/MAC and
+// restricted with ECOWITT_PASSKEYS or STATION_LOCATIONS.
+func ecowittHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "400").Inc()
+		return
+	}
+	form := r.Form
+
+	protocol := "ecowitt"
+	id := form.Get("PASSKEY")
+	if id == "" {
+		protocol = "ambient"
+		id = form.Get("MAC")
+	}
+	if id == "" {
+		http.Error(w, "missing PASSKEY or MAC", http.StatusBadRequest)
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "400").Inc()
+		return
+	}
+	if !ecowittPasskeyAllowed(id) {
+		http.Error(w, "unknown station", http.StatusUnauthorized)
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "401").Inc()
+		return
+	}
+
+	rainRate := formValue(form, "rainratein", inchesToMillimeters)
+	if rainRate == nil {
+		rainRate = formValue(form, "hourlyrainin", inchesToMillimeters)
+	}
+
+	reading := StationReading{
+		StationID:     id,
+		Protocol:      protocol,
+		Temperature:   formValue(form, "tempf", fahrenheitToCelsius),
+		Humidity:      formValue(form, "humidity", nil),
+		DewPoint:      formValue(form, "dewptf", fahrenheitToCelsius),
+		Pressure:      formValue(form, "baromrelin", inchesHgToHPa),
+		WindSpeed:     formValue(form, "windspeedmph", mphToMetersPerSecond),
+		WindGust:      formValue(form, "windgustmph", mphToMetersPerSecond),
+		WindDirection: formValue(form, "winddir", nil),
+		RainRate:      rainRate,
+		DailyRain:     formValue(form, "dailyrainin", inchesToMillimeters),
+		Timestamp:     parseStationTime(form.Get("dateutc")),
+	}
+	stations.Update(reading)
+	log.Printf("Station %s update via %s protocol", id, protocol)
+
+	w.WriteHeader(http.StatusOK)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWundergroundPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     map[string]string
+		query      string
+		wantStatus int
+	}{
+		{name: "password", values: map[string]string{"STATION_PASSWORD": "s3cret"}, query: "ID=KXX1&PASSWORD=s3cret", wantStatus: http.StatusOK},
+		{name: "wrong password", values: map[string]string{"STATION_PASSWORD": "s3cret"}, query: "ID=KXX1&PASSWORD=s3cre", wantStatus: http.StatusUnauthorized},
+		{name: "no password", values: map[string]string{"STATION_PASSWORD": "s3cret"}, query: "ID=KXX1", wantStatus: http.StatusUnauthorized},
+		{name: "open", values: map[string]string{}, query: "ID=KXX1", wantStatus: http.StatusOK},
+		{name: "listed station", values: map[string]string{"STATION_LOCATIONS": "KXX1=55.7,37.6"}, query: "ID=KXX1", wantStatus: http.StatusOK},
+		{name: "unlisted station", values: map[string]string{"STATION_LOCATIONS": "KXX1=55.7,37.6"}, query: "ID=KXX2", wantStatus: http.StatusUnauthorized},
+		{name: "password for an unlisted station", values: map[string]string{"STATION_PASSWORD": "s3cret", "STATION_LOCATIONS": "KXX1=55.7,37.6"}, query: "ID=KXX2&PASSWORD=s3cret", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.values)
+			w := httptest.NewRecorder()
+			wundergroundHandler(w, httptest.NewRequest(http.MethodGet, "/weatherstation/updateweatherstation.php?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEcowittUpload(t *testing.T) {
+	setTestConfig(t, map[string]string{"ECOWITT_PASSKEYS": "PK1,AA:BB"})
+	float := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name         string
+		method       string
+		form         string
+		wantID       string
+		wantProtocol string
+		want         StationReading
+	}{
+		{
+			name:   "ecowitt",
+			method: http.MethodPost,
+			form:   "PASSKEY=PK1&tempf=68&humidity=40&baromrelin=29.92&windspeedmph=10&rainratein=0.1&hourlyrainin=0.5&dailyrainin=1",
+			wantID: "PK1", wantProtocol: "ecowitt",
+			want: StationReading{Temperature: float(20), Humidity: float(40), Pressure: float(1013.21), WindSpeed: float(4.4704), RainRate: float(2.54), DailyRain: float(25.4)},
+		},
+		{
+			name:   "hourly rain without a rate",
+			method: http.MethodPost,
+			form:   "PASSKEY=PK1&tempf=32&hourlyrainin=0.5",
+			wantID: "PK1", wantProtocol: "ecowitt",
+			want: StationReading{Temperature: float(0), RainRate: float(12.7)},
+		},
+		{
+			name:   "no data marker",
+			method: http.MethodPost,
+			form:   "PASSKEY=PK1&tempf=-9999&baromrelin=-9999&rainratein=-9999&hourlyrainin=0.2",
+			wantID: "PK1", wantProtocol: "ecowitt",
+			want: StationReading{RainRate: float(5.08)},
+		},
+		{
+			name:   "ambient",
+			method: http.MethodGet,
+			form:   "MAC=AA:BB&tempf=50",
+			wantID: "AA:BB", wantProtocol: "ambient",
+			want: StationReading{Temperature: float(10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *http.Request
+			if tt.method == http.MethodPost {
+				r = httptest.NewRequest(tt.method, "/data/report/", strings.NewReader(tt.form))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				r = httptest.NewRequest(tt.method, "/data/report/?"+tt.form, nil)
+			}
+			w := httptest.NewRecorder()
+			ecowittHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			got, ok := stations.Get(tt.wantID)
+			if !ok || got.Protocol != tt.wantProtocol {
+				t.Fatalf("reading %+v, %v", got, ok)
+			}
+			fields := []struct {
+				name      string
+				got, want *float64
+			}{
+				{"temperature", got.Temperature, tt.want.Temperature},
+				{"humidity", got.Humidity, tt.want.Humidity},
+				{"pressure", got.Pressure, tt.want.Pressure},
+				{"wind speed", got.WindSpeed, tt.want.WindSpeed},
+				{"rain rate", got.RainRate, tt.want.RainRate},
+				{"daily rain", got.DailyRain, tt.want.DailyRain},
+			}
+			for _, f := range fields {
+				if (f.got == nil) != (f.want == nil) || f.got != nil && math.Abs(*f.got-*f.want) > 0.01 {
+					t.Errorf("%s %v, want %v", f.name, optionalValue(f.got), optionalValue(f.want))
+				}
+			}
+		})
+	}
+}
+
+func TestEcowittPasskeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		passkey string
+		want    bool
+	}{
+		{name: "listed", values: map[string]string{"ECOWITT_PASSKEYS": "PK1,PK2"}, passkey: "PK2", want: true},
+		{name: "not listed", values: map[string]string{"ECOWITT_PASSKEYS": "PK1,PK2"}, passkey: "PK3"},
+		{name: "open", values: map[string]string{}, passkey: "PK3", want: true},
+		{name: "located station", values: map[string]string{"STATION_LOCATIONS": "PK1=55.7,37.6"}, passkey: "PK1", want: true},
+		{name: "other station", values: map[string]string{"STATION_LOCATIONS": "PK1=55.7,37.6"}, passkey: "PK3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.values)
+			if got := ecowittPasskeyAllowed(tt.passkey); got != tt.want {
+				t.Errorf("ecowittPasskeyAllowed(%q) = %v, want %v", tt.passkey, got, tt.want)
+			}
+		})
+	}
+}
+
+func optionalValue(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func TestStationStoreCap(t *testing.T) {
+	setTestConfig(t, map[string]string{"CACHE_MAX_CITIES": "2"})
+	temperature := 10.0
+	for _, id := range []string{"CAP1", "CAP2", "CAP3"} {
+		stations.Update(StationReading{StationID: id, Protocol: "test", Temperature: &temperature, Timestamp: time.Now()})
+	}
+	if _, ok := stations.Get("CAP1"); ok {
+		t.Error("the oldest station was kept")
+	}
+	if _, ok := stations.Get("CAP3"); !ok {
+		t.Error("the newest station was evicted")
+	}
+	if n := len(stations.List()); n != 2 {
+		t.Errorf("%d stations, want 2", n)
+	}
+	if stationTemperatureGauge.DeleteLabelValues("CAP1") || stationUpdatesTotal.DeleteLabelValues("CAP1", "test") {
+		t.Error("the metric series of the evicted station were kept")
+	}
+	if !stationTemperatureGauge.DeleteLabelValues("CAP3") {
+		t.Error("no temperature series for a kept station")
+	}
+}
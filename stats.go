@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startedAt = time.Now()
+
+// Counters behind /api/stats. Prometheus has the same figures split by
+// labels, which is awkward to read back without a Prometheus server.
+var (
+	requestsServed atomic.Uint64
+	cacheHits      atomic.Uint64
+	cacheMisses    atomic.Uint64
+)
+
+// upstreamStatus remembers the outcome of the latest weather fetches.
+type upstreamStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+var upstreamHealth = &upstreamStatus{}
+
+func (u *upstreamStatus) Record(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		u.lastSuccess = time.Now()
+		return
+	}
+	u.lastFailure = time.Now()
+	u.lastError = redactSecrets(err.Error())
+}
+
+// RuntimeStats is the /api/stats response.
+type RuntimeStats struct {
+	StartedAt      time.Time     `json:"started_at"`
+	UptimeSeconds  int64         `json:"uptime_seconds"`
+	RequestsServed uint64        `json:"requests_served"`
+	Cache          CacheStats    `json:"cache"`
+	Upstream       UpstreamStats `json:"upstream"`
+	Goroutines     int           `json:"goroutines"`
+	HeapAllocBytes uint64        `json:"heap_alloc_bytes"`
+	SysBytes       uint64        `json:"sys_bytes"`
+	NumGC          uint32        `json:"num_gc"`
+}
+
+type CacheStats struct {
+	Entries  int     `json:"entries"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type UpstreamStats struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+func currentRuntimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		StartedAt:      startedAt.UTC(),
+		UptimeSeconds:  int64(time.Since(startedAt).Seconds()),
+		RequestsServed: requestsServed.Load(),
+		Cache: CacheStats{
+			Entries: lastObservations.Len(),
+			Hits:    cacheHits.Load(),
+			Misses:  cacheMisses.Load(),
+		},
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: mem.HeapAlloc,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+	}
+	if total := stats.Cache.Hits + stats.Cache.Misses; total > 0 {
+		stats.Cache.HitRatio = float64(stats.Cache.Hits) / float64(total)
+	}
+
+	upstreamHealth.mu.Lock()
+	if t := upstreamHealth.lastSuccess; !t.IsZero() {
+		t = t.UTC()
+		stats.Upstream.LastSuccess = &t
+	}
+	if t := upstreamHealth.lastFailure; !t.IsZero() {
+		t = t.UTC()
+		stats.Upstream.LastFailure = &t
+		stats.Upstream.LastError = upstreamHealth.lastError
+	}
+	upstreamHealth.mu.Unlock()
+	return stats
+}
+
+// runtimeStatsHandler serves /api/stats, which is behind the admin
+// authentication.
+func runtimeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentRuntimeStats())
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
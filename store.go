@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyStoreWriteErrorsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "history_store_write_errors_total",
+		Help: "Total number of history changes that could not be written to the history database",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(historyStoreWriteErrorsTotal)
+}
+
+var (
+	boltPointsBucket = []byte("points")
+	boltMetaBucket   = []byte("meta")
+	// boltCountKey holds the number of points, which HISTORY_MAX_POINTS
+	// is checked against on every addition.
+	boltCountKey = []byte("count")
+)
+
+// boltLockTimeout bounds the wait for the file lock, which another process
+// holds only for the duration of one operation while the database is
+// shared.
+const boltLockTimeout = 5 * time.Second
+
+// boltStore is the embedded, pure-Go key-value backend: points are kept in
+// a bbolt database, keyed by timestamp and ID so that time ranges are
+// cursor scans. The database stays open between operations, except during
+// an upgrade: the process being replaced shares it from the moment it
+// starts the new process, which shares it until the old one has exited.
+// While shared, each operation opens the database; the file lock
+// serializes the two processes and IDs come from the bucket sequence, so
+// neither overwrites the other.
+type boltStore struct {
+	// mu orders the operations of this process, which would otherwise
+	// wait on each other's file locks by polling.
+	mu   sync.RWMutex
+	path string
+	// db is the handle kept between operations, nil while shared.
+	db *bolt.DB
+	// writeErr is the error of the last write, nil once a write succeeds
+	// again.
+	writeErr error
+}
+
+// openBoltStore opens the database at path, creating it when missing. With
+// shareUntil, the database is shared until it is closed.
+func openBoltStore(path string, shareUntil <-chan struct{}) (*boltStore, error) {
+	s := &boltStore{path: path}
+	var count uint64
+	err := s.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltPointsBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		count = boltUint(meta.Get(boltCountKey))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening history database %s: %w", path, err)
+	}
+	log.Printf("Opened history database %s with %d observations", path, count)
+	if shareUntil == nil {
+		if err := s.Hold(); err != nil {
+			return nil, fmt.Errorf("opening history database %s: %w", path, err)
+		}
+		return s, nil
+	}
+	go func() {
+		<-shareUntil
+		if err := s.Hold(); err != nil {
+			logError("Keeping history database %s open failed, opening it for each operation: %v", path, err)
+		}
+	}()
+	return s, nil
+}
+
+// Share closes the database for another process to open it: the one an
+// upgrade starts. Operations open it each time until Hold.
+func (s *boltStore) Share() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return
+	}
+	if err := s.db.Close(); err != nil {
+		logError("Closing history database %s failed: %v", s.path, err)
+	}
+	s.db = nil
+}
+
+// Hold opens the database for the operations to come, once no other
+// process uses it.
+func (s *boltStore) Hold() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return nil
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// open opens the database, waiting for the file lock. The caller holds
+// s.mu, for writing unless readOnly.
+func (s *boltStore) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(s.path, 0o644, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: readOnly})
+}
+
+// update runs fn in a read-write transaction.
+func (s *boltStore) update(fn func(*bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return s.db.Update(fn)
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	err = db.Update(fn)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// view runs fn in a read-only transaction.
+func (s *boltStore) view(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db != nil {
+		return s.db.View(fn)
+	}
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	err = db.View(fn)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write runs fn in update and records its failure for Check.
+func (s *boltStore) write(fn func(*bolt.Tx) error) {
+	err := s.update(fn)
+	s.mu.Lock()
+	s.writeErr = err
+	s.mu.Unlock()
+	if err != nil {
+		historyStoreWriteErrorsTotal.Inc()
+		logError("Writing history database %s failed: %v", s.path, err)
+	}
+}
+
+// boltKey orders points by timestamp, then ID. Flipping the sign bit makes
+// timestamps before 1970 sort before later ones.
+func boltKey(p HistoryPoint) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, boltTime(p.Timestamp))
+	binary.BigEndian.PutUint64(key[8:], p.ID)
+	return key
+}
+
+func boltTime(t time.Time) uint64 { return uint64(t.UnixNano()) ^ 1<<63 }
+
+func boltUint(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func boltPutUint(b *bolt.Bucket, key []byte, v uint64) error {
+	return b.Put(key, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func boltPut(b *bolt.Bucket, p HistoryPoint) error {
+	value, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return b.Put(boltKey(p), value)
+}
+
+// boltDeleteBefore deletes the points older than cutoff and returns how
+// many there were.
+func boltDeleteBefore(b *bolt.Bucket, cutoff time.Time) (int, error) {
+	limit := binary.BigEndian.AppendUint64(nil, boltTime(cutoff))
+	c := b.Cursor()
+	n := 0
+	// Next skips keys after a Delete, so start over from the first each
+	// time.
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Add stores an observation and, when the database holds more than
+// HISTORY_MAX_POINTS, drops the oldest points. Points sharing the timestamp
+// of the last dropped one go too, as in the memory store.
+func (s *boltStore) Add(city string, temperature float64, at time.Time) HistoryPoint {
+	var point HistoryPoint
+	s.write(func(tx *bolt.Tx) error {
+		points, meta := tx.Bucket(boltPointsBucket), tx.Bucket(boltMetaBucket)
+		id, err := points.NextSequence()
+		if err != nil {
+			return err
+		}
+		point = HistoryPoint{ID: id, City: city, Temperature: temperature, Timestamp: at}
+		if err := boltPut(points, point); err != nil {
+			return err
+		}
+		count := boltUint(meta.Get(boltCountKey)) + 1
+
+		if excess := int(count) - runningConfig().HistoryMaxPoints; excess > 0 {
+			c := points.Cursor()
+			k, _ := c.First()
+			for i := 1; i < excess && k != nil; i++ {
+				k, _ = c.Next()
+			}
+			if k != nil {
+				last := int64(binary.BigEndian.Uint64(k[:8]) ^ 1<<63)
+				n, err := boltDeleteBefore(points, time.Unix(0, last+1))
+				if err != nil {
+					return err
+				}
+				count -= uint64(n)
+				memoryEvictionsTotal.WithLabelValues("history").Add(float64(n))
+			}
+		}
+		return boltPutUint(meta, boltCountKey, count)
+	})
+	return point
+}
+
+// Query returns the observations for city with from <= timestamp < to.
+func (s *boltStore) Query(city string, from, to time.Time) []HistoryPoint {
+	return s.filter(from, to, func(p HistoryPoint) bool { return strings.EqualFold(p.City, city) })
+}
+
+// Range returns the observations of every city with from <= timestamp < to.
+func (s *boltStore) Range(from, to time.Time) []HistoryPoint {
+	return s.filter(from, to, func(HistoryPoint) bool { return true })
+}
+
+func (s *boltStore) filter(from, to time.Time, keep func(HistoryPoint) bool) []HistoryPoint {
+	return s.Scan(from, to, func(p HistoryPoint) bool { return !p.Invalidated && keep(p) })
+}
+
+// Scan is filter without the exclusion of invalidated points.
+func (s *boltStore) Scan(from, to time.Time, keep func(HistoryPoint) bool) []HistoryPoint {
+	start := binary.BigEndian.AppendUint64(nil, boltTime(from))
+	end := binary.BigEndian.AppendUint64(nil, boltTime(to))
+	var result []HistoryPoint
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltPointsBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k[:8], end) < 0; k, v = c.Next() {
+			var p HistoryPoint
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("point %x: %w", k, err)
+			}
+			if keep(p) {
+				result = append(result, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logError("Reading history database %s failed: %v", s.path, err)
+		return nil
+	}
+	return result
+}
+
+// Edit applies fn to every stored point accepted by match, invalidated ones
+// included, and returns copies of the points fn changed.
+func (s *boltStore) Edit(match func(HistoryPoint) bool, fn func(*HistoryPoint) bool) []HistoryPoint {
+	var edited []HistoryPoint
+	s.write(func(tx *bolt.Tx) error {
+		edited = nil
+		points := tx.Bucket(boltPointsBucket)
+		var changed [][]byte
+		err := points.ForEach(func(k, v []byte) error {
+			var p HistoryPoint
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("point %x: %w", k, err)
+			}
+			if match(p) && fn(&p) {
+				changed = append(changed, k)
+				edited = append(edited, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets must not be changed while ForEach walks them.
+		for i, k := range changed {
+			if err := points.Delete(k); err != nil {
+				return err
+			}
+			if err := boltPut(points, edited[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return edited
+}
+
+// Prune drops every observation older than cutoff and returns how many were
+// removed.
+func (s *boltStore) Prune(cutoff time.Time) int {
+	var n int
+	s.write(func(tx *bolt.Tx) error {
+		var err error
+		if n, err = boltDeleteBefore(tx.Bucket(boltPointsBucket), cutoff); err != nil || n == 0 {
+			return err
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		return boltPutUint(meta, boltCountKey, boltUint(meta.Get(boltCountKey))-uint64(n))
+	})
+	return n
+}
+
+// Snapshot returns a copy of every stored observation.
+func (s *boltStore) Snapshot() []HistoryPoint {
+	return s.Scan(time.Unix(0, -1<<63), time.Unix(0, 1<<63-1), func(HistoryPoint) bool { return true })
+}
+
+// Restore replaces the stored observations. IDs are kept so that references
+// to them survive a migration; new observations continue after the highest.
+func (s *boltStore) Restore(list []HistoryPoint) {
+	s.write(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltPointsBucket); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		points, err := tx.CreateBucket(boltPointsBucket)
+		if err != nil {
+			return err
+		}
+		var nextID uint64
+		for _, p := range list {
+			if err := boltPut(points, p); err != nil {
+				return err
+			}
+			nextID = max(nextID, p.ID)
+		}
+		if err := points.SetSequence(nextID); err != nil {
+			return err
+		}
+		return boltPutUint(tx.Bucket(boltMetaBucket), boltCountKey, uint64(points.Stats().KeyN))
+	})
+}
+
+// Compact rewrites the database without its free pages when they make up
+// more than half of the file, and returns the sizes before and after; bbolt
+// reuses the pages that Prune and HISTORY_MAX_POINTS free but never gives
+// them back. It does nothing while the database is shared: the other
+// process would keep the replaced file.
+func (s *boltStore) Compact() (before, after int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return 0, 0, nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = info.Size()
+	if int64(s.db.Stats().FreeAlloc)*2 <= before {
+		return before, before, nil
+	}
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, info.Mode().Perm(), &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return before, before, err
+	}
+	if err := bolt.Compact(dst, s.db, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return before, before, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return before, before, err
+	}
+	// Until the new file is open, operations open the database each time.
+	s.db.Close()
+	s.db = nil
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		s.db, _ = s.open(false)
+		return before, before, err
+	}
+	if s.db, err = s.open(false); err != nil {
+		return before, before, err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		after = info.Size()
+	}
+	return before, after, nil
+}
+
+// compactHistory compacts the history database, if any, for the janitor.
+func compactHistory() {
+	s, ok := history.(*boltStore)
+	if !ok {
+		return
+	}
+	before, after, err := s.Compact()
+	if err != nil {
+		logError("Compacting history database %s failed: %v", s.path, err)
+		return
+	}
+	if after < before {
+		log.Printf("Compacted history database %s from %d to %d bytes", s.path, before, after)
+	}
+}
+
+// Check reports whether the database can be written: it fails while the
+// last write failed, or when the database cannot be opened for writing.
+// While the database is held open, the last write decides.
+func (s *boltStore) Check() error {
+	s.mu.RLock()
+	err := s.writeErr
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return nil
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// openHistoryStore returns the backend selected by HISTORY_STORE: "memory"
+// (the default) or "bolt", which keeps the database at HISTORY_STORE_PATH.
+func openHistoryStore(cfg *Config) (Store, error) {
+	switch backend := cfg.HistoryStore; backend {
+	case "memory":
+		return &historyStore{}, nil
+	case "bolt":
+		// The process being upgraded uses the database until it exits.
+		return openBoltStore(cfg.HistoryStorePath, upgradeParentExited)
+	default:
+		return nil, fmt.Errorf("unknown HISTORY_STORE %q, expected memory or bolt", backend)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) *boltStore {
+	t.Helper()
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "history.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func pointIDs(points []HistoryPoint) []uint64 {
+	ids := make([]uint64, len(points))
+	for i, p := range points {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestBoltStoreQuery(t *testing.T) {
+	s := newTestBoltStore(t)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Add("Moscow", 1, base.Add(2*time.Hour))          // 1
+	s.Add("Moscow", 2, base)                           // 2
+	s.Add("London", 3, base.Add(time.Hour))            // 3
+	s.Add("moscow", 4, base.Add(3*time.Hour))          // 4
+	s.Add("Moscow", 5, base.Add(-time.Hour*24*365*60)) // 5, before 1970
+	s.Edit(func(p HistoryPoint) bool { return p.ID == 4 }, func(p *HistoryPoint) bool {
+		p.Invalidated = true
+		return true
+	})
+
+	tests := []struct {
+		name     string
+		city     string
+		from, to time.Time
+		want     []uint64
+	}{
+		{"city in order", "Moscow", base, base.Add(4 * time.Hour), []uint64{2, 1}},
+		{"to is exclusive", "Moscow", base, base.Add(2 * time.Hour), []uint64{2}},
+		{"before 1970", "Moscow", time.Unix(0, 0).Add(-time.Hour * 24 * 365 * 100), base, []uint64{5}},
+		{"other city", "London", base, base.Add(4 * time.Hour), []uint64{3}},
+		{"all cities", "", base, base.Add(4 * time.Hour), []uint64{2, 3, 1}},
+		{"empty range", "Moscow", base.Add(5 * time.Hour), base.Add(6 * time.Hour), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []HistoryPoint
+			if tt.city == "" {
+				got = s.Range(tt.from, tt.to)
+			} else {
+				got = s.Query(tt.city, tt.from, tt.to)
+			}
+			if ids := pointIDs(got); !slices.Equal(ids, tt.want) {
+				t.Errorf("got IDs %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	scanned := s.Scan(base, base.Add(4*time.Hour), func(p HistoryPoint) bool { return p.Invalidated })
+	if ids := pointIDs(scanned); !slices.Equal(ids, []uint64{4}) {
+		t.Errorf("Scan returned invalidated IDs %v, want [4]", ids)
+	}
+}
+
+func TestBoltStoreMaxPoints(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		max     string
+		offsets []time.Duration
+		want    []uint64
+	}{
+		{"under the cap", "5", []time.Duration{0, 1, 2}, []uint64{1, 2, 3}},
+		{"oldest dropped", "2", []time.Duration{0, 1, 2}, []uint64{2, 3}},
+		{"late point dropped first", "2", []time.Duration{1, 2, 0}, []uint64{1, 2}},
+		{"shared timestamp dropped together", "2", []time.Duration{0, 0, 1}, []uint64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, map[string]string{"HISTORY_MAX_POINTS": tt.max})
+			s := newTestBoltStore(t)
+			for _, offset := range tt.offsets {
+				s.Add("Moscow", 0, base.Add(offset*time.Minute))
+			}
+			if ids := pointIDs(s.Snapshot()); !slices.Equal(ids, tt.want) {
+				t.Errorf("kept IDs %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoltStorePruneRestore(t *testing.T) {
+	s := newTestBoltStore(t)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		s.Add("Moscow", float64(i), base.Add(time.Duration(i)*time.Hour))
+	}
+	if n := s.Prune(base.Add(2 * time.Hour)); n != 2 {
+		t.Errorf("Prune removed %d points, want 2", n)
+	}
+	if ids := pointIDs(s.Snapshot()); !slices.Equal(ids, []uint64{3, 4}) {
+		t.Errorf("after Prune kept IDs %v, want [3 4]", ids)
+	}
+
+	s.Restore([]HistoryPoint{
+		{ID: 10, City: "Oslo", Timestamp: base.Add(time.Hour)},
+		{ID: 7, City: "Oslo", Timestamp: base},
+	})
+	if ids := pointIDs(s.Snapshot()); !slices.Equal(ids, []uint64{7, 10}) {
+		t.Errorf("after Restore IDs %v, want [7 10]", ids)
+	}
+	if p := s.Add("Oslo", 0, base.Add(2*time.Hour)); p.ID != 11 {
+		t.Errorf("first ID after Restore is %d, want 11", p.ID)
+	}
+}
+
+// TestBoltStoreShared covers an upgrade: two stores on one file, as the
+// process being replaced and the new one, neither losing the other's
+// points.
+func TestBoltStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	old, err := openBoltStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	old.Add("Moscow", 1, base)
+	old.Share()
+	exited := make(chan struct{})
+	next, err := openBoltStore(path, exited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Add("Moscow", 2, base.Add(time.Minute))
+	next.Add("Moscow", 3, base.Add(time.Minute))
+	old.Add("Moscow", 4, base.Add(2*time.Minute))
+
+	got := next.Snapshot()
+	if ids := pointIDs(got); !slices.Equal(ids, []uint64{1, 2, 3, 4}) {
+		t.Errorf("IDs %v, want [1 2 3 4]", ids)
+	}
+	if err := next.Check(); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	// Once the old process has exited, the new one keeps the database open.
+	close(exited)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		next.mu.RLock()
+		held := next.db != nil
+		next.mu.RUnlock()
+		if held {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the database is still shared")
+		}
+	}
+	next.Add("Moscow", 5, base.Add(3*time.Minute))
+	if ids := pointIDs(next.Snapshot()); !slices.Equal(ids, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("IDs %v, want [1 2 3 4 5]", ids)
+	}
+}
+
+func TestBoltStoreCompact(t *testing.T) {
+	setTestConfig(t, map[string]string{})
+	s := newTestBoltStore(t)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5000; i++ {
+		s.Add("Moscow", float64(i), base.Add(time.Duration(i)*time.Minute))
+	}
+	s.Prune(base.Add(4990 * time.Minute))
+	s.Add("Moscow", 0, base.Add(5000*time.Minute)) // releases the pages Prune freed
+
+	before, after, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before || after == 0 {
+		t.Errorf("compacted from %d to %d bytes", before, after)
+	}
+	if got := s.Snapshot(); len(got) != 11 || got[10].ID != 5001 {
+		t.Errorf("%d points after compaction, last %+v", len(got), got[len(got)-1])
+	}
+	if p := s.Add("Moscow", 1, base.Add(5001*time.Minute)); p.ID != 5002 {
+		t.Errorf("next ID %d, want 5002", p.ID)
+	}
+	if before, after, _ := s.Compact(); after != before {
+		t.Errorf("compacted again without free pages: from %d to %d bytes", before, after)
+	}
+
+	s.Share()
+	if before, after, err := s.Compact(); before != 0 || after != 0 || err != nil {
+		t.Errorf("compacted a shared database: %d, %d, %v", before, after, err)
+	}
+}
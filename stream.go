@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var streamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "stream_clients",
+	Help: "Clients connected to /api/temperature/stream",
+})
+
+func init() {
+	prometheus.MustRegister(streamClients)
+}
+
+// streamKeepAlive is how often an idle stream gets a comment, so that
+// proxies keep it open and clients notice a dead connection.
+const streamKeepAlive = 15 * time.Second
+
+// observationStreams fans new observations out to the open
+// /api/temperature/stream connections of their city.
+type observationStreams struct {
+	mu          sync.Mutex
+	subscribers map[chan weatherResult]string // channel -> lower-cased city
+	done        chan struct{}
+}
+
+var streams = &observationStreams{subscribers: make(map[chan weatherResult]string), done: make(chan struct{})}
+
+// Subscribe returns a channel receiving each new observation of city,
+// until cancel is called.
+func (s *observationStreams) Subscribe(city string) (<-chan weatherResult, func()) {
+	ch := make(chan weatherResult, 1)
+	s.mu.Lock()
+	s.subscribers[ch] = strings.ToLower(city)
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// Publish hands result to the streams of city. It never blocks: a stream
+// that has not caught up with the previous result gets this one instead.
+// Streams send the result as it is, without asking for the weather, so that
+// publishing does not lead to another fetch.
+func (s *observationStreams) Publish(city string, result weatherResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, c := range s.subscribers {
+		if c != strings.ToLower(city) {
+			continue
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- result
+	}
+}
+
+// Close ends every stream, so that a server being upgraded or shut down
+// does not wait for them; clients reconnect to the new process.
+func (s *observationStreams) Close() {
+	close(s.done)
+}
+
+// temperatureStreamHandler serves /api/temperature/stream, the
+// observations of ?city= (default WEATHER_CITY) as server-sent events: an
+// "observation" event with the /api/temperature body right away and for
+// every newer observation. Observations come from the scheduled refresh
+// and other requests; the stream itself asks the provider for one only once
+// the cached one has expired. ?units= and ?lang= apply as for
+// /api/temperature.
+func temperatureStreamHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+	city := q.Get("city")
+	if city == "" {
+		city = weatherCity()
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "request.internal_error")
+		return
+	}
+	updates, cancel := streams.Subscribe(city)
+	defer cancel()
+	streamClients.Inc()
+	defer streamClients.Dec()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+	fmt.Fprintf(w, "retry: 5000\n\n")
+
+	var sent time.Time
+	send := func(result weatherResult) {
+		if !result.FetchedAt.After(sent) {
+			return
+		}
+		sent = result.FetchedAt
+		data, _ := json.Marshal(newWeatherResponse(city, result, units, requestLocale(r), descriptionLanguage(r)))
+		fmt.Fprintf(w, "event: observation\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	refreshAndSend := func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+		defer cancel()
+		result, err := currentWeather(ctx, city)
+		if err != nil {
+			logError("Stream refresh for %s failed: %v", city, err)
+			data, _ := json.Marshal(temperatureProblem(r, city, err))
+			fmt.Fprintf(w, "event: problem\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		send(result)
+	}
+	refreshAndSend()
+
+	// With the cache disabled, streams still poll once a minute.
+	interval := weatherCacheTTL()
+	if interval == 0 {
+		interval = time.Minute
+	}
+	refresh := time.NewTicker(interval)
+	defer refresh.Stop()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streams.done:
+			return
+		case result := <-updates:
+			send(result)
+		case <-refresh.C:
+			refreshAndSend()
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
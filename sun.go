@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Sun events a subscription can trigger on, with the solar altitude that
+// defines them: the upper limb touching the horizon after refraction for
+// sunrise and sunset, the centre 6° below it for civil twilight.
+var sunEvents = map[string]struct {
+	altitude float64
+	rising   bool
+}{
+	"sunrise":    {-0.833, true},
+	"sunset":     {-0.833, false},
+	"civil_dawn": {-6, true},
+	"civil_dusk": {-6, false},
+}
+
+const julianUnixEpoch = 2440587.5
+
+// sunEventTime computes the event on the UTC calendar day of date with the
+// sunrise equation (accurate to a minute or two, which is plenty for lights
+// and blinds). It reports false on days the sun never crosses the altitude,
+// as in polar summer and winter.
+func sunEventTime(event string, date time.Time, lat, lon float64) (time.Time, bool) {
+	spec, ok := sunEvents[event]
+	if !ok {
+		return time.Time{}, false
+	}
+	rad := math.Pi / 180
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	n := math.Ceil(float64(noon.Unix())/86400 + julianUnixEpoch - 2451545.0 + 0.0008)
+
+	meanNoon := n - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanNoon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*longitude*rad)
+	declination := math.Asin(math.Sin(longitude*rad) * math.Sin(23.4397*rad))
+
+	cosHourAngle := (math.Sin(spec.altitude*rad) - math.Sin(lat*rad)*math.Sin(declination)) /
+		(math.Cos(lat*rad) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+	julian := transit + hourAngle/360
+	if spec.rising {
+		julian = transit - hourAngle/360
+	}
+	return time.Unix(int64(math.Round((julian-julianUnixEpoch)*86400)), 0).UTC(), true
+}
+
+// nextSunEvent returns the first occurrence of event shifted by offset that
+// falls after after. Days without the event are skipped; the search gives up
+// after a year, which only happens near the poles for twilight events.
+func nextSunEvent(event string, offset time.Duration, lat, lon float64, after time.Time) (at, eventTime time.Time, ok bool) {
+	day := after.UTC().AddDate(0, 0, -1)
+	for i := 0; i < 370; i++ {
+		if t, ok := sunEventTime(event, day.AddDate(0, 0, i), lat, lon); ok && t.Add(offset).After(after) {
+			return t.Add(offset), t, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// sunWake interrupts runSunEvents when sun event subscriptions change.
+var sunWake = make(chan struct{}, 1)
+
+// runSunEvents fires sun event subscriptions when they come due. It sleeps
+// until the earliest pending event, waking at least hourly so clock jumps
+// and suspended hosts do not delay events for long.
+func runSunEvents() {
+	for {
+		wait := time.Hour
+		if next := webhooks.FireSunEvents(time.Now()); !next.IsZero() {
+			wait = min(wait, time.Until(next))
+		}
+		select {
+		case <-time.After(wait):
+		case <-sunWake:
+		case <-backgroundJobs.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListener returns the socket passed by systemd socket activation
+// (a .socket unit), the first of LISTEN_FDS starting at descriptor 3; false
+// when the process was not socket-activated.
+func systemdListener() (net.Listener, bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	// Like sd_listen_fds(3), so that processes this one starts do not take
+	// the sockets for theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, serving HTTP on the first", n)
+	}
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("systemd socket: %w", err)
+	}
+	return ln, true, nil
+}
+
+// sdNotify sends state to the service manager, as sd_notify(3) does, when
+// it runs the process with Type=notify; it does nothing otherwise.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		logError("Notifying systemd failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logError("Notifying systemd failed: %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// templateFunc is a helper available to notification and UI templates.
+// Helpers that depend on the language are built for each rendering.
+type templateFunc struct {
+	Description string
+	build       func(lang string) any
+}
+
+// templateFuncs is the helper library shared by webhook templates and
+// UI_TEMPLATE. A helper added here is available to both.
+var templateFuncs = map[string]templateFunc{
+	"fahrenheit": {"Converts °C to °F", constFunc(func(c any) (float64, error) { return convertNumber(c, celsiusToFahrenheit) })},
+	"celsius":    {"Converts °F to °C", constFunc(func(f any) (float64, error) { return convertNumber(f, fahrenheitToCelsius) })},
+	"kmh":        {"Converts m/s to km/h", constFunc(func(ms any) (float64, error) { return convertNumber(ms, func(v float64) float64 { return v * 3.6 }) })},
+	"mph":        {"Converts m/s to mph", constFunc(func(ms any) (float64, error) { return convertNumber(ms, metersPerSecondToMph) })},
+	"inhg":       {"Converts hPa to inHg", constFunc(func(hpa any) (float64, error) { return convertNumber(hpa, hPaToInchesHg) })},
+	"round": {"Rounds a number to the given decimals, 0 to 6: round 3.14159 1 is 3.1", constFunc(func(v any, decimals int) (float64, error) {
+		if err := checkDecimals(decimals); err != nil {
+			return 0, err
+		}
+		n, err := templateNumber(v)
+		scale := math.Pow(10, float64(decimals))
+		return math.Round(n*scale) / scale, err
+	})},
+	"number": {"Formats a number with the given decimals, 0 to 6, and the decimal separator of the language", func(lang string) any {
+		return func(v any, decimals int) (string, error) {
+			if err := checkDecimals(decimals); err != nil {
+				return "", err
+			}
+			n, err := templateNumber(v)
+			return formatNumber(n, decimals, lang), err
+		}
+	}},
+	"temperature": {"Formats a temperature in °C, or in °F with \"imperial\": temperature .Temperature \"imperial\"", func(lang string) any {
+		return func(c any, units ...string) (string, error) {
+			n, err := templateNumber(c)
+			if len(units) > 0 && unitSystem(units[0]) == unitsImperial {
+				return formatTemperature(celsiusToFahrenheit(n), unitsImperial, lang), err
+			}
+			return formatTemperature(n, unitsMetric, lang), err
+		}
+	}},
+	"t": {"Translates a message catalog key, with arguments: t \"theme.rain\"", func(lang string) any {
+		return func(key string, args ...any) string { return localize(lang, key, args...) }
+	}},
+	"condition": {"Describes an OpenWeatherMap condition code in the language", func(lang string) any {
+		return func(code int) string { return conditionDescription(lang, Observation{ConditionCode: code}) }
+	}},
+	"emoji": {"Icon of the theme of a condition code, the night icon for clear skies when the second argument is true", constFunc(func(code int, night ...bool) string {
+		theme, _ := themeByToken(conditionTheme(code, len(night) > 0 && night[0]))
+		return theme.Icon
+	})},
+}
+
+// maxDecimals bounds the decimals of round and number: a template must not
+// make strconv write millions of digits.
+const maxDecimals = 6
+
+func checkDecimals(decimals int) error {
+	if decimals < 0 || decimals > maxDecimals {
+		return fmt.Errorf("decimals %d out of range 0..%d", decimals, maxDecimals)
+	}
+	return nil
+}
+
+func constFunc(fn any) func(string) any {
+	return func(string) any { return fn }
+}
+
+// templateFuncMap returns the helpers for rendering in lang.
+func templateFuncMap(lang string) template.FuncMap {
+	funcs := make(template.FuncMap, len(templateFuncs))
+	for name, f := range templateFuncs {
+		funcs[name] = f.build(lang)
+	}
+	return funcs
+}
+
+// templateNumber accepts the integer and floating-point fields of template
+// data alike.
+func templateNumber(v any) (float64, error) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.CanFloat():
+		return rv.Float(), nil
+	case rv.CanInt():
+		return float64(rv.Int()), nil
+	case rv.CanUint():
+		return float64(rv.Uint()), nil
+	case rv.Kind() == reflect.Pointer && !rv.IsNil():
+		return templateNumber(rv.Elem().Interface())
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func convertNumber(v any, convert func(float64) float64) (float64, error) {
+	n, err := templateNumber(v)
+	return convert(n), err
+}
+
+// Limits of rendering a notification template, which anyone who can
+// subscribe may write. Every iteration of a range action counts against
+// maxNotificationIterations, so even a loop that writes nothing stops.
+const (
+	maxNotificationSize       = 64 << 10
+	maxNotificationIterations = 10000
+	maxNotificationRangeDepth = 2
+	notificationTimeout       = time.Second
+)
+
+// notificationTickFunc is the hidden helper called at the start of every
+// range iteration of a notification template.
+const notificationTickFunc = "notificationTick"
+
+// notificationTemplate parses the body template of a webhook subscription.
+// Templates cannot define or call other templates, so they cannot recurse,
+// nor range over numbers, and ranges nest at most maxNotificationRangeDepth
+// deep. Each range iteration calls notificationTickFunc, which
+// renderNotification binds to the limits of one rendering.
+func notificationTemplate(text string) (*template.Template, error) {
+	funcs := templateFuncMap(weatherLang())
+	funcs[notificationTickFunc] = func() string { return "" }
+	tmpl, err := template.New("notification").Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, fmt.Errorf("define and block actions are not allowed")
+	}
+	if err := checkNotificationNode(tmpl.Tree.Root, 0); err != nil {
+		return nil, err
+	}
+	tick, err := template.New("tick").Funcs(funcs).Parse("{{" + notificationTickFunc + "}}")
+	if err != nil {
+		return nil, err
+	}
+	insertTick(tmpl.Tree.Root, tick.Tree.Root.Nodes[0])
+	return tmpl, nil
+}
+
+// checkNotificationNode rejects {{template}} actions, ranges over numbers
+// and ranges nested deeper than maxNotificationRangeDepth in node, found
+// depth ranges deep.
+func checkNotificationNode(node parse.Node, depth int) error {
+	switch n := node.(type) {
+	case *parse.TemplateNode:
+		return fmt.Errorf("template actions are not allowed")
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkNotificationNode(child, depth); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkNotificationBranches(n.List, n.ElseList, depth)
+	case *parse.WithNode:
+		return checkNotificationBranches(n.List, n.ElseList, depth)
+	case *parse.RangeNode:
+		if depth >= maxNotificationRangeDepth {
+			return fmt.Errorf("range actions cannot be nested more than %d deep", maxNotificationRangeDepth)
+		}
+		if rangesOverNumber(n.Pipe) {
+			return fmt.Errorf("range over a number is not allowed")
+		}
+		return checkNotificationBranches(n.List, n.ElseList, depth+1)
+	}
+	return nil
+}
+
+func checkNotificationBranches(list, elseList *parse.ListNode, depth int) error {
+	if err := checkNotificationNode(list, depth); err != nil {
+		return err
+	}
+	return checkNotificationNode(elseList, depth)
+}
+
+// rangesOverNumber reports whether a range pipeline is a number constant or
+// ends in len, which yields one. Ranges over numeric fields and variables
+// are bounded by the iteration limit instead.
+func rangesOverNumber(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Cmds) == 0 {
+		return false
+	}
+	switch arg := pipe.Cmds[len(pipe.Cmds)-1].Args[0].(type) {
+	case *parse.NumberNode:
+		return true
+	case *parse.IdentifierNode:
+		return arg.Ident == "len"
+	}
+	return false
+}
+
+// insertTick makes tick the first action of the body of every range in
+// node.
+func insertTick(node parse.Node, tick parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			insertTick(child, tick)
+		}
+	case *parse.IfNode:
+		insertTick(n.List, tick)
+		insertTick(n.ElseList, tick)
+	case *parse.WithNode:
+		insertTick(n.List, tick)
+		insertTick(n.ElseList, tick)
+	case *parse.RangeNode:
+		insertTick(n.List, tick)
+		insertTick(n.ElseList, tick)
+		n.List.Nodes = append([]parse.Node{tick}, n.List.Nodes...)
+	}
+}
+
+// notificationLimits bounds one rendering of a notification template: its
+// size, range iterations and time. Writes and range iterations fail once a
+// limit is reached, which stops the execution.
+type notificationLimits struct {
+	buf        bytes.Buffer
+	max        int
+	iterations int
+	deadline   time.Time
+}
+
+func (l *notificationLimits) Write(p []byte) (int, error) {
+	if l.buf.Len()+len(p) > l.max {
+		return 0, fmt.Errorf("notification exceeds %d bytes", l.max)
+	}
+	if err := l.checkDeadline(); err != nil {
+		return 0, err
+	}
+	return l.buf.Write(p)
+}
+
+func (l *notificationLimits) tick() (string, error) {
+	if l.iterations++; l.iterations > maxNotificationIterations {
+		return "", fmt.Errorf("notification exceeds %d range iterations", maxNotificationIterations)
+	}
+	return "", l.checkDeadline()
+}
+
+func (l *notificationLimits) checkDeadline() error {
+	if time.Now().After(l.deadline) {
+		return fmt.Errorf("notification took longer than %v to render", notificationTimeout)
+	}
+	return nil
+}
+
+// renderNotification renders the body of event from a subscription's
+// template, parsed by notificationTemplate when the subscription was
+// created, in WEATHER_LANG, up to maxNotificationSize bytes and
+// maxNotificationIterations range iterations within notificationTimeout.
+// Bodies that are valid JSON are sent as JSON, anything else as plain text.
+func renderNotification(tmpl *template.Template, event any) (body []byte, contentType string, err error) {
+	limits := &notificationLimits{max: maxNotificationSize, deadline: time.Now().Add(notificationTimeout)}
+	// The clone shares the parsed template but gets its own helpers, so
+	// deliveries rendering at the same time keep their own limits.
+	run, err := tmpl.Clone()
+	if err != nil {
+		return nil, "", err
+	}
+	funcs := templateFuncMap(weatherLang())
+	funcs[notificationTickFunc] = limits.tick
+	if err := run.Funcs(funcs).Execute(limits, event); err != nil {
+		return nil, "", err
+	}
+	if json.Valid(limits.buf.Bytes()) {
+		return limits.buf.Bytes(), "application/json", nil
+	}
+	return limits.buf.Bytes(), "text/plain; charset=utf-8", nil
+}
+
+// UIPage is the data of UI_TEMPLATE. Observation is nil until the first
+// observation of City has been fetched.
+type UIPage struct {
+	City        string
+	Lang        string
+	Observation *Observation
+	FetchedAt   time.Time
+	Theme       WeatherTheme
+}
+
+// uiTemplate parses UI_TEMPLATE, an html/template file that replaces the
+// built-in page, with the helpers in lang.
+func uiTemplate(path, lang string) (*htmltemplate.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return htmltemplate.New("ui").Funcs(htmltemplate.FuncMap(templateFuncMap(lang))).Parse(string(text))
+}
+
+// checkUITemplate reports whether the UI_TEMPLATE file can be read and
+// parsed.
+func checkUITemplate(path string) error {
+	_, err := uiTemplate(path, defaultLanguage)
+	return err
+}
+
+// serveUITemplate renders UI_TEMPLATE for the city of ?city= or
+// WEATHER_CITY from the last fetched observation; the page is not a reason
+// to call the provider. The file is read on every request, so it can be
+// edited without a restart.
+func serveUITemplate(w http.ResponseWriter, r *http.Request, path string) {
+	page := UIPage{City: r.URL.Query().Get("city"), Lang: requestLocale(r)}
+	if page.City == "" {
+		page.City = weatherCity()
+	}
+	if cached, ok := lastObservations.Get(page.City); ok {
+		page.Observation, page.FetchedAt = &cached.observation, cached.fetchedAt
+		page.Theme, _ = themeByToken(conditionTheme(cached.observation.ConditionCode, isNight(page.City, cached.observation, cached.fetchedAt)))
+		page.Theme.Label = localize(negotiateLanguage(r.Header.Get("Accept-Language")), "theme."+page.Theme.Token)
+	}
+
+	tmpl, err := uiTemplate(path, page.Lang)
+	var buf bytes.Buffer
+	if err == nil {
+		err = tmpl.Execute(&buf, page)
+	}
+	if err != nil {
+		logError("UI_TEMPLATE: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "ui.template_failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// TemplateFunction documents a helper in /api/templates/functions.
+type TemplateFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// templateFunctions lists the helper library sorted by name.
+func templateFunctions() []TemplateFunction {
+	list := make([]TemplateFunction, 0, len(templateFuncs))
+	for name, f := range templateFuncs {
+		list = append(list, TemplateFunction{Name: name, Description: f.Description})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// templateFunctionsHandler serves /api/templates/functions, the helpers
+// available to webhook templates and UI_TEMPLATE.
+func templateFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !writeResponse(w, r, http.StatusOK, templateFunctions()) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateDecimals(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{text: `{{number 3.14159 2}}`, want: "3,14"},
+		{text: `{{number 2 0}}`, want: "2"},
+		{text: `{{round 3.14159 6}}`, want: "3.14159"},
+		{text: `{{number 1 7}}`, wantErr: true},
+		{text: `{{number 1 300000000}}`, wantErr: true},
+		{text: `{{number 1 -1}}`, wantErr: true},
+		{text: `{{round 1 300000000}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			tmpl := template.Must(template.New("").Funcs(templateFuncMap("ru")).Parse(tt.text))
+			var b strings.Builder
+			err := tmpl.Execute(&b, nil)
+			if (err != nil) != tt.wantErr || b.String() != tt.want {
+				t.Errorf("got %q, %v; want %q, error %v", b.String(), err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tenantRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_requests_total",
+			Help: "Total number of requests to tenant routes admitted by tenant",
+		},
+		[]string{"tenant"},
+	)
+	tenantRateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_rate_limited_total",
+			Help: "Total number of requests to tenant routes rejected by the tenant's rate limit",
+		},
+		[]string{"tenant"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tenantRequestsTotal, tenantRateLimitedTotal)
+}
+
+// tenant is one entry of TENANTS: a team with its own cities, OpenWeatherMap
+// key and request rate.
+type tenant struct {
+	Name string
+	// Cities are the cities the tenant may ask for; the first is the
+	// default.
+	Cities []string
+	// APIKey is the tenant's OpenWeatherMap key, empty to use
+	// WEATHER_API_KEY.
+	APIKey string
+	// RequestsPerMinute limits the tenant's requests; 0 is unlimited.
+	RequestsPerMinute int
+	// Principals are the API keys, users or token subjects that may use
+	// the tenant as "<scheme>:<name>", by default the API key named after
+	// the tenant. The scheme keeps an OIDC or LDAP user from passing as the
+	// API key or JWT subject of the same name.
+	Principals []string
+}
+
+// parseTenants parses TENANTS: entries separated by ';' of the form
+// "<name>:cities=<city>|<city>[,api_key=<key>][,requests_per_minute=<n>][,principals=<scheme>:<name>|<scheme>:<name>]".
+// Errors name the tenant, never the values, as entries hold keys.
+func parseTenants(v string) (map[string]tenant, error) {
+	tenants := make(map[string]tenant)
+	for i, entry := range strings.Split(v, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, options, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("entry %d: want <name>:cities=<city>|<city>[,api_key=<key>][,requests_per_minute=<n>][,principals=<scheme>:<name>|<scheme>:<name>]", i+1)
+		}
+		if _, dup := tenants[name]; dup {
+			return nil, fmt.Errorf("tenant %q: defined twice", name)
+		}
+		t := tenant{Name: name}
+		for _, option := range strings.Split(options, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			value = strings.TrimSpace(value)
+			switch key {
+			case "cities":
+				for _, city := range strings.Split(value, "|") {
+					if city = strings.TrimSpace(city); city != "" {
+						t.Cities = append(t.Cities, city)
+					}
+				}
+			case "api_key":
+				t.APIKey = value
+			case "requests_per_minute":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("tenant %q: requests_per_minute must be a positive integer", name)
+				}
+				t.RequestsPerMinute = n
+			case "principals":
+				for _, principal := range strings.Split(value, "|") {
+					if principal = strings.TrimSpace(principal); principal == "" {
+						continue
+					}
+					scheme, id, ok := strings.Cut(principal, ":")
+					if !ok || id == "" || !slices.Contains(authSchemeNames, scheme) {
+						return nil, fmt.Errorf("tenant %q: principal %q must be <scheme>:<name> with a scheme among %s", name, principal, strings.Join(authSchemeNames, ", "))
+					}
+					t.Principals = append(t.Principals, principal)
+				}
+			default:
+				return nil, fmt.Errorf("tenant %q: unknown option %q", name, key)
+			}
+		}
+		if len(t.Cities) == 0 {
+			return nil, fmt.Errorf("tenant %q: no cities", name)
+		}
+		if len(t.Principals) == 0 {
+			t.Principals = []string{"apikey:" + name}
+		}
+		tenants[name] = t
+	}
+	return tenants, nil
+}
+
+// lookupTenant returns the tenant called name. Invalid configuration is
+// rejected at startup and by the config API, so a parse error here means
+// no tenants.
+func lookupTenant(name string) (tenant, bool) {
+	tenants, _ := parseTenants(runningConfig().Tenants)
+	t, ok := tenants[name]
+	return t, ok
+}
+
+// Admits reports whether the caller may use the tenant: the principal the
+// access policy authenticated or the API key of the request must be one of
+// the tenant's principals, scheme and name alike.
+func (t tenant) Admits(r *http.Request) (authenticated, allowed bool) {
+	var names []string
+	if p, ok := requestPrincipal(r); ok {
+		names = append(names, p.Scheme+":"+p.Name)
+	}
+	if id, ok := requestAPIKeyID(r); ok {
+		names = append(names, "apikey:"+id)
+	}
+	for _, name := range names {
+		if slices.Contains(t.Principals, name) {
+			return true, true
+		}
+	}
+	return len(names) > 0, false
+}
+
+// Allows reports whether the tenant may ask for city.
+func (t tenant) Allows(city string) bool {
+	for _, c := range t.Cities {
+		if strings.EqualFold(c, city) {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantLimits keeps the rate limiter and the OpenWeatherMap quota of each
+// tenant, so that one team using up its share does not affect the others.
+type tenantLimits struct {
+	mu       sync.Mutex
+	requests map[string]*quotaTracker
+	upstream map[string]*quotaTracker
+}
+
+var tenantQuotas = &tenantLimits{requests: make(map[string]*quotaTracker), upstream: make(map[string]*quotaTracker)}
+
+// Requests returns the request limiter of t, following changes of its rate.
+func (l *tenantLimits) Requests(t tenant) *quotaTracker {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.requests[t.Name]
+	if q == nil {
+		q = &quotaTracker{perMonth: math.MaxInt}
+		l.requests[t.Name] = q
+	}
+	q.mu.Lock()
+	q.perMinute = t.RequestsPerMinute
+	q.mu.Unlock()
+	return q
+}
+
+// Upstream returns the OpenWeatherMap quota of a tenant with its own key.
+func (l *tenantLimits) Upstream(t tenant) *quotaTracker {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.upstream[t.Name]
+	if q == nil {
+		q = newQuotaTracker(runningConfig())
+		l.upstream[t.Name] = q
+	}
+	return q
+}
+
+// Provider returns the provider of t's observations: OpenWeatherMap with the
+// tenant's key and quota, or the configured provider.
+func (t tenant) Provider() WeatherProvider {
+	if t.APIKey == "" || weatherProviderName() != "openweathermap" {
+		return weatherProvider
+	}
+	quota := tenantQuotas.Upstream(t)
+	return providerFunc(func(ctx context.Context, city string) (Observation, error) {
+		return openWeatherCurrent(ctx, t.APIKey, quota, city)
+	})
+}
+
+type tenantKey struct{}
+
+// requestProvider returns the provider for r: the tenant's on tenant
+// routes, the configured provider otherwise.
+func requestProvider(r *http.Request) WeatherProvider {
+	if t, ok := r.Context().Value(tenantKey{}).(tenant); ok {
+		return t.Provider()
+	}
+	return weatherProvider
+}
+
+// tenantRouted serves next for the tenant named in the route: it admits
+// only the tenant's principals, enforces the tenant's rate limit, defaults
+// ?city= to the tenant's first city and refuses cities outside its list.
+// Requests a shard peer forwarded were counted by the peer.
+func tenantRouted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := lookupTenant(mux.Vars(r)["tenant"])
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, "tenant.not_found", mux.Vars(r)["tenant"])
+			return
+		}
+		switch authenticated, allowed := t.Admits(r); {
+		case !authenticated:
+			w.Header().Set("WWW-Authenticate", apiKeyScheme{}.Challenge(authGroupAPI))
+			writeProblem(w, r, http.StatusUnauthorized, "tenant.unauthenticated", t.Name)
+			return
+		case !allowed:
+			writeProblem(w, r, http.StatusForbidden, "tenant.forbidden", t.Name)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("zip") != "" || q.Get("lat") != "" || q.Get("lon") != "" {
+			writeProblem(w, r, http.StatusBadRequest, "tenant.city_required")
+			return
+		}
+		switch city := q.Get("city"); {
+		case city == "":
+			q.Set("city", t.Cities[0])
+			r.URL.RawQuery = q.Encode()
+		case !t.Allows(city):
+			writeProblem(w, r, http.StatusForbidden, "tenant.city_not_allowed", city, t.Name)
+			return
+		}
+		if shardForwarded(r) {
+			next(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+			return
+		}
+		if t.RequestsPerMinute > 0 {
+			if wait := tenantQuotas.Requests(t).Reserve(); wait > 0 {
+				tenantRateLimitedTotal.WithLabelValues(t.Name).Inc()
+				w.Header().Set("Retry-After", retryAfterSeconds(wait))
+				writeProblem(w, r, http.StatusTooManyRequests, "tenant.rate_limited", t.Name)
+				return
+			}
+		}
+		tenantRequestsTotal.WithLabelValues(t.Name).Inc()
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	}
+}
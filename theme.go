@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Theme tokens: the look of the page for the current conditions.
+// Precipitation, fog and thunderstorms show day and night; clear and cloudy
+// skies turn into night after sunset.
+const (
+	themeSunny        = "sunny"
+	themeCloudy       = "cloudy"
+	themeRain         = "rain"
+	themeThunderstorm = "thunderstorm"
+	themeSnow         = "snow"
+	themeFog          = "fog"
+	themeNight        = "night"
+)
+
+// WeatherTheme describes a theme token for frontends: an icon and the
+// background and text colours of the built-in page.
+type WeatherTheme struct {
+	Token      string `json:"token"`
+	Label      string `json:"label"`
+	Icon       string `json:"icon"`
+	Background string `json:"background"`
+	Foreground string `json:"foreground"`
+}
+
+var weatherThemes = []WeatherTheme{
+	{Token: themeSunny, Icon: "☀️", Background: "#fff4c2", Foreground: "#3d2e00"},
+	{Token: themeCloudy, Icon: "☁️", Background: "#dfe6ec", Foreground: "#24313d"},
+	{Token: themeRain, Icon: "🌧️", Background: "#9fb3c8", Foreground: "#102a43"},
+	{Token: themeThunderstorm, Icon: "⛈️", Background: "#52606d", Foreground: "#f5f7fa"},
+	{Token: themeSnow, Icon: "❄️", Background: "#f0f4f8", Foreground: "#243b53"},
+	{Token: themeFog, Icon: "🌫️", Background: "#cbd2d9", Foreground: "#323f4b"},
+	{Token: themeNight, Icon: "🌙", Background: "#1f2933", Foreground: "#e4e7eb"},
+}
+
+// themeByToken returns the theme of token.
+func themeByToken(token string) (WeatherTheme, bool) {
+	for _, theme := range weatherThemes {
+		if theme.Token == token {
+			return theme, true
+		}
+	}
+	return WeatherTheme{}, false
+}
+
+// conditionTheme maps an OpenWeatherMap condition ID to a theme token.
+// Unknown conditions get the neutral cloudy theme.
+func conditionTheme(code int, night bool) string {
+	switch {
+	case code >= 200 && code < 300:
+		return themeThunderstorm
+	case code >= 300 && code < 600:
+		return themeRain
+	case code >= 600 && code < 700:
+		return themeSnow
+	case code >= 700 && code < 800:
+		return themeFog
+	case night:
+		return themeNight
+	case code == 800:
+		return themeSunny
+	default:
+		return themeCloudy
+	}
+}
+
+// isNight reports whether the sun is down in city at the time of the
+// observation: as the provider says, or else from sunrise and sunset at the
+// coordinates in the city catalog. Without either it is taken to be day.
+func isNight(city string, observation Observation, at time.Time) bool {
+	if observation.Night != nil {
+		return *observation.Night
+	}
+	c, ok := cities.Lookup(city)
+	if !ok {
+		return false
+	}
+	// The next events are searched up to a year ahead, so this holds in
+	// polar night and polar day too.
+	sunrise, _, riseOK := nextSunEvent("sunrise", 0, c.Latitude, c.Longitude, at)
+	sunset, _, setOK := nextSunEvent("sunset", 0, c.Latitude, c.Longitude, at)
+	return riseOK && setOK && sunrise.Before(sunset)
+}
+
+// observationTheme returns the theme token of an observation of city.
+func observationTheme(city string, result weatherResult) string {
+	return conditionTheme(result.ConditionCode, isNight(city, result.Observation, result.FetchedAt))
+}
+
+// themesHandler serves /api/themes, the theme tokens that /api/temperature
+// can return, with labels in the negotiated language.
+func themesHandler(w http.ResponseWriter, r *http.Request) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	themes := make([]WeatherTheme, len(weatherThemes))
+	for i, theme := range weatherThemes {
+		theme.Label = localize(lang, "theme."+theme.Token)
+		themes[i] = theme
+	}
+	if !writeResponse(w, r, http.StatusOK, themes) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
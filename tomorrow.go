@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTomorrowBaseURL = "https://api.tomorrow.io"
+
+// tomorrowConditions maps Tomorrow.io weather codes to OpenWeatherMap
+// condition codes.
+var tomorrowConditions = map[int]int{
+	1000: 800, 1100: 801, 1101: 802, 1102: 803, 1001: 804,
+	2000: 741, 2100: 701,
+	4000: 300, 4200: 500, 4001: 501, 4201: 502,
+	5001: 600, 5100: 600, 5000: 601, 5101: 602,
+	6000: 511, 6001: 511, 6200: 511, 6201: 511,
+	7000: 611, 7101: 611, 7102: 611,
+	8000: 211,
+}
+
+// tomorrowProvider uses the Tomorrow.io realtime endpoint with the key in
+// TOMORROW_API_KEY.
+type tomorrowProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func newTomorrowProvider(cfg *Config) (*tomorrowProvider, error) {
+	apiKey := cfg.TomorrowAPIKey
+	if apiKey == "" {
+		return nil, fmt.Errorf("TOMORROW_API_KEY is required for the tomorrow provider")
+	}
+	baseURL := cfg.TomorrowBaseURL
+	return &tomorrowProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: tracedUpstream},
+	}, nil
+}
+
+func (p *tomorrowProvider) Current(ctx context.Context, city string) (Observation, error) {
+	location := city
+	if code, country, ok := splitZip(city); ok {
+		location = strings.TrimSpace(code + " " + country)
+	} else if c, ok := cities.Lookup(city); ok {
+		location = strconv.FormatFloat(c.Latitude, 'f', 4, 64) + "," + strconv.FormatFloat(c.Longitude, 'f', 4, 64)
+	}
+	params := url.Values{"location": {location}, "apikey": {p.apiKey}, "units": {"metric"}}
+
+	upstreamCallsTotal.Inc()
+	resp, err := upstreamGet(ctx, p.client, p.baseURL+"/v4/weather/realtime?"+params.Encode())
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest:
+		// Tomorrow.io answers 400 for locations it cannot resolve.
+		return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return Observation{}, &QuotaError{RetryAfter: retryAfterHeader(resp)}
+	case resp.StatusCode != http.StatusOK:
+		return Observation{}, fmt.Errorf("%w: Tomorrow.io returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	var body struct {
+		Data struct {
+			Values struct {
+				Temperature *float64 `json:"temperature"`
+				Humidity    *float64 `json:"humidity"`
+				WindSpeed   *float64 `json:"windSpeed"`
+				WeatherCode int      `json:"weatherCode"`
+			} `json:"values"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return Observation{}, fmt.Errorf("%w: invalid Tomorrow.io response: %v", ErrProviderUnavailable, err)
+	}
+	values := body.Data.Values
+	if values.Temperature == nil {
+		return Observation{}, fmt.Errorf("%w: Tomorrow.io response has no temperature", ErrProviderUnavailable)
+	}
+	observation := Observation{Temperature: *values.Temperature, Humidity: -1, WindSpeed: -1, ConditionCode: tomorrowConditions[values.WeatherCode]}
+	if values.Humidity != nil {
+		observation.Humidity = *values.Humidity
+	}
+	if values.WindSpeed != nil {
+		observation.WindSpeed = *values.WindSpeed
+	}
+	return observation, nil
+}
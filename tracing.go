@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// traceContext is a W3C Trace Context (traceparent and tracestate).
+type traceContext struct {
+	TraceID string
+	// SpanID is the span of the caller, the parent of our calls.
+	SpanID string
+	Flags  string
+	State  string
+}
+
+// parseTraceparent parses a version 00 traceparent header,
+// "00-<32 hex trace ID>-<16 hex parent ID>-<2 hex flags>". Future versions
+// may append fields, which are ignored as the specification asks.
+func parseTraceparent(v string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || parts[0] == "ff" || !isLowerHex(parts[0], 2) || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	t := traceContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}
+	if !isLowerHex(t.TraceID, 32) || !isLowerHex(t.SpanID, 16) || !isLowerHex(t.Flags, 2) ||
+		strings.Trim(t.TraceID, "0") == "" || strings.Trim(t.SpanID, "0") == "" {
+		return traceContext{}, false
+	}
+	return t, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type traceKey struct{}
+
+// requestTrace returns the trace of the request ctx belongs to.
+func requestTrace(ctx context.Context) (traceContext, bool) {
+	t, ok := ctx.Value(traceKey{}).(traceContext)
+	return t, ok
+}
+
+// requestTraceID is the trace ID of r for log lines.
+func requestTraceID(r *http.Request) string {
+	t, _ := requestTrace(r.Context())
+	return t.TraceID
+}
+
+// traceMiddleware continues the trace of an incoming traceparent header or,
+// without a valid one, starts a new sampled trace, so that the calls this
+// request makes upstream can be tied together either way.
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if ok {
+			t.State = r.Header.Get("tracestate")
+		} else {
+			t = traceContext{TraceID: randomHex(16), Flags: "01"}
+		}
+		next.ServeHTTP(w, r.WithContext(withUpstreamAttempts(context.WithValue(r.Context(), traceKey{}, t))))
+	})
+}
+
+// traceTransport sends traceparent and tracestate with each upstream
+// request: a new span of the trace in the request context, or of a trace of
+// its own for background calls.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace, ok := requestTrace(req.Context())
+	if !ok {
+		trace = traceContext{TraceID: randomHex(16), Flags: "01"}
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", "00-"+trace.TraceID+"-"+randomHex(8)+"-"+trace.Flags)
+	if trace.State != "" {
+		req.Header.Set("tracestate", trace.State)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// tracedUpstream is the transport of the clients of weather providers.
+var tracedUpstream http.RoundTripper = traceTransport{logTransport{upstreamTransport}}
+
+// upstreamGet is client.Get within ctx, with secrets redacted from the
+// URL in its error.
+func upstreamGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	return resp, redactURLError(err)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTripLegs = 20
+
+// TripLeg is one stop of an itinerary. Requests give the city (or zip) and
+// the local date; responses add the position and the forecast for that day
+// or, when it cannot be had, a localized error.
+type TripLeg struct {
+	City      string       `json:"city,omitempty"`
+	Zip       string       `json:"zip,omitempty"`
+	Date      string       `json:"date"`
+	Latitude  *float64     `json:"latitude,omitempty"`
+	Longitude *float64     `json:"longitude,omitempty"`
+	Forecast  *DayForecast `json:"forecast,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// tripLegProperties are the GeoJSON properties of a leg, flattened so map
+// popups and styles can use them directly.
+type tripLegProperties struct {
+	Leg             int      `json:"leg"`
+	City            string   `json:"city,omitempty"`
+	Zip             string   `json:"zip,omitempty"`
+	Date            string   `json:"date"`
+	MinTemperature  *float64 `json:"min_temperature,omitempty"`
+	MaxTemperature  *float64 `json:"max_temperature,omitempty"`
+	RainProbability *float64 `json:"rain_probability,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+type TripRequest struct {
+	Legs []TripLeg `json:"legs"`
+}
+
+type TripResponse struct {
+	Legs []TripLeg `json:"legs"`
+}
+
+// tripHandler serves POST /api/trip, or a GeoJSON feature collection of the
+// legs with ?format=geojson. Every distinct place is fetched once,
+// concurrently, through the forecast cache; a leg that fails does not fail
+// the others.
+func tripHandler(w http.ResponseWriter, r *http.Request) {
+	if !forecastSupported() {
+		writeProblem(w, r, http.StatusNotImplemented, "forecast.unsupported")
+		return
+	}
+	geojson, ok := requestGeoJSON(w, r)
+	if !ok {
+		return
+	}
+	var req TripRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "trip.invalid_body", err)
+		return
+	}
+	if len(req.Legs) == 0 || len(req.Legs) > maxTripLegs {
+		writeProblem(w, r, http.StatusBadRequest, "trip.invalid_legs", maxTripLegs)
+		return
+	}
+
+	locations := make([]string, len(req.Legs))
+	for i, leg := range req.Legs {
+		if _, err := time.Parse("2006-01-02", leg.Date); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "trip.invalid_date", i+1, leg.Date)
+			return
+		}
+		switch {
+		case leg.Zip != "" && leg.City != "":
+			writeProblem(w, r, http.StatusBadRequest, "request.city_and_zip")
+			return
+		case leg.Zip != "":
+			location, ok := zipLocation(leg.Zip)
+			if !ok {
+				writeProblem(w, r, http.StatusBadRequest, "request.invalid_zip", leg.Zip)
+				return
+			}
+			locations[i] = location
+		case validCityName(leg.City) && !strings.HasPrefix(strings.ToLower(leg.City), zipPrefix):
+			locations[i] = leg.City
+		default:
+			writeProblem(w, r, http.StatusBadRequest, "request.invalid_city", leg.City)
+			return
+		}
+	}
+
+	type fetched struct {
+		forecast Forecast
+		err      error
+	}
+	results := make(map[string]*fetched)
+	var wg sync.WaitGroup
+	for _, location := range locations {
+		key := strings.ToLower(location)
+		if results[key] != nil {
+			continue
+		}
+		result := &fetched{}
+		results[key] = result
+		wg.Add(1)
+		go func(location string) {
+			defer wg.Done()
+			result.forecast, result.err = getForecast(location)
+		}(location)
+	}
+	wg.Wait()
+
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	response := TripResponse{Legs: make([]TripLeg, len(req.Legs))}
+	for i, leg := range req.Legs {
+		out := TripLeg{City: leg.City, Zip: leg.Zip, Date: leg.Date}
+		result := results[strings.ToLower(locations[i])]
+		if result.err != nil {
+			logError("Error fetching trip forecast: %v", result.err)
+		}
+		switch {
+		case errors.Is(result.err, ErrCityNotFound):
+			out.Error = localize(lang, "temperature.city_not_found", locationLabel(locations[i]))
+		case errors.Is(result.err, ErrQuotaExceeded):
+			out.Error = localize(lang, "temperature.quota_exceeded")
+		case errors.Is(result.err, ErrProviderUnavailable):
+			out.Error = localize(lang, "temperature.provider_unavailable")
+		case result.err != nil:
+			out.Error = localize(lang, "temperature.fetch_failed")
+		default:
+			out.Latitude, out.Longitude = result.forecast.Latitude, result.forecast.Longitude
+			if day, ok := result.forecast.Day(leg.Date); ok {
+				out.Forecast = &day
+			} else {
+				out.Error = localize(lang, "trip.date_out_of_range", leg.Date)
+			}
+		}
+		response.Legs[i] = out
+	}
+
+	if geojson {
+		features := make([]GeoJSONFeature, len(response.Legs))
+		for i, leg := range response.Legs {
+			properties := tripLegProperties{Leg: i + 1, City: leg.City, Zip: leg.Zip, Date: leg.Date, Error: leg.Error}
+			if f := leg.Forecast; f != nil {
+				properties.MinTemperature, properties.MaxTemperature, properties.RainProbability = &f.MinTemperature, &f.MaxTemperature, &f.RainProbability
+			}
+			features[i] = newGeoJSONFeature(leg.Latitude, leg.Longitude, properties)
+		}
+		writeGeoJSON(w, r, features)
+		return
+	}
+	if !writeResponse(w, r, http.StatusOK, response) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
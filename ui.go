@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webFiles holds the built-in page: the index.html template and the
+// scripts, styles and icons under static/.
+//
+//go:embed web
+var webFiles embed.FS
+
+// indexTemplate is cloned for each request with the helpers of its
+// language, t among them. static "app.js" is the hashed URL of a file of
+// web/static.
+var indexTemplate = htmltemplate.Must(htmltemplate.New("index.html").
+	Funcs(htmltemplate.FuncMap(templateFuncMap(defaultLanguage))).
+	Funcs(htmltemplate.FuncMap{"static": staticURL}).
+	ParseFS(webFiles, "web/index.html"))
+
+// indexPage is the data of the built-in page.
+type indexPage struct {
+	City string
+	// Cities are the cards of the grid, WEATHER_CITY and COLLECT_CITIES;
+	// the grid is left out for a single city.
+	Cities []string
+	// Lang is the catalog language of ?lang= or Accept-Language.
+	Lang string
+	// Units is ?units=; without it the page uses the units last chosen
+	// with its toggle.
+	Units          string
+	RefreshSeconds int
+	// Title is UI_TITLE or the translated title.
+	Title string
+	// ColorScheme is UI_THEME: auto, light or dark.
+	ColorScheme string
+	// User is who logged in with OIDC, shown with a logout link.
+	User string
+	// CSRFToken is sent by the scripts with requests that change something,
+	// when the page was opened with an OIDC session.
+	CSRFToken string
+}
+
+// uiTitle is the title of the built-in page in lang: UI_TITLE, by default
+// the title of the catalog.
+func uiTitle(lang, key string) string {
+	if title := runningConfig().UITitle; title != "" {
+		return title
+	}
+	return localize(lang, key)
+}
+
+// uiColorScheme is UI_THEME, the light or dark look of the built-in page;
+// auto leaves the choice to the device.
+func uiColorScheme() string {
+	return runningConfig().UITheme
+}
+
+// indexHandler serves the built-in page, or UI_TEMPLATE when set, for the
+// city of ?city= or WEATHER_CITY, in the language of ?lang= or
+// Accept-Language.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := runningConfig()
+	if cfg.UITemplate != "" {
+		serveUITemplate(w, r, cfg.UITemplate)
+		return
+	}
+	q := r.URL.Query()
+	if _, ok := requestUnits(r); !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+	page := indexPage{
+		City:           q.Get("city"),
+		Lang:           negotiateLanguage(r.Header.Get("Accept-Language")),
+		Units:          strings.ToLower(q.Get("units")),
+		RefreshSeconds: int(cfg.UIRefresh / time.Second),
+	}
+	if lang := q.Get("lang"); lang != "" {
+		page.Lang = negotiateLanguage(lang)
+	}
+	if page.City == "" {
+		page.City = weatherCity()
+	}
+	page.Title = uiTitle(page.Lang, "ui.title")
+	page.ColorScheme = uiColorScheme()
+	if p, ok := requestPrincipal(r); ok && p.Scheme == "oidc" {
+		page.User = p.Name
+		page.CSRFToken = requestCSRFToken(r)
+	}
+	if cities := collectCities(); len(cities) > 1 {
+		page.Cities = cities
+	}
+	tmpl := htmltemplate.Must(indexTemplate.Clone()).Funcs(htmltemplate.FuncMap(templateFuncMap(page.Lang)))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		logError("Rendering the page failed: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "ui.template_failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeInheritedEnv marks a process started by an upgrade: it serves on
+// the listener inherited as file descriptor 3 and reports readiness by
+// writing to descriptor 4.
+const upgradeInheritedEnv = "UPGRADE_INHERITED"
+
+// upgradeSocketsEnv lists the other sockets a process started by an upgrade
+// inherits, from descriptor 5 on, as comma-separated "<protocol>@<address>".
+const upgradeSocketsEnv = "UPGRADE_SOCKETS"
+
+// upgradeSettingsEnv is the descriptor, after the sockets, of the pipe a
+// process started by an upgrade reads the settings changed through the
+// admin API from. They are not passed in the environment, which other
+// processes can read, since secrets are among them. The process being
+// upgraded keeps the pipe open until it exits.
+const upgradeSettingsEnv = "UPGRADE_SETTINGS"
+
+// socketFile is a listener or packet socket that can be passed on.
+type socketFile interface {
+	File() (*os.File, error)
+}
+
+type upgradeSocket struct {
+	name   string
+	socket socketFile
+}
+
+// upgradeSockets are the CoAP, Modbus and SNMP sockets, passed on with the
+// HTTP listener so that the new process does not have to bind them again.
+var (
+	upgradeSocketsMu sync.Mutex
+	upgradeSockets   []upgradeSocket
+)
+
+// inheritedSockets are the sockets of upgradeSocketsEnv by name, read once
+// and removed from the environment like upgradeInheritedEnv.
+var inheritedSockets = sync.OnceValue(func() map[string]*os.File {
+	sockets := make(map[string]*os.File)
+	names := os.Getenv(upgradeSocketsEnv)
+	os.Unsetenv(upgradeSocketsEnv)
+	if names == "" {
+		return sockets
+	}
+	for i, name := range strings.Split(names, ",") {
+		sockets[name] = os.NewFile(uintptr(5+i), name)
+	}
+	return sockets
+})
+
+// listenUDPUpgradable returns the UDP socket of protocol on addr inherited
+// from the process being upgraded, or listens on addr, and passes the socket
+// on at the next upgrade.
+func listenUDPUpgradable(protocol, addr string) (*net.UDPConn, error) {
+	name := protocol + "@" + addr
+	var conn *net.UDPConn
+	if f, ok := inheritedSockets()[name]; ok {
+		defer f.Close()
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s socket: %w", protocol, err)
+		}
+		if conn, ok = pc.(*net.UDPConn); !ok {
+			pc.Close()
+			return nil, fmt.Errorf("inherited %s socket is not UDP", protocol)
+		}
+	} else {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return nil, err
+		}
+	}
+	registerUpgradeSocket(name, conn)
+	return conn, nil
+}
+
+// listenTCPUpgradable is listenUDPUpgradable for TCP.
+func listenTCPUpgradable(protocol, addr string) (net.Listener, error) {
+	name := protocol + "@" + addr
+	var ln net.Listener
+	if f, ok := inheritedSockets()[name]; ok {
+		defer f.Close()
+		var err error
+		if ln, err = net.FileListener(f); err != nil {
+			return nil, fmt.Errorf("inherited %s socket: %w", protocol, err)
+		}
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if fl, ok := ln.(socketFile); ok {
+		registerUpgradeSocket(name, fl)
+	}
+	return ln, nil
+}
+
+func registerUpgradeSocket(name string, socket socketFile) {
+	upgradeSocketsMu.Lock()
+	defer upgradeSocketsMu.Unlock()
+	upgradeSockets = append(upgradeSockets, upgradeSocket{name, socket})
+}
+
+// backgroundJobs is cancelled once an upgrade has handed the sockets over.
+// From then on the new process collects, publishes and answers CoAP, Modbus
+// and SNMP, and this one only finishes its HTTP requests.
+var backgroundJobs, stopBackgroundJobs = context.WithCancel(context.Background())
+
+// backgroundTicks is time.Tick for background jobs: the channel is closed
+// once they are stopped, which ends the loops ranging over it.
+func backgroundTicks(d time.Duration) <-chan time.Time {
+	ticker := time.NewTicker(d)
+	ticks := make(chan time.Time)
+	go func() {
+		defer close(ticks)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				select {
+				case ticks <- t:
+				case <-backgroundJobs.Done():
+					return
+				}
+			case <-backgroundJobs.Done():
+				return
+			}
+		}
+	}()
+	return ticks
+}
+
+// closeOnStop closes the socket of a protocol server once background jobs
+// are stopped. The new process keeps its own copy open.
+func closeOnStop(socket io.Closer) {
+	go func() {
+		<-backgroundJobs.Done()
+		socket.Close()
+	}()
+}
+
+// upgradeParentExited is closed once the process that started this one by
+// an upgrade has exited; nil when this one was not started by an upgrade.
+var upgradeParentExited <-chan struct{}
+
+// upgradeSettingsPipe is the pipe to the process started by the upgrade,
+// kept open until this one exits.
+var upgradeSettingsPipe *os.File
+
+// inheritedSettings returns the settings changed through the admin API in
+// the process being upgraded, and sets upgradeParentExited; none when this
+// one was not started by an upgrade.
+func inheritedSettings() (map[string]*string, error) {
+	fd := os.Getenv(upgradeSettingsEnv)
+	os.Unsetenv(upgradeSettingsEnv)
+	if fd == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s=%q: %w", upgradeSettingsEnv, fd, err)
+	}
+	f := os.NewFile(uintptr(n), "upgrade-settings")
+	changes, err := readUpgradeSettings(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	exited := make(chan struct{})
+	upgradeParentExited = exited
+	go func() {
+		io.Copy(io.Discard, f)
+		f.Close()
+		close(exited)
+	}()
+	return changes, nil
+}
+
+// writeUpgradeSettings writes changes, from Config.runtimeChanges, for
+// readUpgradeSettings.
+func writeUpgradeSettings(w io.Writer, changes map[string]*string) error {
+	return json.NewEncoder(w).Encode(changes)
+}
+
+// readUpgradeSettings reads what writeUpgradeSettings wrote, without the
+// settings this version does not know.
+func readUpgradeSettings(r io.Reader) (map[string]*string, error) {
+	var changes map[string]*string
+	if err := json.NewDecoder(r).Decode(&changes); err != nil {
+		return nil, fmt.Errorf("settings of the process being upgraded: %w", err)
+	}
+	for name := range changes {
+		if _, ok := lookupSetting(name); !ok {
+			log.Printf("Setting %s changed in the process being upgraded is unknown, ignored", name)
+			delete(changes, name)
+		}
+	}
+	return changes, nil
+}
+
+// upgradeReady is the pipe to the process that started this one by an
+// upgrade, nil otherwise.
+var upgradeReady *os.File
+
+// upgradeListener returns the listener inherited from the process being
+// upgraded; false when this process was not started by an upgrade.
+func upgradeListener() (net.Listener, bool, error) {
+	if os.Getenv(upgradeInheritedEnv) != "1" {
+		return nil, false, nil
+	}
+	// Processes this one starts, plugins or a later upgrade, must not take
+	// the descriptors for theirs.
+	os.Unsetenv(upgradeInheritedEnv)
+	inheritedSockets()
+	upgradeReady = os.NewFile(4, "upgrade-ready")
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("inherited listener: %w", err)
+	}
+	log.Printf("Serving on the listener inherited from process %d", os.Getppid())
+	return ln, true, nil
+}
+
+// announceReady waits for the warm-up, then writes PID_FILE and tells the
+// process being upgraded, if any, and systemd that it can take over.
+func announceReady() {
+	<-warmup.done
+	if path := runningConfig().PIDFile; path != "" {
+		if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			logError("Writing PID_FILE %s failed: %v", path, err)
+		}
+	}
+	if upgradeReady != nil {
+		upgradeReady.Write([]byte{1})
+		upgradeReady.Close()
+		// The main process of the unit changes; systemd accepts this from
+		// a process other than the main one only with NotifyAccess=all.
+		sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+		return
+	}
+	sdNotify("READY=1")
+}
+
+// serveHTTP serves handler on ln until an upgrade signal (SIGUSR2) has
+// started a new process of the current executable on the same listener and
+// it is ready; then it stops the background jobs and protocol servers,
+// stops accepting connections, waits up to SHUTDOWN_TIMEOUT for the
+// requests in flight and returns. The listening
+// socket is never closed in between, so no connection is refused during the
+// upgrade.
+func serveHTTP(ln net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+	srv.RegisterOnShutdown(streams.Close)
+	drained := make(chan struct{})
+	go func() {
+		if !awaitUpgrade(ln) {
+			return
+		}
+		// The new process serves on the same socket file.
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		stopBackgroundJobs()
+		ctx, cancel := context.WithTimeout(context.Background(), runningConfig().ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logError("Draining requests after the upgrade: %v", err)
+		}
+		close(drained)
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-drained
+	log.Printf("Upgrade complete, process %d exiting", os.Getpid())
+}
+
+// awaitUpgrade retries upgrades on each upgrade signal until one succeeds.
+// It reports false where upgrades are not supported.
+func awaitUpgrade(ln net.Listener) bool {
+	if len(upgradeSignals) == 0 {
+		return false
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, upgradeSignals...)
+	for range signals {
+		log.Printf("Upgrade requested, starting a new process")
+		// The new process opens the history database while this one
+		// still serves.
+		shared, _ := history.(interface {
+			Share()
+			Hold() error
+		})
+		if shared != nil {
+			shared.Share()
+		}
+		if err := startUpgrade(ln); err != nil {
+			logError("Upgrade failed, still serving: %v", err)
+			if shared != nil {
+				if err := shared.Hold(); err != nil {
+					logError("Keeping the history database open failed, opening it for each operation: %v", err)
+				}
+			}
+			continue
+		}
+		signal.Stop(signals)
+		return true
+	}
+	return false
+}
+
+// startUpgrade starts the current executable with the same arguments on
+// the listener and the upgradeSockets and waits up to UPGRADE_TIMEOUT for it to be ready. A new
+// process that exits or times out is left to fail on its own or killed, and
+// this one keeps serving.
+func startUpgrade(ln net.Listener) (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("listener %T cannot be passed on", ln)
+	}
+	listener, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	files := []*os.File{listener, readyWrite}
+	var names []string
+	upgradeSocketsMu.Lock()
+	for _, s := range upgradeSockets {
+		f, err := s.socket.File()
+		if err != nil {
+			upgradeSocketsMu.Unlock()
+			return fmt.Errorf("passing on %s: %w", s.name, err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+	upgradeSocketsMu.Unlock()
+
+	settingsRead, settingsWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// The write end stays open until this process exits, which tells the
+	// new one that it has the files to itself.
+	defer func() {
+		if err != nil {
+			settingsWrite.Close()
+		} else {
+			upgradeSettingsPipe = settingsWrite
+		}
+	}()
+	settingsFD := 3 + len(files)
+	files = append(files, settingsRead)
+
+	cfg := runningConfig()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(cfg.upgradeEnviron(os.Environ()),
+		upgradeInheritedEnv+"=1",
+		upgradeSocketsEnv+"="+strings.Join(names, ","),
+		upgradeSettingsEnv+"="+strconv.Itoa(settingsFD))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	readyWrite.Close()
+	settingsRead.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	// More than a pipe buffer of settings would block until the new
+	// process reads them.
+	go func() {
+		if err := writeUpgradeSettings(settingsWrite, cfg.runtimeChanges()); err != nil {
+			logError("Passing the changed settings to process %d: %v", cmd.Process.Pid, err)
+		}
+	}()
+
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := readyRead.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+	timeout := runningConfig().UpgradeTimeout
+	select {
+	case ok := <-ready:
+		if !ok {
+			return fmt.Errorf("process %d exited before it was ready", cmd.Process.Pid)
+		}
+		log.Printf("Process %d is ready, handing over", cmd.Process.Pid)
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("process %d not ready after %s", cmd.Process.Pid, timeout)
+	}
+}
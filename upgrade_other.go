@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty: handing the listener to a new process relies on
+// Unix file descriptor inheritance.
+var upgradeSignals []os.Signal
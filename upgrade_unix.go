@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals start a binary upgrade, see serveHTTP.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stationUploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "station_uploads_total",
+			Help: "Total number of station data uploads to third-party weather networks",
+		},
+		[]string{"network", "status"},
+	)
+
+	stationUploadLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "station_upload_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful upload to a weather network",
+		},
+		[]string{"network"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(stationUploadsTotal)
+	prometheus.MustRegister(stationUploadLastSuccess)
+}
+
+var uploadClient = &http.Client{Timeout: 30 * time.Second, Transport: upstreamTransport}
+
+// uploadNetwork describes a third-party network accepting station data over
+// a simple HTTP GET upload API.
+type uploadNetwork struct {
+	name     string
+	interval time.Duration
+	url      func(reading StationReading) string
+}
+
+// configuredUploadNetworks returns every network whose credentials are set.
+func configuredUploadNetworks(cfg *Config) ([]uploadNetwork, error) {
+	var networks []uploadNetwork
+
+	if key := cfg.WindyAPIKey; key != "" {
+		station := strconv.Itoa(cfg.WindyStation)
+		networks = append(networks, uploadNetwork{
+			name:     "windy",
+			interval: cfg.WindyInterval,
+			url: func(reading StationReading) string {
+				q := windyParams(reading)
+				q.Set("station", station)
+				return "https://stations.windy.com/pws/update/" + url.PathEscape(key) + "?" + q.Encode()
+			},
+		})
+	}
+
+	if id := cfg.PWSWeatherStationID; id != "" {
+		key := cfg.PWSWeatherAPIKey
+		networks = append(networks, uploadNetwork{
+			name:     "pwsweather",
+			interval: cfg.PWSWeatherInterval,
+			url: func(reading StationReading) string {
+				q := wundergroundParams(reading)
+				q.Set("ID", id)
+				q.Set("PASSWORD", key)
+				q.Set("action", "updateraw")
+				return "https://pwsupdate.pwsweather.com/api/v1/submitwx?" + q.Encode()
+			},
+		})
+	}
+
+	if site := cfg.WOWSiteID; site != "" {
+		key := cfg.WOWAuthKey
+		networks = append(networks, uploadNetwork{
+			name:     "wow",
+			interval: cfg.WOWInterval,
+			url: func(reading StationReading) string {
+				q := wundergroundParams(reading)
+				q.Set("siteid", site)
+				q.Set("siteAuthenticationKey", key)
+				return "https://wow.metoffice.gov.uk/automaticreading?" + q.Encode()
+			},
+		})
+	}
+
+	return networks, nil
+}
+
+func runStationUploads(cfg *Config) error {
+	networks, err := configuredUploadNetworks(cfg)
+	if err != nil {
+		return err
+	}
+	stationID := cfg.UploadStation
+	for _, network := range networks {
+		log.Printf("Uploading station data to %s every %v", network.name, network.interval)
+		go network.run(stationID)
+	}
+	return nil
+}
+
+func (n uploadNetwork) run(stationID string) {
+	for range backgroundTicks(n.interval) {
+		reading, ok := stations.Fresh(stationID, 2*n.interval)
+		if !ok {
+			continue
+		}
+		if err := n.upload(reading); err != nil {
+			logError("Upload to %s failed: %v", n.name, err)
+			stationUploadsTotal.WithLabelValues(n.name, "error").Inc()
+			continue
+		}
+		stationUploadsTotal.WithLabelValues(n.name, "success").Inc()
+		stationUploadLastSuccess.WithLabelValues(n.name).SetToCurrentTime()
+	}
+}
+
+func (n uploadNetwork) upload(reading StationReading) error {
+	resp, err := uploadClient.Get(n.url(reading))
+	if err != nil {
+		// Never log the URL: it carries the network credentials.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", n.name, resp.StatusCode)
+	}
+	return nil
+}
+
+func setParam(q url.Values, key string, value *float64, convert func(float64) float64) {
+	if value == nil {
+		return
+	}
+	v := *value
+	if convert != nil {
+		v = convert(v)
+	}
+	q.Set(key, strconv.FormatFloat(v, 'f', 2, 64))
+}
+
+// wundergroundParams encodes a reading in the imperial Weather Underground
+// upload format, which PWSWeather and WOW both accept.
+func wundergroundParams(reading StationReading) url.Values {
+	q := url.Values{}
+	q.Set("dateutc", reading.Timestamp.UTC().Format("2006-01-02 15:04:05"))
+	q.Set("softwaretype", "weather-app")
+	setParam(q, "tempf", reading.Temperature, celsiusToFahrenheit)
+	setParam(q, "humidity", reading.Humidity, nil)
+	setParam(q, "dewptf", reading.DewPoint, celsiusToFahrenheit)
+	setParam(q, "baromin", reading.Pressure, hPaToInchesHg)
+	setParam(q, "windspeedmph", reading.WindSpeed, metersPerSecondToMph)
+	setParam(q, "windgustmph", reading.WindGust, metersPerSecondToMph)
+	setParam(q, "winddir", reading.WindDirection, nil)
+	setParam(q, "rainin", reading.RainRate, millimetersToInches)
+	setParam(q, "dailyrainin", reading.DailyRain, millimetersToInches)
+	return q
+}
+
+// windyParams encodes a reading in the metric units of the Windy station API.
+func windyParams(reading StationReading) url.Values {
+	q := url.Values{}
+	q.Set("ts", strconv.FormatInt(reading.Timestamp.Unix(), 10))
+	setParam(q, "temp", reading.Temperature, nil)
+	setParam(q, "humidity", reading.Humidity, nil)
+	setParam(q, "dewpoint", reading.DewPoint, nil)
+	setParam(q, "pressure", reading.Pressure, func(hpa float64) float64 { return hpa * 100 })
+	setParam(q, "wind", reading.WindSpeed, nil)
+	setParam(q, "gust", reading.WindGust, nil)
+	setParam(q, "winddir", reading.WindDirection, nil)
+	setParam(q, "precip", reading.RainRate, nil)
+	return q
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// upstreamTransport carries every outbound HTTP call to weather providers
+// and third-party services. configureUpstream sets it up at startup.
+var upstreamTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+var weatherClient = &http.Client{Timeout: 10 * time.Second, Transport: keyFailoverTransport{tracedUpstream}}
+
+// configureUpstream presents UPSTREAM_CLIENT_CERT/UPSTREAM_CLIENT_KEY when
+// both are set. It runs after secrets are resolved, because the key may be
+// one of them.
+func configureUpstream(cfg *Config) error {
+	if err := configureUpstreamProxy(cfg); err != nil {
+		return err
+	}
+	certFile, keyFile := cfg.UpstreamClientCert, cfg.UpstreamClientKey
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("loading upstream client certificate: %w", err)
+		}
+		upstreamTransport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// configureUpstreamProxy routes upstream calls through UPSTREAM_PROXY
+// (http, https or socks5) or, when it is unset, through the proxy named by
+// HTTP_PROXY/HTTPS_PROXY. Hosts listed in NO_PROXY are always reached
+// directly. None of these settings are secrets, so it runs before secrets
+// are resolved and calls to cloud secret stores already use the proxy.
+func configureUpstreamProxy(cfg *Config) error {
+	tlsConfig, err := upstreamTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	upstreamTransport.TLSClientConfig = tlsConfig
+	// Webhook targets are chosen by API clients and must not be presented
+	// the client certificate.
+	webhookTransport.TLSClientConfig = &tls.Config{MinVersion: tlsConfig.MinVersion, RootCAs: tlsConfig.RootCAs}
+
+	upstreamTransport.Proxy = http.ProxyFromEnvironment
+	raw := cfg.UpstreamProxy
+	if raw == "" {
+		return nil
+	}
+	proxy, err := url.Parse(raw)
+	if err != nil || proxy.Host == "" {
+		// The value is not shown: it may carry the proxy's credentials.
+		return fmt.Errorf("invalid UPSTREAM_PROXY, expected a URL with a host")
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported UPSTREAM_PROXY scheme %q, expected http, https or socks5", proxy.Scheme)
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	upstreamTransport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+	return nil
+}
+
+// bypassProxy matches host against a NO_PROXY list: "*", IP addresses,
+// CIDR ranges and domains, which also cover their subdomains.
+func bypassProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig trusts the certificates in UPSTREAM_CA_FILE in addition
+// to the system roots, which is what TLS-intercepting gateways need.
+// configureUpstream adds the client certificate.
+func upstreamTLSConfig(cfg *Config) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tlsVersions[cfg.UpstreamTLSMinVersion]}
+
+	if path := cfg.UpstreamCAFile; path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading UPSTREAM_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("UPSTREAM_CA_FILE %s contains no PEM certificates", path)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
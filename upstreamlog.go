@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialParams matches API keys in URLs quoted by transport errors.
+var credentialParams = regexp.MustCompile(`((?i:appid|apikey|api_key|key|token)=)[^&\s"]+`)
+
+// redactSecrets replaces API keys in query parameters and the values of
+// secret settings, wherever they appear, with REDACTED, so that URLs and
+// error messages of upstream calls can be logged.
+func redactSecrets(s string) string {
+	s = credentialParams.ReplaceAllString(s, "${1}REDACTED")
+	cfg := runningConfig()
+	for _, setting := range configSettings {
+		if setting.Type != settingSecret {
+			continue
+		}
+		// Short values would mask unrelated text and are no secret anyway.
+		if v, _ := cfg.Lookup(setting.Name); len(v) >= 8 {
+			s = strings.ReplaceAll(s, v, "REDACTED")
+			s = strings.ReplaceAll(s, url.QueryEscape(v), "REDACTED")
+		}
+	}
+	for _, v := range owmKeys.Retired() {
+		if len(v) >= 8 {
+			s = strings.ReplaceAll(s, v, "REDACTED")
+			s = strings.ReplaceAll(s, url.QueryEscape(v), "REDACTED")
+		}
+	}
+	return s
+}
+
+// redactURLError removes secrets from the URL that http.Client quotes in
+// its errors.
+func redactURLError(err error) error {
+	if e, ok := err.(*url.Error); ok {
+		e.URL = redactSecrets(e.URL)
+	}
+	return err
+}
+
+type upstreamAttemptsKey struct{}
+
+// upstreamAttempts counts the calls an incoming request makes to each
+// upstream URL, so that repeated calls are logged as retries.
+type upstreamAttempts struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func withUpstreamAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamAttemptsKey{}, &upstreamAttempts{count: make(map[string]int)})
+}
+
+// attempt returns the number of the call to target within ctx, 1 for calls
+// made outside an incoming request.
+func attempt(ctx context.Context, target string) int {
+	a, ok := ctx.Value(upstreamAttemptsKey{}).(*upstreamAttempts)
+	if !ok {
+		return 1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.count[target]++
+	return a.count[target]
+}
+
+// logTransport logs each upstream call with its redacted URL, status,
+// duration and trace ID when LOG_LEVEL is debug. Calls to a URL the same
+// incoming request has already called are logged as retries.
+type logTransport struct {
+	base http.RoundTripper
+}
+
+func (t logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !debugLogging() {
+		return t.base.RoundTrip(req)
+	}
+	target := redactSecrets(req.URL.String())
+	n := attempt(req.Context(), req.Method+" "+target)
+	retry := ""
+	if n > 1 {
+		retry = " (retry " + strconv.Itoa(n-1) + ")"
+	}
+	trace, _ := parseTraceparent(req.Header.Get("traceparent"))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		log.Printf("DEBUG upstream %s %s%s failed after %s (trace %q): %s", req.Method, target, retry, elapsed, trace.TraceID, redactSecrets(err.Error()))
+		return nil, err
+	}
+	log.Printf("DEBUG upstream %s %s%s: %d in %s (trace %q)", req.Method, target, retry, resp.StatusCode, elapsed, trace.TraceID)
+	return resp, nil
+}
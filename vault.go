@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var vaultRefreshesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "vault_refreshes_total",
+		Help: "Total number of periodic token renewals and secret reads from Vault by status",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(vaultRefreshesTotal)
+}
+
+const defaultVaultK8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultSecret is a setting read from Vault: field of the KV v2 secret at
+// path of the secrets engine mounted at mount.
+type vaultSecret struct {
+	setting string
+	mount   string
+	path    string
+	field   string
+}
+
+// parseVaultSecrets parses VAULT_SECRETS,
+// "<setting>=<mount>/<path>#<field>" separated by ','.
+func parseVaultSecrets(v string) ([]vaultSecret, error) {
+	var secrets []vaultSecret
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, ref, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q: expected <setting>=<mount>/<path>#<field>", entry)
+		}
+		if strings.HasPrefix(name, "VAULT_") {
+			return nil, fmt.Errorf("%q: settings of Vault itself cannot be read from Vault", entry)
+		}
+		location, field, ok := strings.Cut(strings.TrimSpace(ref), "#")
+		mount, path, hasPath := strings.Cut(strings.Trim(location, "/"), "/")
+		if !ok || field == "" || !hasPath || mount == "" || path == "" {
+			return nil, fmt.Errorf("%q: expected <setting>=<mount>/<path>#<field>", entry)
+		}
+		secrets = append(secrets, vaultSecret{setting: name, mount: mount, path: path, field: field})
+	}
+	return secrets, nil
+}
+
+// vaultClient reads settings such as WEATHER_API_KEY from HashiCorp Vault
+// into the running configuration, where they are read like any other
+// setting, so the
+// secrets never appear in manifests. It logs in with a token, AppRole or a
+// Kubernetes service account, renews its token when half the lease has
+// passed and reads the secrets again every VAULT_REFRESH, which picks up
+// rotated keys of Live settings without a restart.
+type vaultClient struct {
+	addr      string
+	namespace string
+	method    string
+	mount     string
+	secrets   []vaultSecret
+	client    *http.Client
+	// refreshEvery is VAULT_REFRESH.
+	refreshEvery time.Duration
+	// The credentials of method: VAULT_TOKEN, VAULT_ROLE_ID and
+	// VAULT_SECRET_ID, or VAULT_ROLE and VAULT_K8S_TOKEN_FILE.
+	loginToken, roleID, secretID, role, tokenFile string
+	// applied are the values of the last read, which is the only goroutine
+	// to use them.
+	applied map[string]string
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	issued    time.Time
+	lease     time.Duration // 0 for tokens that do not expire
+}
+
+// vaultManages reports whether VAULT_SECRETS reads setting from Vault.
+func vaultManages(setting string) bool {
+	cfg := runningConfig()
+	if cfg.VaultAddr == "" {
+		return false
+	}
+	secrets, _ := parseVaultSecrets(cfg.VaultSecrets)
+	return slices.ContainsFunc(secrets, func(s vaultSecret) bool { return s.setting == setting })
+}
+
+// newVaultClient returns nil without VAULT_ADDR. It does not connect.
+func newVaultClient(cfg *Config) (*vaultClient, error) {
+	addr := cfg.VaultAddr
+	if addr == "" {
+		return nil, nil
+	}
+	secrets, err := parseVaultSecrets(cfg.VaultSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAULT_SECRETS: %v", err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("VAULT_ADDR is set but VAULT_SECRETS lists no settings")
+	}
+	for _, s := range secrets {
+		if _, ok := lookupSetting(s.setting); !ok {
+			return nil, fmt.Errorf("invalid VAULT_SECRETS: unknown setting %s", s.setting)
+		}
+	}
+
+	v := &vaultClient{
+		addr:         strings.TrimSuffix(addr, "/"),
+		namespace:    cfg.VaultNamespace,
+		method:       cfg.VaultAuthMethod,
+		mount:        cfg.VaultAuthMount,
+		secrets:      secrets,
+		refreshEvery: cfg.VaultRefresh,
+		loginToken:   cfg.VaultToken,
+		roleID:       cfg.VaultRoleID,
+		secretID:     cfg.VaultSecretID,
+		role:         cfg.VaultRole,
+		tokenFile:    cfg.VaultK8sTokenFile,
+	}
+	if v.mount == "" {
+		v.mount = v.method
+	}
+	switch v.method {
+	case "token":
+		if v.loginToken == "" {
+			return nil, fmt.Errorf("VAULT_AUTH_METHOD token requires VAULT_TOKEN")
+		}
+	case "approle":
+		if v.roleID == "" || v.secretID == "" {
+			return nil, fmt.Errorf("VAULT_AUTH_METHOD approle requires VAULT_ROLE_ID and VAULT_SECRET_ID")
+		}
+	case "kubernetes":
+		if v.role == "" {
+			return nil, fmt.Errorf("VAULT_AUTH_METHOD kubernetes requires VAULT_ROLE")
+		}
+	default:
+		return nil, fmt.Errorf("unknown VAULT_AUTH_METHOD %q, expected token, approle or kubernetes", v.method)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if path := cfg.VaultCACert; path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading VAULT_CACERT: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("VAULT_CACERT %s contains no PEM certificates", path)
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	v.client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return v, nil
+}
+
+// vaultAuth is the auth block of login and renewal responses.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// call sends a request to the Vault API at path and decodes the JSON
+// response into out.
+func (v *vaultClient) call(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Request", "true")
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	v.mu.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mu.Unlock()
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var problem struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&problem)
+		if len(problem.Errors) > 0 {
+			return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.Join(problem.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *vaultClient) setAuth(auth vaultAuth) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = auth.ClientToken
+	v.renewable = auth.Renewable
+	v.issued = time.Now()
+	v.lease = time.Duration(auth.LeaseDuration) * time.Second
+}
+
+// login obtains a token with VAULT_AUTH_METHOD. A VAULT_TOKEN is looked up
+// to learn its lease instead.
+func (v *vaultClient) login(ctx context.Context) error {
+	var body map[string]string
+	switch v.method {
+	case "token":
+		v.mu.Lock()
+		v.token = v.loginToken
+		v.mu.Unlock()
+		var lookup struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := v.call(ctx, http.MethodGet, "auth/token/lookup-self", nil, &lookup); err != nil {
+			return fmt.Errorf("looking up VAULT_TOKEN: %w", err)
+		}
+		v.setAuth(vaultAuth{ClientToken: v.loginToken, LeaseDuration: lookup.Data.TTL, Renewable: lookup.Data.Renewable})
+		return nil
+	case "approle":
+		body = map[string]string{"role_id": v.roleID, "secret_id": v.secretID}
+	case "kubernetes":
+		jwt, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading the service account token: %w", err)
+		}
+		body = map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	v.mu.Lock()
+	v.token = ""
+	v.mu.Unlock()
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := v.call(ctx, http.MethodPost, "auth/"+v.mount+"/login", body, &resp); err != nil {
+		return fmt.Errorf("%s login: %w", v.method, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("%s login returned no token", v.method)
+	}
+	v.setAuth(resp.Auth)
+	return nil
+}
+
+// renew extends the lease of the token.
+func (v *vaultClient) renew(ctx context.Context) error {
+	v.mu.Lock()
+	renewable := v.renewable
+	v.mu.Unlock()
+	if !renewable {
+		return fmt.Errorf("token is not renewable")
+	}
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := v.call(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &resp); err != nil {
+		return err
+	}
+	v.setAuth(resp.Auth)
+	return nil
+}
+
+// read fetches the secrets and returns the settings to set. Nothing is
+// returned unless every secret was read and is valid for its setting. A
+// setting is only returned again when its value changed in Vault, so that a
+// value applied through the admin API stays until Vault has a new one.
+func (v *vaultClient) read(ctx context.Context) (map[string]string, error) {
+	documents := make(map[string]map[string]any)
+	values := make(map[string]string, len(v.secrets))
+	for _, s := range v.secrets {
+		location := s.mount + "/data/" + s.path
+		data, ok := documents[location]
+		if !ok {
+			var resp struct {
+				Data struct {
+					Data map[string]any `json:"data"`
+				} `json:"data"`
+			}
+			if err := v.call(ctx, http.MethodGet, location, nil, &resp); err != nil {
+				return nil, fmt.Errorf("reading %s/%s: %w", s.mount, s.path, err)
+			}
+			data = resp.Data.Data
+			documents[location] = data
+		}
+		value, ok := data[s.field].(string)
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no string field %q for %s", s.mount, s.path, s.field, s.setting)
+		}
+		setting, _ := lookupSetting(s.setting)
+		if err := setting.validate(value); err != nil {
+			return nil, fmt.Errorf("%s from %s/%s: %v", s.setting, s.mount, s.path, err)
+		}
+		values[s.setting] = value
+	}
+	changed := make(map[string]string, len(values))
+	for name, value := range values {
+		old, read := v.applied[name]
+		if read && old == value {
+			continue
+		}
+		if read {
+			log.Printf("%s changed in Vault", name)
+		}
+		changed[name] = value
+	}
+	v.applied = values
+	return changed, nil
+}
+
+// nextRefresh is how long to wait before the next refresh: VAULT_REFRESH,
+// or less when half the token lease passes earlier.
+func (v *vaultClient) nextRefresh() time.Duration {
+	wait := v.refreshEvery
+	v.mu.Lock()
+	if v.lease > 0 {
+		wait = min(wait, time.Until(v.issued.Add(v.lease/2)))
+	}
+	v.mu.Unlock()
+	return max(wait, 5*time.Second)
+}
+
+// refresh renews the token once half its lease has passed, logging in
+// again when that fails, and reads the secrets again.
+func (v *vaultClient) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	due := v.lease > 0 && time.Since(v.issued) >= v.lease/2
+	v.mu.Unlock()
+	if due {
+		if err := v.renew(ctx); err != nil {
+			if err := v.login(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	values, err := v.read(ctx)
+	if err != nil {
+		return err
+	}
+	updateConfig(func(c *Config) *Config { return c.with(values) })
+	return nil
+}
+
+// Run refreshes the token and the secrets until the process exits. A
+// failed refresh keeps the values read before.
+func (v *vaultClient) Run() {
+	for {
+		time.Sleep(v.nextRefresh())
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := v.refresh(ctx)
+		cancel()
+		if err != nil {
+			vaultRefreshesTotal.WithLabelValues("failed").Inc()
+			logError("Vault refresh failed: %v", err)
+			continue
+		}
+		vaultRefreshesTotal.WithLabelValues("ok").Inc()
+	}
+}
+
+// loadVaultSecrets logs in to Vault and returns cfg with the settings of
+// VAULT_SECRETS read from it. The client is nil without VAULT_ADDR.
+func loadVaultSecrets(cfg *Config) (*Config, *vaultClient, error) {
+	v, err := newVaultClient(cfg)
+	if v == nil || err != nil {
+		return cfg, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := v.login(ctx); err != nil {
+		return nil, nil, err
+	}
+	values, err := v.read(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg.with(values), v, nil
+}
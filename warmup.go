@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupState tracks the fetch of the configured cities at startup, which
+// /readyz waits for so that the first requests after a deploy find the cache
+// filled instead of all paying the upstream latency.
+type warmupState struct {
+	mu       sync.Mutex
+	total    int
+	fetched  int
+	failed   int
+	finished bool
+	timedOut bool
+	took     time.Duration
+	// done is closed when the warm-up is over, fetched or timed out.
+	done chan struct{}
+}
+
+var warmup = &warmupState{done: make(chan struct{})}
+
+// warmupTimeout is WARMUP_TIMEOUT, how long readiness waits for the warm-up;
+// 0 disables it.
+func warmupTimeout() time.Duration {
+	return runningConfig().WarmupTimeout
+}
+
+// warmupProviders returns the cities to fetch at startup with the provider
+// of each: WEATHER_CITY and the COLLECT_CITIES this instance owns, then the
+// cities of TENANTS with the tenant's provider.
+func warmupProviders() ([]string, map[string]WeatherProvider) {
+	cities := collectCities()
+	providers := make(map[string]WeatherProvider, len(cities))
+	for _, city := range cities {
+		providers[city] = weatherProvider
+	}
+	tenants, _ := parseTenants(runningConfig().Tenants)
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		t := tenants[name]
+		for _, city := range t.Cities {
+			if !shards.Owns(city) || slices.ContainsFunc(cities, func(c string) bool { return strings.EqualFold(c, city) }) {
+				continue
+			}
+			cities = append(cities, city)
+			providers[city] = t.Provider()
+		}
+	}
+	return cities, providers
+}
+
+// runWarmup fetches the configured cities into the cache, giving up waiting
+// after WARMUP_TIMEOUT: an upstream outage must not keep instances out of
+// the load balancer for good, and the provider check of /readyz reports it
+// anyway. Fetches still under way when it gives up complete in the
+// background.
+func runWarmup(cfg *Config) {
+	timeout := cfg.WarmupTimeout
+	if timeout == 0 {
+		warmup.finish(false, 0)
+		return
+	}
+	cities, providers := warmupProviders()
+	warmup.mu.Lock()
+	warmup.total = len(cities)
+	warmup.mu.Unlock()
+
+	start := time.Now()
+	fetched := make(chan struct{})
+	go func() {
+		defer close(fetched)
+		forEachCity("warmup", cities, func(city string) error {
+			_, err := currentWeatherFrom(context.Background(), providers[city], city)
+			warmup.mu.Lock()
+			if err != nil {
+				warmup.failed++
+			} else {
+				warmup.fetched++
+			}
+			warmup.mu.Unlock()
+			return err
+		})
+	}()
+	select {
+	case <-fetched:
+		warmup.finish(false, time.Since(start))
+	case <-time.After(timeout):
+		warmup.finish(true, time.Since(start))
+	}
+	warmup.mu.Lock()
+	defer warmup.mu.Unlock()
+	log.Printf("Warm-up fetched %d of %d cities in %v", warmup.fetched, warmup.total, warmup.took.Round(time.Millisecond))
+}
+
+func (w *warmupState) finish(timedOut bool, took time.Duration) {
+	w.mu.Lock()
+	w.finished, w.timedOut, w.took = true, timedOut, took
+	w.mu.Unlock()
+	close(w.done)
+}
+
+// checkWarmup fails until the warm-up is over.
+func checkWarmup() ReadinessCheck {
+	warmup.mu.Lock()
+	defer warmup.mu.Unlock()
+	progress := fmt.Sprintf("%d of %d cities fetched", warmup.fetched, warmup.total)
+	if warmup.failed > 0 {
+		progress += fmt.Sprintf(", %d failed", warmup.failed)
+	}
+	switch {
+	case !warmup.finished:
+		return ReadinessCheck{Status: "failed", Detail: "warming up: " + progress}
+	case warmup.total == 0:
+		return ReadinessCheck{Status: "skipped"}
+	case warmup.timedOut:
+		return ReadinessCheck{Status: "ok", Detail: fmt.Sprintf("%s, gave up waiting after %s", progress, warmup.took.Round(time.Second))}
+	}
+	return ReadinessCheck{Status: "ok", Detail: fmt.Sprintf("%s in %s", progress, warmup.took.Round(time.Millisecond))}
+}
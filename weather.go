@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCityDistanceKm bounds how far from the requested point the city whose
+// provider weather is served may lie.
+const maxCityDistanceKm = 50
+
+// WeatherObservation is the response of /api/weather: conditions at a place,
+// taken from the local station network when it covers the place and from
+// the weather provider otherwise.
+type WeatherObservation struct {
+	City          string                `json:"city,omitempty"`
+	Latitude      *float64              `json:"latitude,omitempty"`
+	Longitude     *float64              `json:"longitude,omitempty"`
+	Temperature   float64               `json:"temperature"`
+	Humidity      *float64              `json:"humidity,omitempty"`
+	WindSpeed     *float64              `json:"wind_speed,omitempty"`
+	Comfort       *Comfort              `json:"comfort,omitempty"`
+	ConditionCode int                   `json:"condition_code,omitempty"`
+	Description   string                `json:"description,omitempty"`
+	Unit          string                `json:"unit"`
+	Timestamp     string                `json:"timestamp"`
+	Source        string                `json:"source"`
+	Stations      []StationContribution `json:"stations,omitempty"`
+	Lineage       *Lineage              `json:"lineage,omitempty"`
+}
+
+// Lineage explains how a served value was derived; it is included with
+// ?debug=lineage. Raw values are in metric units as received.
+type Lineage struct {
+	Source          string           `json:"source"`
+	Provider        string           `json:"provider,omitempty"`
+	Raw             *LineageValue    `json:"raw,omitempty"`
+	FetchedAt       time.Time        `json:"fetched_at"`
+	CacheHit        bool             `json:"cache_hit"`
+	CacheAgeSeconds float64          `json:"cache_age_seconds"`
+	QuotaFallback   bool             `json:"quota_fallback,omitempty"`
+	Anomaly         string           `json:"anomaly,omitempty"`
+	Stations        []StationLineage `json:"stations,omitempty"`
+	Smoothing       string           `json:"smoothing"`
+	Steps           []string         `json:"steps"`
+}
+
+// LineageValue is a value as received from a provider or station.
+type LineageValue struct {
+	Temperature   float64  `json:"temperature"`
+	Humidity      *float64 `json:"humidity,omitempty"`
+	WindSpeed     *float64 `json:"wind_speed,omitempty"`
+	ConditionCode int      `json:"condition_code,omitempty"`
+}
+
+// StationLineage is the raw reading of one station and its fusion weight.
+type StationLineage struct {
+	StationContribution
+	Protocol  string       `json:"protocol"`
+	Timestamp time.Time    `json:"timestamp"`
+	Raw       LineageValue `json:"raw"`
+}
+
+// StationContribution is the share of one station in an aggregated value.
+type StationContribution struct {
+	StationID  string  `json:"station_id"`
+	DistanceKm float64 `json:"distance_km"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Weight     float64 `json:"weight"`
+}
+
+// parseStationLocations parses STATION_LOCATIONS: "id=lat,lon;id2=lat,lon".
+// Upload protocols do not carry coordinates, so they are configured here.
+func parseStationLocations(v string) (map[string][2]float64, error) {
+	locations := make(map[string][2]float64)
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, coords, ok := strings.Cut(entry, "=")
+		latRaw, lonRaw, ok2 := strings.Cut(coords, ",")
+		if !ok || !ok2 || strings.TrimSpace(id) == "" {
+			return nil, fmt.Errorf("invalid station location %q, expected id=lat,lon", entry)
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(latRaw), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(lonRaw), 64)
+		if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+			return nil, fmt.Errorf("invalid coordinates in station location %q", entry)
+		}
+		locations[strings.TrimSpace(id)] = [2]float64{lat, lon}
+	}
+	return locations, nil
+}
+
+// nearestStations aggregates the fresh readings of located stations within
+// STATION_RADIUS_KM of a point. Each station is weighted by inverse squared
+// distance times the share of STATION_MAX_AGE it has left, so close and
+// recent readings dominate. It reports false when fewer than
+// STATION_MIN_COUNT stations qualify.
+func nearestStations(lat, lon float64, now time.Time) (WeatherObservation, bool) {
+	cfg := runningConfig()
+	locations, _ := parseStationLocations(cfg.StationLocations)
+	radius := cfg.StationRadiusKm
+	maxAge := cfg.StationMaxAge
+
+	var (
+		contributions                []StationContribution
+		readings                     []StationReading
+		total, temperature, humidity float64
+		humidityWeight               float64
+		latest                       time.Time
+	)
+	for _, reading := range stations.List() {
+		location, ok := locations[reading.StationID]
+		age := now.Sub(reading.Timestamp)
+		if !ok || reading.Temperature == nil || age > maxAge {
+			continue
+		}
+		distance := haversineKm(lat, lon, location[0], location[1])
+		if distance > radius {
+			continue
+		}
+		if age < 0 {
+			age = 0
+		}
+		weight := (1 - age.Seconds()/maxAge.Seconds()) / math.Pow(math.Max(distance, 0.1), 2)
+		if weight <= 0 {
+			continue
+		}
+		contributions = append(contributions, StationContribution{
+			StationID:  reading.StationID,
+			DistanceKm: math.Round(distance*100) / 100,
+			AgeSeconds: math.Round(age.Seconds()),
+			Weight:     weight,
+		})
+		readings = append(readings, reading)
+	}
+	if len(contributions) == 0 || len(contributions) < cfg.StationMinCount {
+		return WeatherObservation{}, false
+	}
+
+	for i, c := range contributions {
+		total += c.Weight
+		temperature += c.Weight * *readings[i].Temperature
+		if readings[i].Humidity != nil {
+			humidity += c.Weight * *readings[i].Humidity
+			humidityWeight += c.Weight
+		}
+		if readings[i].Timestamp.After(latest) {
+			latest = readings[i].Timestamp
+		}
+	}
+	lineage := &Lineage{
+		Source:    "stations",
+		FetchedAt: latest.UTC(),
+		Smoothing: "none",
+		Steps: []string{
+			fmt.Sprintf("selected %d stations within %g km with readings younger than %v", len(contributions), radius, maxAge),
+			"weighted each station by (1 - age/max_age) / distance_km^2",
+			"averaged temperature and humidity with the normalized weights",
+		},
+	}
+	for i := range contributions {
+		contributions[i].Weight = math.Round(contributions[i].Weight/total*1000) / 1000
+		lineage.Stations = append(lineage.Stations, StationLineage{
+			StationContribution: contributions[i],
+			Protocol:            readings[i].Protocol,
+			Timestamp:           readings[i].Timestamp,
+			Raw:                 LineageValue{Temperature: *readings[i].Temperature, Humidity: readings[i].Humidity},
+		})
+	}
+	sort.Slice(contributions, func(i, j int) bool { return contributions[i].Weight > contributions[j].Weight })
+	sort.Slice(lineage.Stations, func(i, j int) bool { return lineage.Stations[i].Weight > lineage.Stations[j].Weight })
+
+	observation := WeatherObservation{
+		Latitude:    &lat,
+		Longitude:   &lon,
+		Temperature: temperature / total,
+		Timestamp:   latest.UTC().Format(time.RFC3339),
+		Source:      "stations",
+		Stations:    contributions,
+		Lineage:     lineage,
+	}
+	if humidityWeight > 0 {
+		h := humidity / humidityWeight
+		observation.Humidity = &h
+	}
+	return observation, true
+}
+
+// weatherHandler serves /api/weather for ?lat=&lon=, ?city=, ?zip= or, without
+// parameters, WEATHER_CITY. Cities are located through the city catalog.
+func weatherHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	units, ok := requestUnits(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_units", q.Get("units"))
+		return
+	}
+
+	debugLineage := false
+	switch debug := q.Get("debug"); debug {
+	case "":
+	case "lineage":
+		debugLineage = true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "request.invalid_debug", debug)
+		return
+	}
+
+	city := q.Get("city")
+	var lat, lon float64
+	located := false
+	if q.Get("lat") != "" || q.Get("lon") != "" {
+		var err1, err2 error
+		lat, err1 = strconv.ParseFloat(q.Get("lat"), 64)
+		lon, err2 = strconv.ParseFloat(q.Get("lon"), 64)
+		if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+			writeProblem(w, r, http.StatusBadRequest, "request.invalid_coordinates", q.Get("lat"), q.Get("lon"))
+			return
+		}
+		located = true
+		if city == "" {
+			if nearest, ok := cities.Nearest(lat, lon); ok && nearest.DistanceKm <= maxCityDistanceKm {
+				city = nearest.Name + "," + nearest.Country
+			}
+		}
+	} else {
+		if city, ok = requestCity(w, r); !ok {
+			return
+		}
+		if c, ok := cities.Lookup(city); ok {
+			lat, lon, located = c.Latitude, c.Longitude, true
+		}
+	}
+
+	var observation WeatherObservation
+	fromStations := false
+	if located {
+		observation, fromStations = nearestStations(lat, lon, time.Now())
+	}
+	if !fromStations {
+		if city == "" {
+			writeProblem(w, r, http.StatusNotFound, "weather.no_coverage", q.Get("lat"), q.Get("lon"))
+			return
+		}
+		result, err := currentWeather(context.WithoutCancel(r.Context()), city)
+		if result.RetryAfter > 0 {
+			w.Header().Set("Retry-After", retryAfterSeconds(result.RetryAfter))
+		}
+		if err != nil {
+			writeTemperatureError(w, r, city, err)
+			return
+		}
+		setCacheHeaders(w, result)
+		observation = WeatherObservation{
+			Temperature:   result.Temperature,
+			ConditionCode: result.ConditionCode,
+			Description:   conditionDescription(descriptionLanguage(r), result.Observation),
+			Timestamp:     result.FetchedAt.UTC().Format(time.RFC3339),
+			Source:        result.Source,
+		}
+		if result.Humidity >= 0 {
+			humidity := result.Humidity
+			observation.Humidity = &humidity
+		}
+		if result.WindSpeed >= 0 {
+			wind := result.WindSpeed
+			observation.WindSpeed = &wind
+		}
+		if located {
+			observation.Latitude, observation.Longitude = &lat, &lon
+		}
+		observation.Lineage = providerLineage(city, result)
+	}
+	observation.City = locationLabel(city)
+
+	humidity, wind := -1.0, -1.0
+	if observation.Humidity != nil {
+		humidity = *observation.Humidity
+	}
+	if observation.WindSpeed != nil {
+		wind = *observation.WindSpeed
+	}
+	comfort := comfortMetrics(observation.Temperature, humidity, wind).in(units)
+	observation.Comfort = &comfort
+
+	observation.Unit = "celsius"
+	if units == unitsImperial {
+		observation.Temperature = celsiusToFahrenheit(observation.Temperature)
+		observation.Unit = "fahrenheit"
+		if observation.WindSpeed != nil {
+			mph := metersPerSecondToMph(*observation.WindSpeed)
+			observation.WindSpeed = &mph
+		}
+		observation.Lineage.Steps = append(observation.Lineage.Steps, "converted celsius to fahrenheit")
+	}
+	observation.Temperature = math.Round(observation.Temperature*100) / 100
+	if observation.Humidity != nil {
+		h := math.Round(*observation.Humidity*10) / 10
+		observation.Humidity = &h
+	}
+	if observation.WindSpeed != nil {
+		v := math.Round(*observation.WindSpeed*10) / 10
+		observation.WindSpeed = &v
+	}
+	observation.Lineage.Steps = append(observation.Lineage.Steps, "rounded temperature to 0.01, humidity and wind speed to 0.1")
+	if !debugLineage {
+		observation.Lineage = nil
+	}
+
+	if !writeResponse(w, r, http.StatusOK, observation) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}
+
+// providerLineage describes a value that came from the weather provider,
+// directly or through the observation cache.
+func providerLineage(city string, result weatherResult) *Lineage {
+	provider := weatherProviderName()
+	raw := &LineageValue{Temperature: result.Temperature, ConditionCode: result.ConditionCode}
+	if result.Humidity >= 0 {
+		humidity := result.Humidity
+		raw.Humidity = &humidity
+	}
+	if result.WindSpeed >= 0 {
+		wind := result.WindSpeed
+		raw.WindSpeed = &wind
+	}
+	lineage := &Lineage{
+		Source:          "provider",
+		Provider:        provider,
+		Raw:             raw,
+		FetchedAt:       result.FetchedAt.UTC(),
+		CacheHit:        result.Source == "cache",
+		CacheAgeSeconds: math.Round(time.Since(result.FetchedAt).Seconds()),
+		QuotaFallback:   result.Source == "cache" && result.RetryAfter > 0,
+		Anomaly:         anomalies.Kind(city),
+		Smoothing:       "none",
+	}
+	switch {
+	case lineage.QuotaFallback:
+		lineage.Steps = append(lineage.Steps, "served the last cached observation because the provider quota is exhausted")
+	case lineage.CacheHit:
+		lineage.Steps = append(lineage.Steps, "served from the observation cache (younger than WEATHER_CACHE_TTL)")
+	default:
+		lineage.Steps = append(lineage.Steps, "fetched from the provider")
+	}
+	if lineage.Anomaly != "" {
+		lineage.Steps = append(lineage.Steps, "flagged the latest fetched observation as anomalous ("+lineage.Anomaly+")")
+	}
+	return lineage
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultWeatherAPIBaseURL = "https://api.weatherapi.com"
+
+// weatherAPIConditions maps WeatherAPI.com condition codes to OpenWeatherMap
+// condition codes.
+var weatherAPIConditions = map[int]int{
+	1000: 800, 1003: 802, 1006: 803, 1009: 804,
+	1030: 701, 1135: 741, 1147: 741,
+	1063: 500, 1066: 600, 1069: 611, 1072: 511, 1087: 210,
+	1114: 601, 1117: 602,
+	1150: 300, 1153: 300, 1168: 511, 1171: 511,
+	1180: 500, 1183: 500, 1186: 501, 1189: 501, 1192: 502, 1195: 502,
+	1198: 511, 1201: 511, 1204: 611, 1207: 611,
+	1210: 600, 1213: 600, 1216: 601, 1219: 601, 1222: 602, 1225: 602, 1237: 611,
+	1240: 520, 1243: 521, 1246: 522, 1249: 613, 1252: 613,
+	1255: 621, 1258: 622, 1261: 611, 1264: 611,
+	1273: 200, 1276: 201, 1279: 211, 1282: 211,
+}
+
+// WeatherAPI.com error codes, sent with status 400, 401 or 403.
+const (
+	weatherAPINoLocation    = 1006
+	weatherAPIQuotaExceeded = 2007
+)
+
+// weatherAPIProvider uses the WeatherAPI.com current conditions endpoint
+// with the key in WEATHERAPI_KEY.
+type weatherAPIProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func newWeatherAPIProvider(cfg *Config) (*weatherAPIProvider, error) {
+	apiKey := cfg.WeatherAPIComKey
+	if apiKey == "" {
+		return nil, fmt.Errorf("WEATHERAPI_KEY is required for the weatherapi provider")
+	}
+	baseURL := cfg.WeatherAPIComBaseURL
+	return &weatherAPIProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: tracedUpstream},
+	}, nil
+}
+
+func (p *weatherAPIProvider) Current(ctx context.Context, city string) (Observation, error) {
+	query := city
+	if code, _, ok := splitZip(city); ok {
+		// WeatherAPI.com recognises US ZIP, UK and Canadian postal codes
+		// by their format and takes no country.
+		query = code
+	} else if c, ok := cities.Lookup(city); ok {
+		query = strconv.FormatFloat(c.Latitude, 'f', 4, 64) + "," + strconv.FormatFloat(c.Longitude, 'f', 4, 64)
+	}
+	params := url.Values{"key": {p.apiKey}, "q": {query}, "lang": {weatherLang()}}
+
+	upstreamCallsTotal.Inc()
+	resp, err := upstreamGet(ctx, p.client, p.baseURL+"/v1/current.json?"+params.Encode())
+	if err != nil {
+		return Observation{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Current *struct {
+			TempC     *float64 `json:"temp_c"`
+			Humidity  *float64 `json:"humidity"`
+			WindKph   *float64 `json:"wind_kph"`
+			Condition struct {
+				Code int    `json:"code"`
+				Text string `json:"text"`
+			} `json:"condition"`
+		} `json:"current"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+
+	switch {
+	case body.Error != nil && body.Error.Code == weatherAPINoLocation:
+		return Observation{}, fmt.Errorf("%w: %s", ErrCityNotFound, city)
+	case body.Error != nil && body.Error.Code == weatherAPIQuotaExceeded:
+		// The monthly quota resets at the start of the next month; ask
+		// again in an hour rather than hammering the API until then.
+		return Observation{}, &QuotaError{RetryAfter: time.Hour}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return Observation{}, &QuotaError{RetryAfter: retryAfterHeader(resp)}
+	case body.Error != nil:
+		return Observation{}, fmt.Errorf("%w: WeatherAPI.com error %d: %s", ErrProviderUnavailable, body.Error.Code, body.Error.Message)
+	case resp.StatusCode != http.StatusOK:
+		return Observation{}, fmt.Errorf("%w: WeatherAPI.com returned status %d", ErrProviderUnavailable, resp.StatusCode)
+	case decodeErr != nil || body.Current == nil || body.Current.TempC == nil:
+		return Observation{}, fmt.Errorf("%w: invalid WeatherAPI.com response", ErrProviderUnavailable)
+	}
+
+	observation := Observation{
+		Temperature:     *body.Current.TempC,
+		Humidity:        -1,
+		WindSpeed:       -1,
+		ConditionCode:   weatherAPIConditions[body.Current.Condition.Code],
+		Description:     body.Current.Condition.Text,
+		DescriptionLang: weatherLang(),
+	}
+	if body.Current.Humidity != nil {
+		observation.Humidity = *body.Current.Humidity
+	}
+	if body.Current.WindKph != nil {
+		observation.WindSpeed = *body.Current.WindKph / 3.6
+	}
+	return observation, nil
+}
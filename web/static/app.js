@@ -0,0 +1,214 @@
+// The server renders the city, language, refresh interval and translated
+// messages into the page.
+const page = document.body.dataset;
+let city = page.city;
+// ?units= wins over the units last chosen with the toggle.
+let units = page.units || localStorage.getItem('units') || 'metric';
+let unitSymbol = units === 'imperial' ? '°F' : '°C';
+// Trip forecasts are in Celsius only.
+const fromCelsius = c => units === 'imperial' ? c * 9 / 5 + 32 : c;
+// Query parameters of every API call: units and the page language.
+const apiParams = () => 'units=' + units + '&lang=' + page.lang;
+// Requests that change something carry the CSRF token of a login session.
+const csrfHeaders = page.csrf ? {'X-CSRF-Token': page.csrf} : {};
+// Window of the history chart, chosen with the range buttons.
+let chartWindow = '24h';
+let themes = {};
+// Widgets stay hidden unless /api/capabilities says the deployment
+// serves what they need.
+let features = {};
+fetch('/api/capabilities')
+    .then(response => response.ok ? response.json() : {})
+    .then(caps => {
+        features = caps.features || {};
+        updatePanels();
+    });
+fetch('/api/themes', {headers: {'Accept-Language': page.lang}})
+    .then(response => response.ok ? response.json() : [])
+    .then(list => {
+        list.forEach(t => { themes[t.token] = t; });
+        applyTheme(document.body.dataset.theme);
+        updateCards();
+    });
+// The dark color scheme keeps its colors; the weather theme only changes
+// the icon there.
+const darkScheme = () => document.documentElement.dataset.colorScheme === 'dark' ||
+    (document.documentElement.dataset.colorScheme === 'auto' && matchMedia('(prefers-color-scheme: dark)').matches);
+function applyTheme(token) {
+    const theme = themes[token];
+    const colors = theme && !darkScheme();
+    document.body.dataset.theme = token || '';
+    document.body.style.background = colors ? theme.background : '';
+    document.body.style.color = colors ? theme.foreground : '';
+    document.getElementById('icon').textContent = theme ? theme.icon : '';
+    document.getElementById('icon').title = theme ? theme.label : '';
+}
+function showPanel(id, text) {
+    const panel = document.getElementById(id);
+    panel.textContent = text || '';
+    panel.hidden = !text;
+}
+function updatePanels() {
+    if (features.history) {
+        fetch('/api/temperature/stats?window=24h&' + apiParams() + '&city=' + encodeURIComponent(city))
+            .then(response => response.ok ? response.json() : {})
+            .then(stats => showPanel('history', stats.count ? '24h: ' + stats.min.toFixed(1) + '…' + stats.max.toFixed(1) + unitSymbol : ''))
+            .catch(() => showPanel('history', ''));
+        updateChart();
+        updateTrends();
+    }
+    if (features.forecast) {
+        const tomorrow = new Date(Date.now() + 86400000);
+        const date = tomorrow.getFullYear() + '-' + String(tomorrow.getMonth() + 1).padStart(2, '0') + '-' + String(tomorrow.getDate()).padStart(2, '0');
+        fetch('/api/trip', {method: 'POST', headers: csrfHeaders, body: JSON.stringify({legs: [{city: city, date: date}]})})
+            .then(response => response.ok ? response.json() : {})
+            .then(trip => {
+                const f = trip.legs && trip.legs[0].forecast;
+                showPanel('forecast', f ? '⏭ ' + fromCelsius(f.min_temperature).toFixed(0) + '…' + fromCelsius(f.max_temperature).toFixed(0) + unitSymbol + ', ☔ ' + f.rain_probability.toFixed(0) + '%' : '');
+            })
+            .catch(() => showPanel('forecast', ''));
+    }
+}
+function updateChart() {
+    fetch('/api/temperature/history?window=' + chartWindow + '&' + apiParams() + '&city=' + encodeURIComponent(city))
+        .then(response => response.ok ? response.json() : {points: []})
+        .then(series => {
+            document.getElementById('chart-panel').hidden = false;
+            drawChart(document.getElementById('chart'), series.points, unitSymbol);
+        })
+        .catch(() => { document.getElementById('chart-panel').hidden = true; });
+}
+document.getElementById('ranges').addEventListener('click', event => {
+    const button = event.target.closest('button');
+    if (!button) return;
+    chartWindow = button.dataset.window;
+    document.querySelectorAll('#ranges button').forEach(b => b.classList.toggle('selected', b === button));
+    updateChart();
+});
+// The grid shows a card for every city the server collects, with the
+// trend over the last three hours when history is available.
+const cards = Array.from(document.querySelectorAll('.card'));
+function updateCards() {
+    cards.forEach(card => {
+        card.classList.toggle('selected', card.dataset.city === city);
+        fetch('/api/temperature?' + apiParams() + '&city=' + encodeURIComponent(card.dataset.city))
+            .then(response => response.json())
+            .then(data => {
+                const theme = themes[data.theme];
+                card.querySelector('.card-icon').textContent = theme ? theme.icon : '';
+                card.querySelector('.card-icon').title = theme ? theme.label : '';
+                card.querySelector('.card-temp').textContent = data.temperature === undefined ? '—' :
+                    data.temperature.toFixed(1) + unitSymbol + ' ' + (card.dataset.trend || '');
+            })
+            .catch(() => { card.querySelector('.card-temp').textContent = '—'; });
+    });
+}
+function updateTrends() {
+    cards.forEach(card => {
+        fetch('/api/temperature/history?window=3h&resolution=raw&' + apiParams() + '&city=' + encodeURIComponent(card.dataset.city))
+            .then(response => response.ok ? response.json() : {points: []})
+            .then(series => {
+                const p = series.points;
+                const change = p.length > 1 ? p[p.length - 1].temperature - p[0].temperature : 0;
+                card.dataset.trend = p.length < 2 ? '' : change > 0.5 ? '↑' : change < -0.5 ? '↓' : '→';
+            });
+    });
+}
+document.querySelectorAll('.card').forEach(card => card.addEventListener('click', () => {
+    city = card.dataset.city;
+    input.value = '';
+    updateTemperature();
+    updatePanels();
+    updateCards();
+}));
+function showTemperature(data) {
+    if (data.temperature === undefined) {
+        const names = (data.suggestions || []).map(c => c.name + ',' + c.country);
+        document.getElementById('temp').textContent = data.detail;
+        document.getElementById('condition').textContent = names.length ? names.join(' · ') : '';
+        applyTheme('');
+        return;
+    }
+    document.getElementById('temp').textContent = data.temperature.toFixed(1) + unitSymbol;
+    document.getElementById('condition').textContent = (data.display && data.display.condition) || '';
+    applyTheme(data.theme);
+    lastUpdate = new Date(data.timestamp);
+    showStatus(true);
+    localStorage.setItem(lastReadingKey(), JSON.stringify(data));
+}
+// The last reading of each city is kept, so that the page shows it while
+// the stream connects or when offline.
+const lastReadingKey = () => 'last:' + units + ':' + city;
+function showLastReading() {
+    const data = JSON.parse(localStorage.getItem(lastReadingKey()) || 'null');
+    if (!data) return;
+    showTemperature(data);
+    showStatus(false);
+}
+// The temperature arrives over /api/temperature/stream. EventSource
+// reconnects by itself after a dropped connection; a stream the server
+// refused is retried here with a growing delay.
+let stream, lastUpdate, retryDelay = 1000, retryTimer;
+function showStatus(live) {
+    const time = lastUpdate ? lastUpdate.toLocaleTimeString(page.lang) : '—';
+    document.getElementById('status').textContent = (live ? page.msgUpdated : page.msgConnectionLost).replace('{time}', time);
+    document.getElementById('temp').classList.toggle('stale', !live);
+}
+function updateTemperature() {
+    if (stream) stream.close();
+    clearTimeout(retryTimer);
+    showLastReading();
+    stream = new EventSource('/api/temperature/stream?' + apiParams() + '&city=' + encodeURIComponent(city));
+    stream.addEventListener('observation', event => {
+        retryDelay = 1000;
+        showTemperature(JSON.parse(event.data));
+    });
+    stream.addEventListener('problem', event => showTemperature(JSON.parse(event.data)));
+    stream.addEventListener('error', () => {
+        showStatus(false);
+        if (stream.readyState === EventSource.CLOSED) {
+            retryTimer = setTimeout(updateTemperature, retryDelay);
+            retryDelay = Math.min(retryDelay * 2, 60000);
+        }
+    });
+}
+const input = document.getElementById('city');
+let typing;
+input.addEventListener('input', () => {
+    clearTimeout(typing);
+    if (!features.city_search || input.value.length < 2) return;
+    typing = setTimeout(() => {
+        fetch('/api/cities?limit=5&q=' + encodeURIComponent(input.value))
+            .then(response => response.ok ? response.json() : [])
+            .then(found => {
+                document.getElementById('suggestions').replaceChildren(...found.map(c => {
+                    const option = document.createElement('option');
+                    option.value = c.name + ',' + c.country;
+                    return option;
+                }));
+            });
+    }, 300);
+});
+document.getElementById('picker').addEventListener('submit', event => {
+    event.preventDefault();
+    city = input.value.trim() || page.city;
+    updateTemperature();
+    updatePanels();
+    updateCards();
+});
+updateTemperature();
+const unitsButton = document.getElementById('units');
+unitsButton.textContent = unitSymbol;
+unitsButton.addEventListener('click', () => {
+    units = units === 'imperial' ? 'metric' : 'imperial';
+    unitSymbol = units === 'imperial' ? '°F' : '°C';
+    unitsButton.textContent = unitSymbol;
+    localStorage.setItem('units', units);
+    updateTemperature();
+    updatePanels();
+    updateCards();
+});
+updateCards();
+if ('serviceWorker' in navigator) navigator.serviceWorker.register('/sw.js');
+setInterval(updateCards, page.refresh * 1000);
+setInterval(updatePanels, 600000);
@@ -0,0 +1,47 @@
+// A minimal SVG line chart for the temperature history, so that the page
+// needs no third-party charting library or CDN.
+const svgNS = 'http://www.w3.org/2000/svg';
+
+function svgElement(name, attrs, text) {
+    const el = document.createElementNS(svgNS, name);
+    for (const [key, value] of Object.entries(attrs)) el.setAttribute(key, value);
+    if (text !== undefined) el.textContent = text;
+    return el;
+}
+
+// drawChart draws points ({timestamp, temperature, min?, max?}) into svg,
+// with the min–max band of hourly and daily points behind the line.
+function drawChart(svg, points, unitSymbol) {
+    const width = 600, height = 200, left = 40, right = 10, top = 10, bottom = 24;
+    svg.setAttribute('viewBox', '0 0 ' + width + ' ' + height);
+    svg.replaceChildren();
+    if (points.length < 2) {
+        svg.append(svgElement('text', {x: width / 2, y: height / 2, 'text-anchor': 'middle', class: 'chart-label'}, '—'));
+        return;
+    }
+    const times = points.map(p => Date.parse(p.timestamp));
+    const lows = points.map(p => p.min !== undefined ? p.min : p.temperature);
+    const highs = points.map(p => p.max !== undefined ? p.max : p.temperature);
+    const t0 = times[0], t1 = times[times.length - 1];
+    let lo = Math.floor(Math.min(...lows)), hi = Math.ceil(Math.max(...highs));
+    if (lo === hi) { lo--; hi++; }
+    const x = t => left + (t - t0) / (t1 - t0) * (width - left - right);
+    const y = v => top + (hi - v) / (hi - lo) * (height - top - bottom);
+
+    for (const v of [lo, (lo + hi) / 2, hi]) {
+        svg.append(svgElement('line', {x1: left, x2: width - right, y1: y(v), y2: y(v), class: 'chart-grid'}));
+        svg.append(svgElement('text', {x: left - 4, y: y(v) + 4, 'text-anchor': 'end', class: 'chart-label'}, v.toFixed(0) + unitSymbol));
+    }
+    const long = t1 - t0 > 2 * 86400000, lang = document.documentElement.lang;
+    for (const t of [t0, (t0 + t1) / 2, t1]) {
+        const d = new Date(t);
+        const label = long ? d.toLocaleDateString(lang, {day: 'numeric', month: 'short'}) : d.toLocaleTimeString(lang, {hour: '2-digit', minute: '2-digit'});
+        svg.append(svgElement('text', {x: x(t), y: height - 6, 'text-anchor': t === t0 ? 'start' : t === t1 ? 'end' : 'middle', class: 'chart-label'}, label));
+    }
+    if (points.some(p => p.min !== undefined)) {
+        const band = times.map((t, i) => x(t) + ',' + y(highs[i]))
+            .concat(times.map((t, i) => x(t) + ',' + y(lows[i])).reverse());
+        svg.append(svgElement('polygon', {points: band.join(' '), class: 'chart-band'}));
+    }
+    svg.append(svgElement('polyline', {points: times.map((t, i) => x(t) + ',' + y(points[i].temperature)).join(' '), class: 'chart-line'}));
+}
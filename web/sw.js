@@ -0,0 +1,40 @@
+// Service worker of the built-in page. It keeps the page, its static
+// files and the last /api/temperature responses, so that an installed
+// dashboard still opens and shows the last known reading when offline.
+const CACHE = '{{.Cache}}';
+const ASSETS = [{{range $i, $a := .Assets}}{{if $i}}, {{end}}'{{$a}}'{{end}}];
+
+self.addEventListener('install', event => {
+    event.waitUntil(caches.open(CACHE).then(cache => cache.addAll(ASSETS)).then(() => self.skipWaiting()));
+});
+self.addEventListener('activate', event => {
+    event.waitUntil(caches.keys()
+        .then(keys => Promise.all(keys.filter(key => key !== CACHE).map(key => caches.delete(key))))
+        .then(() => self.clients.claim()));
+});
+// Network first, falling back to the last response kept in the cache.
+function networkFirst(request, fallback) {
+    return fetch(request)
+        .then(response => {
+            if (response.ok) {
+                const copy = response.clone();
+                caches.open(CACHE).then(cache => cache.put(request, copy));
+            }
+            return response;
+        })
+        .catch(() => caches.match(request).then(cached => cached || (fallback && caches.match(fallback))));
+}
+self.addEventListener('fetch', event => {
+    const request = event.request;
+    const url = new URL(request.url);
+    if (request.method !== 'GET' || url.origin !== location.origin) return;
+    if (request.mode === 'navigate') {
+        event.respondWith(networkFirst(request, '/'));
+    } else if (url.pathname.startsWith('/static/')) {
+        // Hashed names never change content.
+        event.respondWith(caches.match(request).then(cached => cached || fetch(request)));
+    } else if (url.pathname === '/api/temperature') {
+        event.respondWith(networkFirst(request));
+    }
+    // Everything else, the stream among it, goes to the network as usual.
+});
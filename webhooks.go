@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webhookDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Total number of webhook delivery attempts by outcome",
+		},
+		[]string{"status"},
+	)
+
+	webhookSubscriptionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_subscriptions",
+			Help: "Number of active webhook subscriptions",
+		},
+	)
+
+	webhookDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_notifications_dropped_total",
+			Help: "Total number of webhook events given up on by reason (queue_full, retry_budget, failed)",
+		},
+		[]string{"reason"},
+	)
+
+	webhookInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_deliveries_in_flight",
+			Help: "Number of webhook requests currently being sent",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveriesTotal)
+	prometheus.MustRegister(webhookSubscriptionsGauge)
+	prometheus.MustRegister(webhookDroppedTotal)
+	prometheus.MustRegister(webhookInFlightGauge)
+}
+
+const (
+	webhookAttempts    = 4
+	webhookMaxFailures = 5
+	webhookQueueSize   = 16
+)
+
+var errWebhookDestination = errors.New("webhook destination is a private address")
+
+// deliverySlots bounds how many webhook requests are in flight at once, so
+// a few slow subscribers cannot tie up connections and memory for everyone.
+// The limit is WEBHOOK_CONCURRENCY, read on every acquire so it can be
+// changed while running.
+type deliverySlots struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	used  int
+}
+
+func newDeliverySlots() *deliverySlots {
+	s := &deliverySlots{}
+	s.freed = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *deliverySlots) Acquire() {
+	s.mu.Lock()
+	for s.used >= runningConfig().WebhookConcurrency {
+		s.freed.Wait()
+	}
+	s.used++
+	s.mu.Unlock()
+	webhookInFlightGauge.Inc()
+}
+
+func (s *deliverySlots) Release() {
+	s.mu.Lock()
+	s.used--
+	s.mu.Unlock()
+	s.freed.Signal()
+	webhookInFlightGauge.Dec()
+}
+
+// retryBudget caps retries at a share of first attempts: every event
+// deposits WEBHOOK_RETRY_RATIO tokens, every retry spends one, and at most
+// retryBudgetMax tokens are saved up. While many subscribers fail together
+// retries stop quickly instead of multiplying the outbound traffic.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+const retryBudgetMax = 10
+
+func webhookRetryRatio() float64 {
+	return runningConfig().WebhookRetryRatio
+}
+
+func (b *retryBudget) Deposit() {
+	b.mu.Lock()
+	b.tokens = math.Min(retryBudgetMax, b.tokens+webhookRetryRatio())
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var (
+	webhookSlots   = newDeliverySlots()
+	webhookRetries = &retryBudget{tokens: retryBudgetMax}
+)
+
+// webhookClient refuses to connect to loopback, private, shared (CGNAT)
+// and link-local addresses unless WEBHOOK_ALLOW_PRIVATE is set, so
+// subscriptions cannot be used to probe the internal network. It goes
+// through the upstream proxy like every other outbound call.
+var webhookClient = &http.Client{
+	Timeout:       10 * time.Second,
+	Transport:     webhookGuard{webhookTransport},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// webhookTransport shares the proxy of upstreamTransport; configureUpstream
+// gives it the CA settings. Direct connections are checked as they are
+// dialed, which also covers every address a name resolves to.
+var webhookTransport = &http.Transport{
+	Proxy:               func(req *http.Request) (*url.URL, error) { return upstreamTransport.Proxy(req) },
+	DialContext:         webhookDial,
+	ForceAttemptHTTP2:   true,
+	MaxIdleConns:        100,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// webhookProxiedKey marks requests that go through a proxy, whose own
+// address is not subject to the guard.
+type webhookProxiedKey struct{}
+
+// webhookGuard checks the target of proxied requests before handing them to
+// the proxy, which would otherwise connect to it on our behalf.
+type webhookGuard struct{ next http.RoundTripper }
+
+func (g webhookGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxy, err := upstreamTransport.Proxy(req)
+	if err != nil || proxy == nil || runningConfig().WebhookAllowPrivate {
+		return g.next.RoundTrip(req)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if webhookBlockedIP(addr.IP) {
+			return nil, errWebhookDestination
+		}
+	}
+	return g.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), webhookProxiedKey{}, true)))
+}
+
+func webhookDial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if ctx.Value(webhookProxiedKey{}) == nil {
+		dialer.Control = webhookDialControl
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if runningConfig().WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if webhookBlockedIP(net.ParseIP(host)) {
+		return errWebhookDestination
+	}
+	return nil
+}
+
+// sharedAddressSpace is 100.64.0.0/10, used by carrier-grade NAT and by
+// many cloud providers for internal services.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func webhookBlockedIP(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Subscription types: new observations, changes of the forecast for one
+// day, or sunrise, sunset and twilight at the subscription's location.
+const (
+	subscriptionObservation    = "observation"
+	subscriptionForecastChange = "forecast_change"
+	subscriptionSunEvent       = "sun_event"
+)
+
+// Subscription is a registered callback. The secret is only returned when
+// the subscription is created.
+type Subscription struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	URL       string    `json:"url"`
+	City      string    `json:"city"`
+	Threshold float64   `json:"threshold,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Template, when set, renders the body of each notification from the
+	// event instead of sending the event as JSON.
+	Template string `json:"template,omitempty"`
+
+	// Forecast change subscriptions: the day watched and how much its rain
+	// probability (percentage points) or maximum temperature (°C) must move.
+	Day                   string  `json:"day,omitempty"`
+	RainProbabilityChange float64 `json:"rain_probability_change,omitempty"`
+	MaxTemperatureChange  float64 `json:"max_temperature_change,omitempty"`
+
+	// Sun event subscriptions: the event, how long before (negative) or
+	// after it to notify, and where. NextAt is when the next notification
+	// is due.
+	Event     string     `json:"event,omitempty"`
+	Offset    string     `json:"offset,omitempty"`
+	Latitude  *float64   `json:"latitude,omitempty"`
+	Longitude *float64   `json:"longitude,omitempty"`
+	NextAt    *time.Time `json:"next_at,omitempty"`
+
+	// tmpl is Template, parsed once when the subscription is created.
+	tmpl     *template.Template
+	queue    chan any
+	lastSent *float64
+	// baseline is the forecast the subscriber was last told about, or the
+	// first one fetched.
+	baseline *DayForecast
+	offset   time.Duration
+	// nextEvent is the time of the sun event NextAt belongs to.
+	nextEvent time.Time
+}
+
+// WebhookEvent is the JSON body POSTed to subscribers.
+type WebhookEvent struct {
+	SubscriptionID string    `json:"subscription_id"`
+	City           string    `json:"city"`
+	Temperature    float64   `json:"temperature"`
+	Humidity       float64   `json:"humidity"`
+	ConditionCode  int       `json:"condition_code"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// SunEventNotification is POSTed offset before or after a sun event.
+// EventTime is when the event itself happens.
+type SunEventNotification struct {
+	SubscriptionID string    `json:"subscription_id"`
+	Type           string    `json:"type"`
+	City           string    `json:"city,omitempty"`
+	Event          string    `json:"event"`
+	Offset         string    `json:"offset,omitempty"`
+	EventTime      time.Time `json:"event_time"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// ForecastChangeEvent is POSTed when the forecast for a subscribed day moved
+// past one of the subscription's thresholds.
+type ForecastChangeEvent struct {
+	SubscriptionID string      `json:"subscription_id"`
+	Type           string      `json:"type"`
+	City           string      `json:"city"`
+	Previous       DayForecast `json:"previous"`
+	Current        DayForecast `json:"current"`
+	Timestamp      time.Time   `json:"timestamp"`
+}
+
+type webhookStore struct {
+	mu            sync.RWMutex
+	subscriptions map[string]*Subscription
+}
+
+var webhooks = &webhookStore{subscriptions: make(map[string]*Subscription)}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *webhookStore) Add(sub *Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscriptions) >= runningConfig().WebhookMaxSubscriptions {
+		return false
+	}
+	sub.queue = make(chan any, webhookQueueSize)
+	s.subscriptions[sub.ID] = sub
+	webhookSubscriptionsGauge.Set(float64(len(s.subscriptions)))
+	go s.deliverLoop(sub)
+	switch sub.Type {
+	case subscriptionForecastChange:
+		select {
+		case forecastWake <- struct{}{}:
+		default:
+		}
+	case subscriptionSunEvent:
+		sub.scheduleSunEvent(time.Now())
+		select {
+		case sunWake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// scheduleSunEvent sets NextAt to the first notification due after after.
+func (sub *Subscription) scheduleSunEvent(after time.Time) {
+	at, eventTime, ok := nextSunEvent(sub.Event, sub.offset, *sub.Latitude, *sub.Longitude, after)
+	if !ok {
+		sub.NextAt, sub.nextEvent = nil, time.Time{}
+		return
+	}
+	sub.NextAt, sub.nextEvent = &at, eventTime
+}
+
+func (s *webhookStore) Get(id string) (Subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return Subscription{}, false
+	}
+	public := *sub
+	public.Secret = ""
+	return public, true
+}
+
+func (s *webhookStore) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[id]
+	if ok {
+		delete(s.subscriptions, id)
+		close(sub.queue)
+		webhookSubscriptionsGauge.Set(float64(len(s.subscriptions)))
+	}
+	return ok
+}
+
+// Notify queues a new observation for every subscriber of city whose
+// threshold it crosses. It never blocks: a subscriber whose queue is full
+// misses the event, so slow subscribers cannot hold up the poller.
+func (s *webhookStore) Notify(city string, result weatherResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subscriptions {
+		if sub.Type != subscriptionObservation || !strings.EqualFold(sub.City, city) {
+			continue
+		}
+		if sub.lastSent != nil && math.Abs(result.Temperature-*sub.lastSent) < sub.Threshold {
+			continue
+		}
+		event := WebhookEvent{
+			SubscriptionID: sub.ID,
+			City:           city,
+			Temperature:    result.Temperature,
+			Humidity:       result.Humidity,
+			ConditionCode:  result.ConditionCode,
+			Timestamp:      result.FetchedAt,
+		}
+		select {
+		case sub.queue <- event:
+			temperature := result.Temperature
+			sub.lastSent = &temperature
+		default:
+			webhookDeliveriesTotal.WithLabelValues("dropped").Inc()
+			webhookDroppedTotal.WithLabelValues("queue_full").Inc()
+		}
+	}
+}
+
+// ForecastCities lists the cities watched by forecast change subscriptions.
+func (s *webhookStore) ForecastCities() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]bool)
+	var list []string
+	for _, sub := range s.subscriptions {
+		if sub.Type == subscriptionForecastChange && !seen[strings.ToLower(sub.City)] {
+			seen[strings.ToLower(sub.City)] = true
+			list = append(list, sub.City)
+		}
+	}
+	return list
+}
+
+// NotifyForecast compares the new forecast with the baseline of every
+// forecast change subscription for its city. The first forecast of a day
+// becomes the baseline; later ones notify when they differ from it by a
+// threshold and then replace it, so slow drift is reported as well as jumps.
+func (s *webhookStore) NotifyForecast(forecast Forecast, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subscriptions {
+		if sub.Type != subscriptionForecastChange || !strings.EqualFold(sub.City, forecast.City) {
+			continue
+		}
+		date := sub.Day
+		if offset, ok := strings.CutPrefix(sub.Day, "+"); ok {
+			n, _ := strconv.Atoi(offset)
+			date = forecast.Date(now, n)
+		}
+		day, ok := forecast.Day(date)
+		if !ok {
+			continue
+		}
+		if sub.baseline == nil || sub.baseline.Date != day.Date {
+			sub.baseline = &day
+			continue
+		}
+		if math.Abs(day.RainProbability-sub.baseline.RainProbability) < sub.RainProbabilityChange &&
+			math.Abs(day.MaxTemperature-sub.baseline.MaxTemperature) < sub.MaxTemperatureChange {
+			continue
+		}
+		event := ForecastChangeEvent{
+			SubscriptionID: sub.ID,
+			Type:           subscriptionForecastChange,
+			City:           locationLabel(sub.City),
+			Previous:       *sub.baseline,
+			Current:        day,
+			Timestamp:      now.UTC(),
+		}
+		select {
+		case sub.queue <- event:
+			sub.baseline = &day
+		default:
+			webhookDeliveriesTotal.WithLabelValues("dropped").Inc()
+			webhookDroppedTotal.WithLabelValues("queue_full").Inc()
+		}
+	}
+}
+
+// FireSunEvents queues notifications for sun event subscriptions that are
+// due at now and schedules their next ones. Events missed while the process
+// was not running are skipped. It returns when the next notification is
+// due, or the zero time if none is pending.
+func (s *webhookStore) FireSunEvents(now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, sub := range s.subscriptions {
+		if sub.Type != subscriptionSunEvent {
+			continue
+		}
+		if sub.NextAt == nil {
+			// Polar day or night: look again once the hourly wake-up
+			// comes round.
+			sub.scheduleSunEvent(now)
+		} else if !sub.NextAt.After(now) {
+			event := SunEventNotification{
+				SubscriptionID: sub.ID,
+				Type:           subscriptionSunEvent,
+				City:           locationLabel(sub.City),
+				Event:          sub.Event,
+				Offset:         sub.Offset,
+				EventTime:      sub.nextEvent,
+				Timestamp:      now.UTC(),
+			}
+			select {
+			case sub.queue <- event:
+			default:
+				webhookDeliveriesTotal.WithLabelValues("dropped").Inc()
+				webhookDroppedTotal.WithLabelValues("queue_full").Inc()
+			}
+			sub.scheduleSunEvent(now)
+		}
+		if sub.NextAt != nil && (next.IsZero() || sub.NextAt.Before(next)) {
+			next = *sub.NextAt
+		}
+	}
+	return next
+}
+
+// deliverLoop sends queued events in order. A subscription is removed when
+// the subscriber answers 410 Gone or several events in a row fail.
+func (s *webhookStore) deliverLoop(sub *Subscription) {
+	failures := 0
+	for {
+		var event any
+		select {
+		case e, ok := <-sub.queue:
+			if !ok {
+				return
+			}
+			event = e
+		case <-backgroundJobs.Done():
+			return
+		}
+		err := deliverWebhook(sub, event)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if errors.Is(err, errRetryBudget) {
+			webhookDroppedTotal.WithLabelValues("retry_budget").Inc()
+		} else if !errors.Is(err, errWebhookGone) {
+			webhookDroppedTotal.WithLabelValues("failed").Inc()
+		}
+		logError("Webhook delivery to subscription %s failed: %v", sub.ID, err)
+		if errors.Is(err, errWebhookGone) || failures >= webhookMaxFailures {
+			log.Printf("Removing dead webhook subscription %s", sub.ID)
+			s.Remove(sub.ID)
+		}
+	}
+}
+
+var (
+	errWebhookGone = errors.New("subscriber answered 410 Gone")
+	errRetryBudget = errors.New("webhook retry budget exhausted")
+)
+
+// deliverWebhook POSTs event with exponential backoff between attempts. The
+// body is signed as in "X-Webhook-Signature: t=<unix>,v1=<hex>", where v1 is
+// HMAC-SHA256(secret, "<t>.<body>"). A subscription with a template gets the
+// rendered template as the body instead of the event. Each attempt waits for a delivery slot;
+// retries also need a token from the retry budget.
+func deliverWebhook(sub *Subscription, event any) error {
+	body, err := json.Marshal(event)
+	contentType := "application/json"
+	if err == nil && sub.tmpl != nil {
+		body, contentType, err = renderNotification(sub.tmpl, event)
+	}
+	if err != nil {
+		return err
+	}
+
+	webhookRetries.Deposit()
+	var lastErr error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			if !webhookRetries.Withdraw() {
+				return fmt.Errorf("%w (last error: %v)", errRetryBudget, lastErr)
+			}
+			time.Sleep(time.Duration(1<<(2*(attempt-1))) * time.Second)
+		}
+
+		timestamp := fmt.Sprint(time.Now().Unix())
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+
+		req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+		webhookSlots.Acquire()
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		webhookSlots.Release()
+		if err != nil {
+			webhookDeliveriesTotal.WithLabelValues("error").Inc()
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			webhookDeliveriesTotal.WithLabelValues("success").Inc()
+			return nil
+		case resp.StatusCode == http.StatusGone:
+			webhookDeliveriesTotal.WithLabelValues("gone").Inc()
+			return errWebhookGone
+		}
+		webhookDeliveriesTotal.WithLabelValues("error").Inc()
+		lastErr = fmt.Errorf("subscriber returned status %d", resp.StatusCode)
+	}
+	return lastErr
+}
+
+type subscriptionRequest struct {
+	Type      string  `json:"type"`
+	URL       string  `json:"url"`
+	City      string  `json:"city"`
+	Threshold float64 `json:"threshold"`
+	Template  string  `json:"template"`
+
+	Day                   string   `json:"day"`
+	RainProbabilityChange *float64 `json:"rain_probability_change"`
+	MaxTemperatureChange  *float64 `json:"max_temperature_change"`
+
+	Event     string   `json:"event"`
+	Offset    string   `json:"offset"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+func createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_body", err)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_url", req.URL)
+		return
+	}
+	if req.Threshold < 0 || math.IsNaN(req.Threshold) {
+		writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_threshold", req.Threshold)
+		return
+	}
+	if req.City == "" {
+		req.City = weatherCity()
+	}
+	var tmpl *template.Template
+	if req.Template != "" {
+		if tmpl, err = notificationTemplate(req.Template); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_template", err)
+			return
+		}
+	}
+
+	sub := &Subscription{
+		ID:        randomHex(16),
+		Type:      req.Type,
+		URL:       u.String(),
+		City:      req.City,
+		Threshold: req.Threshold,
+		Secret:    randomHex(32),
+		CreatedAt: time.Now().UTC(),
+		Template:  req.Template,
+		tmpl:      tmpl,
+	}
+	switch req.Type {
+	case "":
+		sub.Type = subscriptionObservation
+	case subscriptionObservation:
+	case subscriptionForecastChange:
+		if !forecastSupported() {
+			writeProblem(w, r, http.StatusBadRequest, "subscription.forecast_unsupported")
+			return
+		}
+		if !parseForecastDay(req.Day) {
+			writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_day", req.Day)
+			return
+		}
+		sub.Day, sub.RainProbabilityChange, sub.MaxTemperatureChange = req.Day, 30, 5
+		if v := req.RainProbabilityChange; v != nil {
+			sub.RainProbabilityChange = *v
+		}
+		if v := req.MaxTemperatureChange; v != nil {
+			sub.MaxTemperatureChange = *v
+		}
+		if sub.RainProbabilityChange <= 0 || sub.MaxTemperatureChange <= 0 ||
+			math.IsNaN(sub.RainProbabilityChange) || math.IsNaN(sub.MaxTemperatureChange) {
+			writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_change")
+			return
+		}
+	case subscriptionSunEvent:
+		if _, ok := sunEvents[req.Event]; !ok {
+			writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_event", req.Event)
+			return
+		}
+		sub.Event = req.Event
+		if req.Offset != "" {
+			offset, err := time.ParseDuration(req.Offset)
+			if err != nil || offset.Abs() > 12*time.Hour {
+				writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_offset", req.Offset)
+				return
+			}
+			sub.Offset, sub.offset = req.Offset, offset
+		}
+		switch {
+		case req.Latitude != nil && req.Longitude != nil:
+			if math.Abs(*req.Latitude) > 90 || math.Abs(*req.Longitude) > 180 {
+				writeProblem(w, r, http.StatusBadRequest, "request.invalid_coordinates", fmt.Sprint(*req.Latitude), fmt.Sprint(*req.Longitude))
+				return
+			}
+			sub.Latitude, sub.Longitude = req.Latitude, req.Longitude
+		default:
+			c, ok := cities.Lookup(sub.City)
+			if !ok {
+				writeProblem(w, r, http.StatusBadRequest, "subscription.unlocated", sub.City)
+				return
+			}
+			sub.Latitude, sub.Longitude = &c.Latitude, &c.Longitude
+		}
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "subscription.invalid_type", req.Type)
+		return
+	}
+	if !webhooks.Add(sub) {
+		writeProblem(w, r, http.StatusTooManyRequests, "subscription.limit_reached")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	auditNote(r, "id", sub.ID)
+	auditNote(r, "city", sub.City)
+	w.Header().Set("Location", "/api/subscriptions/"+sub.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "201").Inc()
+}
+
+func getSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := webhooks.Get(mux.Vars(r)["id"])
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "subscription.not_found")
+		return
+	}
+	if !writeResponse(w, r, http.StatusOK, sub) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, "/api/subscriptions/{id}", "200").Inc()
+}
+
+func deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if !webhooks.Remove(mux.Vars(r)["id"]) {
+		writeProblem(w, r, http.StatusNotFound, "subscription.not_found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	httpRequestsTotal.WithLabelValues(r.Method, "/api/subscriptions/{id}", "204").Inc()
+}
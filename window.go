@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WeatherWindow is a stretch of consecutive forecast steps that all satisfy
+// the constraints of a /api/window request.
+type WeatherWindow struct {
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+	Hours              float64   `json:"hours"`
+	MinTemperature     float64   `json:"min_temperature"`
+	MaxTemperature     float64   `json:"max_temperature"`
+	MaxWindSpeed       float64   `json:"max_wind_speed"`
+	MaxRainProbability float64   `json:"max_rain_probability"`
+}
+
+type WindowResponse struct {
+	City      string          `json:"city"`
+	StepHours int             `json:"step_hours"`
+	Windows   []WeatherWindow `json:"windows"`
+}
+
+// windowConstraints are the limits of a /api/window request; nil ones do not
+// apply.
+type windowConstraints struct {
+	minTemp, maxTemp, maxWind, maxRain *float64
+}
+
+func (c windowConstraints) match(step ForecastStep) bool {
+	return (c.minTemp == nil || step.Temperature >= *c.minTemp) &&
+		(c.maxTemp == nil || step.Temperature <= *c.maxTemp) &&
+		(c.maxWind == nil || step.WindSpeed <= *c.maxWind) &&
+		(c.maxRain == nil || step.RainProbability <= *c.maxRain)
+}
+
+// findWindows returns the runs of matching steps that end after now and last
+// at least length. A step already under way counts from its start.
+func findWindows(steps []ForecastStep, c windowConstraints, length time.Duration, now time.Time) []WeatherWindow {
+	windows := []WeatherWindow{}
+	var run *WeatherWindow
+	flush := func() {
+		if run != nil && run.End.Sub(run.Start) >= length {
+			run.Hours = run.End.Sub(run.Start).Hours()
+			windows = append(windows, *run)
+		}
+		run = nil
+	}
+	for _, step := range steps {
+		end := step.Time.Add(forecastStep)
+		if !end.After(now) {
+			continue
+		}
+		if !c.match(step) {
+			flush()
+			continue
+		}
+		if run != nil && !run.End.Equal(step.Time) {
+			flush()
+		}
+		if run == nil {
+			run = &WeatherWindow{Start: step.Time, MinTemperature: math.Inf(1), MaxTemperature: math.Inf(-1)}
+		}
+		run.End = end
+		run.MinTemperature = math.Min(run.MinTemperature, step.Temperature)
+		run.MaxTemperature = math.Max(run.MaxTemperature, step.Temperature)
+		run.MaxWindSpeed = math.Max(run.MaxWindSpeed, step.WindSpeed)
+		run.MaxRainProbability = math.Max(run.MaxRainProbability, step.RainProbability)
+	}
+	flush()
+	return windows
+}
+
+// windowHandler serves /api/window: upcoming periods of at least ?hours=
+// (default 1) in which the forecast stays within min-temp, max-temp (°C),
+// max-wind (m/s) and max-rain (precipitation probability, %).
+func windowHandler(w http.ResponseWriter, r *http.Request) {
+	if !forecastSupported() {
+		writeProblem(w, r, http.StatusNotImplemented, "forecast.unsupported")
+		return
+	}
+	city, ok := requestCity(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	var c windowConstraints
+	for _, param := range []struct {
+		name  string
+		value **float64
+	}{{"min-temp", &c.minTemp}, {"max-temp", &c.maxTemp}, {"max-wind", &c.maxWind}, {"max-rain", &c.maxRain}} {
+		raw := q.Get(param.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			writeProblem(w, r, http.StatusBadRequest, "window.invalid_constraint", param.name, raw)
+			return
+		}
+		*param.value = &v
+	}
+	hours := 1.0
+	if raw := q.Get("hours"); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v <= 0 || v > forecastDays*24 {
+			writeProblem(w, r, http.StatusBadRequest, "window.invalid_hours", raw)
+			return
+		}
+		hours = v
+	}
+
+	forecast, err := getForecast(city)
+	if err != nil {
+		writeTemperatureError(w, r, city, err)
+		return
+	}
+	response := WindowResponse{
+		City:      locationLabel(city),
+		StepHours: int(forecastStep.Hours()),
+		Windows:   findWindows(forecast.Steps, c, time.Duration(hours*float64(time.Hour)), time.Now()),
+	}
+	if !writeResponse(w, r, http.StatusOK, response) {
+		return
+	}
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+}